@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"jpg-watermark-cli/watermark"
+)
+
+// 命令行参数可以临时覆盖 config.json 中的常用设置，只对本次运行生效，试验不同的品质、字体、位置时不必反复修改配置文件。
+// 参数在载入配置文件之后、合并水印块和布局方案之前应用，因此 -position、-font-size 对各方向的布局方案同样生效
+
+var (
+	configFiles     []string                  // --config 指定的配置文件，按顺序载入
+	configOverrides []func(*watermark.Config) // 命令行中写出的覆盖项，按出现的顺序应用
+)
+
+// registerConfigFlags 注册覆盖配置的命令行参数，需要在 flag.Parse 之前调用
+func registerConfigFlags() {
+	flag.Func("config", "配置文件，默认为当前目录的 config.json；可以写多次，后面的文件覆盖前面的", func(s string) error {
+		configFiles = append(configFiles, s)
+		return nil
+	})
+	overrideFlag("quality", "JPEG 品质（1-100），覆盖 jpegQuality", func(c *watermark.Config) *int { return &c.JpegQuality }, func(s string) (int, error) {
+		return parseIntFlag(s, 1, 100)
+	})
+	overrideFlag("output", "输出目录，覆盖 outputFolder", func(c *watermark.Config) *string { return &c.OutputFolder }, parseStringFlag)
+	overrideFlag("concurrency", "同时处理的图片数量，覆盖 maxConcurrency", func(c *watermark.Config) *int { return &c.MaxConcurrency }, func(s string) (int, error) {
+		return parseIntFlag(s, 1, 1024)
+	})
+	overrideFlag("font", "字体文件，覆盖 fontPath", func(c *watermark.Config) *string { return &c.FontPath }, parseStringFlag)
+	overrideFlag("font-size", "字号，覆盖 watermarkSettings.fontSize", func(c *watermark.Config) *float64 { return &c.WatermarkSettings.FontSize }, func(s string) (float64, error) {
+		return strconv.ParseFloat(s, 64)
+	})
+	overrideFlag("position", "水印位置，覆盖 watermarkSettings.position", func(c *watermark.Config) *string { return &c.WatermarkSettings.Position }, parseStringFlag)
+	overrideFlag("template", "水印模板，覆盖 watermarkTemplate", func(c *watermark.Config) *string { return &c.WatermarkTemplate }, parseStringFlag)
+	overrideFlag("format", "输出格式 jpeg、png、webp，覆盖 outputFormat", func(c *watermark.Config) *string { return &c.OutputFormat }, parseStringFlag)
+	overrideFlag("max-size", "输出图片长边的最大像素数，覆盖 maxOutputDimension", func(c *watermark.Config) *int { return &c.MaxOutputDimension }, func(s string) (int, error) {
+		return parseIntFlag(s, 0, 1<<16)
+	})
+}
+
+// overrideFlag 注册一个覆盖配置项的参数，field 返回要覆盖的配置项。取值在解析参数时检查，载入配置后才写入
+func overrideFlag[T any](name, usage string, field func(*watermark.Config) *T, parse func(string) (T, error)) {
+	flag.Func(name, usage, func(s string) error {
+		v, err := parse(s)
+		if err != nil {
+			return err
+		}
+		configOverrides = append(configOverrides, func(c *watermark.Config) { *field(c) = v })
+		return nil
+	})
+}
+
+func parseStringFlag(s string) (string, error) {
+	return s, nil
+}
+
+// parseIntFlag 解析 [lo, hi] 范围内的整数
+func parseIntFlag(s string, lo, hi int) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("需要整数")
+	}
+	if v < lo || v > hi {
+		return 0, fmt.Errorf("取值范围为 %d-%d", lo, hi)
+	}
+	return v, nil
+}
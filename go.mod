@@ -3,9 +3,15 @@ module jpg-watermark-cli
 go 1.23.6
 
 require (
+	github.com/HugoSmits86/nativewebp v1.1.4
 	github.com/disintegration/imaging v1.6.2
+	github.com/esimov/pigo v1.4.6
+	github.com/go-text/typesetting v0.3.0
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0
 	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 )
 
-require golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8 // indirect
+require golang.org/x/image v0.24.0
+
+require golang.org/x/text v0.22.0 // indirect
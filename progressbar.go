@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"jpg-watermark-cli/watermark"
+)
+
+// 控制台进度条：按进度事件统计已处理、失败的文件数，显示处理速度和预计剩余时间。
+// 输出到终端时在同一行刷新；输出被重定向到文件或管道时，每隔一段时间打印一行，避免日志中全是回车符
+
+const (
+	progressBarWidth       = 30
+	progressRedrawInterval = 100 * time.Millisecond
+	progressLineInterval   = 5 * time.Second // 非终端时每行的间隔
+)
+
+// progressBar 是一次运行的进度
+type progressBar struct {
+	mu       sync.Mutex
+	out      io.Writer
+	tty      bool
+	total    int
+	done     int
+	failed   int
+	start    time.Time
+	lastDraw time.Time
+}
+
+// startProgressBar 开始显示进度，total 为要处理的文件数
+func startProgressBar(total int) *progressBar {
+	b := &progressBar{out: os.Stdout, tty: isTerminal(os.Stdout), total: total, start: time.Now()}
+	watermark.OnProgress(b.handle)
+	b.mu.Lock()
+	b.draw()
+	b.mu.Unlock()
+	return b
+}
+
+// isTerminal 判断文件是否为终端（字符设备）
+func isTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
+
+func (b *progressBar) handle(e watermark.ProgressEvent) {
+	if e.Type != watermark.FileDone && e.Type != watermark.FileFailed {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done++
+	if e.Type == watermark.FileFailed {
+		b.failed++
+	}
+	interval := progressRedrawInterval
+	if !b.tty {
+		interval = progressLineInterval
+	}
+	if b.done == b.total || time.Since(b.lastDraw) >= interval {
+		b.draw()
+	}
+}
+
+// draw 输出当前进度，调用时需持有 b.mu
+func (b *progressBar) draw() {
+	b.lastDraw = time.Now()
+	line := b.line()
+	if b.tty {
+		fmt.Fprintf(b.out, "\r\033[K%s", line)
+	} else {
+		fmt.Fprintln(b.out, line)
+	}
+}
+
+// line 生成进度文字，如 [#######-------] 1234/5000 失败 3  12.5 张/秒  剩余 05:01
+func (b *progressBar) line() string {
+	filled := progressBarWidth
+	if b.total > 0 {
+		filled = progressBarWidth * b.done / b.total
+	}
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled)
+	s := fmt.Sprintf("[%s] %d/%d", bar, b.done, b.total)
+	if b.failed > 0 {
+		s += fmt.Sprintf(" 失败 %d", b.failed)
+	}
+
+	elapsed := time.Since(b.start)
+	if b.done == 0 || elapsed <= 0 {
+		return s
+	}
+	rate := float64(b.done) / elapsed.Seconds()
+	s += fmt.Sprintf("  %.1f 张/秒", rate)
+	if remaining := b.total - b.done; remaining > 0 {
+		s += "  剩余 " + formatDuration(time.Duration(float64(remaining)/rate*float64(time.Second)))
+	} else {
+		s += "  用时 " + formatDuration(elapsed)
+	}
+	return s
+}
+
+// finish 输出最终进度并换行
+func (b *progressBar) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// 全部完成时 handle 已经输出过最终进度
+	if b.done != b.total {
+		b.draw()
+	}
+	if b.tty {
+		fmt.Fprintln(b.out)
+	}
+}
+
+// formatDuration 把时长格式化为 mm:ss，超过一小时时为 h:mm:ss
+func formatDuration(d time.Duration) string {
+	sec := int(d.Round(time.Second).Seconds())
+	if sec >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", sec/3600, sec/60%60, sec%60)
+	}
+	return fmt.Sprintf("%02d:%02d", sec/60, sec%60)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"jpg-watermark-cli/watermark"
+)
+
+// 控制台输出的详细程度。-q 不向控制台输出任何内容，处理完直接退出，适合在脚本中运行；
+// 默认显示进度条和汇总；-v 逐个显示文件的去向和用时；-vv 再把日志同时输出到控制台，
+// 并记录每次逆地理编码请求的坐标和耗时。process.log 中的内容与详细程度无关，-vv 时多出调试记录
+
+var verbosity = watermark.VerbosityNormal
+
+// logToConsole 表示日志是否输出到控制台。日志只写入 process.log 时，fatalf 另外在控制台显示错误
+var logToConsole = true
+
+// registerVerbosityFlags 注册 -q、-v、-vv 参数，需要在 flag.Parse 之前调用
+func registerVerbosityFlags() {
+	flag.BoolFunc("q", "安静模式：控制台不输出任何内容，处理完不等待回车", func(string) error {
+		verbosity = watermark.VerbosityQuiet
+		return nil
+	})
+	flag.BoolFunc("v", "逐个显示文件的去向和用时", func(string) error {
+		verbosity = max(verbosity, watermark.VerbosityVerbose)
+		return nil
+	})
+	flag.BoolFunc("vv", "调试模式：日志同时输出到控制台，并记录逆地理编码请求", func(string) error {
+		verbosity = watermark.VerbosityDebug
+		return nil
+	})
+}
+
+// consolePrintln 向控制台输出一行，安静模式下不输出
+func consolePrintln(args ...any) {
+	if verbosity > watermark.VerbosityQuiet {
+		fmt.Println(args...)
+	}
+}
+
+// fatalf 记录错误后退出，日志没有输出到控制台时另外在控制台显示，安静模式下不显示
+func fatalf(format string, args ...any) {
+	log.Printf(format, args...)
+	if !logToConsole && verbosity > watermark.VerbosityQuiet {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+	os.Exit(1)
+}
+
+// showFileResults 在 -v 及以上时按进度事件逐个显示文件的去向和用时
+func showFileResults() {
+	var mu sync.Mutex
+	started := map[string]time.Time{}
+	watermark.OnProgress(func(e watermark.ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch e.Type {
+		case watermark.FileStarted:
+			started[e.Filename] = e.Time
+			return
+		case watermark.FileDone:
+			target := e.OutputPath
+			if target == "" {
+				target = "跳过"
+			}
+			fmt.Printf("%s -> %s（%s）\n", e.Filename, target, e.Time.Sub(started[e.Filename]).Round(time.Millisecond))
+		case watermark.FileFailed:
+			fmt.Printf("%s 失败: %v（%s）\n", e.Filename, e.Err, e.Time.Sub(started[e.Filename]).Round(time.Millisecond))
+		default:
+			return
+		}
+		delete(started, e.Filename)
+	})
+}
@@ -0,0 +1,83 @@
+package watermark
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CaptionHook 是可插拔的图片描述生成器，例如调用图像识别模型。
+// 返回的描述会追加在日期、地点、相机信息之后
+var CaptionHook func(outputPath string, info *PhotoInfo) (string, error)
+
+// altTextPath 返回输出图片对应的描述文件路径
+func altTextPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".txt"
+}
+
+// buildAltText 根据拍摄时间、地点和相机生成图片描述
+func buildAltText(info *PhotoInfo) string {
+	var b strings.Builder
+	b.WriteString(info.Time.Format("2006年1月2日 15:04"))
+	b.WriteString(" 拍摄")
+	if info.Address != "" {
+		b.WriteString("于" + info.Address)
+	}
+	if camera := cameraName(info.Make, info.Model); camera != "" {
+		b.WriteString("，相机: " + camera)
+	}
+	b.WriteString("。")
+	return b.String()
+}
+
+// cameraName 拼接厂商和型号，型号中已包含厂商名时不重复
+func cameraName(make, model string) string {
+	if model == "" {
+		return make
+	}
+	if make == "" || strings.HasPrefix(strings.ToLower(model), strings.ToLower(make)) {
+		return model
+	}
+	return make + " " + model
+}
+
+// writeAltText 为输出图片写入描述文本文件
+func writeAltText(outputPath string, info *PhotoInfo) error {
+	text := buildAltText(info)
+
+	if caption, err := runCaptionHook(outputPath, info); err != nil {
+		return fmt.Errorf("生成图片描述失败: %v", err)
+	} else if caption != "" {
+		text += caption
+	}
+
+	path := altTextPath(outputPath)
+	if err := os.WriteFile(path, []byte(text+"\n"), 0644); err != nil {
+		return fmt.Errorf("写入描述文件 %s 失败: %v", path, err)
+	}
+	return nil
+}
+
+// runCaptionHook 依次调用代码中注册的 CaptionHook 和配置的外部命令
+func runCaptionHook(outputPath string, info *PhotoInfo) (string, error) {
+	if CaptionHook != nil {
+		return CaptionHook(outputPath, info)
+	}
+	if config.AltTextCommand == "" {
+		return "", nil
+	}
+
+	args := strings.Fields(config.AltTextCommand)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, args[0], append(args[1:], outputPath)...).Output()
+	if err != nil {
+		return "", fmt.Errorf("执行 %s 失败: %v", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,102 @@
+package watermark
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// 时区、国家等边界数据使用 GeoJSON，每个 Feature 的 geometry 为 Polygon 或 MultiPolygon，
+// properties 由使用的地方按需解析
+
+// geoJSONFeature 是 GeoJSON 中的一个 Feature
+type geoJSONFeature struct {
+	Properties json.RawMessage `json:"properties"`
+	Geometry   struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	} `json:"geometry"`
+}
+
+// readGeoJSON 读取 FeatureCollection 中的全部 Feature
+func readGeoJSON(name string) ([]geoJSONFeature, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Features []geoJSONFeature `json:"features"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %v", name, err)
+	}
+	return doc.Features, nil
+}
+
+// polygons 返回 Feature 中的多边形，其他类型的 geometry 返回空
+func (f geoJSONFeature) polygons() ([]boundaryPolygon, error) {
+	var polygons [][][][2]float64
+	switch f.Geometry.Type {
+	case "Polygon":
+		var p [][][2]float64
+		if err := json.Unmarshal(f.Geometry.Coordinates, &p); err != nil {
+			return nil, err
+		}
+		polygons = append(polygons, p)
+	case "MultiPolygon":
+		if err := json.Unmarshal(f.Geometry.Coordinates, &polygons); err != nil {
+			return nil, err
+		}
+	}
+
+	var result []boundaryPolygon
+	for _, rings := range polygons {
+		if len(rings) > 0 {
+			result = append(result, newBoundaryPolygon(rings))
+		}
+	}
+	return result, nil
+}
+
+// boundaryPolygon 是边界中的一个多边形，第一个环为外边界，其余为内部的洞，坐标为 [经度, 纬度]
+type boundaryPolygon struct {
+	minLat, maxLat, minLong, maxLong float64
+	rings                            [][][2]float64
+}
+
+func newBoundaryPolygon(rings [][][2]float64) boundaryPolygon {
+	p := boundaryPolygon{rings: rings, minLat: 90, maxLat: -90, minLong: 180, maxLong: -180}
+	for _, pt := range rings[0] {
+		p.minLong, p.maxLong = min(p.minLong, pt[0]), max(p.maxLong, pt[0])
+		p.minLat, p.maxLat = min(p.minLat, pt[1]), max(p.maxLat, pt[1])
+	}
+	return p
+}
+
+// contains 判断点是否在外边界内且不在任何一个洞内
+func (p *boundaryPolygon) contains(lat, long float64) bool {
+	if lat < p.minLat || lat > p.maxLat || long < p.minLong || long > p.maxLong {
+		return false
+	}
+	if !ringContains(p.rings[0], lat, long) {
+		return false
+	}
+	for _, hole := range p.rings[1:] {
+		if ringContains(hole, lat, long) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringContains 用射线法判断点是否在环内
+func ringContains(ring [][2]float64, lat, long float64) bool {
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > lat) != (b[1] > lat) && long < (b[0]-a[0])*(lat-a[1])/(b[1]-a[1])+a[0] {
+			in = !in
+		}
+	}
+	return in
+}
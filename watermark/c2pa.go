@@ -0,0 +1,422 @@
+package watermark
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// C2PA 内容凭证：在输出 JPEG 的 APP11 段中写入 JUMBF 格式的清单，
+// 记录添加水印、解析地址等处理步骤，用户提供的证书和私钥对清单签名（COSE_Sign1）。
+// 清单的哈希绑定（c2pa.hash.data）覆盖除 APP11 段以外的整个文件，
+// 因此签名后的文件再被修改任何字节都会校验失败
+
+// JUMBF 盒子类型的 UUID，前 4 字节为类型名，后 12 字节固定
+var (
+	jumbfManifestStore = jumbfUUID("c2pa")
+	jumbfManifest      = jumbfUUID("c2ma")
+	jumbfAssertions    = jumbfUUID("c2as")
+	jumbfClaim         = jumbfUUID("c2cl")
+	jumbfSignature     = jumbfUUID("c2cs")
+	jumbfCBOR          = jumbfUUID("cbor")
+)
+
+func jumbfUUID(name string) []byte {
+	return append([]byte(name), 0x00, 0x11, 0x00, 0x10, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71)
+}
+
+// c2paSigner 是载入的签名证书链和私钥
+type c2paSigner struct {
+	chain [][]byte // DER 编码的证书，签名证书在前
+	key   crypto.Signer
+	alg   int // COSE 算法编号
+}
+
+var c2paKey *c2paSigner
+
+// loadC2PASigner 检查配置并载入证书和私钥，未启用时什么也不做
+func loadC2PASigner() error {
+	c := config.C2PA
+	if !c.Enabled {
+		return nil
+	}
+	if outputFormat() != "jpeg" {
+		return fmt.Errorf("C2PA 内容凭证目前只支持 JPEG 输出")
+	}
+
+	certPEM, err := os.ReadFile(c.Certificate)
+	if err != nil {
+		return fmt.Errorf("读取 C2PA 证书失败: %v", err)
+	}
+	signer := &c2paSigner{}
+	for block, rest := pem.Decode(certPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			signer.chain = append(signer.chain, block.Bytes)
+		}
+	}
+	if len(signer.chain) == 0 {
+		return fmt.Errorf("C2PA 证书文件 %s 中没有证书", c.Certificate)
+	}
+
+	keyPEM, err := os.ReadFile(c.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("读取 C2PA 私钥失败: %v", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return fmt.Errorf("C2PA 私钥文件 %s 不是 PEM 格式", c.PrivateKey)
+	}
+	var key any
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return fmt.Errorf("解析 C2PA 私钥失败: %v", err)
+	}
+
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			signer.alg = -7 // ES256
+		case elliptic.P384():
+			signer.alg = -35 // ES384
+		default:
+			return fmt.Errorf("不支持的 ECDSA 曲线: %s", k.Curve.Params().Name)
+		}
+		signer.key = k
+	case *rsa.PrivateKey:
+		signer.alg = -37 // PS256
+		signer.key = k
+	case ed25519.PrivateKey:
+		signer.alg = -8 // EdDSA
+		signer.key = k
+	default:
+		return fmt.Errorf("不支持的私钥类型 %T", key)
+	}
+	c2paKey = signer
+	return nil
+}
+
+// signC2PA 给已写入的输出文件加上 C2PA 清单
+func signC2PA(outputPath string, info *PhotoInfo, watermarkText string) error {
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		return fmt.Errorf("读取输出文件失败: %v", err)
+	}
+	signed, err := embedC2PAManifest(data, c2paActions(info, watermarkText))
+	if err != nil {
+		return fmt.Errorf("生成 C2PA 清单失败: %v", err)
+	}
+	return writeOutputFile(outputPath, signed)
+}
+
+// c2paActions 返回要记录的处理步骤
+func c2paActions(info *PhotoInfo, watermarkText string) []any {
+	actions := []any{
+		cborMap{
+			{"action", "c2pa.edited"},
+			{"softwareAgent", c2paGenerator},
+			{"parameters", cborMap{{"description", "添加水印: " + strings.ReplaceAll(strings.TrimSpace(watermarkText), "\n", " / ")}}},
+		},
+	}
+	if info.Address != "" {
+		actions = append(actions, cborMap{
+			{"action", "c2pa.edited.metadata"},
+			{"softwareAgent", c2paGenerator},
+			{"parameters", cborMap{{"description", "根据 GPS 坐标解析地址: " + info.Address}}},
+		})
+	}
+	return actions
+}
+
+const c2paGenerator = "jpg-watermark-cli"
+
+// embedC2PAManifest 把签名后的清单插入 JPEG 开头的 APP0/APP1 段之后。
+// 清单中记录了自身所占的字节范围，而范围的长度又取决于清单的大小，因此反复生成直到长度不再变化
+func embedC2PAManifest(data []byte, actions []any) ([]byte, error) {
+	offset, err := c2paInsertOffset(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// 排除范围正好是插入的 APP11 段，其余字节就是原文件
+	digest := sha256.Sum256(data)
+	instanceID := "xmp:iid:" + newUUID()
+	label := "urn:uuid:" + newUUID()
+
+	length := 0
+	for range 5 {
+		store, err := c2paManifestStore(label, instanceID, actions, digest[:], offset, length)
+		if err != nil {
+			return nil, err
+		}
+		segments := jumbfAPP11Segments(store)
+		if len(segments) == length {
+			out := make([]byte, 0, len(data)+len(segments))
+			out = append(out, data[:offset]...)
+			out = append(out, segments...)
+			return append(out, data[offset:]...), nil
+		}
+		length = len(segments)
+	}
+	return nil, fmt.Errorf("清单长度无法稳定")
+}
+
+// c2paInsertOffset 返回 SOI 和紧随其后的 APP0、APP1 段之后的位置，EXIF 仍然保持在文件开头
+func c2paInsertOffset(data []byte) (int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0, fmt.Errorf("不是有效的JPEG文件")
+	}
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF && (data[pos+1] == 0xE0 || data[pos+1] == 0xE1) {
+		pos += 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+	}
+	if pos > len(data) {
+		return 0, fmt.Errorf("JPEG段长度错误")
+	}
+	return pos, nil
+}
+
+// c2paManifestStore 生成完整的清单仓库（JUMBF 超级盒子）
+func c2paManifestStore(label, instanceID string, actions []any, digest []byte, offset, length int) ([]byte, error) {
+	hashData := cborMap{
+		{"exclusions", []any{cborMap{{"start", offset}, {"length", length}}}},
+		{"name", "jumbf manifest"},
+		{"alg", "sha256"},
+		{"hash", digest},
+		{"pad", []byte{}},
+	}
+	assertions := []struct {
+		label string
+		value any
+	}{
+		{"c2pa.actions", cborMap{{"actions", actions}}},
+		{"c2pa.hash.data", hashData},
+	}
+
+	var assertionBoxes [][]byte
+	var refs []any
+	for _, a := range assertions {
+		value, err := cborEncode(a.value)
+		if err != nil {
+			return nil, err
+		}
+		box := jumbfSuperbox(jumbfCBOR, a.label, jumbfBox("cbor", value))
+		assertionBoxes = append(assertionBoxes, box)
+		// 哈希覆盖超级盒子的内容，不含盒子头的 8 字节
+		sum := sha256.Sum256(box[8:])
+		refs = append(refs, cborMap{{"url", "self#jumbf=c2pa.assertions/" + a.label}, {"hash", sum[:]}})
+	}
+
+	claim, err := cborEncode(cborMap{
+		{"claim_generator", c2paGenerator},
+		{"signature", "self#jumbf=c2pa.signature"},
+		{"assertions", refs},
+		{"dc:format", "image/jpeg"},
+		{"instanceID", instanceID},
+		{"alg", "sha256"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	signature, err := c2paKey.sign(claim)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := jumbfSuperbox(jumbfManifest, label,
+		jumbfSuperbox(jumbfAssertions, "c2pa.assertions", bytes.Join(assertionBoxes, nil)),
+		jumbfSuperbox(jumbfClaim, "c2pa.claim", jumbfBox("cbor", claim)),
+		jumbfSuperbox(jumbfSignature, "c2pa.signature", jumbfBox("cbor", signature)),
+	)
+	return jumbfSuperbox(jumbfManifestStore, "c2pa", manifest), nil
+}
+
+// sign 生成声明的 COSE_Sign1 签名（载荷分离），证书链放在受保护的头部
+func (s *c2paSigner) sign(claim []byte) ([]byte, error) {
+	var chain any = s.chain[0]
+	if len(s.chain) > 1 {
+		certs := make([]any, len(s.chain))
+		for i, c := range s.chain {
+			certs[i] = c
+		}
+		chain = certs
+	}
+	protected, err := cborEncode(cborMap{{1, s.alg}, {33, chain}})
+	if err != nil {
+		return nil, err
+	}
+	toBeSigned, err := cborEncode([]any{"Signature1", protected, []byte{}, claim})
+	if err != nil {
+		return nil, err
+	}
+
+	var sig []byte
+	switch k := s.key.(type) {
+	case *ecdsa.PrivateKey:
+		hash := crypto.SHA256
+		if s.alg == -35 {
+			hash = crypto.SHA384
+		}
+		h := hash.New()
+		h.Write(toBeSigned)
+		var r, ss *big.Int
+		if r, ss, err = ecdsa.Sign(rand.Reader, k, h.Sum(nil)); err == nil {
+			// COSE 的 ECDSA 签名是定长的 r||s，而不是 ASN.1
+			size := (k.Curve.Params().BitSize + 7) / 8
+			sig = make([]byte, 2*size)
+			r.FillBytes(sig[:size])
+			ss.FillBytes(sig[size:])
+		}
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256(toBeSigned)
+		sig, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	default:
+		sig, err = s.key.Sign(rand.Reader, toBeSigned, crypto.Hash(0))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("签名失败: %v", err)
+	}
+	return cborEncode(cborTag{18, []any{protected, cborMap{}, nil, sig}})
+}
+
+// jumbfBox 生成一个普通的 ISO BMFF 盒子
+func jumbfBox(boxType string, payload []byte) []byte {
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	box = append(box, boxType...)
+	return append(box, payload...)
+}
+
+// jumbfSuperbox 生成 JUMBF 超级盒子：描述盒子（类型 UUID、可请求、带标签）加上内容盒子
+func jumbfSuperbox(uuid []byte, label string, contents ...[]byte) []byte {
+	desc := append(append([]byte(nil), uuid...), 0x03)
+	desc = append(append(desc, label...), 0)
+	payload := jumbfBox("jumd", desc)
+	for _, c := range contents {
+		payload = append(payload, c...)
+	}
+	return jumbfBox("jumb", payload)
+}
+
+// jumbfAPP11Segments 把 JUMBF 盒子切分为 JPEG APP11 段（ISO 19566-5），
+// 每段都重复盒子头，后面跟着按序号排列的一部分内容
+func jumbfAPP11Segments(box []byte) []byte {
+	header, content := box[:8], box[8:]
+	const maxChunk = 0xFFFF - 2 - 2 - 2 - 4 - 8
+	var out []byte
+	for seq := uint32(1); ; seq++ {
+		chunk := content[:min(maxChunk, len(content))]
+		content = content[len(chunk):]
+		out = append(out, 0xFF, 0xEB)
+		out = binary.BigEndian.AppendUint16(out, uint16(2+2+2+4+8+len(chunk)))
+		out = append(out, 'J', 'P', 0x00, 0x01)
+		out = binary.BigEndian.AppendUint32(out, seq)
+		out = append(out, header...)
+		out = append(out, chunk...)
+		if len(content) == 0 {
+			return out
+		}
+	}
+}
+
+// newUUID 生成随机的 UUID v4
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0F | 0x40
+	b[8] = b[8]&0x3F | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// cborMap 是保持键顺序的 CBOR 映射，键可以是字符串或整数
+type cborMap []struct {
+	key   any
+	value any
+}
+
+// cborTag 是带标签的 CBOR 数据项
+type cborTag struct {
+	tag   uint64
+	value any
+}
+
+// cborEncode 按 RFC 8949 编码清单用到的几种数据类型，遇到其它类型时返回错误
+func cborEncode(v any) ([]byte, error) {
+	var buf []byte
+	var err error
+	var enc func(v any)
+	head := func(major byte, n uint64) {
+		switch {
+		case n < 24:
+			buf = append(buf, major<<5|byte(n))
+		case n <= 0xFF:
+			buf = append(buf, major<<5|24, byte(n))
+		case n <= 0xFFFF:
+			buf = binary.BigEndian.AppendUint16(append(buf, major<<5|25), uint16(n))
+		case n <= 0xFFFFFFFF:
+			buf = binary.BigEndian.AppendUint32(append(buf, major<<5|26), uint32(n))
+		default:
+			buf = binary.BigEndian.AppendUint64(append(buf, major<<5|27), n)
+		}
+	}
+	enc = func(v any) {
+		if err != nil {
+			return
+		}
+		switch v := v.(type) {
+		case nil:
+			buf = append(buf, 0xF6)
+		case int:
+			if v < 0 {
+				head(1, uint64(-1-v))
+			} else {
+				head(0, uint64(v))
+			}
+		case []byte:
+			head(2, uint64(len(v)))
+			buf = append(buf, v...)
+		case string:
+			head(3, uint64(len(v)))
+			buf = append(buf, v...)
+		case []any:
+			head(4, uint64(len(v)))
+			for _, item := range v {
+				enc(item)
+			}
+		case cborMap:
+			head(5, uint64(len(v)))
+			for _, kv := range v {
+				enc(kv.key)
+				enc(kv.value)
+			}
+		case cborTag:
+			head(6, v.tag)
+			enc(v.value)
+		default:
+			err = fmt.Errorf("CBOR 编码失败: 不支持的类型 %T", v)
+		}
+	}
+	enc(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
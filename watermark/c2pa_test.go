@@ -0,0 +1,69 @@
+package watermark
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestCBOREncode(t *testing.T) {
+	// 期望值取自 RFC 8949 附录 A
+	tests := []struct {
+		name string
+		v    any
+		want string
+	}{
+		{"0", 0, "00"},
+		{"23", 23, "17"},
+		{"24", 24, "1818"},
+		{"100", 100, "1864"},
+		{"1000", 1000, "1903e8"},
+		{"1000000", 1000000, "1a000f4240"},
+		{"1000000000000", 1000000000000, "1b000000e8d4a51000"},
+		{"-1", -1, "20"},
+		{"-100", -100, "3863"},
+		{"-1000", -1000, "3903e7"},
+		{"null", nil, "f6"},
+		{"空字节串", []byte{}, "40"},
+		{"字节串", []byte{1, 2, 3, 4}, "4401020304"},
+		{"空字符串", "", "60"},
+		{"IETF", "IETF", "6449455446"},
+		{"ü", "ü", "62c3bc"},
+		{"水", "水", "63e6b0b4"},
+		{"空数组", []any{}, "80"},
+		{"嵌套数组", []any{1, []any{2, 3}, []any{4, 5}}, "8301820203820405"},
+		{"空映射", cborMap{}, "a0"},
+		{"整数键", cborMap{{1, 2}, {3, 4}}, "a201020304"},
+		{"字符串键", cborMap{{"a", 1}, {"b", []any{2, 3}}}, "a26161016162820203"},
+		{"标签", cborTag{1, 1363896240}, "c11a514b67b0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cborEncode(tt.v)
+			if err != nil {
+				t.Fatalf("cborEncode(%#v) 失败: %v", tt.v, err)
+			}
+			if hex.EncodeToString(got) != tt.want {
+				t.Errorf("cborEncode(%#v) = %x，期望 %s", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCBOREncodeUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+	}{
+		{"浮点数", 1.5},
+		{"数组中的 uint", []any{1, uint(2)}},
+		{"映射的值", cborMap{{"a", struct{}{}}}},
+		{"标签的值", cborTag{18, map[string]int{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := cborEncode(tt.v); err == nil {
+				t.Errorf("cborEncode(%#v) = %x，应当返回错误", tt.v, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package watermark
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"math"
+)
+
+// 文字与背景对比度的最低要求，取 WCAG 对大号文字的标准
+const minContrastRatio = 3.0
+
+// 色觉异常模拟矩阵（Machado 2009，严重程度 1.0），作用于线性 RGB
+var colorBlindMatrices = []struct {
+	name string
+	m    [3][3]float64
+}{
+	{"红色盲", [3][3]float64{{0.152286, 1.052583, -0.204868}, {0.114503, 0.786281, 0.099216}, {-0.003882, -0.048116, 1.051998}}},
+	{"绿色盲", [3][3]float64{{0.367322, 0.860646, -0.227968}, {0.280085, 0.672501, 0.047413}, {-0.011820, 0.042940, 0.968881}}},
+	{"蓝色盲", [3][3]float64{{1.255528, -0.076749, -0.178779}, {-0.078411, 0.930809, 0.147602}, {0.004733, 0.691367, 0.303900}}},
+}
+
+// checkPrintGamut 检查水印颜色是否超出常见印刷（CMYK）色域，在程序启动时调用一次
+func checkPrintGamut() {
+	c := config.WatermarkSettings.Color
+	h, s, v := rgbToHSV(c.R, c.G, c.B)
+	// sRGB 中高饱和、高亮度的绿、青、蓝、紫色在 CMYK 印刷中通常无法还原
+	if s > 0.85 && v > 0.85 && h >= 90 && h <= 300 {
+		msg := fmt.Sprintf("水印颜色 (%d,%d,%d) 饱和度过高，可能超出印刷色域，印刷后会发灰，建议将饱和度降到 85%% 以下", c.R, c.G, c.B)
+		log.Println(msg)
+		consolePrintln("警告: " + msg)
+	}
+}
+
+// checkWatermarkContrast 采样水印区域的背景，检查水印颜色在正常视觉和色觉异常情况下的对比度
+func checkWatermarkContrast(img image.Image, region image.Rectangle, filename string, ws *WatermarkSettings) {
+	bg, ok := averageLinearColor(img, region)
+	if !ok {
+		return
+	}
+	c := ws.Color
+	if ws.AdaptiveColor.Enabled {
+		c, _ = adaptiveColors(ws, bg)
+	}
+	fg := [3]float64{srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)}
+
+	ratio := contrastRatio(relativeLuminance(fg), relativeLuminance(bg))
+	if ratio < minContrastRatio {
+		log.Printf("%s: 水印颜色与背景对比度仅为 %.2f:1（建议不低于 %.1f:1），%s",
+			filename, ratio, minContrastRatio, suggestColor(bg))
+		return
+	}
+
+	for _, cb := range colorBlindMatrices {
+		r := contrastRatio(relativeLuminance(applyMatrix(cb.m, fg)), relativeLuminance(applyMatrix(cb.m, bg)))
+		if r < minContrastRatio {
+			log.Printf("%s: %s 用户看到的水印对比度仅为 %.2f:1，%s", filename, cb.name, r, suggestColor(bg))
+		}
+	}
+}
+
+// watermarkColors 返回文字和描边的颜色。启用自适应颜色时采样文字块所在区域的背景来选择
+func watermarkColors(img image.Image, l watermarkLayout) (fill, stroke RGBAColor) {
+	ws := l.ws
+	fill, stroke = ws.Color, ws.Stroke.Color
+	if !ws.AdaptiveColor.Enabled {
+		return fill, stroke
+	}
+
+	bg, ok := averageLinearColor(img, image.Rect(l.x, l.y, l.x+l.maxWidth, l.y+l.height))
+	if !ok {
+		return fill, stroke
+	}
+	fill, stroke = adaptiveColors(ws, bg)
+	stroke.A = ws.Stroke.Color.A
+	return fill, stroke
+}
+
+// adaptiveColors 在浅色和深色中选出与背景对比度更高的作为文字颜色，另一种作为描边颜色
+func adaptiveColors(ws *WatermarkSettings, bg [3]float64) (fill, stroke RGBAColor) {
+	light, dark := ws.AdaptiveColor.Light, ws.AdaptiveColor.Dark
+	bgLum := relativeLuminance(bg)
+	if contrastRatio(colorLuminance(light), bgLum) >= contrastRatio(colorLuminance(dark), bgLum) {
+		return light, dark
+	}
+	return dark, light
+}
+
+func colorLuminance(c RGBAColor) float64 {
+	return relativeLuminance([3]float64{srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)})
+}
+
+// suggestColor 根据背景亮度建议使用浅色或深色文字
+func suggestColor(bg [3]float64) string {
+	if relativeLuminance(bg) > 0.18 {
+		return "背景偏亮，建议改用深色文字或加深描边"
+	}
+	return "背景偏暗，建议改用白色等浅色文字"
+}
+
+// averageLinearColor 计算区域内的平均线性 RGB，为了速度按步长采样
+func averageLinearColor(img image.Image, region image.Rectangle) ([3]float64, bool) {
+	region = region.Intersect(img.Bounds())
+	if region.Empty() {
+		return [3]float64{}, false
+	}
+
+	step := int(math.Sqrt(float64(region.Dx()*region.Dy()) / 10000))
+	if step < 1 {
+		step = 1
+	}
+
+	var sum [3]float64
+	n := 0
+	for y := region.Min.Y; y < region.Max.Y; y += step {
+		for x := region.Min.X; x < region.Max.X; x += step {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum[0] += srgbToLinear(uint8(r >> 8))
+			sum[1] += srgbToLinear(uint8(g >> 8))
+			sum[2] += srgbToLinear(uint8(b >> 8))
+			n++
+		}
+	}
+	return [3]float64{sum[0] / float64(n), sum[1] / float64(n), sum[2] / float64(n)}, true
+}
+
+func srgbToLinear(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func relativeLuminance(c [3]float64) float64 {
+	return 0.2126*c[0] + 0.7152*c[1] + 0.0722*c[2]
+}
+
+func contrastRatio(l1, l2 float64) float64 {
+	if l1 < l2 {
+		l1, l2 = l2, l1
+	}
+	return (l1 + 0.05) / (l2 + 0.05)
+}
+
+func applyMatrix(m [3][3]float64, c [3]float64) [3]float64 {
+	var out [3]float64
+	for i := 0; i < 3; i++ {
+		v := m[i][0]*c[0] + m[i][1]*c[1] + m[i][2]*c[2]
+		out[i] = math.Min(1, math.Max(0, v))
+	}
+	return out
+}
+
+func rgbToHSV(r8, g8, b8 uint8) (h, s, v float64) {
+	r, g, b := float64(r8)/255, float64(g8)/255, float64(b8)/255
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	v = max
+	if max == 0 {
+		return 0, 0, v
+	}
+	s = (max - min) / max
+	if max == min {
+		return 0, s, v
+	}
+	switch max {
+	case r:
+		h = 60 * math.Mod((g-b)/(max-min), 6)
+	case g:
+		h = 60 * ((b-r)/(max-min) + 2)
+	default:
+		h = 60 * ((r-g)/(max-min) + 4)
+	}
+	if h < 0 {
+		h += 360
+	}
+	return h, s, v
+}
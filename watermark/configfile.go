@@ -0,0 +1,80 @@
+package watermark
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// 默认读取当前目录的 config.json。旅行、人像等不同场景可以各写一份配置，用 --config 选择；
+// --config 可以写多次，后面的文件只需写出与前面不同的项。当前目录没有配置文件时，
+// 再到用户配置目录（Windows 为 %APPDATA%，Linux、macOS 为 ~/.config）下的 jpg-watermark-cli/config.json 查找
+
+// configDirName 是用户配置目录下存放配置文件的子目录
+const configDirName = "jpg-watermark-cli"
+
+var (
+	configFiles       []string        // Options.ConfigFiles，即 --config 指定的配置文件，按顺序载入
+	configOverrides   []func(*Config) // Options.Overrides，即命令行中覆盖配置的参数，按出现的顺序应用
+	loadedConfigFiles []string        // 实际载入的配置文件
+)
+
+// findConfigFiles 返回要载入的配置文件：--config 指定的文件，没有指定时为当前目录或用户配置目录中的 config.json
+func findConfigFiles() []string {
+	if len(configFiles) > 0 {
+		return configFiles
+	}
+	if _, err := os.Stat("config.json"); err == nil {
+		return []string{"config.json"}
+	}
+	for _, dir := range userConfigDirs() {
+		path := filepath.Join(dir, configDirName, "config.json")
+		if _, err := os.Stat(path); err == nil {
+			return []string{path}
+		}
+	}
+	return []string{"config.json"}
+}
+
+// userConfigDirs 返回用户配置目录。macOS 的 os.UserConfigDir 为 ~/Library/Application Support，
+// 习惯放在 ~/.config 的也能找到
+func userConfigDirs() []string {
+	var dirs []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, dir)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		if dir := filepath.Join(home, ".config"); !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// decodeConfigFile 把配置文件中写出的项覆盖到 config 上，数组整体替换
+func decodeConfigFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("打开配置文件失败: %v", err)
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return fmt.Errorf("解析配置文件 %s 失败: %v", path, err)
+	}
+	return nil
+}
+
+// applyConfigOverrides 把命令行参数写入已载入的配置
+func applyConfigOverrides() {
+	for _, apply := range configOverrides {
+		apply(&config)
+	}
+}
+
+// LoadedConfigFiles 返回 LoadConfig 实际载入的配置文件
+func LoadedConfigFiles() []string {
+	return slices.Clone(loadedConfigFiles)
+}
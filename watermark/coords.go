@@ -0,0 +1,48 @@
+package watermark
+
+import "math"
+
+// 国内地图服务使用的坐标系：GPS 记录的是 WGS-84，高德、腾讯使用 GCJ-02（国测局加偏坐标），
+// 百度在 GCJ-02 的基础上再次加偏（BD-09）。下面是公开的近似换算公式，误差在几米以内
+
+const (
+	gcjAxis = 6378245.0              // 克拉索夫斯基椭球长半轴
+	gcjEE   = 0.00669342162296594323 // 第一偏心率的平方
+)
+
+// outOfChina 判断坐标是否在中国大致范围之外，范围外的坐标不加偏
+func outOfChina(lat, long float64) bool {
+	return long < 72.004 || long > 137.8347 || lat < 0.8293 || lat > 55.8271
+}
+
+// toGCJ02 把照片中的坐标转换为高德、腾讯使用的 GCJ-02 坐标。
+// 部分国产手机写入 EXIF 的已经是 GCJ-02 坐标，关闭 convertGCJ02 后原样使用
+func toGCJ02(lat, long float64) (float64, float64) {
+	if !config.ConvertGCJ02 {
+		return lat, long
+	}
+	return wgs84ToGCJ02(lat, long)
+}
+
+// wgs84ToGCJ02 把 WGS-84 坐标换算为 GCJ-02 坐标
+func wgs84ToGCJ02(lat, long float64) (float64, float64) {
+	if outOfChina(lat, long) {
+		return lat, long
+	}
+	x, y := long-105, lat-35
+	dLat := -100 + 2*x + 3*y + 0.2*y*y + 0.1*x*y + 0.2*math.Sqrt(math.Abs(x)) +
+		(20*math.Sin(6*x*math.Pi)+20*math.Sin(2*x*math.Pi))*2/3 +
+		(20*math.Sin(y*math.Pi)+40*math.Sin(y/3*math.Pi))*2/3 +
+		(160*math.Sin(y/12*math.Pi)+320*math.Sin(y*math.Pi/30))*2/3
+	dLong := 300 + x + 2*y + 0.1*x*x + 0.1*x*y + 0.1*math.Sqrt(math.Abs(x)) +
+		(20*math.Sin(6*x*math.Pi)+20*math.Sin(2*x*math.Pi))*2/3 +
+		(20*math.Sin(x*math.Pi)+40*math.Sin(x/3*math.Pi))*2/3 +
+		(150*math.Sin(x/12*math.Pi)+300*math.Sin(x/30*math.Pi))*2/3
+
+	radLat := lat / 180 * math.Pi
+	magic := 1 - gcjEE*math.Sin(radLat)*math.Sin(radLat)
+	sqrtMagic := math.Sqrt(magic)
+	dLat = dLat * 180 / ((gcjAxis * (1 - gcjEE)) / (magic * sqrtMagic) * math.Pi)
+	dLong = dLong * 180 / (gcjAxis / sqrtMagic * math.Cos(radLat) * math.Pi)
+	return lat + dLat, long + dLong
+}
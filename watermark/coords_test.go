@@ -0,0 +1,31 @@
+package watermark
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWGS84ToGCJ02(t *testing.T) {
+	tests := []struct {
+		name              string
+		lat, long         float64
+		wantLat, wantLong float64
+	}{
+		// 与常用的 coordtransform 库的结果一致
+		{"北京", 39.915, 116.404, 39.91640428150164, 116.41024449916938},
+		{"杭州", 30.256389, 120.158889, 30.254052, 120.163571},
+		{"深圳", 22.543096, 114.057865, 22.540379, 114.062979},
+		// 境外坐标不加偏
+		{"东京", 35.681236, 139.767125, 35.681236, 139.767125},
+		{"巴黎", 48.858370, 2.294481, 48.858370, 2.294481},
+		{"南半球", -33.856784, 151.215297, -33.856784, 151.215297},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lat, long := wgs84ToGCJ02(tt.lat, tt.long)
+			if math.Abs(lat-tt.wantLat) > 1e-6 || math.Abs(long-tt.wantLong) > 1e-6 {
+				t.Errorf("wgs84ToGCJ02(%v, %v) = (%.6f, %.6f)，期望 (%.6f, %.6f)", tt.lat, tt.long, lat, long, tt.wantLat, tt.wantLong)
+			}
+		})
+	}
+}
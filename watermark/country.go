@@ -0,0 +1,116 @@
+package watermark
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// 国外拍摄的照片按 GPS 坐标在国家边界数据中离线查出所在国家，地址中带上国家名称，
+// 也可以在前面加上国旗 emoji。边界数据使用 Natural Earth 的 Admin 0 – Countries 等 GeoJSON，
+// properties 中 ISO_A2 为国家代码，NAME_ZH、NAME_EN、NAME_JA 等为各语言的国家名称
+
+// countryPolygon 是某个国家边界中的一个多边形
+type countryPolygon struct {
+	boundaryPolygon
+	code, name string
+}
+
+// countryPolygons 全部国家的多边形，未配置 countries.dataset 时为空
+var countryPolygons []countryPolygon
+
+// domesticCountryCodes 中的地区不算境外，地址中不加国家
+var domesticCountryCodes = []string{"CN", "HK", "MO", "TW"}
+
+// loadCountries 读取国家边界数据，国家名称按 geocodeLanguage 选择
+func loadCountries() error {
+	dataset := config.Countries.Dataset
+	if dataset == "" {
+		return nil
+	}
+	features, err := readGeoJSON(dataset)
+	if err != nil {
+		return err
+	}
+	nameKeys := countryNameKeys(geocodeLanguage())
+	for _, f := range features {
+		var props map[string]any
+		json.Unmarshal(f.Properties, &props)
+		code := strings.ToUpper(propString(props, "ISO_A2_EH", "ISO_A2", "ISO3166-1-Alpha-2", "iso_a2"))
+		name := propString(props, nameKeys...)
+		if code == "" && name == "" {
+			continue
+		}
+		polygons, err := f.polygons()
+		if err != nil {
+			return fmt.Errorf("解析 %s 的边界失败: %v", name, err)
+		}
+		for _, p := range polygons {
+			countryPolygons = append(countryPolygons, countryPolygon{boundaryPolygon: p, code: code, name: name})
+		}
+	}
+	if len(countryPolygons) == 0 {
+		return fmt.Errorf("国家边界数据 %s 中没有国家", dataset)
+	}
+	log.Printf("已读取国家边界数据 %s，共 %d 个多边形", dataset, len(countryPolygons))
+	return nil
+}
+
+// countryNameKeys 返回国家名称可能使用的属性名，优先使用与 geocodeLanguage 对应的语言
+func countryNameKeys(lang string) []string {
+	lang = strings.ToLower(lang)
+	var keys []string
+	switch {
+	case lang == "zh-tw" || lang == "zh-hk" || strings.HasPrefix(lang, "zh-hant"):
+		keys = append(keys, "NAME_ZHT", "NAME_ZH")
+	default:
+		primary, _, _ := strings.Cut(lang, "-")
+		keys = append(keys, "NAME_"+strings.ToUpper(primary))
+	}
+	return append(keys, "NAME", "ADMIN", "name")
+}
+
+// propString 返回第一个非空的字符串属性，Natural Earth 中缺少的代码为 -99
+func propString(props map[string]any, keys ...string) string {
+	for _, k := range keys {
+		if v, ok := props[k].(string); ok && v != "" && v != "-99" {
+			return v
+		}
+	}
+	return ""
+}
+
+// fillCountry 按坐标补上国家代码，逆地理编码没有返回国家时也补上国家名称
+func fillCountry(loc *Location, lat, long float64) {
+	for i := range countryPolygons {
+		if p := &countryPolygons[i]; p.contains(lat, long) {
+			loc.CountryCode = p.code
+			if loc.Country == "" {
+				loc.Country = p.name
+			}
+			return
+		}
+	}
+}
+
+// abroad 判断是否为境外的地址，国家未知时视为境内
+func (l Location) abroad() bool {
+	return l.CountryCode != "" && !slices.Contains(domesticCountryCodes, l.CountryCode)
+}
+
+// Flag 返回国旗 emoji，如 JP 为 🇯🇵，国家未知时为空
+func (l Location) Flag() string {
+	if len(l.CountryCode) != 2 {
+		return ""
+	}
+	var flag []rune
+	for _, c := range l.CountryCode {
+		if c < 'A' || c > 'Z' {
+			return ""
+		}
+		flag = append(flag, 0x1F1E6+c-'A')
+	}
+	return string(flag)
+}
@@ -0,0 +1,213 @@
+package watermark
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// 拍摄时间的时区：EXIF 2.31 起相机会在 OffsetTimeOriginal 中记录拍摄时的 UTC 偏移，如 +08:00。
+// 有偏移的时间使用对应的固定时区，没有时区信息的时间一律使用 time.Local，
+// 因此 t.Location() != time.Local 表示拍摄时间的时区是确定的
+
+// goexif 不认识的 OffsetTime 字段，需要从 Exif 子目录中另外读取
+const (
+	exifOffsetTime          exif.FieldName = "OffsetTime"
+	exifOffsetTimeOriginal  exif.FieldName = "OffsetTimeOriginal"
+	exifOffsetTimeDigitized exif.FieldName = "OffsetTimeDigitized"
+)
+
+var offsetTimeFields = map[uint16]exif.FieldName{
+	0x9010: exifOffsetTime,
+	0x9011: exifOffsetTimeOriginal,
+	0x9012: exifOffsetTimeDigitized,
+}
+
+// loadOffsetTimes 从 Exif 子目录中读取 OffsetTime 等字段，读取失败时忽略
+func loadOffsetTimes(x *exif.Exif) {
+	tag, err := x.Get(exif.ExifIFDPointer)
+	if err != nil {
+		return
+	}
+	offset, err := tag.Int64(0)
+	if err != nil {
+		return
+	}
+	r := bytes.NewReader(x.Raw)
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	dir, _, err := tiff.DecodeDir(r, x.Tiff.Order)
+	if err != nil {
+		return
+	}
+	x.LoadTags(dir, offsetTimeFields, false)
+}
+
+// dateTag 是一个日期字段，以及与它对应的 UTC 偏移和不足一秒部分的字段
+type dateTag struct {
+	date, offset, subSec exif.FieldName
+}
+
+// dateTags 是 dateTags 配置可选的字段，CreateDate 是 exiftool 对 DateTimeDigitized 的叫法
+var dateTags = map[string]dateTag{
+	"DateTimeOriginal":  {exif.DateTimeOriginal, exifOffsetTimeOriginal, exif.SubSecTimeOriginal},
+	"CreateDate":        {exif.DateTimeDigitized, exifOffsetTimeDigitized, exif.SubSecTimeDigitized},
+	"DateTimeDigitized": {exif.DateTimeDigitized, exifOffsetTimeDigitized, exif.SubSecTimeDigitized},
+	"DateTime":          {exif.DateTime, exifOffsetTime, exif.SubSecTime},
+}
+
+// defaultDateTags 是未配置 dateTags 时的顺序。修图软件保存时会把 DateTime 改为编辑时间，放在最后
+var defaultDateTags = []string{"DateTimeOriginal", "DateTimeDigitized", "DateTime"}
+
+// exifTime 按 dateTags 的顺序读取 EXIF 拍摄时间，并加上对应 SubSecTime 字段中不足一秒的部分，
+// 连拍的照片时间精确到毫秒，不会因为同一秒内拍了多张而相同。
+// 有对应的 OffsetTime 字段时按其中的 UTC 偏移设置时区，没有时依次使用 OffsetTimeOriginal、OffsetTime
+func exifTime(x *exif.Exif) (time.Time, error) {
+	names := config.DateTags
+	if len(names) == 0 {
+		names = defaultDateTags
+	}
+	loadOffsetTimes(x)
+	for _, name := range names {
+		tag := dateTags[name]
+		t, err := time.ParseInLocation("2006:01:02 15:04:05", exifString(x, tag.date), time.Local)
+		if err != nil {
+			continue
+		}
+		for _, field := range []exif.FieldName{tag.offset, exifOffsetTimeOriginal, exifOffsetTime} {
+			if m := utcOffsetPattern.FindStringSubmatch(exifString(x, field)); m != nil {
+				loc, _ := parseTimezone(m[0])
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc)
+				break
+			}
+		}
+		if d, ok := parseSubSec(exifString(x, tag.subSec)); ok {
+			t = t.Add(d)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("EXIF中没有 %s", strings.Join(names, "、"))
+}
+
+// hasKnownZone 判断拍摄时间的时区是否确定
+func hasKnownZone(t time.Time) bool {
+	return t.Location() != time.Local
+}
+
+// utcOffset 返回拍摄时间的 UTC 偏移，如 UTC+08:00，时区不确定时为空
+func utcOffset(t time.Time) string {
+	if !hasKnownZone(t) {
+		return ""
+	}
+	return "UTC" + t.Format("-07:00")
+}
+
+// applyDisplayTimezone 把时区确定的拍摄时间换算到 displayTimezone，
+// 同一批照片来自不同时区时统一显示为同一个时区的时间
+func applyDisplayTimezone(info *PhotoInfo) {
+	if config.DisplayTimezone == "" || !hasKnownZone(info.Time) {
+		return
+	}
+	loc, err := parseTimezone(config.DisplayTimezone)
+	if err != nil {
+		return
+	}
+	info.Time = info.Time.In(loc)
+}
+
+// parseSubSec 解析 SubSecTime 字段，它是秒的小数部分的数字，如 "05" 为 0.05 秒
+func parseSubSec(s string) (time.Duration, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" || len(s) > 9 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	for i := len(s); i < 9; i++ {
+		n *= 10
+	}
+	return time.Duration(n), true
+}
+
+// outputBaseName 返回按拍摄时间命名的输出文件名（不含扩展名），
+// 时间带毫秒时加上毫秒，如 20240131102030_120，同一秒内的连拍按顺序排列
+func outputBaseName(t time.Time) string {
+	name := t.Format("20060102150405")
+	if ms := t.Nanosecond() / int(time.Millisecond); ms > 0 {
+		name += fmt.Sprintf("_%03d", ms)
+	}
+	return name
+}
+
+// 没有 EXIF 拍摄时间的照片（截图、微信保存的图片、扫描件等）默认复制到 noExifFolder。
+// 配置 dateFallback 后按顺序尝试从文件名中解析日期或使用文件的修改时间，照常加水印
+
+// dateFallbackNames 是 dateFallback 可选的来源
+var dateFallbackNames = []string{"filename", "mtime"}
+
+// validateDateSettings 检查 dateTags、dateFallback 中的名称和 displayTimezone
+func validateDateSettings() error {
+	for _, name := range config.DateTags {
+		if _, ok := dateTags[name]; !ok {
+			return fmt.Errorf("dateTags 中的 %q 无效，可选 DateTimeOriginal、CreateDate、DateTimeDigitized、DateTime", name)
+		}
+	}
+	for _, name := range config.DateFallback {
+		if !slices.Contains(dateFallbackNames, name) {
+			return fmt.Errorf("dateFallback 中的 %q 无效，可选 filename、mtime", name)
+		}
+	}
+	if _, err := parseTimezone(config.DisplayTimezone); err != nil {
+		return fmt.Errorf("displayTimezone 无效: %v", err)
+	}
+	return nil
+}
+
+// filenameDatePattern 匹配文件名中的日期和可选的时间，如 IMG_20240131_102030、
+// PXL_20240131_102030123、Screenshot_2024-01-31-10-20-30、微信图片_20240131102030、2024-01-31 10.20.30
+var filenameDatePattern = regexp.MustCompile(`((?:19|20)\d{2})[-_.]?(\d{2})[-_.]?(\d{2})(?:[-_ T.]?(\d{2})[-_.:]?(\d{2})[-_.:]?(\d{2}))?`)
+
+// fallbackTime 按 dateFallback 的顺序推测拍摄时间，返回时间和来源的说明
+func fallbackTime(filename string) (time.Time, string, bool) {
+	for _, name := range config.DateFallback {
+		switch name {
+		case "filename":
+			if t, ok := filenameDate(filepath.Base(filename)); ok {
+				return t, "文件名中的日期", true
+			}
+		case "mtime":
+			if st, err := os.Stat(filename); err == nil {
+				return st.ModTime().Truncate(time.Second), "文件修改时间", true
+			}
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// filenameDate 从文件名中解析日期，没有时间时为当天 0 点；月、日、时分秒超出范围的不算
+func filenameDate(name string) (time.Time, bool) {
+	for _, m := range filenameDatePattern.FindAllStringSubmatch(name, -1) {
+		var v [6]int
+		for i := range v {
+			v[i], _ = strconv.Atoi(m[i+1])
+		}
+		t := time.Date(v[0], time.Month(v[1]), v[2], v[3], v[4], v[5], 0, time.Local)
+		if t.Month() == time.Month(v[1]) && t.Day() == v[2] && t.Hour() == v[3] && t.Minute() == v[4] && t.Second() == v[5] {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,64 @@
+package watermark
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSubSec(t *testing.T) {
+	tests := []struct {
+		s      string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"5", 500 * time.Millisecond, true},
+		{"05", 50 * time.Millisecond, true},
+		{"123", 123 * time.Millisecond, true},
+		{"120000", 120 * time.Millisecond, true},
+		{"123456789", 123456789, true},
+		{" 42 ", 420 * time.Millisecond, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{"   ", 0, false},
+		{"1234567890", 0, false},
+		{"-5", 0, false},
+		{"1a", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseSubSec(tt.s)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseSubSec(%q) = (%v, %v)，期望 (%v, %v)", tt.s, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestFilenameDate(t *testing.T) {
+	date := func(y, mo, d, h, mi, s int) time.Time {
+		return time.Date(y, time.Month(mo), d, h, mi, s, 0, time.Local)
+	}
+	tests := []struct {
+		name   string
+		want   time.Time
+		wantOK bool
+	}{
+		{"IMG_20240131_102030.jpg", date(2024, 1, 31, 10, 20, 30), true},
+		{"PXL_20240131_102030123.jpg", date(2024, 1, 31, 10, 20, 30), true},
+		{"Screenshot_2024-01-31-10-20-30.png", date(2024, 1, 31, 10, 20, 30), true},
+		{"微信图片_20240131102030.jpg", date(2024, 1, 31, 10, 20, 30), true},
+		{"2024-01-31 10.20.30.jpg", date(2024, 1, 31, 10, 20, 30), true},
+		{"mmexport20240131.jpg", date(2024, 1, 31, 0, 0, 0), true},
+		{"1999.12.31.jpg", date(1999, 12, 31, 0, 0, 0), true},
+		// 日期或时间超出范围的不算，继续查找后面的日期
+		{"IMG_20240131_256199.jpg", time.Time{}, false},
+		{"20240230-copy-20240229.jpg", date(2024, 2, 29, 0, 0, 0), true},
+		{"20231301.jpg", time.Time{}, false},
+		{"DSC01234.jpg", time.Time{}, false},
+		{"18991231.jpg", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := filenameDate(tt.name)
+		if !got.Equal(tt.want) || ok != tt.wantOK {
+			t.Errorf("filenameDate(%q) = (%v, %v)，期望 (%v, %v)", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package watermark
+
+import (
+	"fmt"
+	"strings"
+)
+
+// --dry-run 演练一遍处理过程：照常扫描文件、读取 EXIF、解析地址、渲染水印文字，
+// 打印每个文件会写到哪里，但不创建目录和输出文件，不备份、移动或上传原图，也不生成运行报告。
+// 日志输出到控制台而不是 process.log，地址缓存只读不写，没有配置文件时也不生成默认配置
+
+var dryRun bool
+
+// dryRunWatermark 打印加水印的照片会写入的位置和水印文字
+func dryRunWatermark(info *PhotoInfo, outputPath, watermarkText string) {
+	target := outputPath
+	if config.InPlace {
+		target += fmt.Sprintf("（原地替换，原图备份到 %s）", config.BackupFolder)
+	}
+	fmt.Printf("[加水印] %s -> %s\n", info.Filename, target)
+	if text := strings.TrimSpace(watermarkText); text != "" {
+		fmt.Printf("    水印: %s\n", strings.ReplaceAll(text, "\n", " / "))
+	}
+	emitProgress(ProgressEvent{Type: FileDone, Filename: info.Filename, OutputPath: outputPath})
+}
+
+// dryRunCopy 打印原样复制到 noExifFolder、screenshots.folder 等目录的文件，newPath 为空时表示保持不变
+func dryRunCopy(kind, filename, newPath, reason string) {
+	target := newPath
+	if target == "" {
+		target = "保持不变"
+	}
+	if reason != "" {
+		target += "（" + reason + "）"
+	}
+	fmt.Printf("[%s] %s -> %s\n", kind, filename, target)
+	emitProgress(ProgressEvent{Type: FileDone, Filename: filename, OutputPath: newPath})
+}
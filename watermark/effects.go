@@ -0,0 +1,263 @@
+package watermark
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// backgroundPadding 返回底板的内边距（像素），未启用底板时为 0
+func backgroundPadding(ws *WatermarkSettings, fontSize float64) int {
+	bg := ws.Background
+	if !bg.Enabled {
+		return 0
+	}
+	return int(math.Round(resolveSize(bg.Padding, int(fontSize), ws.Unit)))
+}
+
+// drawBackground 在文字块后面绘制半透明的圆角底板
+func drawBackground(dst draw.Image, l watermarkLayout) {
+	bg := l.ws.Background
+	if !bg.Enabled || bg.Opacity <= 0 {
+		return
+	}
+
+	pad := backgroundPadding(l.ws, l.fontSize)
+	rect := l.block().Inset(-pad)
+	radius := resolveSize(bg.Radius, int(l.fontSize), l.ws.Unit)
+	mask := &roundedRectMask{rect: rect, radius: math.Min(radius, float64(min(rect.Dx(), rect.Dy()))/2)}
+
+	src := image.NewUniform(bg.Color.withOpacity(bg.Opacity))
+	draw.DrawMask(dst, rect.Intersect(dst.Bounds()), src, image.Point{}, mask, rect.Intersect(dst.Bounds()).Min, draw.Over)
+}
+
+// roundedRectMask 是圆角矩形的遮罩，圆角边缘按像素中心到圆弧的距离做抗锯齿
+type roundedRectMask struct {
+	rect   image.Rectangle
+	radius float64
+}
+
+func (m *roundedRectMask) ColorModel() color.Model { return color.AlphaModel }
+
+func (m *roundedRectMask) Bounds() image.Rectangle { return m.rect }
+
+func (m *roundedRectMask) At(x, y int) color.Color {
+	if !(image.Point{x, y}).In(m.rect) {
+		return color.Alpha{}
+	}
+	px, py := float64(x)+0.5, float64(y)+0.5
+	// 离像素最近的圆角圆心，像素不在四个角上时完全覆盖
+	cx := math.Max(float64(m.rect.Min.X)+m.radius, math.Min(px, float64(m.rect.Max.X)-m.radius))
+	cy := math.Max(float64(m.rect.Min.Y)+m.radius, math.Min(py, float64(m.rect.Max.Y)-m.radius))
+	d := math.Hypot(px-cx, py-cy)
+	if d == 0 {
+		return color.Alpha{255}
+	}
+	coverage := math.Max(0, math.Min(1, m.radius-d+0.5))
+	return color.Alpha{uint8(coverage * 255)}
+}
+
+// scrimRect 返回渐变覆盖的区域，未启用时为空矩形
+func scrimRect(ws *WatermarkSettings, bounds image.Rectangle, position string) image.Rectangle {
+	scrim := ws.Scrim
+	if !scrim.Enabled || scrim.Strength <= 0 {
+		return image.Rectangle{}
+	}
+	h := int(math.Round(resolveSize(scrim.Height, bounds.Dy(), ws.Unit)))
+	h = max(0, min(h, bounds.Dy()))
+	if _, fy := anchorFactors(position); fy == 0 {
+		return image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Min.Y+h)
+	}
+	return image.Rect(bounds.Min.X, bounds.Max.Y-h, bounds.Max.X, bounds.Max.Y)
+}
+
+// drawScrim 绘制从图片边缘向内渐隐的渐变，不透明度按 smoothstep 曲线过渡，避免出现明显的分界线
+func drawScrim(dst draw.Image, bounds image.Rectangle, wm *watermark) {
+	rect := scrimRect(wm.ws, bounds, wm.position)
+	if rect.Empty() {
+		return
+	}
+	scrim := wm.ws.Scrim
+	_, fy := anchorFactors(wm.position)
+
+	area := rect.Intersect(dst.Bounds())
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		// t 在图片边缘为 1，在渐变的内侧边缘为 0
+		t := float64(y-rect.Min.Y) / float64(rect.Dy())
+		if fy == 0 {
+			t = 1 - t
+		}
+		t = t * t * (3 - 2*t)
+		src := image.NewUniform(scrim.Color.withOpacity(scrim.Strength * t))
+		line := image.Rect(area.Min.X, y, area.Max.X, y+1)
+		draw.Draw(dst, line, src, image.Point{}, draw.Over)
+	}
+}
+
+// dilateMask 返回把 mask 中的文字向外扩展 width 像素后的描边遮罩。
+// 对文字像素做欧氏距离变换，距离在 width 以内的像素完全覆盖，最外 1 像素按距离抗锯齿，
+// 轮廓宽度均匀且与描边宽度无关，只需遍历两次图片
+func dilateMask(mask *image.Alpha, width int) *image.Alpha {
+	r := mask.Rect
+	w, h := r.Dx(), r.Dy()
+	const inf = 1e20
+	dist := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if mask.Pix[y*mask.Stride+x] < 128 {
+				dist[y*w+x] = inf
+			}
+		}
+	}
+
+	n := max(w, h)
+	f, d, z := make([]float64, n), make([]float64, n), make([]float64, n+1)
+	v := make([]int, n)
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			f[y] = dist[y*w+x]
+		}
+		distanceTransform1D(f[:h], d[:h], v, z)
+		for y := 0; y < h; y++ {
+			dist[y*w+x] = d[y]
+		}
+	}
+	for y := 0; y < h; y++ {
+		row := dist[y*w : (y+1)*w]
+		copy(f, row)
+		distanceTransform1D(f[:w], d[:w], v, z)
+		copy(row, d[:w])
+	}
+
+	out := image.NewAlpha(r)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// 距离从文字像素的中心算起，文字边缘约在其外 0.5 像素处
+			coverage := math.Max(0, math.Min(1, float64(width)+1-math.Sqrt(dist[y*w+x])))
+			a := max(uint8(coverage*255), mask.Pix[y*mask.Stride+x])
+			out.Pix[y*out.Stride+x] = a
+		}
+	}
+	return out
+}
+
+// distanceTransform1D 计算一维的平方距离变换（Felzenszwalb & Huttenlocher）：
+// d[q] = min over p of (q-p)² + f[p]。v、z 为工作区，长度分别不小于 len(f) 和 len(f)+1
+func distanceTransform1D(f, d []float64, v []int, z []float64) {
+	n := len(f)
+	if n == 0 {
+		return
+	}
+	parabola := func(q, p int) float64 {
+		return ((f[q] + float64(q*q)) - (f[p] + float64(p*p))) / float64(2*q-2*p)
+	}
+	k := 0
+	v[0] = 0
+	z[0], z[1] = math.Inf(-1), math.Inf(1)
+	for q := 1; q < n; q++ {
+		s := parabola(q, v[k])
+		for s <= z[k] {
+			k--
+			s = parabola(q, v[k])
+		}
+		k++
+		v[k] = q
+		z[k], z[k+1] = s, math.Inf(1)
+	}
+	k = 0
+	for q := 0; q < n; q++ {
+		for z[k+1] < float64(q) {
+			k++
+		}
+		d[q] = float64((q-v[k])*(q-v[k])) + f[v[k]]
+	}
+}
+
+// blendModes 是支持的混合模式，按 W3C Compositing 规范逐通道计算，cb 为照片颜色，cs 为水印颜色，取值 0-1
+var blendModes = map[string]func(cb, cs float64) float64{
+	"multiply": func(cb, cs float64) float64 { return cb * cs },
+	"screen":   screenBlend,
+	"overlay": func(cb, cs float64) float64 {
+		if cb <= 0.5 {
+			return 2 * cb * cs
+		}
+		return screenBlend(cs, 2*cb-1)
+	},
+	"soft-light": func(cb, cs float64) float64 {
+		if cs <= 0.5 {
+			return cb - (1-2*cs)*cb*(1-cb)
+		}
+		d := math.Sqrt(cb)
+		if cb <= 0.25 {
+			d = ((16*cb-12)*cb + 4) * cb
+		}
+		return cb + (2*cs-1)*(d-cb)
+	},
+}
+
+func screenBlend(cb, cs float64) float64 { return cb + cs - cb*cs }
+
+// validateBlendModes 检查主水印、各水印块和各布局方案的 blendMode
+func validateBlendModes() error {
+	check := func(mode string) error {
+		if mode == "" || mode == "normal" || blendModes[mode] != nil {
+			return nil
+		}
+		return fmt.Errorf("不支持的混合模式 %q，可选 normal、multiply、screen、overlay、soft-light", mode)
+	}
+	if err := check(config.WatermarkSettings.BlendMode); err != nil {
+		return err
+	}
+	for i, block := range config.Watermarks {
+		if err := check(block.settings.BlendMode); err != nil {
+			return fmt.Errorf("第 %d 个水印块: %v", i+1, err)
+		}
+	}
+	lp := &config.LayoutProfiles
+	for _, p := range []struct {
+		name string
+		ws   *WatermarkSettings
+	}{{"竖图", &lp.portrait}, {"横图", &lp.landscape}, {"方图", &lp.square}} {
+		if err := check(p.ws.BlendMode); err != nil {
+			return fmt.Errorf("%s布局方案: %v", p.name, err)
+		}
+	}
+	return nil
+}
+
+// drawBlended 把透明图层 layer 按混合模式叠加到 dst 的 target 区域，normal 时等同于 draw.Over。
+// 照片视为不透明：结果为 (1-αs)·Cb + αs·B(Cb, Cs)
+func drawBlended(dst draw.Image, target image.Rectangle, layer image.Image, mode string) {
+	blend := blendModes[mode]
+	if blend == nil {
+		draw.Draw(dst, target, layer, layer.Bounds().Min, draw.Over)
+		return
+	}
+
+	area := target.Intersect(dst.Bounds())
+	shift := layer.Bounds().Min.Sub(target.Min)
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			sr, sg, sb, sa := layer.At(x+shift.X, y+shift.Y).RGBA()
+			if sa == 0 {
+				continue
+			}
+			br, bg, bb, ba := dst.At(x, y).RGBA()
+			as := float64(sa) / 0xFFFF
+			mix := func(cb, cs uint32) uint16 {
+				b, s := float64(cb)/0xFFFF, float64(cs)/float64(sa)
+				return uint16(math.Round(((1-as)*b + as*blend(b, s)) * 0xFFFF))
+			}
+			dst.Set(x, y, color.RGBA64{mix(br, sr), mix(bg, sg), mix(bb, sb), uint16(ba)})
+		}
+	}
+}
+
+// subtractMask 从 dst 中扣除 mask 覆盖的部分，两者的区域相同
+func subtractMask(dst, mask *image.Alpha) {
+	for i, a := range mask.Pix {
+		dst.Pix[i] = uint8(uint32(dst.Pix[i]) * uint32(255-a) / 255)
+	}
+}
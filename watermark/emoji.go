@@ -0,0 +1,229 @@
+package watermark
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-text/typesetting/di"
+	gofont "github.com/go-text/typesetting/font"
+	"github.com/go-text/typesetting/shaping"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// freetype 只能绘制轮廓字形，CBDT/sbix 等彩色 emoji 字体画出来是方框。
+// 因此开启 emoji 后，emoji 先从 emoji.folder 中按码位查找图片，文件名与 Twemoji、Noto Emoji
+// 的 PNG 一致，如 📍 对应 1f4cd.png，👍🏻 对应 1f44d-1f3fb.png；再从 emoji.font 指定的彩色字体中
+// 取出位图；都没有时按普通文字绘制，★、✓ 等字体中有字形的符号照常显示
+
+var (
+	emojiCacheMu sync.Mutex
+	emojiCache   = map[string]image.Image{} // 找不到的 emoji 也记录为 nil，只提示一次
+)
+
+// textSegment 是一行文字中的一段普通文字或一个 emoji
+type textSegment struct {
+	text     string
+	emoji    image.Image    // emoji 图片，普通文字时为 nil
+	shaped   *shapedText    // 整形后的字形，不需要整形时为 nil
+	font     *truetype.Font // 备用字体，使用该行的字体时为 nil
+	fontPath string         // font 对应的字体文件
+}
+
+// splitEmoji 把一行文字拆成普通文字和 emoji 片段；没有对应图片的 emoji 留在普通文字中
+func splitEmoji(line string) []textSegment {
+	if !config.Emoji.Enabled {
+		return []textSegment{{text: line}}
+	}
+
+	var segments []textSegment
+	var text []rune
+	runes := []rune(line)
+	for i := 0; i < len(runes); {
+		if !isEmojiRune(runes[i]) {
+			text = append(text, runes[i])
+			i++
+			continue
+		}
+		n := emojiClusterLength(runes[i:])
+		img := emojiImage(runes[i : i+n])
+		if img == nil {
+			// 按文字绘制时去掉变体选择符，它在普通字体中没有字形
+			for _, r := range runes[i : i+n] {
+				if r != 0xFE0F {
+					text = append(text, r)
+				}
+			}
+			i += n
+			continue
+		}
+		if len(text) > 0 {
+			segments = append(segments, textSegment{text: string(text)})
+			text = nil
+		}
+		segments = append(segments, textSegment{text: string(runes[i : i+n]), emoji: img})
+		i += n
+	}
+	if len(text) > 0 || len(segments) == 0 {
+		segments = append(segments, textSegment{text: string(text)})
+	}
+	return segments
+}
+
+// isEmojiRune 判断是否为 emoji 的起始字符（常用的符号和图形区段、国旗字母）
+func isEmojiRune(r rune) bool {
+	return (r >= 0x1F000 && r <= 0x1FAFF) || (r >= 0x2600 && r <= 0x27BF) || (r >= 0x2B00 && r <= 0x2BFF)
+}
+
+// emojiClusterLength 返回从 runes[0] 开始的 emoji 序列长度：
+// 包括变体选择符、肤色修饰、零宽连接的组合 emoji，以及两个字母组成的国旗
+func emojiClusterLength(runes []rune) int {
+	if isRegionalIndicator(runes[0]) {
+		if len(runes) > 1 && isRegionalIndicator(runes[1]) {
+			return 2
+		}
+		return 1
+	}
+	n := 1
+	for n < len(runes) {
+		r := runes[n]
+		switch {
+		case r == 0xFE0F || (r >= 0x1F3FB && r <= 0x1F3FF):
+			n++
+		case r == 0x200D && n+1 < len(runes) && isEmojiRune(runes[n+1]):
+			n += 2
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// emojiImage 返回 emoji 序列对应的图片，找不到时返回 nil。
+// 先在 emoji.folder 中按完整码位查找，再去掉变体选择符 FE0F 查找（Twemoji 的多数文件名不含 FE0F），
+// 最后从 emoji.font 中查找
+func emojiImage(cluster []rune) image.Image {
+	var codes, stripped []string
+	for _, r := range cluster {
+		code := fmt.Sprintf("%x", r)
+		codes = append(codes, code)
+		if r != 0xFE0F {
+			stripped = append(stripped, code)
+		}
+	}
+	key := strings.Join(codes, "-")
+
+	emojiCacheMu.Lock()
+	defer emojiCacheMu.Unlock()
+	if img, ok := emojiCache[key]; ok {
+		return img
+	}
+
+	var img image.Image
+	for _, name := range []string{key, strings.Join(stripped, "-")} {
+		if config.Emoji.Folder == "" {
+			break
+		}
+		path := filepath.Join(config.Emoji.Folder, name+".png")
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		logo, err := loadLogo(path)
+		if err != nil {
+			log.Print(err)
+			break
+		}
+		img = logo
+		break
+	}
+	if img == nil {
+		img = emojiFontImage(cluster)
+	}
+	if img == nil {
+		log.Printf("没有找到 emoji %s 的图片 %s.png，按文字绘制", string(cluster), key)
+	}
+	emojiCache[key] = img
+	return img
+}
+
+// emojiFontImage 从 emoji.font 中取出 emoji 序列的彩色位图（CBDT 或 sbix 表中的 PNG、JPEG）。
+// 组合 emoji、肤色和国旗由字体的连字规则合成一个字形，整形后不是一个字形或该字形没有位图时返回 nil
+func emojiFontImage(cluster []rune) image.Image {
+	if config.Emoji.Font == "" {
+		return nil
+	}
+	shapingMu.Lock()
+	defer shapingMu.Unlock()
+	face, err := loadShapingFace(config.Emoji.Font)
+	if err != nil {
+		if _, loaded := fallbackFontErrors.LoadOrStore(config.Emoji.Font, err); !loaded {
+			log.Printf("加载 emoji 字体失败: %v", err)
+		}
+		return nil
+	}
+
+	input := shaping.Input{
+		Text:      cluster,
+		RunStart:  0,
+		RunEnd:    len(cluster),
+		Direction: di.DirectionLTR,
+		Face:      face,
+		Size:      fixed.I(64),
+	}
+	var segmenter shaping.Segmenter
+	var shaper shaping.HarfbuzzShaper
+	var glyphs []shaping.Glyph
+	for _, in := range segmenter.Split(input, singleFace{face}) {
+		glyphs = append(glyphs, shaper.Shape(in).Glyphs...)
+	}
+	if len(glyphs) != 1 || glyphs[0].GlyphID == 0 {
+		return nil
+	}
+	// 字体对象没有设置分辨率，取最大的一组位图，绘制时再缩小到字号大小
+	bitmap, ok := face.GlyphData(glyphs[0].GlyphID).(gofont.GlyphBitmap)
+	if !ok || (bitmap.Format != gofont.PNG && bitmap.Format != gofont.JPG) {
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(bitmap.Data))
+	if err != nil {
+		log.Printf("解码 emoji %s 的位图失败: %v", string(cluster), err)
+		return nil
+	}
+	return img
+}
+
+// measureSegment 返回片段的宽度：emoji 占一个字号见方，整形过的文字按整形结果，普通文字按字体测量，字体不可用时估算
+func measureSegment(face font.Face, size float64, seg textSegment) int {
+	if seg.font != nil && seg.emoji == nil && seg.shaped == nil {
+		face = truetype.NewFace(seg.font, &truetype.Options{Size: size, DPI: 72})
+		defer face.Close()
+	}
+	switch {
+	case seg.emoji != nil:
+		return int(size)
+	case seg.shaped != nil:
+		return seg.shaped.width
+	case face != nil:
+		return font.MeasureString(face, seg.text).Ceil()
+	default:
+		return int(size * estimateLineWidth(seg.text))
+	}
+}
+
+// emojiRect 返回 emoji 在图片中的绘制区域：与字号等大，底部略低于基线，和汉字的字身对齐
+func (r textRun) emojiRect(size float64) image.Rectangle {
+	em := int(size)
+	top := r.dot.Y - int(size*0.88)
+	return image.Rect(r.dot.X, top, r.dot.X+em, top+em)
+}
@@ -0,0 +1,350 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// tag 子命令把 artist、copyright 和 exifEdit.userComment 写入当前目录（或指定的）照片的 EXIF，
+// 不加水印、不重新编码，只替换 APP1 段。exifEdit.applyToOutput 为 true 时加水印的输出图片也写入这些字段
+
+const (
+	tagArtist      = 0x013B
+	tagCopyright   = 0x8298
+	tagExifIFD     = 0x8769
+	tagUserComment = 0x9286
+
+	exifTypeASCII     = 2
+	exifTypeUndefined = 7
+)
+
+// tiffValue 是要写入 IFD 的一个字段值，count 按 data 的长度和类型计算
+type tiffValue struct {
+	typ  uint16
+	data []byte
+}
+
+// exifEdits 按 exifEdit 的设置返回要写入 IFD0 和 Exif 子目录的字段。
+// overwrite 为 false 时照片中已有值的字段不写，x 为 nil 表示照片没有 EXIF
+func exifEdits(x *exif.Exif, order binary.ByteOrder) (ifd0, exifIFD map[uint16]tiffValue) {
+	ifd0, exifIFD = map[uint16]tiffValue{}, map[uint16]tiffValue{}
+	has := func(field exif.FieldName) bool {
+		return x != nil && !config.ExifEdit.Overwrite && exifString(x, field) != ""
+	}
+	if config.Artist != "" && !has(exif.Artist) {
+		ifd0[tagArtist] = asciiValue(config.Artist)
+	}
+	if config.Copyright != "" && !has(exif.Copyright) {
+		ifd0[tagCopyright] = asciiValue(config.Copyright)
+	}
+	if text := config.ExifEdit.UserComment; text != "" && (x == nil || config.ExifEdit.Overwrite || userComment(x) == "") {
+		exifIFD[tagUserComment] = userCommentValue(text, order)
+	}
+	return ifd0, exifIFD
+}
+
+// asciiValue 编码 ASCII 类型的字段，非 ASCII 字符按 UTF-8 写入，与 exiftool 等工具的做法一致
+func asciiValue(s string) tiffValue {
+	return tiffValue{typ: exifTypeASCII, data: append([]byte(s), 0)}
+}
+
+// userCommentValue 编码 UserComment：前 8 字节为字符编码，纯 ASCII 时为 ASCII，否则为按 TIFF 字节序的 UCS-2
+func userCommentValue(s string, order binary.ByteOrder) tiffValue {
+	isASCII := !strings.ContainsFunc(s, func(r rune) bool { return r > 0x7F })
+	if isASCII {
+		return tiffValue{typ: exifTypeUndefined, data: append([]byte("ASCII\x00\x00\x00"), s...)}
+	}
+	units := utf16.Encode([]rune(s))
+	data := make([]byte, 8+2*len(units))
+	copy(data, "UNICODE\x00")
+	for i, u := range units {
+		order.PutUint16(data[8+2*i:], u)
+	}
+	return tiffValue{typ: exifTypeUndefined, data: data}
+}
+
+// userComment 读取照片已有的 UserComment，只用于判断是否为空
+func userComment(x *exif.Exif) string {
+	tag, err := x.Get(exif.UserComment)
+	if err != nil || len(tag.Val) < 8 {
+		return ""
+	}
+	return strings.Trim(string(tag.Val[8:]), "\x00 ")
+}
+
+// applyExifEdits 按 exifEdit 的设置改写 APP1 段，app1 为 nil 时新建。没有要写的字段时返回 nil
+func applyExifEdits(app1 []byte) ([]byte, error) {
+	if app1 == nil {
+		app1 = minimalExif()
+	}
+	x, err := exif.Decode(bytes.NewReader(app1[len(exifHeader):]))
+	if err != nil {
+		x = nil
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if bytes.HasPrefix(app1[len(exifHeader):], []byte("II")) {
+		order = binary.LittleEndian
+	}
+	ifd0, exifIFD := exifEdits(x, order)
+	if len(ifd0) == 0 && len(exifIFD) == 0 {
+		return nil, nil
+	}
+	return setExifFields(app1, ifd0, exifIFD)
+}
+
+// setExifFields 替换或加入 IFD0 和 Exif 子目录中的字段。改动的目录复制到 TIFF 数据末尾后再修改，
+// 其他数据的偏移都不变，MakerNote、缩略图等原样保留
+func setExifFields(app1 []byte, ifd0, exifIFD map[uint16]tiffValue) ([]byte, error) {
+	if !bytes.HasPrefix(app1, exifHeader) {
+		return nil, fmt.Errorf("缺少EXIF头")
+	}
+	tiff := append([]byte(nil), app1[len(exifHeader):]...)
+	if len(tiff) < 8 {
+		return nil, fmt.Errorf("TIFF头长度不足")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("未知的字节序: %q", tiff[:2])
+	}
+
+	ifd0Offset := int(order.Uint32(tiff[4:]))
+	entries, _, err := readIFDEntries(tiff, order, ifd0Offset)
+	if err != nil {
+		return nil, fmt.Errorf("读取IFD0失败: %v", err)
+	}
+	if len(exifIFD) > 0 {
+		exifOffset := 0
+		for _, e := range entries {
+			if order.Uint16(e) == tagExifIFD {
+				exifOffset = int(order.Uint32(e[8:]))
+			}
+		}
+		var newOffset int
+		if tiff, newOffset, err = rewriteIFD(tiff, order, exifOffset, exifIFD); err != nil {
+			return nil, fmt.Errorf("改写Exif子目录失败: %v", err)
+		}
+		pointer := make([]byte, 4)
+		order.PutUint32(pointer, uint32(newOffset))
+		ifd0[tagExifIFD] = tiffValue{typ: exifTypeLong, data: pointer}
+	}
+	tiff, ifd0Offset, err = rewriteIFD(tiff, order, ifd0Offset, ifd0)
+	if err != nil {
+		return nil, fmt.Errorf("改写IFD0失败: %v", err)
+	}
+	order.PutUint32(tiff[4:], uint32(ifd0Offset))
+	return finishAPP1(tiff)
+}
+
+// readIFDEntries 返回 offset 处目录的各条目（每条 12 字节）和下一个目录的偏移，offset 为 0 时为空目录
+func readIFDEntries(tiff []byte, order binary.ByteOrder, offset int) ([][]byte, uint32, error) {
+	if offset == 0 {
+		return nil, 0, nil
+	}
+	if offset < 8 || offset+2 > len(tiff) {
+		return nil, 0, fmt.Errorf("目录偏移越界")
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	end := offset + 2 + count*12
+	if end+4 > len(tiff) {
+		return nil, 0, fmt.Errorf("目录长度越界")
+	}
+	entries := make([][]byte, count)
+	for i := range entries {
+		entries[i] = slices.Clone(tiff[offset+2+i*12 : offset+14+i*12])
+	}
+	return entries, order.Uint32(tiff[end:]), nil
+}
+
+// rewriteIFD 把 offset 处的目录连同 values 中的字段写到 TIFF 数据末尾，返回新数据和新目录的偏移。
+// 原目录留在原处不再引用，条目按标签号排序
+func rewriteIFD(tiff []byte, order binary.ByteOrder, offset int, values map[uint16]tiffValue) ([]byte, int, error) {
+	entries, next, err := readIFDEntries(tiff, order, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	entries = slices.DeleteFunc(entries, func(e []byte) bool {
+		_, ok := values[order.Uint16(e)]
+		return ok
+	})
+
+	for _, tag := range slices.Sorted(maps.Keys(values)) {
+		v := values[tag]
+		entry := make([]byte, 12)
+		order.PutUint16(entry, tag)
+		order.PutUint16(entry[2:], v.typ)
+		order.PutUint32(entry[4:], uint32(len(v.data)/exifTypeSizes[v.typ]))
+		if len(v.data) <= 4 {
+			copy(entry[8:], v.data)
+		} else {
+			if len(tiff)%2 == 1 {
+				tiff = append(tiff, 0)
+			}
+			order.PutUint32(entry[8:], uint32(len(tiff)))
+			tiff = append(tiff, v.data...)
+		}
+		entries = append(entries, entry)
+	}
+	slices.SortFunc(entries, func(a, b []byte) int { return int(order.Uint16(a)) - int(order.Uint16(b)) })
+	tiff, newOffset := appendIFD(tiff, order, entries, next)
+	return tiff, newOffset, nil
+}
+
+// appendIFD 把由 entries 组成、下一个目录偏移为 next 的目录追加到 TIFF 数据末尾，返回新数据和目录的偏移
+func appendIFD(tiff []byte, order binary.ByteOrder, entries [][]byte, next uint32) ([]byte, int) {
+	if len(tiff)%2 == 1 {
+		tiff = append(tiff, 0)
+	}
+	offset := len(tiff)
+	ifd := make([]byte, 2+len(entries)*12+4)
+	order.PutUint16(ifd, uint16(len(entries)))
+	for i, e := range entries {
+		copy(ifd[2+i*12:], e)
+	}
+	order.PutUint32(ifd[2+len(entries)*12:], next)
+	return append(tiff, ifd...), offset
+}
+
+// replaceExifSegment 去掉 JPEG 中原有的 EXIF APP1 段，在 SOI 之后插入 app1
+func replaceExifSegment(jpegData, app1 []byte) ([]byte, error) {
+	if len(jpegData) < 4 || jpegData[0] != 0xFF || jpegData[1] != 0xD8 {
+		return nil, fmt.Errorf("不是有效的JPEG文件")
+	}
+	out := append([]byte(nil), jpegData[:2]...)
+	pos := 2
+	for pos+4 <= len(jpegData) {
+		if jpegData[pos] != 0xFF {
+			return nil, fmt.Errorf("JPEG段标记错误: 偏移 %d", pos)
+		}
+		marker := jpegData[pos+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(jpegData[pos+2:]))
+		if end > len(jpegData) {
+			return nil, fmt.Errorf("JPEG段长度错误: 偏移 %d", pos)
+		}
+		if !(marker == 0xE1 && bytes.HasPrefix(jpegData[pos+4:end], exifHeader)) {
+			out = append(out, jpegData[pos:end]...)
+		}
+		pos = end
+	}
+	out = append(out, jpegData[pos:]...)
+	return insertExifSegment(out, app1), nil
+}
+
+// RunTag 实现 tag 子命令：并发改写照片的 EXIF，沿用 maxConcurrency、读写限流和运行报告，在 LoadConfig 之后调用
+func RunTag(files []string) int {
+	if config.Artist == "" && config.Copyright == "" && config.ExifEdit.UserComment == "" {
+		fmt.Println("请先在配置中填写 artist、copyright 或 exifEdit.userComment")
+		return 2
+	}
+	defer emitProgress(ProgressEvent{Type: RunFinished})
+	resetReport()
+	initIOLimits()
+	if len(files) == 0 {
+		var err error
+		if files, err = listInputFiles(); err != nil {
+			fmt.Printf("获取jpg文件失败: %v\n", err)
+			return 1
+		}
+		// 只改写 JPEG，PNG、WebP 跳过
+		files = slices.DeleteFunc(files, func(f string) bool {
+			ext := strings.ToLower(filepath.Ext(f))
+			return ext != ".jpg" && ext != ".jpeg"
+		})
+	}
+	fmt.Println("jpg文件数量:", len(files))
+
+	sem := make(chan struct{}, max(config.MaxConcurrency, 1))
+	var failed, changed int
+	for _, file := range files {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(filename string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			emitProgress(ProgressEvent{Type: FileStarted, Filename: filename})
+			ok, err := tagFile(filename)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+				log.Printf("写入 %s 的EXIF失败: %v", filename, err)
+				addRecord(ImageRecord{Source: filename, Status: StatusError, Error: err.Error()})
+				emitProgress(ProgressEvent{Type: FileFailed, Filename: filename, Err: err})
+				return
+			}
+			if ok {
+				changed++
+				addRecord(ImageRecord{Source: filename, Output: filename, Status: StatusOK})
+			}
+			emitProgress(ProgressEvent{Type: FileDone, Filename: filename, OutputPath: filename})
+		}(file)
+	}
+	wg.Wait()
+
+	if reports, err := writeReport(); err != nil {
+		log.Printf("写入运行报告失败: %v", err)
+	} else if len(reports) > 0 {
+		fmt.Println("运行报告:", strings.Join(reports, ", "))
+	}
+	fmt.Printf("已写入 %d 个文件，%d 个无需改动，%d 个失败\n", changed, len(files)-changed-failed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// tagFile 改写一个文件的 EXIF，先写入临时文件再替换原文件，保留原文件的修改时间。
+// 字段都已有值、无需改动时返回 false
+func tagFile(filename string) (bool, error) {
+	data, err := readSourceFile(filename)
+	if err != nil {
+		return false, err
+	}
+	app1, err := readExifSegment(data)
+	if err != nil {
+		return false, err
+	}
+	edited, err := applyExifEdits(app1)
+	if err != nil || edited == nil {
+		return false, err
+	}
+	out, err := replaceExifSegment(data, edited)
+	if err != nil {
+		return false, err
+	}
+
+	st, err := os.Stat(filename)
+	if err != nil {
+		return false, err
+	}
+	tmp := filename + ".tmp"
+	if err := writeOutputFile(tmp, out); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return false, fmt.Errorf("替换原文件失败: %v", err)
+	}
+	os.Chtimes(filename, st.ModTime(), st.ModTime())
+	log.Printf("已写入 %s 的EXIF", filename)
+	return true, nil
+}
@@ -0,0 +1,140 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// 经过部分聊天软件转发的照片 EXIF 有轻微损坏：某个字段的数据偏移越界、IFD 的条目数大于实际长度、
+// 下一个 IFD 的偏移是乱码等。goexif 遇到任何一处错误都会放弃整个 EXIF，照片就被当作没有 EXIF。
+// 这里先跳过损坏的字段重建目录再解析；目录本身也无法读取时，直接在数据中查找拍摄时间
+
+const (
+	tagInteropIFD        = 0xA005
+	tagDateTimeOriginal  = 0x9003
+	maxExifSubIFDNesting = 2
+)
+
+// subIFDTags 是指向子目录的字段：Exif、GPS 在 IFD0 中，Interoperability 在 Exif 子目录中
+var subIFDTags = []uint16{tagExifIFD, tagGPSIFD, tagInteropIFD}
+
+// decodeDamagedExif 在 exif.Decode 失败后尝试修复 EXIF，cause 为原来的错误
+func decodeDamagedExif(filename string, tiff []byte, cause error) (*exif.Exif, error) {
+	if repaired, err := repairExif(tiff); err == nil {
+		x, err := exif.Decode(bytes.NewReader(repaired))
+		if err == nil || (x != nil && !exif.IsCriticalError(err)) {
+			log.Printf("【EXIF损坏】%s: %v，已跳过损坏的字段", filename, cause)
+			return x, nil
+		}
+	}
+
+	if t, ok := scanExifDateTime(tiff); ok {
+		app1, err := setExifFields(minimalExif(), map[uint16]tiffValue{}, map[uint16]tiffValue{
+			tagDateTimeOriginal: asciiValue(t),
+		})
+		if err == nil {
+			if x, err := exif.Decode(bytes.NewReader(app1[len(exifHeader):])); err == nil {
+				log.Printf("【EXIF损坏】%s: %v，只找到拍摄时间 %s", filename, cause, t)
+				return x, nil
+			}
+		}
+	}
+	return nil, cause
+}
+
+// repairExif 重建 IFD0 及其子目录，去掉数据越界、类型未知的字段，返回新的 TIFF 数据。
+// 原数据保持不动，新目录追加在末尾，没有损坏的字段偏移不变。IFD1（缩略图）不再保留
+func repairExif(tiff []byte) ([]byte, error) {
+	if len(tiff) < 8 {
+		return nil, fmt.Errorf("TIFF头长度不足")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("未知的字节序: %q", tiff[:2])
+	}
+	out, ifd0, err := salvageIFD(tiff, slices.Clone(tiff), order, int(order.Uint32(tiff[4:])), 0)
+	if err != nil {
+		return nil, err
+	}
+	order.PutUint32(out[4:], uint32(ifd0))
+	return out, nil
+}
+
+// salvageIFD 读取原数据 orig 中 offset 处目录的完好条目，递归修复子目录后把新目录追加到 out 末尾，
+// 返回新的 out 和新目录的偏移。条目数超过剩余数据时按实际能读到的条目处理
+func salvageIFD(orig, out []byte, order binary.ByteOrder, offset, depth int) ([]byte, int, error) {
+	if offset < 8 || offset+2 > len(orig) {
+		return out, 0, fmt.Errorf("目录偏移越界")
+	}
+	count := int(order.Uint16(orig[offset:]))
+	count = min(count, (len(orig)-offset-2)/12)
+
+	var entries [][]byte
+	for i := range count {
+		entry := slices.Clone(orig[offset+2+i*12 : offset+14+i*12])
+		if !validExifEntry(orig, order, entry) {
+			continue
+		}
+		if tag := order.Uint16(entry); slices.Contains(subIFDTags, tag) {
+			if depth >= maxExifSubIFDNesting {
+				continue
+			}
+			var sub int
+			var err error
+			if out, sub, err = salvageIFD(orig, out, order, int(order.Uint32(entry[8:])), depth+1); err != nil {
+				continue
+			}
+			order.PutUint32(entry[8:], uint32(sub))
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return out, 0, fmt.Errorf("目录中没有完好的条目")
+	}
+	out, newOffset := appendIFD(out, order, entries, 0)
+	return out, newOffset, nil
+}
+
+// validExifEntry 检查条目的类型是否已知、数据是否在 TIFF 数据范围内
+func validExifEntry(tiff []byte, order binary.ByteOrder, entry []byte) bool {
+	size := uint64(exifTypeSizes[order.Uint16(entry[2:])]) * uint64(order.Uint32(entry[4:]))
+	if size == 0 {
+		return false
+	}
+	if size <= 4 {
+		return true
+	}
+	return uint64(order.Uint32(entry[8:]))+size <= uint64(len(tiff))
+}
+
+// exifDateTimePattern 匹配 EXIF 的日期时间格式，如 2024:01:31 10:20:30
+var exifDateTimePattern = regexp.MustCompile(`\d{4}:\d{2}:\d{2} \d{2}:\d{2}:\d{2}`)
+
+// scanExifDateTime 在损坏的 EXIF 数据中查找日期时间字符串。DateTime（修改时间）不会早于拍摄时间，
+// 因此取其中最早的一个
+func scanExifDateTime(tiff []byte) (string, bool) {
+	var earliest string
+	var earliestTime time.Time
+	for _, m := range exifDateTimePattern.FindAll(tiff, -1) {
+		t, err := time.Parse("2006:01:02 15:04:05", string(m))
+		if err != nil || t.Year() < 1900 {
+			continue
+		}
+		if earliest == "" || t.Before(earliestTime) {
+			earliest, earliestTime = string(m), t
+		}
+	}
+	return earliest, earliest != ""
+}
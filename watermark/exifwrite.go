@@ -0,0 +1,251 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	tagCompression     = 0x0103
+	tagOrientation     = 0x0112
+	tagThumbnailOffset = 0x0201
+	tagThumbnailLength = 0x0202
+	tagGPSIFD          = 0x8825
+
+	exifTypeShort = 3
+	exifTypeLong  = 4
+
+	// IFD1 中 Compression=6 表示 JPEG 缩略图
+	compressionJPEGThumbnail = 6
+	maxAPP1PayloadSize       = 65533
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// exifTypeSizes 为 TIFF 各数据类型单个值占用的字节数
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// readExifSegment 读取 JPEG 数据中的 EXIF APP1 段内容（以 "Exif\0\0" 开头），没有时返回 nil
+func readExifSegment(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, fmt.Errorf("不是有效的JPEG文件")
+	}
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, fmt.Errorf("JPEG段标记错误: 偏移 %d", pos)
+		}
+		marker := data[pos+1]
+		// SOS 之后是图像数据，不再有元数据段
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, fmt.Errorf("JPEG段长度错误: 偏移 %d", pos)
+		}
+		payload := data[pos+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) {
+			return append([]byte(nil), payload...), nil
+		}
+		pos = end
+	}
+	return nil, nil
+}
+
+// insertExifSegment 把 EXIF APP1 段插入到 JPEG 数据的 SOI 标记之后
+func insertExifSegment(jpegData, app1 []byte) []byte {
+	out := make([]byte, 0, len(jpegData)+len(app1)+4)
+	out = append(out, jpegData[:2]...)
+	out = append(out, 0xFF, 0xE1, byte((len(app1)+2)>>8), byte(len(app1)+2))
+	out = append(out, app1...)
+	return append(out, jpegData[2:]...)
+}
+
+// rewriteExif 原地改写 APP1 段：像素已经按方向旋转过，Orientation 统一改为 1；
+// stripGPS 为 true 时从 IFD0 中删除 GPS 指针，并把 GPS IFD 的数据清零
+func rewriteExif(app1 []byte, stripGPS bool) error {
+	if !bytes.HasPrefix(app1, exifHeader) {
+		return fmt.Errorf("缺少EXIF头")
+	}
+	tiff := app1[len(exifHeader):]
+	if len(tiff) < 8 {
+		return fmt.Errorf("TIFF头长度不足")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return fmt.Errorf("未知的字节序: %q", tiff[:2])
+	}
+
+	ifd0 := int(order.Uint32(tiff[4:]))
+	if ifd0+2 > len(tiff) {
+		return fmt.Errorf("IFD0偏移越界")
+	}
+	count := int(order.Uint16(tiff[ifd0:]))
+	if ifd0+2+count*12+4 > len(tiff) {
+		return fmt.Errorf("IFD0长度越界")
+	}
+
+	for i := 0; i < count; i++ {
+		entry := tiff[ifd0+2+i*12:]
+		tag := order.Uint16(entry)
+		switch {
+		case tag == tagOrientation:
+			order.PutUint16(entry[8:], 1)
+		case tag == tagGPSIFD && stripGPS:
+			clearIFD(tiff, order, int(order.Uint32(entry[8:])))
+
+			// 后面的条目和下一个 IFD 的偏移整体前移一个条目
+			start := ifd0 + 2 + i*12
+			end := ifd0 + 2 + count*12 + 4
+			copy(tiff[start:], tiff[start+12:end])
+			for j := end - 12; j < end; j++ {
+				tiff[j] = 0
+			}
+			count--
+			order.PutUint16(tiff[ifd0:], uint16(count))
+			i--
+		}
+	}
+	return nil
+}
+
+// clearIFD 把 offset 处的 IFD 条目及其引用的数据清零
+func clearIFD(tiff []byte, order binary.ByteOrder, offset int) {
+	if offset <= 0 || offset+2 > len(tiff) {
+		return
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	end := offset + 2 + count*12
+	if end > len(tiff) {
+		return
+	}
+
+	for i := 0; i < count; i++ {
+		entry := tiff[offset+2+i*12:]
+		size := exifTypeSizes[order.Uint16(entry[2:])] * int(order.Uint32(entry[4:]))
+		if size > 4 {
+			dataOffset := int(order.Uint32(entry[8:]))
+			if dataOffset >= 0 && dataOffset+size <= len(tiff) {
+				for j := dataOffset; j < dataOffset+size; j++ {
+					tiff[j] = 0
+				}
+			}
+		}
+	}
+	for j := offset; j < end; j++ {
+		tiff[j] = 0
+	}
+}
+
+// minimalExif 构造只包含 Orientation=1 的 EXIF APP1 段，原图没有 EXIF 或不保留 EXIF 时用来承载缩略图
+func minimalExif() []byte {
+	tiff := make([]byte, 8+2+12+4)
+	order := binary.BigEndian
+	copy(tiff, "MM")
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], tagOrientation)
+	order.PutUint16(tiff[12:], exifTypeShort)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], 1)
+	return append(append([]byte(nil), exifHeader...), tiff...)
+}
+
+// setExifThumbnail 把 IFD1 中的缩略图替换为 thumb（JPEG 数据），没有 IFD1 时新建一个。
+// 旧缩略图的数据会被清零，新缩略图追加在 TIFF 数据末尾
+func setExifThumbnail(app1, thumb []byte) ([]byte, error) {
+	if !bytes.HasPrefix(app1, exifHeader) {
+		return nil, fmt.Errorf("缺少EXIF头")
+	}
+	tiff := append([]byte(nil), app1[len(exifHeader):]...)
+	if len(tiff) < 8 {
+		return nil, fmt.Errorf("TIFF头长度不足")
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+	if string(tiff[:2]) == "II" {
+		order = binary.LittleEndian
+	}
+
+	ifd0 := int(order.Uint32(tiff[4:]))
+	if ifd0+2 > len(tiff) {
+		return nil, fmt.Errorf("IFD0偏移越界")
+	}
+	nextPtr := ifd0 + 2 + int(order.Uint16(tiff[ifd0:]))*12
+	if nextPtr+4 > len(tiff) {
+		return nil, fmt.Errorf("IFD0长度越界")
+	}
+
+	// 已有 JPEG 缩略图时只替换数据
+	if ifd1 := int(order.Uint32(tiff[nextPtr:])); ifd1 > 0 && ifd1+2 <= len(tiff) {
+		count := int(order.Uint16(tiff[ifd1:]))
+		var offsetEntry, lengthEntry []byte
+		for i := 0; i < count && ifd1+2+i*12+12 <= len(tiff); i++ {
+			entry := tiff[ifd1+2+i*12:]
+			switch order.Uint16(entry) {
+			case tagThumbnailOffset:
+				offsetEntry = entry
+			case tagThumbnailLength:
+				lengthEntry = entry
+			}
+		}
+		if offsetEntry != nil && lengthEntry != nil {
+			oldOffset := int(order.Uint32(offsetEntry[8:]))
+			oldLength := int(order.Uint32(lengthEntry[8:]))
+			if oldOffset > 0 && oldOffset+oldLength <= len(tiff) {
+				clear(tiff[oldOffset : oldOffset+oldLength])
+			}
+			if len(tiff)%2 == 1 {
+				tiff = append(tiff, 0)
+			}
+			order.PutUint32(offsetEntry[8:], uint32(len(tiff)))
+			order.PutUint32(lengthEntry[8:], uint32(len(thumb)))
+			tiff = append(tiff, thumb...)
+			return finishAPP1(tiff)
+		}
+	}
+
+	// 新建 IFD1：Compression=6、缩略图偏移、缩略图长度
+	if len(tiff)%2 == 1 {
+		tiff = append(tiff, 0)
+	}
+	ifd1 := len(tiff)
+	order.PutUint32(tiff[nextPtr:], uint32(ifd1))
+	ifd := make([]byte, 2+3*12+4)
+	order.PutUint16(ifd, 3)
+	putEntry := func(i int, tag, typ uint16, value uint32) {
+		e := ifd[2+i*12:]
+		order.PutUint16(e, tag)
+		order.PutUint16(e[2:], typ)
+		order.PutUint32(e[4:], 1)
+		if typ == exifTypeShort {
+			order.PutUint16(e[8:], uint16(value))
+		} else {
+			order.PutUint32(e[8:], value)
+		}
+	}
+	putEntry(0, tagCompression, exifTypeShort, compressionJPEGThumbnail)
+	putEntry(1, tagThumbnailOffset, exifTypeLong, uint32(ifd1+len(ifd)))
+	putEntry(2, tagThumbnailLength, exifTypeLong, uint32(len(thumb)))
+	tiff = append(tiff, ifd...)
+	tiff = append(tiff, thumb...)
+	return finishAPP1(tiff)
+}
+
+func finishAPP1(tiff []byte) ([]byte, error) {
+	if len(exifHeader)+len(tiff) > maxAPP1PayloadSize {
+		return nil, fmt.Errorf("EXIF数据超过APP1段的64KB上限")
+	}
+	return append(append([]byte(nil), exifHeader...), tiff...), nil
+}
@@ -0,0 +1,112 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// gpsLatitude 是测试照片的纬度 30°15'40"，按 RATIONAL 编码
+var gpsLatitude = rationalValue(30, 15, 40)
+
+func rationalValue(vs ...uint32) tiffValue {
+	var data []byte
+	for _, v := range vs {
+		data = binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(data, v), 1)
+	}
+	return tiffValue{typ: 5, data: data}
+}
+
+// gpsJPEG 构造一张带有相机信息、拍摄时间、GPS 坐标且需要旋转的 JPEG
+func gpsJPEG(t *testing.T) []byte {
+	t.Helper()
+	order := binary.BigEndian
+	tiff := minimalExif()[len(exifHeader):]
+	tiff, gpsOffset, err := rewriteIFD(tiff, order, 0, map[uint16]tiffValue{
+		0x0001: asciiValue("N"),
+		0x0002: gpsLatitude,
+		0x0003: asciiValue("E"),
+		0x0004: rationalValue(120, 9, 20),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app1, err := setExifFields(append(append([]byte(nil), exifHeader...), tiff...), map[uint16]tiffValue{
+		0x010F:         asciiValue("Canon"),
+		0x0110:         asciiValue("Canon EOS R6"),
+		tagOrientation: {typ: exifTypeShort, data: order.AppendUint16(nil, 6)},
+		tagGPSIFD:      {typ: exifTypeLong, data: order.AppendUint32(nil, uint32(gpsOffset))},
+	}, map[uint16]tiffValue{
+		tagDateTimeOriginal: asciiValue("2024:01:31 10:20:30"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return insertExifSegment(buf.Bytes(), app1)
+}
+
+func TestRewriteExifStripGPS(t *testing.T) {
+	source := gpsJPEG(t)
+	if x, err := exif.Decode(bytes.NewReader(source)); err != nil {
+		t.Fatal(err)
+	} else if _, _, err := x.LatLong(); err != nil {
+		t.Fatalf("构造的原图没有 GPS 坐标: %v", err)
+	}
+
+	app1, err := readExifSegment(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app1 = bytes.Clone(app1)
+	if err := rewriteExif(app1, true); err != nil {
+		t.Fatal(err)
+	}
+	out, err := replaceExifSegment(source, app1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, err := exif.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("改写后的 EXIF 无法解析: %v", err)
+	}
+	if _, err := x.Get(exif.GPSInfoIFDPointer); err == nil {
+		t.Error("IFD0 中仍有 GPS 指针")
+	}
+	for _, name := range []exif.FieldName{exif.GPSLatitudeRef, exif.GPSLatitude, exif.GPSLongitudeRef, exif.GPSLongitude} {
+		if _, err := x.Get(name); err == nil {
+			t.Errorf("仍能读出 %s", name)
+		}
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		t.Errorf("仍能读出坐标 %v, %v", lat, long)
+	}
+	// GPS 目录引用的数据也已清零，直接查找字节也找不到坐标
+	if bytes.Contains(out, gpsLatitude.data) {
+		t.Error("输出中仍有纬度的原始数据")
+	}
+
+	for name, want := range map[exif.FieldName]string{
+		exif.Make:             "Canon",
+		exif.Model:            "Canon EOS R6",
+		exif.DateTimeOriginal: "2024:01:31 10:20:30",
+	} {
+		if got := exifString(x, name); got != want {
+			t.Errorf("%s = %q，期望 %q", name, got, want)
+		}
+	}
+	if tag, err := x.Get(exif.Orientation); err != nil {
+		t.Error(err)
+	} else if v, _ := tag.Int(0); v != 1 {
+		t.Errorf("Orientation = %d，期望 1", v)
+	}
+}
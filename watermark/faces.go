@@ -0,0 +1,77 @@
+package watermark
+
+import (
+	_ "embed"
+	"image"
+	"log"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	pigo "github.com/esimov/pigo/core"
+)
+
+// facefinder 是 pigo 自带的人脸检测级联分类器（MIT 许可）
+//
+//go:embed cascade/facefinder
+var faceCascade []byte
+
+// 检测前把图片缩小到长边不超过该值，人脸检测不需要全分辨率
+const faceDetectMaxSide = 640
+
+// 检测结果的可信度阈值，低于该值的多为误检
+const faceMinQuality = 5.0
+
+var (
+	faceClassifierOnce sync.Once
+	faceClassifier     *pigo.Pigo
+	faceClassifierErr  error
+)
+
+// detectFaces 返回图片中人脸所在的矩形（整张图片坐标系）
+func detectFaces(img image.Image) []image.Rectangle {
+	faceClassifierOnce.Do(func() {
+		faceClassifier, faceClassifierErr = pigo.NewPigo().Unpack(faceCascade)
+	})
+	if faceClassifierErr != nil {
+		log.Printf("加载人脸检测模型失败: %v", faceClassifierErr)
+		return nil
+	}
+
+	bounds := img.Bounds()
+	small := imaging.Fit(img, faceDetectMaxSide, faceDetectMaxSide, imaging.Box)
+	scale := float64(bounds.Dx()) / float64(small.Bounds().Dx())
+
+	cols, rows := small.Bounds().Dx(), small.Bounds().Dy()
+	pixels := make([]uint8, cols*rows)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			i := small.PixOffset(x, y)
+			r, g, b := float64(small.Pix[i]), float64(small.Pix[i+1]), float64(small.Pix[i+2])
+			pixels[y*cols+x] = uint8(0.299*r + 0.587*g + 0.114*b)
+		}
+	}
+
+	params := pigo.CascadeParams{
+		MinSize:     20,
+		MaxSize:     max(cols, rows),
+		ShiftFactor: 0.1,
+		ScaleFactor: 1.1,
+		ImageParams: pigo.ImageParams{Pixels: pixels, Rows: rows, Cols: cols, Dim: cols},
+	}
+	detections := faceClassifier.ClusterDetections(faceClassifier.RunCascade(params, 0), 0.2)
+
+	var faces []image.Rectangle
+	for _, d := range detections {
+		if d.Q < faceMinQuality {
+			continue
+		}
+		half := float64(d.Scale) / 2
+		faces = append(faces, image.Rect(
+			bounds.Min.X+int((float64(d.Col)-half)*scale),
+			bounds.Min.Y+int((float64(d.Row)-half)*scale),
+			bounds.Min.X+int((float64(d.Col)+half)*scale),
+			bounds.Min.Y+int((float64(d.Row)+half)*scale),
+		))
+	}
+	return faces
+}
@@ -0,0 +1,128 @@
+package watermark
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// 读写分别限流：网络存储（NAS/SMB）上读取的最佳并发数和 CPU 渲染的并发数往往不同。
+// 源文件由 prefetchSourceFiles 的读取协程预先读入，再交给 maxConcurrency 个渲染协程处理，
+// 读取数可以大于渲染数，用多个并发请求掩盖网络存储的延迟
+var (
+	readSem  chan struct{}
+	writeSem chan struct{}
+)
+
+func initIOLimits() {
+	readSem = make(chan struct{}, ioLimit(config.ReadConcurrency))
+	writeSem = make(chan struct{}, ioLimit(config.WriteConcurrency))
+}
+
+// ioLimit 未配置时沿用 maxConcurrency
+func ioLimit(n int) int {
+	if n > 0 {
+		return n
+	}
+	if config.MaxConcurrency > 0 {
+		return config.MaxConcurrency
+	}
+	return 1
+}
+
+func ioBufferSize() int {
+	if config.IOBufferSizeKB > 0 {
+		return config.IOBufferSizeKB * 1024
+	}
+	return 64 * 1024
+}
+
+// readSourceFile 一次性读入源文件，后续 EXIF 解析、解码都在内存中完成，
+// 避免在网络存储上对同一文件反复打开、随机读取
+func readSourceFile(filename string) ([]byte, error) {
+	readSem <- struct{}{}
+	defer func() { <-readSem }()
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("打开文件失败: %v", err)
+	}
+	defer file.Close()
+
+	var data bytes.Buffer
+	if info, err := file.Stat(); err == nil {
+		data.Grow(int(info.Size()) + bytes.MinRead)
+	}
+	if _, err := data.ReadFrom(bufio.NewReaderSize(file, ioBufferSize())); err != nil {
+		return nil, fmt.Errorf("读取文件失败: %v", err)
+	}
+	return data.Bytes(), nil
+}
+
+// sourceFile 是预先读入内存的源文件，读取失败时 err 不为 nil
+type sourceFile struct {
+	filename string
+	data     []byte
+	err      error
+}
+
+// prefetchSourceFiles 用 readConcurrency 个协程按顺序读入源文件，通过返回的通道交给渲染协程，
+// 全部读完后关闭通道。重复的文件只读一次。通道的容量与读取协程数相同，
+// 渲染跟不上时读取协程暂停，内存中等待渲染的文件数有上限
+func prefetchSourceFiles(files []string) <-chan sourceFile {
+	readers := ioLimit(config.ReadConcurrency)
+	names := make(chan string)
+	out := make(chan sourceFile, readers)
+
+	go func() {
+		defer close(names)
+		seen := make(map[string]bool)
+		for _, f := range files {
+			if !seen[f] {
+				seen[f] = true
+				names <- f
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				data, err := readSourceFile(name)
+				out <- sourceFile{filename: name, data: data, err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// writeOutputFile 写入输出文件
+func writeOutputFile(path string, data []byte) error {
+	writeSem <- struct{}{}
+	defer func() { <-writeSem }()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("无法创建目标文件 %s: %v", path, err)
+	}
+
+	w := bufio.NewWriterSize(file, ioBufferSize())
+	if _, err := w.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("写入文件 %s 失败: %v", path, err)
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("写入文件 %s 失败: %v", path, err)
+	}
+	return file.Close()
+}
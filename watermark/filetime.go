@@ -0,0 +1,19 @@
+package watermark
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// setFileTimes 把文件的修改时间（Windows 上还有创建时间）设置为拍摄时间，
+// 方便资源管理器和相册按时间排序
+func setFileTimes(path string, t time.Time) error {
+	if err := os.Chtimes(path, t, t); err != nil {
+		return fmt.Errorf("设置文件时间失败: %v", err)
+	}
+	if err := setCreationTime(path, t); err != nil {
+		return fmt.Errorf("设置文件创建时间失败: %v", err)
+	}
+	return nil
+}
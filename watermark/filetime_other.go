@@ -0,0 +1,10 @@
+//go:build !windows
+
+package watermark
+
+import "time"
+
+// 其他系统没有可修改的创建时间，只设置修改时间
+func setCreationTime(path string, t time.Time) error {
+	return nil
+}
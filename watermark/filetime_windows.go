@@ -0,0 +1,24 @@
+//go:build windows
+
+package watermark
+
+import (
+	"syscall"
+	"time"
+)
+
+func setCreationTime(path string, t time.Time) error {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	h, err := syscall.CreateFile(p, syscall.FILE_WRITE_ATTRIBUTES, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(h)
+
+	ft := syscall.NsecToFiletime(t.UnixNano())
+	return syscall.SetFileTime(h, &ft, nil, nil)
+}
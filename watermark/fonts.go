@@ -0,0 +1,234 @@
+package watermark
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+)
+
+// 各系统上常见的中文字体位置，配置的字体不存在时依次尝试。
+// macOS 的苹方（PingFang）是 CFF 轮廓，freetype 无法解析，所以优先使用黑体、冬青黑体
+var systemFontCandidates = map[string][]string{
+	"darwin": {
+		"/System/Library/Fonts/STHeiti Medium.ttc",
+		"/System/Library/Fonts/STHeiti Light.ttc",
+		"/System/Library/Fonts/Hiragino Sans GB.ttc",
+		"/System/Library/Fonts/Supplemental/Arial Unicode.ttf",
+		"/Library/Fonts/Arial Unicode.ttf",
+		"~/Library/Fonts/Arial Unicode.ttf",
+	},
+	"windows": {
+		"C:/Windows/Fonts/msyh.ttc",
+		"C:/Windows/Fonts/simhei.ttf",
+		"C:/Windows/Fonts/simsun.ttc",
+	},
+	"linux": {
+		"/usr/share/fonts/truetype/wqy/wqy-microhei.ttc",
+		"/usr/share/fonts/wqy-microhei/wqy-microhei.ttc",
+		"/usr/share/fonts/truetype/droid/DroidSansFallbackFull.ttf",
+	},
+}
+
+// builtinFontPath 表示使用内置字体，可以写在 fontPath、lines[].fontPath 等配置中
+const builtinFontPath = "builtin"
+
+// 配置的字体和系统字体都找不到时使用内置字体，不会整个水印都画不出来。
+// 内置字体是 Noto Sans CJK SC 的子集，含 GB2312 中的全部汉字，生成方法见 fonts/README
+//
+//go:embed fonts/default.ttf
+var builtinFont []byte
+
+// resolveFontPath 配置的字体文件不存在时，从系统字体目录中找一个可用的中文字体，仍找不到时使用内置字体
+func resolveFontPath() {
+	if config.FontPath == builtinFontPath {
+		return
+	}
+	if _, err := os.Stat(config.FontPath); err == nil {
+		return
+	}
+
+	for _, candidate := range systemFontCandidates[runtime.GOOS] {
+		path := expandHome(candidate)
+		if _, err := os.Stat(path); err == nil {
+			log.Printf("字体文件 %s 不存在，改用系统字体 %s", config.FontPath, path)
+			config.FontPath = path
+			// fontIndex 是针对原来的字体设置的，换成系统字体后不再适用
+			config.FontIndex = 0
+			return
+		}
+	}
+	log.Printf("字体文件 %s 不存在，也没有找到可用的系统字体，改用内置字体", config.FontPath)
+	config.FontPath = builtinFontPath
+	config.FontIndex = 0
+}
+
+// readFontFile 读取字体文件，path 为 builtinFontPath 时返回内置字体
+func readFontFile(path string) ([]byte, error) {
+	if path == builtinFontPath {
+		return builtinFont, nil
+	}
+	return os.ReadFile(path)
+}
+
+func expandHome(path string) string {
+	if len(path) < 2 || path[:2] != "~/" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
+
+var (
+	fontCacheMu sync.Mutex
+	fontCache   = map[string]*truetype.Font{}
+)
+
+// loadFont 读取并解析字体文件，解析结果按路径缓存，避免每张图片都重新解析
+func loadFont(path string) (*truetype.Font, error) {
+	fontCacheMu.Lock()
+	defer fontCacheMu.Unlock()
+	if f, ok := fontCache[path]; ok {
+		return f, nil
+	}
+
+	fontBytes, err := readFontFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("加载字体文件失败: %v", err)
+	}
+	index, err := selectCollectionFace(path, fontBytes)
+	if err != nil {
+		return nil, err
+	}
+	f, err := freetype.ParseFont(collectionFace(fontBytes, index))
+	if err != nil {
+		return nil, fmt.Errorf("解析字体失败: %v", err)
+	}
+	fontCache[path] = f
+	return f, nil
+}
+
+// isFontCollection 判断字体数据是否为字体集合（.ttc）
+func isFontCollection(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "ttcf"
+}
+
+// collectionFace 返回把字体集合中第 index 个字体调到第一位的字体数据。
+// freetype 只解析集合中的第一个字体，而集合中各字体表的偏移量都是相对文件开头的，
+// 因此只需复制一份数据并改写第一个偏移量。不是字体集合或 index 为 0 时原样返回
+func collectionFace(data []byte, index int) []byte {
+	if index == 0 || !isFontCollection(data) {
+		return data
+	}
+	face := slices.Clone(data)
+	copy(face[12:16], data[12+4*index:16+4*index])
+	return face
+}
+
+// selectCollectionFace 返回 path 中要使用的字体序号。只有主字体 fontPath 按 fontIndex、fontStyle 选择，
+// 其它字体（备用字体、按行设置的字体等）都使用集合中的第一个字体
+func selectCollectionFace(path string, data []byte) (int, error) {
+	if path != config.FontPath || !isFontCollection(data) {
+		return 0, nil
+	}
+	n := int(binary.BigEndian.Uint32(data[8:12]))
+	if len(data) < 12+4*n {
+		return 0, fmt.Errorf("解析字体失败: 字体集合 %s 已损坏", path)
+	}
+	if config.FontIndex < 0 || config.FontIndex >= n {
+		return 0, fmt.Errorf("fontIndex %d 超出范围，字体集合 %s 中只有 %d 个字体", config.FontIndex, path, n)
+	}
+	if config.FontStyle == "" {
+		return config.FontIndex, nil
+	}
+
+	var styles []string
+	for i := 0; i < n; i++ {
+		f, err := truetype.Parse(collectionFace(data, i))
+		if err != nil {
+			continue
+		}
+		// 依次比较样式名（Regular、Bold）、排版样式名（Light 等细分字重常写在这里）和完整名称
+		for _, id := range []truetype.NameID{truetype.NameIDFontSubfamily, truetype.NameIDPreferredSubfamily, truetype.NameIDFontFullName} {
+			if name := f.Name(id); name != "" && strings.EqualFold(name, config.FontStyle) {
+				return i, nil
+			}
+		}
+		styles = append(styles, fmt.Sprintf("%d: %s", i, f.Name(truetype.NameIDFontFullName)))
+	}
+	log.Printf("字体集合 %s 中没有样式为 %s 的字体，使用第 %d 个字体。可选的字体有 %s",
+		path, config.FontStyle, config.FontIndex, strings.Join(styles, "，"))
+	return config.FontIndex, nil
+}
+
+var fallbackFontErrors sync.Map
+
+// splitByFont 把文字片段按字体拆分：primary 中没有字形的字符依次到 fallbackFonts 中查找，
+// 找到的字符用备用字体绘制。空白字符跟随前一个字符的字体，避免单独拆出一段
+func splitByFont(segments []textSegment, primary *truetype.Font) []textSegment {
+	if primary == nil || len(config.FallbackFonts) == 0 {
+		return segments
+	}
+
+	var out []textSegment
+	for _, seg := range segments {
+		if seg.emoji != nil {
+			out = append(out, seg)
+			continue
+		}
+		var text []rune
+		var current *truetype.Font
+		var currentPath string
+		for _, r := range seg.text {
+			f, path := current, currentPath
+			if !unicode.IsSpace(r) {
+				f, path = fontForRune(r, primary)
+			}
+			if f != current && len(text) > 0 {
+				out = append(out, textSegment{text: string(text), font: current, fontPath: currentPath})
+				text = nil
+			}
+			current, currentPath = f, path
+			text = append(text, r)
+		}
+		if len(text) > 0 || seg.text == "" {
+			out = append(out, textSegment{text: string(text), font: current, fontPath: currentPath})
+		}
+	}
+	return out
+}
+
+// fontForRune 返回能绘制 r 的字体：primary 有字形时返回 nil 表示使用 primary，
+// 否则返回第一个包含该字形的备用字体；都没有时也返回 nil，仍由 primary 绘制
+func fontForRune(r rune, primary *truetype.Font) (*truetype.Font, string) {
+	if primary.Index(r) != 0 {
+		return nil, ""
+	}
+	for _, path := range config.FallbackFonts {
+		f, err := loadFont(path)
+		if err != nil {
+			// 加载失败的备用字体只提示一次
+			if _, reported := fallbackFontErrors.LoadOrStore(path, err); !reported {
+				log.Printf("备用字体: %v", err)
+			}
+			continue
+		}
+		if f.Index(r) != 0 {
+			return f, path
+		}
+	}
+	return nil, ""
+}
@@ -0,0 +1,399 @@
+//go:build ignore
+
+// gen.go 从 Noto Sans CJK 生成内置字体 default.ttf：取出 ASCII、拉丁字母、常用标点和 GB2312 中全部字符的字形，
+// 把 CFF 轮廓的三次曲线转换为二次曲线（freetype 只能解析 TrueType 轮廓），写成只含基本表的 TrueType 字体。
+// 用法（-index 2 为集合中的简体中文字体）：
+//
+//	go run watermark/fonts/gen.go -index 2 -o watermark/fonts/default.ttf NotoSansCJK-Bold.ttc
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+
+	gofont "github.com/go-text/typesetting/font"
+	ot "github.com/go-text/typesetting/font/opentype"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// tolerance 是二次曲线与原曲线之间允许的最大偏差（字体单位，1000 为一个字高）
+const tolerance = 1.0
+
+func main() {
+	index := flag.Int("index", 0, "字体集合中的序号")
+	output := flag.String("o", "default.ttf", "输出文件")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatal("用法: go run watermark/fonts/gen.go [-index n] [-o default.ttf] 字体文件")
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	loaders, err := ot.NewLoaders(file)
+	if err != nil {
+		log.Fatalf("解析字体失败: %v", err)
+	}
+	if *index < 0 || *index >= len(loaders) {
+		log.Fatalf("-index %d 超出范围，字体中只有 %d 个字体", *index, len(loaders))
+	}
+	ld := loaders[*index]
+	ft, err := gofont.NewFont(ld)
+	if err != nil {
+		log.Fatalf("解析字体失败: %v", err)
+	}
+	face := gofont.NewFace(ft)
+
+	// 按码位顺序分配新的字形编号，cmap 中连续的字符大多对应连续的字形
+	var cmap []mapping
+	glyphs := []gofont.GID{0}
+	newGID := map[gofont.GID]uint32{0: 0}
+	for _, r := range charset() {
+		gid, ok := ft.NominalGlyph(r)
+		if !ok {
+			continue
+		}
+		id, ok := newGID[gid]
+		if !ok {
+			id = uint32(len(glyphs))
+			newGID[gid] = id
+			glyphs = append(glyphs, gid)
+		}
+		cmap = append(cmap, mapping{r, id})
+	}
+
+	var glyf, loca, hmtx bytes.Buffer
+	var maxPoints, maxContours int
+	xMin, yMin, xMax, yMax := math.MaxInt16, math.MaxInt16, math.MinInt16, math.MinInt16
+	for _, gid := range glyphs {
+		binary.Write(&loca, binary.BigEndian, uint32(glyf.Len()))
+		contours := convertOutline(face, gid)
+		g := encodeGlyph(contours)
+		glyf.Write(g.data)
+		for glyf.Len()%4 != 0 {
+			glyf.WriteByte(0)
+		}
+		binary.Write(&hmtx, binary.BigEndian, uint16(math.Round(float64(face.HorizontalAdvance(gid)))))
+		binary.Write(&hmtx, binary.BigEndian, g.xMin)
+		if len(contours) > 0 {
+			xMin, yMin = min(xMin, int(g.xMin)), min(yMin, int(g.yMin))
+			xMax, yMax = max(xMax, int(g.xMax)), max(yMax, int(g.yMax))
+		}
+		maxPoints, maxContours = max(maxPoints, g.points), max(maxContours, len(contours))
+	}
+	binary.Write(&loca, binary.BigEndian, uint32(glyf.Len()))
+
+	raw := func(tag string) []byte {
+		b, err := ld.RawTable(ot.MustNewTag(tag))
+		if err != nil {
+			log.Fatalf("读取 %s 表失败: %v", tag, err)
+		}
+		return slices.Clone(b)
+	}
+
+	head := raw("head")
+	binary.BigEndian.PutUint32(head[8:], 0) // checkSumAdjustment 最后计算
+	binary.BigEndian.PutUint16(head[36:], uint16(int16(xMin)))
+	binary.BigEndian.PutUint16(head[38:], uint16(int16(yMin)))
+	binary.BigEndian.PutUint16(head[40:], uint16(int16(xMax)))
+	binary.BigEndian.PutUint16(head[42:], uint16(int16(yMax)))
+	binary.BigEndian.PutUint16(head[50:], 1) // indexToLocFormat：loca 使用 32 位偏移量
+
+	hhea := raw("hhea")
+	binary.BigEndian.PutUint16(hhea[34:], uint16(len(glyphs)))
+
+	maxp := make([]byte, 32)
+	binary.BigEndian.PutUint32(maxp[0:], 0x00010000)
+	binary.BigEndian.PutUint16(maxp[4:], uint16(len(glyphs)))
+	binary.BigEndian.PutUint16(maxp[6:], uint16(maxPoints))
+	binary.BigEndian.PutUint16(maxp[8:], uint16(maxContours))
+	binary.BigEndian.PutUint16(maxp[14:], 2) // maxZones
+
+	os2 := raw("OS/2")
+	binary.BigEndian.PutUint16(os2[64:], uint16(min(cmap[0].r, 0xFFFF)))
+	binary.BigEndian.PutUint16(os2[66:], uint16(min(cmap[len(cmap)-1].r, 0xFFFF)))
+
+	// post 使用 3.0 版，不保存字形名称
+	post := raw("post")[:32]
+	binary.BigEndian.PutUint32(post[0:], 0x00030000)
+
+	tables := map[string][]byte{
+		"OS/2": os2,
+		"cmap": encodeCmap(cmap),
+		"glyf": glyf.Bytes(),
+		"head": head,
+		"hhea": hhea,
+		"hmtx": hmtx.Bytes(),
+		"loca": loca.Bytes(),
+		"maxp": maxp,
+		"name": raw("name"),
+		"post": post,
+	}
+	if err := os.WriteFile(*output, writeFont(tables), 0644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("已生成 %s：%d 个字符，%d 个字形\n", *output, len(cmap), len(glyphs))
+}
+
+// charset 返回要保留的字符：ASCII、拉丁字母补充、常用标点、中日韩标点、全角字符和 GB2312 中的全部字符
+func charset() []rune {
+	var runes []rune
+	for _, block := range [][2]rune{{0x20, 0x7E}, {0xA0, 0xFF}, {0x2010, 0x205E}, {0x3000, 0x303F}, {0xFF01, 0xFF5E}} {
+		for r := block[0]; r <= block[1]; r++ {
+			runes = append(runes, r)
+		}
+	}
+	dec := simplifiedchinese.GBK.NewDecoder()
+	for hi := 0xA1; hi <= 0xF7; hi++ {
+		for lo := 0xA1; lo <= 0xFE; lo++ {
+			s, err := dec.Bytes([]byte{byte(hi), byte(lo)})
+			if err != nil {
+				continue
+			}
+			for _, r := range string(s) {
+				if r != '�' && r >= 0x80 {
+					runes = append(runes, r)
+				}
+			}
+		}
+	}
+	slices.Sort(runes)
+	return slices.Compact(runes)
+}
+
+type mapping struct {
+	r   rune
+	gid uint32
+}
+
+type point struct {
+	x, y int
+	on   bool
+}
+
+type vec struct{ x, y float64 }
+
+func (a vec) add(b vec) vec       { return vec{a.x + b.x, a.y + b.y} }
+func (a vec) sub(b vec) vec       { return vec{a.x - b.x, a.y - b.y} }
+func (a vec) scale(k float64) vec { return vec{a.x * k, a.y * k} }
+func (a vec) point(on bool) point { return point{int(math.Round(a.x)), int(math.Round(a.y)), on} }
+
+// convertOutline 把字形轮廓转换为 TrueType 的轮廓点。CFF 的外轮廓为逆时针，TrueType 为顺时针，转换时反转方向
+func convertOutline(face *gofont.Face, gid gofont.GID) [][]point {
+	outline, ok := face.GlyphData(gid).(gofont.GlyphOutline)
+	if !ok {
+		return nil
+	}
+	var contours [][]point
+	var current []point
+	var pen vec
+	closeContour := func() {
+		if len(current) > 1 && current[len(current)-1] == current[0] {
+			current = current[:len(current)-1]
+		}
+		if len(current) >= 2 {
+			// 反转后仍以原来的起点开头，保证第一个点在曲线上
+			slices.Reverse(current[1:])
+			contours = append(contours, current)
+		}
+		current = nil
+	}
+	add := func(p point) {
+		if n := len(current); n > 0 && current[n-1].x == p.x && current[n-1].y == p.y {
+			return
+		}
+		current = append(current, p)
+	}
+	for _, seg := range outline.Segments {
+		args := seg.ArgsSlice()
+		end := vec{float64(args[len(args)-1].X), float64(args[len(args)-1].Y)}
+		switch seg.Op {
+		case ot.SegmentOpMoveTo:
+			closeContour()
+			add(end.point(true))
+		case ot.SegmentOpLineTo:
+			add(end.point(true))
+		case ot.SegmentOpQuadTo:
+			add(vec{float64(args[0].X), float64(args[0].Y)}.point(false))
+			add(end.point(true))
+		case ot.SegmentOpCubeTo:
+			c1 := vec{float64(args[0].X), float64(args[0].Y)}
+			c2 := vec{float64(args[1].X), float64(args[1].Y)}
+			cubicToQuads(pen, c1, c2, end, 0, add)
+		}
+		pen = end
+	}
+	closeContour()
+	return contours
+}
+
+// cubicToQuads 用二次曲线逼近三次曲线，偏差超过 tolerance 时从中点分成两段分别逼近
+func cubicToQuads(p0, p1, p2, p3 vec, depth int, add func(point)) {
+	// 单段二次曲线逼近的最大偏差为 √3/36·|p3 - 3p2 + 3p1 - p0|
+	d := p3.sub(p2.scale(3)).add(p1.scale(3)).sub(p0)
+	if math.Sqrt(3)/36*math.Hypot(d.x, d.y) <= tolerance || depth >= 8 {
+		q := p1.add(p2).scale(3).sub(p0).sub(p3).scale(0.25)
+		add(q.point(false))
+		add(p3.point(true))
+		return
+	}
+	p01, p12, p23 := p0.add(p1).scale(0.5), p1.add(p2).scale(0.5), p2.add(p3).scale(0.5)
+	p012, p123 := p01.add(p12).scale(0.5), p12.add(p23).scale(0.5)
+	mid := p012.add(p123).scale(0.5)
+	cubicToQuads(p0, p01, p012, mid, depth+1, add)
+	cubicToQuads(mid, p123, p23, p3, depth+1, add)
+}
+
+type encodedGlyph struct {
+	data                   []byte
+	xMin, yMin, xMax, yMax int16
+	points                 int
+}
+
+// encodeGlyph 按 glyf 表的简单字形格式编码轮廓，没有轮廓时（如空格）返回空数据
+func encodeGlyph(contours [][]point) encodedGlyph {
+	var g encodedGlyph
+	if len(contours) == 0 {
+		return g
+	}
+	g.xMin, g.yMin, g.xMax, g.yMax = math.MaxInt16, math.MaxInt16, math.MinInt16, math.MinInt16
+	var ends []uint16
+	var flags, xs, ys []byte
+	prevX, prevY := 0, 0
+	for _, c := range contours {
+		for _, p := range c {
+			g.xMin, g.yMin = min(g.xMin, int16(p.x)), min(g.yMin, int16(p.y))
+			g.xMax, g.yMax = max(g.xMax, int16(p.x)), max(g.yMax, int16(p.y))
+			var flag byte
+			if p.on {
+				flag |= 0x01
+			}
+			flag, xs = encodeDelta(flag, p.x-prevX, 0x02, 0x10, xs)
+			flag, ys = encodeDelta(flag, p.y-prevY, 0x04, 0x20, ys)
+			flags = append(flags, flag)
+			prevX, prevY = p.x, p.y
+			g.points++
+		}
+		ends = append(ends, uint16(g.points-1))
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, []int16{int16(len(contours)), g.xMin, g.yMin, g.xMax, g.yMax})
+	binary.Write(&buf, binary.BigEndian, ends)
+	binary.Write(&buf, binary.BigEndian, uint16(0)) // 不含指令
+	// 相同的标志用重复标志压缩
+	for i := 0; i < len(flags); {
+		n := 1
+		for i+n < len(flags) && flags[i+n] == flags[i] && n < 256 {
+			n++
+		}
+		if n > 1 {
+			buf.Write([]byte{flags[i] | 0x08, byte(n - 1)})
+		} else {
+			buf.WriteByte(flags[i])
+		}
+		i += n
+	}
+	buf.Write(xs)
+	buf.Write(ys)
+	g.data = buf.Bytes()
+	return g
+}
+
+// encodeDelta 编码一个坐标差值：0 时只设置 same 标志，绝对值小于 256 时用 1 字节，否则用 2 字节
+func encodeDelta(flag byte, d int, short, same byte, out []byte) (byte, []byte) {
+	switch {
+	case d == 0:
+		return flag | same, out
+	case d > 0 && d < 256:
+		return flag | short | same, append(out, byte(d))
+	case d < 0 && d > -256:
+		return flag | short, append(out, byte(-d))
+	default:
+		return flag, binary.BigEndian.AppendUint16(out, uint16(int16(d)))
+	}
+}
+
+// encodeCmap 生成只含一个格式 12 子表的 cmap 表，码位和字形编号都连续的字符合并为一组
+func encodeCmap(cmap []mapping) []byte {
+	var groups [][3]uint32
+	for _, m := range cmap {
+		if n := len(groups); n > 0 && groups[n-1][1]+1 == uint32(m.r) && groups[n-1][2]+uint32(m.r)-groups[n-1][0] == m.gid {
+			groups[n-1][1] = uint32(m.r)
+			continue
+		}
+		groups = append(groups, [3]uint32{uint32(m.r), uint32(m.r), m.gid})
+	}
+
+	var buf bytes.Buffer
+	// 两条编码记录（Unicode 完整字符集、Windows UCS-4）指向同一个子表
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 2, 0, 4})
+	binary.Write(&buf, binary.BigEndian, uint32(20))
+	binary.Write(&buf, binary.BigEndian, []uint16{3, 10})
+	binary.Write(&buf, binary.BigEndian, uint32(20))
+	binary.Write(&buf, binary.BigEndian, []uint16{12, 0})
+	binary.Write(&buf, binary.BigEndian, []uint32{uint32(16 + 12*len(groups)), 0, uint32(len(groups))})
+	for _, g := range groups {
+		binary.Write(&buf, binary.BigEndian, g)
+	}
+	return buf.Bytes()
+}
+
+// writeFont 按标签顺序写出表目录和各表，并计算 head 表的 checkSumAdjustment
+func writeFont(tables map[string][]byte) []byte {
+	tags := make([]string, 0, len(tables))
+	for tag := range tables {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+
+	n := len(tags)
+	searchRange := 1
+	entrySelector := 0
+	for searchRange*2 <= n {
+		searchRange *= 2
+		entrySelector++
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(0x00010000))
+	binary.Write(&buf, binary.BigEndian, []uint16{uint16(n), uint16(searchRange * 16), uint16(entrySelector), uint16(n*16 - searchRange*16)})
+
+	offset := 12 + 16*n
+	var headOffset int
+	for _, tag := range tags {
+		data := tables[tag]
+		if tag == "head" {
+			headOffset = offset
+		}
+		buf.WriteString(tag)
+		binary.Write(&buf, binary.BigEndian, []uint32{checksum(data), uint32(offset), uint32(len(data))})
+		offset += (len(data) + 3) &^ 3
+	}
+	for _, tag := range tags {
+		buf.Write(tables[tag])
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	font := buf.Bytes()
+	binary.BigEndian.PutUint32(font[headOffset+8:], 0xB1B0AFBA-checksum(font))
+	return font
+}
+
+func checksum(data []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(data); i += 4 {
+		var word [4]byte
+		copy(word[:], data[i:])
+		sum += binary.BigEndian.Uint32(word[:])
+	}
+	return sum
+}
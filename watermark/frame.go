@@ -0,0 +1,247 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+)
+
+// frameStyle 判断是否使用边框样式：照片下方加一条信息栏，文字印在信息栏中而不是照片上
+func frameStyle() bool {
+	return strings.EqualFold(strings.TrimSpace(config.Style), "frame")
+}
+
+// polaroidStyle 判断是否使用拍立得相纸样式
+func polaroidStyle() bool {
+	return strings.EqualFold(strings.TrimSpace(config.Style), "polaroid")
+}
+
+// framedStyle 判断文字是否印在照片外的边框中
+func framedStyle() bool {
+	return frameStyle() || polaroidStyle()
+}
+
+// renderFrame 把照片放进带信息栏（或拍立得相纸）的画布。照片像素不复制，只为边框中写字的部分分配内存
+func renderFrame(photo image.Image, wm *watermark) image.Image {
+	if polaroidStyle() {
+		return renderPolaroid(photo, wm)
+	}
+
+	fc := config.Frame
+	pb := photo.Bounds()
+	short := min(pb.Dx(), pb.Dy())
+	border := int(math.Round(resolveSize(fc.Border, short, config.WatermarkSettings.Unit)))
+	barHeight := int(math.Round(resolveSize(fc.BarHeight, short, config.WatermarkSettings.Unit)))
+
+	bounds := image.Rect(0, 0, pb.Dx()+2*border, pb.Dy()+border+barHeight)
+	bar := image.NewRGBA(image.Rect(0, border+pb.Dy(), bounds.Dx(), bounds.Dy()))
+	draw.Draw(bar, bar.Rect, image.NewUniform(fc.Color.toRGBA()), image.Point{}, draw.Src)
+	drawFrameBar(bar, wm)
+
+	return &framedImage{
+		photo:     photo,
+		photoRect: image.Rect(border, border, border+pb.Dx(), border+pb.Dy()),
+		bar:       bar,
+		bounds:    bounds,
+		fill:      fc.Color.toRGBA(),
+	}
+}
+
+// drawFrameBar 在信息栏中绘制文字：左侧左对齐，右侧右对齐（有品牌标志时画在右侧文字前面，中间加一条分隔线），
+// 每侧第一行用 textColor，其余行字号小一些并用 secondaryColor
+func drawFrameBar(bar *image.RGBA, wm *watermark) {
+	f, err := loadFont(config.FontPath)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	r := bar.Rect
+	h := float64(r.Dy())
+	margin := int(h * 0.4)
+
+	left := frameTextBlock(f, wm.frameLeft, h)
+	left.draw(bar, r.Min.X+margin, r)
+
+	right := frameTextBlock(f, wm.frameRight, h)
+	x := r.Max.X - margin - right.width
+	right.draw(bar, x, r)
+
+	if wm.brand != nil {
+		gap := int(h * 0.2)
+		logoHeight := int(h * 0.45)
+		b := wm.brand.Bounds()
+		logoWidth := int(math.Round(float64(b.Dx()) * float64(logoHeight) / float64(b.Dy())))
+		top := r.Min.Y + (r.Dy()-logoHeight)/2
+
+		divider := max(1, int(h/60))
+		x -= gap + divider
+		draw.Draw(bar, image.Rect(x, top, x+divider, top+logoHeight), image.NewUniform(config.Frame.SecondaryColor.toRGBA()), image.Point{}, draw.Over)
+		x -= gap + logoWidth
+		drawBrandLogo(bar, wm.brand, image.Rect(x, top, x+logoWidth, top+logoHeight))
+	}
+}
+
+// frameBlock 是信息栏一侧排好版的多行文字
+type frameBlock struct {
+	font   *truetype.Font
+	lines  []string
+	sizes  []float64
+	widths []int
+	height int
+	width  int
+}
+
+func frameTextBlock(f *truetype.Font, text string, barHeight float64) frameBlock {
+	b := frameBlock{font: f}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		size := barHeight * 0.15
+		if len(b.lines) == 0 {
+			size = barHeight * 0.2
+		}
+		face := truetype.NewFace(f, &truetype.Options{Size: size, DPI: 72})
+		w := font.MeasureString(face, line).Ceil()
+		face.Close()
+
+		b.lines = append(b.lines, line)
+		b.sizes = append(b.sizes, size)
+		b.widths = append(b.widths, w)
+		b.width = max(b.width, w)
+		b.height += int(size * 1.3)
+	}
+	return b
+}
+
+// draw 以 x 为左边界、在 r 中垂直居中绘制
+func (b frameBlock) draw(dst draw.Image, x int, r image.Rectangle) {
+	c := freetype.NewContext()
+	c.SetDPI(72)
+	c.SetFont(b.font)
+	c.SetClip(dst.Bounds())
+	c.SetDst(dst)
+
+	y := r.Min.Y + (r.Dy()-b.height)/2
+	for i, line := range b.lines {
+		lineHeight := int(b.sizes[i] * 1.3)
+		col := config.Frame.TextColor
+		if i > 0 {
+			col = config.Frame.SecondaryColor
+		}
+		c.SetFontSize(b.sizes[i])
+		c.SetSrc(image.NewUniform(col.toRGBA()))
+		// 基线放在行高中间偏下，使文字在行内大致居中
+		baseline := y + (lineHeight+int(b.sizes[i]*0.7))/2
+		if _, err := c.DrawString(line, freetype.Pt(x, baseline)); err != nil {
+			log.Printf("绘制边框文字失败: %v", err)
+		}
+		y += lineHeight
+	}
+}
+
+// renderPolaroid 模仿拍立得相纸：四周等宽的边框，底部留白更宽，文字居中写在留白中
+func renderPolaroid(photo image.Image, wm *watermark) image.Image {
+	pc := config.Polaroid
+	pb := photo.Bounds()
+	short := min(pb.Dx(), pb.Dy())
+	border := int(math.Round(resolveSize(pc.Border, short, config.WatermarkSettings.Unit)))
+	bottom := int(math.Round(resolveSize(pc.Bottom, short, config.WatermarkSettings.Unit)))
+
+	bounds := image.Rect(0, 0, pb.Dx()+2*border, pb.Dy()+border+bottom)
+	bar := image.NewRGBA(image.Rect(0, border+pb.Dy(), bounds.Dx(), bounds.Dy()))
+	draw.Draw(bar, bar.Rect, image.NewUniform(pc.Color.toRGBA()), image.Point{}, draw.Src)
+	drawPolaroidCaption(bar, wm.caption)
+
+	return &framedImage{
+		photo:     photo,
+		photoRect: image.Rect(border, border, border+pb.Dx(), border+pb.Dy()),
+		bar:       bar,
+		bounds:    bounds,
+		fill:      pc.Color.toRGBA(),
+	}
+}
+
+func drawPolaroidCaption(bar *image.RGBA, caption string) {
+	if strings.TrimSpace(caption) == "" {
+		return
+	}
+	fontPath := config.Polaroid.FontPath
+	if fontPath == "" {
+		fontPath = config.FontPath
+	}
+	f, err := loadFont(fontPath)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	r := bar.Rect
+	size := float64(r.Dy()) * 0.2
+	lines := strings.Split(caption, "\n")
+	// 文字过宽时缩小字号，左右至少留出一个字的空白
+	face := truetype.NewFace(f, &truetype.Options{Size: size, DPI: 72})
+	widest := 0
+	for _, line := range lines {
+		widest = max(widest, font.MeasureString(face, line).Ceil())
+	}
+	face.Close()
+	if limit := float64(r.Dx()) - 2*size; widest > 0 && float64(widest) > limit {
+		size *= limit / float64(widest)
+	}
+
+	c := freetype.NewContext()
+	c.SetDPI(72)
+	c.SetFont(f)
+	c.SetFontSize(size)
+	c.SetClip(bar.Bounds())
+	c.SetDst(bar)
+	c.SetSrc(image.NewUniform(config.Polaroid.TextColor.toRGBA()))
+
+	face = truetype.NewFace(f, &truetype.Options{Size: size, DPI: 72})
+	defer face.Close()
+	lineHeight := int(size * 1.3)
+	y := r.Min.Y + (r.Dy()-lineHeight*len(lines))/2
+	for _, line := range lines {
+		w := font.MeasureString(face, line).Ceil()
+		baseline := y + (lineHeight+int(size*0.7))/2
+		if _, err := c.DrawString(line, freetype.Pt(r.Min.X+(r.Dx()-w)/2, baseline)); err != nil {
+			log.Printf("绘制拍立得文字失败: %v", err)
+		}
+		y += lineHeight
+	}
+}
+
+// framedImage 由照片、信息栏和纯色边框拼接而成
+type framedImage struct {
+	photo     image.Image
+	photoRect image.Rectangle // 照片在画布中的位置
+	bar       *image.RGBA
+	bounds    image.Rectangle
+	fill      color.Color
+}
+
+func (f *framedImage) ColorModel() color.Model { return color.RGBAModel }
+
+func (f *framedImage) Bounds() image.Rectangle { return f.bounds }
+
+func (f *framedImage) At(x, y int) color.Color {
+	p := image.Pt(x, y)
+	switch {
+	case p.In(f.photoRect):
+		q := p.Sub(f.photoRect.Min).Add(f.photo.Bounds().Min)
+		return f.photo.At(q.X, q.Y)
+	case p.In(f.bar.Rect):
+		return f.bar.At(x, y)
+	default:
+		return f.fill
+	}
+}
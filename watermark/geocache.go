@@ -0,0 +1,125 @@
+package watermark
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// 地址缓存保存在 JSON Lines 文件中，每解析出一个新地点追加一行，
+// 程序中途退出也不会丢失已写入的记录；启动时读入全部记录，同一个键以最后一行为准
+
+// geocodeCacheRecord 是缓存文件中的一行
+type geocodeCacheRecord struct {
+	Key string `json:"key"` // 服务名/语言/纬度,经度，坐标按 precision 取整
+	Location
+}
+
+// geocodeCacheEntry 是一个地点的解析结果，同时处理的几张照片只有第一张发出请求
+type geocodeCacheEntry struct {
+	once sync.Once
+	loc  Location
+	err  error
+}
+
+// cachedGeocoder 在另一个 Geocoder 外面加上本地缓存
+type cachedGeocoder struct {
+	name string
+	next Geocoder
+
+	mu      sync.Mutex
+	entries map[string]*geocodeCacheEntry
+	file    *os.File
+}
+
+func newCachedGeocoder(name string, next Geocoder) (*cachedGeocoder, error) {
+	c := &cachedGeocoder{name: name, next: next, entries: map[string]*geocodeCacheEntry{}}
+	path := config.GeocodeCache.Path
+	if err := c.load(path); err != nil {
+		return nil, fmt.Errorf("读取地址缓存失败: %v", err)
+	}
+	// 演练模式只读取缓存，不创建缓存文件，新解析的地点也不写入
+	if dryRun {
+		return c, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("打开地址缓存失败: %v", err)
+	}
+	c.file = f
+	return c, nil
+}
+
+// load 读入缓存文件，文件不存在时视为空缓存，无法解析的行跳过
+func (c *cachedGeocoder) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec geocodeCacheRecord
+		if json.Unmarshal(sc.Bytes(), &rec) != nil || rec.Key == "" {
+			continue
+		}
+		e := &geocodeCacheEntry{loc: rec.Location}
+		e.once.Do(func() {})
+		c.entries[rec.Key] = e
+	}
+	log.Printf("已载入 %d 条地址缓存", len(c.entries))
+	return sc.Err()
+}
+
+func (c *cachedGeocoder) key(lat, long float64) string {
+	p := config.GeocodeCache.Precision
+	if p <= 0 {
+		p = 4
+	}
+	return fmt.Sprintf("%s/%.*f,%.*f", c.name, p, lat, p, long)
+}
+
+func (c *cachedGeocoder) ReverseGeocode(lat, long float64) (Location, error) {
+	key := c.key(lat, long)
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &geocodeCacheEntry{}
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+
+	e.once.Do(func() {
+		e.loc, e.err = c.next.ReverseGeocode(lat, long)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if e.err != nil {
+			// 失败的结果不缓存，之后同一地点的照片重新请求
+			delete(c.entries, key)
+			return
+		}
+		c.append(key, e.loc)
+	})
+	return e.loc, e.err
+}
+
+// append 把新解析的地点追加到缓存文件，没有打开缓存文件（演练模式）时不写入，调用时需持有 c.mu
+func (c *cachedGeocoder) append(key string, loc Location) {
+	if c.file == nil {
+		return
+	}
+	line, err := json.Marshal(geocodeCacheRecord{Key: key, Location: loc})
+	if err != nil {
+		return
+	}
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		log.Printf("写入地址缓存失败: %v", err)
+	}
+}
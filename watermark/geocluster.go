@@ -0,0 +1,67 @@
+package watermark
+
+import (
+	"log"
+	"sync"
+)
+
+// 在同一个地方拍的几百张照片坐标只差几米，地址也相同。距离已解析过的照片不超过
+// geocodeCluster.radius 米的照片归为同一簇，直接使用这一簇第一张照片的地址，只请求一次
+
+// geocodeCluster 是一簇照片，坐标为第一张照片的坐标
+type geocodeCluster struct {
+	lat, long float64
+	once      sync.Once
+	loc       Location
+	err       error
+}
+
+// clusteringGeocoder 在另一个 Geocoder 外面按距离合并请求
+type clusteringGeocoder struct {
+	next     Geocoder
+	radiusKm float64
+
+	mu       sync.Mutex
+	clusters []*geocodeCluster
+}
+
+func newClusteringGeocoder(next Geocoder) *clusteringGeocoder {
+	radius := config.GeocodeCluster.Radius
+	if radius <= 0 {
+		radius = 100
+	}
+	return &clusteringGeocoder{next: next, radiusKm: radius / 1000}
+}
+
+func (g *clusteringGeocoder) ReverseGeocode(lat, long float64) (Location, error) {
+	g.mu.Lock()
+	var c *geocodeCluster
+	for _, candidate := range g.clusters {
+		if d := haversineKm(lat, long, candidate.lat, candidate.long); d <= g.radiusKm {
+			c = candidate
+			log.Printf("坐标 %f,%f 与 %.0f 米外的照片使用同一地址", lat, long, d*1000)
+			break
+		}
+	}
+	if c == nil {
+		c = &geocodeCluster{lat: lat, long: long}
+		g.clusters = append(g.clusters, c)
+	}
+	g.mu.Unlock()
+
+	c.once.Do(func() {
+		c.loc, c.err = g.next.ReverseGeocode(c.lat, c.long)
+		if c.err != nil {
+			// 失败的簇去掉，之后附近的照片重新请求
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			for i, candidate := range g.clusters {
+				if candidate == c {
+					g.clusters = append(g.clusters[:i], g.clusters[i+1:]...)
+					break
+				}
+			}
+		}
+	})
+	return c.loc, c.err
+}
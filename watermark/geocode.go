@@ -0,0 +1,603 @@
+package watermark
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 请求公共地图服务时使用的 User-Agent，OpenStreetMap 的服务要求能识别出程序
+const userAgent = "jpg-watermark-cli (+https://github.com/li01452/Jpg-EXIF-Watermarker)"
+
+// Geocoder 是逆地理编码服务：把 WGS-84 坐标解析为行政区划。
+// 新增服务只需实现这个接口并在 newGeocoder 中登记，处理流程通过 getAddressFromGPS 调用
+type Geocoder interface {
+	ReverseGeocode(lat, long float64) (Location, error)
+}
+
+var (
+	geocoder      Geocoder
+	geocodeClient = &http.Client{Timeout: 20 * time.Second}
+	geocodeFailed atomic.Int64 // 未能获取地址的照片数
+)
+
+// loadGeocoder 按 geocoder 配置创建逆地理编码服务。
+// 在线服务外面依次加上限速重试和本地缓存，缓存命中时不占用请求配额
+func loadGeocoder() error {
+	name := strings.ToLower(cmp.Or(config.Geocoder, "amap"))
+	g, err := newGeocoder(name)
+	if err != nil {
+		return err
+	}
+	if name != "offline" {
+		g = newRetryingGeocoder(g)
+		if config.GeocodeClient.TimeoutSeconds > 0 {
+			geocodeClient.Timeout = time.Duration(config.GeocodeClient.TimeoutSeconds) * time.Second
+		}
+	}
+	if config.GeocodeCache.Enabled {
+		// 开启地标时请求的内容不同，与不开启时分开缓存
+		key := name + "/" + geocodeLanguage()
+		if config.Landmark.Enabled {
+			key += "+landmark"
+		}
+		if g, err = newCachedGeocoder(key, g); err != nil {
+			return err
+		}
+	}
+	if config.GeocodeCluster.Enabled {
+		g = newClusteringGeocoder(g)
+	}
+	geocoder = g
+	return nil
+}
+
+func newGeocoder(name string) (Geocoder, error) {
+	switch name {
+	case "amap":
+		return amapGeocoder{key: config.AmapAPIKey}, nil
+	case "nominatim":
+		return newNominatimGeocoder(), nil
+	case "google":
+		if config.Geocoders.Google.APIKey == "" {
+			return nil, fmt.Errorf("使用 Google 逆地理编码需要填写 geocoders.google.apiKey")
+		}
+		return googleGeocoder{}, nil
+	case "baidu":
+		if config.Geocoders.Baidu.APIKey == "" {
+			return nil, fmt.Errorf("使用百度逆地理编码需要填写 geocoders.baidu.apiKey")
+		}
+		return baiduGeocoder{key: config.Geocoders.Baidu.APIKey}, nil
+	case "tencent":
+		if config.Geocoders.Tencent.APIKey == "" {
+			return nil, fmt.Errorf("使用腾讯逆地理编码需要填写 geocoders.tencent.apiKey")
+		}
+		return tencentGeocoder{key: config.Geocoders.Tencent.APIKey}, nil
+	case "offline":
+		return newOfflineGeocoder()
+	default:
+		return nil, fmt.Errorf("不支持的逆地理编码服务: %s", name)
+	}
+}
+
+// geocodeLanguage 返回请求地址时使用的语言，默认为简体中文
+func geocodeLanguage() string {
+	return cmp.Or(config.GeocodeLanguage, "zh-CN")
+}
+
+// cjkAddressLanguage 判断地址是否按中文、日文的习惯从大到小连写
+func cjkAddressLanguage(lang string) bool {
+	lang = strings.ToLower(lang)
+	return lang == "" || strings.HasPrefix(lang, "zh") || strings.HasPrefix(lang, "ja")
+}
+
+// getAddressFromGPS 用配置的服务解析拍摄地点，失败时记录日志并返回空地址
+func getAddressFromGPS(lat, long float64) Location {
+	loc, err := geocoder.ReverseGeocode(lat, long)
+	if err != nil {
+		geocodeFailed.Add(1)
+		log.Printf("获取地址失败: %v", err)
+		return Location{}
+	}
+	return loc
+}
+
+// printGeocodeSummary 有照片未能获取地址时在控制台提示，避免地址为空却不知道原因
+func printGeocodeSummary() {
+	if n := geocodeFailed.Load(); n > 0 {
+		where := " process.log"
+		if dryRun {
+			where = "上面的日志"
+		}
+		consolePrintf("有 %d 张照片未能获取地址，原因见%s\n", n, where)
+	}
+}
+
+// temporaryError 是可以重试的失败：网络错误、服务端错误或请求过于频繁
+type temporaryError struct {
+	err error
+}
+
+func (e temporaryError) Error() string { return e.err.Error() }
+
+func (e temporaryError) Unwrap() error { return e.err }
+
+// retryingGeocoder 让所有请求按 geocodeClient.qps 排队，遇到 temporaryError 时按指数退避重试
+type retryingGeocoder struct {
+	next    Geocoder
+	limiter *rateLimiter // 不限速时为 nil
+	retries int
+}
+
+func newRetryingGeocoder(next Geocoder) *retryingGeocoder {
+	gc := config.GeocodeClient
+	g := &retryingGeocoder{next: next, retries: gc.Retries}
+	if gc.QPS > 0 {
+		g.limiter = &rateLimiter{interval: time.Duration(float64(time.Second) / gc.QPS)}
+	}
+	return g
+}
+
+func (g *retryingGeocoder) ReverseGeocode(lat, long float64) (Location, error) {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		if g.limiter != nil {
+			g.limiter.wait()
+		}
+		start := time.Now()
+		loc, err := g.next.ReverseGeocode(lat, long)
+		if err != nil {
+			debugf("逆地理编码请求 (%f, %f) 失败，用时 %v: %v", lat, long, time.Since(start).Round(time.Millisecond), err)
+		} else {
+			debugf("逆地理编码请求 (%f, %f)，用时 %v", lat, long, time.Since(start).Round(time.Millisecond))
+		}
+		var temp temporaryError
+		if err == nil || !errors.As(err, &temp) {
+			return loc, err
+		}
+		if attempt >= g.retries {
+			return Location{}, fmt.Errorf("%v（已重试 %d 次）", err, g.retries)
+		}
+		log.Printf("获取地址失败，%v 后重试: %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// AmapResponse 定义高德地图API的响应结构
+type AmapResponse struct {
+	Status    string `json:"status"`
+	Info      string `json:"info"`
+	Infocode  string `json:"infocode"`
+	Regeocode struct {
+		AddressComponent struct {
+			Country  string      `json:"country"`
+			Province string      `json:"province"`
+			City     interface{} `json:"city"` // 兼容字符串或数组
+			District string      `json:"district"`
+			Township interface{} `json:"township"` // 同上
+			// 没有门牌时 streetNumber 可能是空数组，字段也可能是空数组
+			StreetNumber json.RawMessage `json:"streetNumber"`
+		} `json:"addressComponent"`
+		// 请求 extensions=all 时返回附近的兴趣点和所在的区域，距离为字符串
+		Pois []amapPlace `json:"pois"`
+		Aois []amapPlace `json:"aois"`
+	} `json:"regeocode"`
+}
+
+// amapPlace 是高德返回的兴趣点或区域
+type amapPlace struct {
+	Name     string      `json:"name"`
+	Type     interface{} `json:"type"`
+	Distance interface{} `json:"distance"`
+}
+
+// amapRetryableCodes 是高德表示访问过于频繁、服务繁忙的 infocode，稍后重试即可
+var amapRetryableCodes = map[string]bool{
+	"10004": true, "10014": true, "10015": true, "10016": true,
+	"10019": true, "10020": true, "10021": true,
+}
+
+// amapGeocoder 调用高德地图的逆地理编码 API，接口只接受 GCJ-02 坐标
+type amapGeocoder struct {
+	key string
+}
+
+func (g amapGeocoder) ReverseGeocode(lat, long float64) (Location, error) {
+	if g.key == "" {
+		return Location{}, fmt.Errorf("API Key 为空")
+	}
+
+	lat, long = toGCJ02(lat, long)
+	url := fmt.Sprintf("https://restapi.amap.com/v3/geocode/regeo?output=JSON&location=%.6f,%.6f&key=%s", long, lat, g.key)
+	if config.Landmark.Enabled {
+		// 搜索兴趣点的半径，高德允许 0~3000 米
+		url += fmt.Sprintf("&extensions=all&radius=%d", int(math.Min(3000, math.Max(10, config.Landmark.Radius))))
+	} else {
+		url += "&radius=10"
+	}
+	var amapResp AmapResponse
+	if err := getGeocodeJSON("高德", url, &amapResp); err != nil {
+		return Location{}, err
+	}
+	if amapResp.Status != "1" {
+		err := fmt.Errorf("高德 API 返回错误状态: %s %s（%s）", amapResp.Status, amapResp.Info, amapResp.Infocode)
+		if amapRetryableCodes[amapResp.Infocode] {
+			return Location{}, temporaryError{err}
+		}
+		return Location{}, err
+	}
+
+	ac := amapResp.Regeocode.AddressComponent
+	loc := Location{
+		Country:  ac.Country,
+		Province: ac.Province,
+		City:     amapString(ac.City),
+		District: ac.District,
+		Township: amapString(ac.Township),
+	}
+	var sn struct {
+		Street interface{} `json:"street"`
+		Number interface{} `json:"number"`
+	}
+	if json.Unmarshal(ac.StreetNumber, &sn) == nil {
+		loc.Street, loc.StreetNumber = amapString(sn.Street), amapString(sn.Number)
+	}
+	loc.Landmark, loc.LandmarkDistance = amapLandmark(amapResp.Regeocode.Aois, amapResp.Regeocode.Pois)
+	return loc, nil
+}
+
+// amapLandmark 选出最合适的地标：优先取照片所在或最近的区域，其次取类型符合 poiTypes 的最近的兴趣点
+func amapLandmark(aois, pois []amapPlace) (string, float64) {
+	best, bestDist := "", math.Inf(1)
+	for _, p := range aois {
+		if d := amapDistance(p.Distance); p.Name != "" && d < bestDist {
+			best, bestDist = p.Name, d
+		}
+	}
+	if best != "" {
+		return best, bestDist
+	}
+	for _, p := range pois {
+		types := config.Landmark.POITypes
+		matched := len(types) == 0 || slices.ContainsFunc(types, func(t string) bool {
+			return strings.Contains(amapString(p.Type), t)
+		})
+		if d := amapDistance(p.Distance); matched && p.Name != "" && d < bestDist {
+			best, bestDist = p.Name, d
+		}
+	}
+	if best == "" {
+		return "", 0
+	}
+	return best, bestDist
+}
+
+// amapDistance 解析高德返回的距离，无法解析时视为无穷远
+func amapDistance(v interface{}) float64 {
+	if d, err := strconv.ParseFloat(amapString(v), 64); err == nil {
+		return d
+	}
+	return math.Inf(1)
+}
+
+// amapString 处理高德的字段可能是字符串或数组的情况，没有值时高德返回空数组
+func amapString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []interface{}:
+		if len(v) > 0 {
+			if str, ok := v[0].(string); ok {
+				return str
+			}
+		}
+	}
+	return ""
+}
+
+// rateLimiter 让并发的请求排队，相邻两次请求至少间隔 interval
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// wait 阻塞到可以发出下一次请求
+func (r *rateLimiter) wait() {
+	r.mu.Lock()
+	now := time.Now()
+	at := r.next
+	if at.Before(now) {
+		at = now
+	}
+	r.next = at.Add(r.interval)
+	r.mu.Unlock()
+	time.Sleep(time.Until(at))
+}
+
+// nominatim 公共服务的地址，使用政策要求每秒最多一次请求
+const nominatimPublicURL = "https://nominatim.openstreetmap.org"
+
+// nominatimGeocoder 调用 OpenStreetMap 的 Nominatim 逆地理编码 API
+type nominatimGeocoder struct {
+	url     string
+	email   string
+	limiter *rateLimiter // 请求公共服务时限速，自建服务为 nil
+}
+
+func newNominatimGeocoder() *nominatimGeocoder {
+	nc := config.Geocoders.Nominatim
+	g := &nominatimGeocoder{url: strings.TrimRight(cmp.Or(nc.URL, nominatimPublicURL), "/"), email: nc.Email}
+	if g.url == nominatimPublicURL {
+		g.limiter = &rateLimiter{interval: time.Second}
+	}
+	return g
+}
+
+func (g *nominatimGeocoder) ReverseGeocode(lat, long float64) (Location, error) {
+	q := url.Values{}
+	q.Set("format", "jsonv2")
+	q.Set("lat", fmt.Sprintf("%.6f", lat))
+	q.Set("lon", fmt.Sprintf("%.6f", long))
+	q.Set("addressdetails", "1")
+	q.Set("accept-language", geocodeLanguage())
+	if g.email != "" {
+		q.Set("email", g.email)
+	}
+	var result struct {
+		Error   string            `json:"error"`
+		Address map[string]string `json:"address"`
+	}
+	if g.limiter != nil {
+		g.limiter.wait()
+	}
+	if err := getGeocodeJSON("Nominatim", g.url+"/reverse?"+q.Encode(), &result); err != nil {
+		return Location{}, err
+	}
+	if result.Error != "" {
+		// 海上等没有地址的坐标返回 Unable to geocode
+		return Location{}, fmt.Errorf("Nominatim 返回错误: %s", result.Error)
+	}
+	return nominatimLocation(result.Address), nil
+}
+
+// nominatimLocation 把 Nominatim 的地址字段对应到省、市、区、街道。
+// 各国的行政区划层级不同，按常见程度依次取第一个非空的字段；
+// 直辖市的 city 和 state 相同，此时城市留空，与高德的结果一致
+func nominatimLocation(addr map[string]string) Location {
+	loc := Location{
+		Country:      addr["country"],
+		Province:     firstField(addr, "state", "province", "region"),
+		City:         firstField(addr, "city", "town", "municipality", "village", "county"),
+		District:     firstField(addr, "city_district", "district", "borough", "suburb", "county"),
+		Township:     firstField(addr, "suburb", "quarter", "neighbourhood", "hamlet"),
+		Street:       firstField(addr, "road", "pedestrian", "footway"),
+		StreetNumber: addr["house_number"],
+	}
+	if loc.District == loc.City {
+		loc.District = ""
+	}
+	if loc.Township == loc.District {
+		loc.Township = ""
+	}
+	if loc.City == loc.Province {
+		loc.City = ""
+	}
+	return loc
+}
+
+// firstField 返回 addr 中 keys 里第一个非空的字段
+func firstField(addr map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v := addr[k]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// googleGeocoder 调用 Google Geocoding API 的逆地理编码
+type googleGeocoder struct{}
+
+func (googleGeocoder) ReverseGeocode(lat, long float64) (Location, error) {
+	gc := config.Geocoders.Google
+	q := url.Values{}
+	q.Set("latlng", fmt.Sprintf("%.6f,%.6f", lat, long))
+	q.Set("key", gc.APIKey)
+	q.Set("language", cmp.Or(gc.Language, geocodeLanguage()))
+	if len(gc.ResultTypes) > 0 {
+		q.Set("result_type", strings.Join(gc.ResultTypes, "|"))
+	}
+	var result struct {
+		Status       string `json:"status"`
+		ErrorMessage string `json:"error_message"`
+		Results      []struct {
+			AddressComponents []struct {
+				LongName string   `json:"long_name"`
+				Types    []string `json:"types"`
+			} `json:"address_components"`
+		} `json:"results"`
+	}
+	if err := getGeocodeJSON("Google", "https://maps.googleapis.com/maps/api/geocode/json?"+q.Encode(), &result); err != nil {
+		return Location{}, err
+	}
+	if result.Status != "OK" {
+		// ZERO_RESULTS 表示该坐标（或按 resultTypes 过滤后）没有地址
+		err := fmt.Errorf("Google API 返回错误状态: %s %s", result.Status, result.ErrorMessage)
+		if result.Status == "OVER_QUERY_LIMIT" || result.Status == "UNKNOWN_ERROR" {
+			return Location{}, temporaryError{err}
+		}
+		return Location{}, err
+	}
+	if len(result.Results) == 0 {
+		return Location{}, fmt.Errorf("Google API 返回 OK 但没有结果")
+	}
+
+	// 结果按精确程度从高到低排列，第一个结果的地址组成最完整
+	addr := map[string]string{}
+	for _, c := range result.Results[0].AddressComponents {
+		for _, t := range c.Types {
+			if addr[t] == "" {
+				addr[t] = c.LongName
+			}
+		}
+	}
+	loc := Location{
+		Country:      addr["country"],
+		Province:     addr["administrative_area_level_1"],
+		City:         firstField(addr, "locality", "postal_town", "administrative_area_level_2"),
+		District:     firstField(addr, "sublocality_level_1", "sublocality", "administrative_area_level_3"),
+		Township:     firstField(addr, "sublocality_level_2", "neighborhood"),
+		Street:       addr["route"],
+		StreetNumber: addr["street_number"],
+	}
+	if loc.City == loc.Province {
+		loc.City = ""
+	}
+	return loc, nil
+}
+
+// chinaAddressComponent 是百度、腾讯返回的行政区划，两者的字段名相同
+type chinaAddressComponent struct {
+	Country  string `json:"country"` // 百度
+	Nation   string `json:"nation"`  // 腾讯
+	Province string `json:"province"`
+	City     string `json:"city"`
+	District string `json:"district"`
+	Town     string `json:"town"` // 百度的乡镇、街道，腾讯在 address_reference 中
+	Street   string `json:"street"`
+	Number   string `json:"street_number"`
+}
+
+// location 转换为 Location。直辖市的城市与省份相同，城市留空，与高德的结果一致
+func (c chinaAddressComponent) location() Location {
+	loc := Location{
+		Country:      cmp.Or(c.Country, c.Nation),
+		Province:     c.Province,
+		City:         c.City,
+		District:     c.District,
+		Township:     c.Town,
+		Street:       c.Street,
+		StreetNumber: c.Number,
+	}
+	if loc.City == loc.Province {
+		loc.City = ""
+	}
+	return loc
+}
+
+// getGeocodeJSON 请求逆地理编码 API 并把 JSON 响应解析到 v，name 用于错误信息。
+// 网络错误、429 和 5xx 状态码返回可以重试的 temporaryError
+func getGeocodeJSON(name, url string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := geocodeClient.Do(req)
+	if err != nil {
+		return temporaryError{fmt.Errorf("%s API 请求失败: %v", name, err)}
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return temporaryError{fmt.Errorf("读取%s API 响应失败: %v", name, err)}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return temporaryError{fmt.Errorf("%s API 返回状态码 %d: %.200s", name, resp.StatusCode, body)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s API 返回状态码 %d: %.200s", name, resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("解析%s API 响应失败，响应体内容: %.200s，错误信息: %v", name, body, err)
+	}
+	return nil
+}
+
+// baiduGeocoder 调用百度地图的逆地理编码 API，接口支持直接传入 WGS-84 坐标
+type baiduGeocoder struct {
+	key string
+}
+
+func (g baiduGeocoder) ReverseGeocode(lat, long float64) (Location, error) {
+	q := url.Values{}
+	q.Set("ak", g.key)
+	q.Set("output", "json")
+	q.Set("coordtype", "wgs84ll")
+	if lang := geocodeLanguage(); !cjkAddressLanguage(lang) {
+		q.Set("language", lang)
+	}
+	q.Set("location", fmt.Sprintf("%.6f,%.6f", lat, long))
+
+	var result struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+		Result  struct {
+			AddressComponent chinaAddressComponent `json:"addressComponent"`
+		} `json:"result"`
+	}
+	if err := getGeocodeJSON("百度", "https://api.map.baidu.com/reverse_geocoding/v3/?"+q.Encode(), &result); err != nil {
+		return Location{}, err
+	}
+	if result.Status != 0 {
+		// 1 为服务器内部错误，401 为并发量超过配额
+		err := fmt.Errorf("百度 API 返回错误状态: %d %s", result.Status, result.Message)
+		if result.Status == 1 || result.Status == 401 {
+			return Location{}, temporaryError{err}
+		}
+		return Location{}, err
+	}
+	return result.Result.AddressComponent.location(), nil
+}
+
+// tencentGeocoder 调用腾讯位置服务的逆地理编码 API，接口只接受 GCJ-02 坐标
+type tencentGeocoder struct {
+	key string
+}
+
+func (g tencentGeocoder) ReverseGeocode(lat, long float64) (Location, error) {
+	lat, long = toGCJ02(lat, long)
+	q := url.Values{}
+	q.Set("key", g.key)
+	q.Set("location", fmt.Sprintf("%.6f,%.6f", lat, long))
+
+	var result struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+		Result  struct {
+			AddressComponent chinaAddressComponent `json:"address_component"`
+			AddressReference struct {
+				Town struct {
+					Title string `json:"title"`
+				} `json:"town"`
+			} `json:"address_reference"`
+		} `json:"result"`
+	}
+	if err := getGeocodeJSON("腾讯", "https://apis.map.qq.com/ws/geocoder/v1/?"+q.Encode(), &result); err != nil {
+		return Location{}, err
+	}
+	if result.Status != 0 {
+		// 120 为每秒请求量超过上限
+		err := fmt.Errorf("腾讯 API 返回错误状态: %d %s", result.Status, result.Message)
+		if result.Status == 120 {
+			return Location{}, temporaryError{err}
+		}
+		return Location{}, err
+	}
+	result.Result.AddressComponent.Town = result.Result.AddressReference.Town.Title
+	return result.Result.AddressComponent.location(), nil
+}
@@ -0,0 +1,201 @@
+package watermark
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 离线逆地理编码从本地的地名数据中找出离拍摄地点最近的一条，不需要 API Key 和网络。
+// 支持两种数据格式，按扩展名区分：
+//   - .csv：每行 纬度,经度,省,市,区，坐标为 WGS-84，第一行可以是表头；
+//   - .txt：GeoNames 的 cities500.txt、cities1000.txt 等导出文件，同目录下有 admin1CodesASCII.txt 时用它补全省份名称。
+// 数据按 1°×1° 的网格建立索引，查询时只比较附近网格中的地点
+
+// geoPlace 是数据中的一个地点
+type geoPlace struct {
+	lat, long float64
+	loc       Location
+}
+
+// offlineGeocoder 在内存中的地名数据里查找最近的地点
+type offlineGeocoder struct {
+	grid          map[[2]int][]geoPlace
+	maxDistanceKm float64
+}
+
+// 地球平均半径（千米）
+const earthRadiusKm = 6371.0
+
+func newOfflineGeocoder() (*offlineGeocoder, error) {
+	oc := config.Geocoders.Offline
+	if oc.Dataset == "" {
+		return nil, fmt.Errorf("使用离线逆地理编码需要填写 geocoders.offline.dataset")
+	}
+	var places []geoPlace
+	var err error
+	switch strings.ToLower(filepath.Ext(oc.Dataset)) {
+	case ".csv":
+		places, err = loadCSVPlaces(oc.Dataset)
+	case ".txt":
+		places, err = loadGeoNamesPlaces(oc.Dataset)
+	default:
+		return nil, fmt.Errorf("不支持的离线地名数据格式: %s，请使用 .csv 或 GeoNames 的 .txt 文件", oc.Dataset)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取离线地名数据失败: %v", err)
+	}
+	if len(places) == 0 {
+		return nil, fmt.Errorf("离线地名数据 %s 中没有地点", oc.Dataset)
+	}
+
+	g := &offlineGeocoder{grid: map[[2]int][]geoPlace{}, maxDistanceKm: oc.MaxDistanceKm}
+	if g.maxDistanceKm <= 0 {
+		g.maxDistanceKm = 50
+	}
+	for _, p := range places {
+		cell := geoCell(p.lat, p.long)
+		g.grid[cell] = append(g.grid[cell], p)
+	}
+	return g, nil
+}
+
+func geoCell(lat, long float64) [2]int {
+	return [2]int{int(math.Floor(lat)), int(math.Floor(long))}
+}
+
+func (g *offlineGeocoder) ReverseGeocode(lat, long float64) (Location, error) {
+	// 按最大距离换算要搜索的网格范围，经度方向的网格在高纬度处更窄
+	dLat := int(math.Ceil(g.maxDistanceKm / 111))
+	dLong := 180
+	if c := math.Cos(lat * math.Pi / 180); c > 0.01 {
+		dLong = min(180, int(math.Ceil(g.maxDistanceKm/(111*c))))
+	}
+
+	center := geoCell(lat, long)
+	best, bestDist := (*geoPlace)(nil), math.Inf(1)
+	for i := center[0] - dLat; i <= center[0]+dLat; i++ {
+		for j := center[1] - dLong; j <= center[1]+dLong; j++ {
+			// 经度跨越 ±180° 时回绕
+			cell := [2]int{i, (j+180+360)%360 - 180}
+			for k := range g.grid[cell] {
+				p := &g.grid[cell][k]
+				if d := haversineKm(lat, long, p.lat, p.long); d < bestDist {
+					best, bestDist = p, d
+				}
+			}
+		}
+	}
+	if best == nil || bestDist > g.maxDistanceKm {
+		return Location{}, fmt.Errorf("%.0f 公里内没有离线地名数据中的地点", g.maxDistanceKm)
+	}
+	return best.loc, nil
+}
+
+// haversineKm 计算两点间的球面距离
+func haversineKm(lat1, long1, lat2, long2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLong := (lat2-lat1)*rad, (long2-long1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// loadCSVPlaces 读取 纬度,经度,省,市,区 格式的 CSV，坐标无法解析的行（如表头）跳过
+func loadCSVPlaces(name string) ([]geoPlace, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(bufio.NewReader(f))
+	r.FieldsPerRecord = -1
+	var places []geoPlace
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return places, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) < 3 {
+			continue
+		}
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(rec[0], "\ufeff")), 64)
+		long, err2 := strconv.ParseFloat(strings.TrimSpace(rec[1]), 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		field := func(i int) string {
+			if i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		places = append(places, geoPlace{lat: lat, long: long, loc: Location{Province: field(2), City: field(3), District: field(4)}})
+	}
+}
+
+// loadGeoNamesPlaces 读取 GeoNames 的城市数据，只保留居民点（feature class 为 P）。
+// 城市取地名，省份取一级行政区的名称
+func loadGeoNamesPlaces(name string) ([]geoPlace, error) {
+	admin1, err := loadGeoNamesAdmin1(filepath.Join(filepath.Dir(name), "admin1CodesASCII.txt"))
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var places []geoPlace
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		// 0 geonameid, 1 name, 4 latitude, 5 longitude, 6 feature class, 8 country code, 10 admin1 code
+		cols := strings.Split(sc.Text(), "\t")
+		if len(cols) < 11 || cols[6] != "P" {
+			continue
+		}
+		lat, err1 := strconv.ParseFloat(cols[4], 64)
+		long, err2 := strconv.ParseFloat(cols[5], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		loc := Location{Province: admin1[cols[8]+"."+cols[10]], City: cols[1]}
+		places = append(places, geoPlace{lat: lat, long: long, loc: loc})
+	}
+	return places, sc.Err()
+}
+
+// loadGeoNamesAdmin1 读取一级行政区代码（如 CN.02）到名称的对应表，文件不存在时返回空表
+func loadGeoNamesAdmin1(name string) (map[string]string, error) {
+	names := map[string]string{}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return names, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		cols := strings.Split(sc.Text(), "\t")
+		if len(cols) >= 2 {
+			names[cols[0]] = cols[1]
+		}
+	}
+	return names, sc.Err()
+}
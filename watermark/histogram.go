@@ -0,0 +1,107 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+// 统计直方图最多采样的像素数，大图按固定步长抽样，形状与全图统计几乎一致
+const histogramSamples = 1 << 20
+
+// histogram 是照片红、绿、蓝和亮度各 256 级的像素计数
+type histogram struct {
+	r, g, b, luma [256]int
+}
+
+// computeHistogram 统计 img 的直方图
+func computeHistogram(img image.Image) *histogram {
+	bounds := img.Bounds()
+	step := max(1, int(math.Ceil(math.Sqrt(float64(bounds.Dx()*bounds.Dy())/histogramSamples))))
+
+	h := &histogram{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, _ := img.At(x, y).RGBA()
+			r, g, b = r>>8, g>>8, b>>8
+			h.r[r]++
+			h.g[g]++
+			h.b[b]++
+			// Rec. 601 亮度，与 JPEG 的 Y 通道一致
+			h.luma[(299*r+587*g+114*b+500)/1000]++
+		}
+	}
+	return h
+}
+
+// histogramRect 返回直方图在整张图片中的位置，不绘制直方图时为空矩形
+func histogramRect(bounds image.Rectangle, wm *watermark) image.Rectangle {
+	if wm.hist == nil {
+		return image.Rectangle{}
+	}
+	width, height := bounds.Dx(), bounds.Dy()
+	ws := config.WatermarkSettings
+	w := max(2, int(math.Round(resolveSize(config.Histogram.Size, min(width, height), ws.Unit))))
+	h := max(1, w/2)
+
+	widthPadding := int(resolveSize(ws.WidthPadding, width, ws.Unit))
+	heightPadding := int(resolveSize(ws.HeightPadding, height, ws.Unit))
+	fx, fy := anchorFactors(config.Histogram.Position)
+	x := anchorOffset(bounds.Min.X, width, w, widthPadding, fx)
+	y := anchorOffset(bounds.Min.Y, height, h, heightPadding, fy)
+	return image.Rect(x, y, x+w, y+h)
+}
+
+// drawHistogram 在半透明的圆角背景上绘制直方图，rgb 模式下三个通道半透明叠加
+func drawHistogram(dst draw.Image, bounds image.Rectangle, wm *watermark) {
+	rect := histogramRect(bounds, wm)
+	area := rect.Intersect(dst.Bounds())
+	if area.Empty() {
+		return
+	}
+
+	hc := config.Histogram
+	radius := float64(rect.Dy()) / 12
+	bg := image.NewUniform(RGBAColor{A: 255}.withOpacity(hc.Opacity))
+	draw.DrawMask(dst, area, bg, image.Point{}, &roundedRectMask{rect: rect, radius: radius}, area.Min, draw.Over)
+
+	inner := rect.Inset(max(1, int(radius/2)))
+	if inner.Empty() {
+		return
+	}
+	if strings.ToLower(hc.Mode) == "rgb" {
+		drawHistogramChannel(dst, inner, &wm.hist.r, color.NRGBA{255, 60, 60, 150})
+		drawHistogramChannel(dst, inner, &wm.hist.g, color.NRGBA{60, 255, 60, 150})
+		drawHistogramChannel(dst, inner, &wm.hist.b, color.NRGBA{60, 120, 255, 150})
+		return
+	}
+	drawHistogramChannel(dst, inner, &wm.hist.luma, color.NRGBA{240, 240, 240, 220})
+}
+
+// drawHistogramChannel 在 rect 中每列画一根柱子。
+// 高度以 1~254 级中的最大值为满格，避免纯黑、纯白处的溢出尖峰把其余部分压扁
+func drawHistogramChannel(dst draw.Image, rect image.Rectangle, counts *[256]int, c color.NRGBA) {
+	peak := 1
+	for _, n := range counts[1:255] {
+		peak = max(peak, n)
+	}
+
+	src := image.NewUniform(c)
+	w, h := rect.Dx(), rect.Dy()
+	for x := 0; x < w; x++ {
+		// 柱子比 256 级少时，一列合并多个等级，取其中的最大值
+		from, to := x*256/w, max(x*256/w+1, (x+1)*256/w)
+		n := 0
+		for _, v := range counts[from:to] {
+			n = max(n, v)
+		}
+		bar := int(math.Round(math.Min(1, float64(n)/float64(peak)) * float64(h)))
+		if bar == 0 {
+			continue
+		}
+		col := image.Rect(rect.Min.X+x, rect.Max.Y-bar, rect.Min.X+x+1, rect.Max.Y)
+		draw.Draw(dst, col.Intersect(dst.Bounds()), src, image.Point{}, draw.Over)
+	}
+}
@@ -0,0 +1,133 @@
+package watermark
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// inPlaceOutputPath 原地模式下输出写回原文件的位置。原文件的扩展名与输出格式一致时沿用原文件名，
+// 否则替换扩展名，避免 .png、.webp 文件中写入 JPEG 数据
+func inPlaceOutputPath(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == outputExt() || (outputExt() == ".jpg" && ext == ".jpeg") {
+		return filename
+	}
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + outputExt()
+}
+
+// inPlaceSidecars 返回原地模式下会写到 outputPath 旁边、并且已经存在的附属文件（如 Lightroom、
+// darktable 的 .xmp），这些文件要和原图一起备份，不能被覆盖
+func inPlaceSidecars(outputPath string) []string {
+	var paths []string
+	for _, s := range []struct {
+		enabled bool
+		path    string
+	}{
+		{config.XMPSidecar, xmpSidecarPath(outputPath)},
+		{config.JSONSidecar, jsonSidecarPath(outputPath)},
+		{config.AltText, altTextPath(outputPath)},
+	} {
+		if _, err := os.Stat(s.path); s.enabled && err == nil {
+			paths = append(paths, s.path)
+		}
+	}
+	return paths
+}
+
+// backupOriginal 把原图和 sidecars 中的附属文件移动到备份目录，返回原位置到备份位置的对应关系。
+// 附属文件与原图的备份使用相同的文件名，备份目录中已有同名文件时自动加序号
+func backupOriginal(filename string, sidecars []string) (map[string]string, error) {
+	base := filepath.Base(filename)
+	ext := filepath.Ext(base)
+	name := strings.TrimSuffix(base, ext)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var targets map[string]string
+	for i := 0; ; i++ {
+		backupName := name
+		if i > 0 {
+			backupName = fmt.Sprintf("%s_%d", name, i)
+		}
+		targets = map[string]string{filename: filepath.Join(config.BackupFolder, backupName+ext)}
+		for _, s := range sidecars {
+			targets[s] = filepath.Join(config.BackupFolder, backupName+filepath.Ext(s))
+		}
+		if !anyExists(targets) {
+			break
+		}
+	}
+
+	if err := moveFile(filename, targets[filename]); err != nil {
+		return nil, fmt.Errorf("备份原图失败: %v", err)
+	}
+	log.Printf("已备份原图: %s -> %s", filename, targets[filename])
+	backups := map[string]string{filename: targets[filename]}
+	for _, s := range sidecars {
+		if err := moveFile(s, targets[s]); err != nil {
+			restoreBackup(backups)
+			return nil, fmt.Errorf("备份附属文件 %s 失败: %v", s, err)
+		}
+		log.Printf("已备份附属文件: %s -> %s", s, targets[s])
+		backups[s] = targets[s]
+	}
+	return backups, nil
+}
+
+// anyExists 判断 targets 中的备份位置是否有已经存在的文件
+func anyExists(targets map[string]string) bool {
+	for _, path := range targets {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreBackup 处理失败时把备份的原图和附属文件移回原位置
+func restoreBackup(backups map[string]string) {
+	for path, backupPath := range backups {
+		if err := moveFile(backupPath, path); err != nil {
+			log.Printf("恢复 %s 失败，原文件保存在 %s: %v", path, backupPath, err)
+			continue
+		}
+		log.Printf("处理失败，已恢复: %s", path)
+	}
+}
+
+// moveFile 移动文件，跨磁盘时退化为复制后删除
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// moveOriginal 确认输出文件已写入后，把原图移入原图目录，输入目录随处理进度逐渐清空
+func moveOriginal(filename, outputPath string) error {
+	info, err := os.Stat(outputPath)
+	if err != nil || info.Size() == 0 {
+		return fmt.Errorf("输出文件 %s 未正确写入，保留原图", outputPath)
+	}
+
+	target := filepath.Join(config.OriginalsFolder, filepath.Base(filename))
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("原图目录中已存在 %s，保留原图", target)
+	}
+	if err := moveFile(filename, target); err != nil {
+		return fmt.Errorf("移动原图失败: %v", err)
+	}
+	log.Printf("已移动原图: %s -> %s", filename, target)
+	return nil
+}
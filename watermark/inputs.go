@@ -0,0 +1,160 @@
+package watermark
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// 照片 App 导出时，编辑过的照片以 IMG_E1234.JPG 命名，与原图 IMG_1234.JPG 放在一起
+var appleEditedName = regexp.MustCompile(`^(?i)(IMG)_E(\d+)$`)
+
+// inputExts 是可以加水印的图片格式
+var inputExts = []string{".jpg", ".jpeg", ".png", ".webp"}
+
+// listInputFiles 列出当前目录下待处理的图片。扩展名不区分大小写（照片 App 导出为 .JPG），
+// 同时存在编辑版本时跳过原图，并忽略 .AAE 调整文件
+func listInputFiles() ([]string, error) {
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	names := make(map[string]bool)
+	aaeCount, heifCount := 0, 0
+	for _, e := range entries {
+		name := e.Name()
+		ext := strings.ToLower(filepath.Ext(name))
+		switch {
+		case e.IsDir():
+			if ext == ".photoslibrary" {
+				log.Printf("跳过照片图库 %s，请先在照片 App 中选择照片并导出后再处理", name)
+			}
+		case ext == ".aae":
+			aaeCount++
+		case ext == ".heic" || ext == ".heif":
+			heifCount++
+		case slices.Contains(inputExts, ext):
+			files = append(files, name)
+			names[strings.ToUpper(strings.TrimSuffix(name, filepath.Ext(name)))] = true
+		}
+	}
+	if aaeCount > 0 {
+		log.Printf("忽略 %d 个 AAE 调整文件", aaeCount)
+	}
+	if heifCount > 0 {
+		log.Printf("跳过 %d 个 HEIC 文件：没有可用的纯 Go 解码器，请先导出为 JPEG", heifCount)
+	}
+
+	// 有编辑版本时使用编辑后的照片
+	edited := make(map[string]bool)
+	for base := range names {
+		if m := appleEditedName.FindStringSubmatch(base); m != nil {
+			edited[strings.ToUpper(m[1])+"_"+m[2]] = true
+		}
+	}
+	result := files[:0]
+	for _, f := range files {
+		base := strings.ToUpper(strings.TrimSuffix(f, filepath.Ext(f)))
+		if edited[base] {
+			log.Printf("跳过 %s，使用编辑后的版本", f)
+			continue
+		}
+		result = append(result, f)
+	}
+
+	sort.Strings(result)
+	return result, nil
+}
+
+// loadCaption 确定本次运行的固定说明文字：命令行参数优先，其次是当前目录的 caption.txt，最后是配置中的 caption
+func loadCaption(flagValue string) error {
+	if flagValue != "" {
+		config.Caption = flagValue
+		return nil
+	}
+	data, err := os.ReadFile("caption.txt")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// 记事本保存的 UTF-8 文件可能带有 BOM
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	config.Caption = strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+	log.Printf("使用 caption.txt 中的说明文字: %s", config.Caption)
+	return nil
+}
+
+// locationOverride 是 locations.txt 中的一条规则
+type locationOverride struct {
+	pattern string // 文件名的通配符，以 / 结尾时匹配所在目录的名称
+	place   string
+}
+
+var locationOverrides []locationOverride
+
+// loadLocationOverrides 读取当前目录的 locations.txt。每行一条规则，格式为 “模式 = 地点”，
+// # 开头的行为注释；文件不存在时不做任何事
+func loadLocationOverrides() error {
+	data, err := os.ReadFile("locations.txt")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	for i, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern, place, ok := strings.Cut(line, "=")
+		pattern, place = strings.TrimSpace(pattern), strings.TrimSpace(place)
+		if !ok || pattern == "" || place == "" {
+			return fmt.Errorf("locations.txt 第 %d 行格式错误，应为 “模式 = 地点”: %s", i+1, line)
+		}
+		if _, err := filepath.Match(strings.TrimSuffix(pattern, "/"), ""); err != nil {
+			return fmt.Errorf("locations.txt 第 %d 行的模式 %q 无效: %v", i+1, pattern, err)
+		}
+		locationOverrides = append(locationOverrides, locationOverride{pattern: strings.ToLower(pattern), place: place})
+	}
+	log.Printf("已读取 locations.txt 中的 %d 条地点规则", len(locationOverrides))
+	return nil
+}
+
+// overrideLocation 返回第一条匹配 filename 的规则指定的地点，不区分大小写
+func overrideLocation(filename string) (string, bool) {
+	if len(locationOverrides) == 0 {
+		return "", false
+	}
+	name := strings.ToLower(filepath.Base(filename))
+	var dirs []string
+	if abs, err := filepath.Abs(filename); err == nil {
+		dirs = strings.Split(strings.ToLower(filepath.ToSlash(filepath.Dir(abs))), "/")
+	}
+	for _, o := range locationOverrides {
+		if dir, ok := strings.CutSuffix(o.pattern, "/"); ok {
+			for _, d := range dirs {
+				if matched, _ := filepath.Match(dir, d); matched {
+					return o.place, true
+				}
+			}
+			continue
+		}
+		if matched, _ := filepath.Match(o.pattern, name); matched {
+			return o.place, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,706 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+)
+
+// 分块处理超大 JPEG 时使用的基线 JPEG 编解码：只在量化后的 DCT 系数这一层读写，
+// 需要改动的块才做反变换和正变换，其余块的系数原样写回，不损失画质。
+// 支持 8 位、哈夫曼编码、单次扫描的灰度和 YCbCr 图片，渐进式、算术编码、CMYK 等返回错误
+
+// unzig 把 Z 字形顺序的序号换算为 8x8 块中按行排列的序号
+var unzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// jpegComponent 是 SOF 中的一个颜色分量
+type jpegComponent struct {
+	id     byte
+	h, v   int  // 水平、垂直采样因子
+	tq     byte // 量化表
+	td, ta byte // 扫描中使用的 DC、AC 哈夫曼表
+}
+
+// jpegStream 是解析出的 JPEG 头部信息和熵编码数据
+type jpegStream struct {
+	width, height int
+	sof           byte // 0xC0（基线）或 0xC1（扩展顺序）
+	comps         []jpegComponent
+	quant         [4][64]uint16 // 量化表，Z 字形顺序
+	quantPrec     [4]byte       // 量化表的精度：0 为 8 位，1 为 16 位
+	huff          [2][4]*huffmanTable
+	restart       int // 重启间隔（MCU 数），0 表示没有
+	hmax, vmax    int
+	mcusX, mcusY  int
+	ratio         image.YCbCrSubsampleRatio
+	scan          []byte // SOS 之后的熵编码数据
+}
+
+// parseJPEGStream 解析 JPEG 的头部，直到第一个 SOS。不支持的类型返回说明原因的错误
+func parseJPEGStream(data []byte) (*jpegStream, error) {
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return nil, fmt.Errorf("不是 JPEG 文件")
+	}
+	s := &jpegStream{}
+	var quantSet [4]bool
+	adobeTransform := -1
+	pos := 2
+	for {
+		if pos+4 > len(data) || data[pos] != 0xFF {
+			return nil, fmt.Errorf("JPEG 文件格式错误")
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, fmt.Errorf("JPEG 文件格式错误")
+		}
+		seg := data[pos+4 : pos+2+length]
+		pos += 2 + length
+
+		switch {
+		case marker == 0xDB:
+			for len(seg) > 0 {
+				pq, tq := seg[0]>>4, seg[0]&15
+				size := 64 * (1 + int(pq))
+				if pq > 1 || tq > 3 || len(seg) < 1+size {
+					return nil, fmt.Errorf("量化表格式错误")
+				}
+				for k := range 64 {
+					if pq == 0 {
+						s.quant[tq][k] = uint16(seg[1+k])
+					} else {
+						s.quant[tq][k] = binary.BigEndian.Uint16(seg[1+2*k:])
+					}
+				}
+				s.quantPrec[tq], quantSet[tq] = pq, true
+				seg = seg[1+size:]
+			}
+		case marker == 0xC4:
+			for len(seg) > 0 {
+				if len(seg) < 17 || seg[0]>>4 > 1 || seg[0]&15 > 3 {
+					return nil, fmt.Errorf("哈夫曼表格式错误")
+				}
+				tc, th := seg[0]>>4, seg[0]&15
+				n := 0
+				for _, c := range seg[1:17] {
+					n += int(c)
+				}
+				if n > 256 || len(seg) < 17+n {
+					return nil, fmt.Errorf("哈夫曼表格式错误")
+				}
+				t, err := newHuffmanTable(seg[1:17], seg[17:17+n])
+				if err != nil {
+					return nil, err
+				}
+				s.huff[tc][th] = t
+				seg = seg[17+n:]
+			}
+		case marker == 0xDD:
+			if len(seg) < 2 {
+				return nil, fmt.Errorf("重启间隔格式错误")
+			}
+			s.restart = int(binary.BigEndian.Uint16(seg))
+		case marker == 0xEE:
+			if bytes.HasPrefix(seg, []byte("Adobe")) && len(seg) >= 12 {
+				adobeTransform = int(seg[11])
+			}
+		case marker == 0xC0 || marker == 0xC1:
+			if err := s.parseSOF(marker, seg); err != nil {
+				return nil, err
+			}
+		case marker >= 0xC2 && marker <= 0xCF:
+			return nil, fmt.Errorf("是渐进式或算术编码的 JPEG")
+		case marker == 0xDA:
+			if s.comps == nil {
+				return nil, fmt.Errorf("JPEG 文件缺少 SOF")
+			}
+			if len(s.comps) == 3 && (adobeTransform == 0 || string([]byte{s.comps[0].id, s.comps[1].id, s.comps[2].id}) == "RGB") {
+				return nil, fmt.Errorf("颜色分量是 RGB 而不是 YCbCr")
+			}
+			if err := s.parseSOS(seg); err != nil {
+				return nil, err
+			}
+			for _, c := range s.comps {
+				if !quantSet[c.tq] || s.huff[0][c.td] == nil || s.huff[1][c.ta] == nil {
+					return nil, fmt.Errorf("JPEG 文件缺少量化表或哈夫曼表")
+				}
+			}
+			s.scan = data[pos:]
+			return s, nil
+		}
+	}
+}
+
+// parseSOF 解析帧头，确定分量、采样因子和 MCU 的数量
+func (s *jpegStream) parseSOF(marker byte, seg []byte) error {
+	if len(seg) < 6 {
+		return fmt.Errorf("SOF 格式错误")
+	}
+	if seg[0] != 8 {
+		return fmt.Errorf("采样精度为 %d 位", seg[0])
+	}
+	s.sof = marker
+	s.height = int(binary.BigEndian.Uint16(seg[1:]))
+	s.width = int(binary.BigEndian.Uint16(seg[3:]))
+	nf := int(seg[5])
+	if s.width == 0 || s.height == 0 {
+		return fmt.Errorf("图片高度写在 DNL 中")
+	}
+	if nf != 1 && nf != 3 {
+		return fmt.Errorf("有 %d 个颜色分量", nf)
+	}
+	if len(seg) < 6+3*nf {
+		return fmt.Errorf("SOF 格式错误")
+	}
+	s.comps = make([]jpegComponent, nf)
+	for i := range s.comps {
+		b := seg[6+3*i:]
+		s.comps[i] = jpegComponent{id: b[0], h: int(b[1] >> 4), v: int(b[1] & 15), tq: b[2] & 3}
+	}
+
+	// 单个分量时不交织，每个 MCU 只有一个块，与采样因子无关
+	if nf == 1 {
+		s.comps[0].h, s.comps[0].v = 1, 1
+	} else {
+		for _, c := range s.comps[1:] {
+			if c.h != 1 || c.v != 1 {
+				return fmt.Errorf("色度采样方式不受支持")
+			}
+		}
+		ratios := map[[2]int]image.YCbCrSubsampleRatio{
+			{1, 1}: image.YCbCrSubsampleRatio444,
+			{2, 1}: image.YCbCrSubsampleRatio422,
+			{2, 2}: image.YCbCrSubsampleRatio420,
+			{1, 2}: image.YCbCrSubsampleRatio440,
+			{4, 1}: image.YCbCrSubsampleRatio411,
+			{4, 2}: image.YCbCrSubsampleRatio410,
+		}
+		ratio, ok := ratios[[2]int{s.comps[0].h, s.comps[0].v}]
+		if !ok {
+			return fmt.Errorf("色度采样方式不受支持")
+		}
+		s.ratio = ratio
+	}
+	s.hmax, s.vmax = s.comps[0].h, s.comps[0].v
+	s.mcusX = (s.width + 8*s.hmax - 1) / (8 * s.hmax)
+	s.mcusY = (s.height + 8*s.vmax - 1) / (8 * s.vmax)
+	return nil
+}
+
+// parseSOS 解析扫描头，只支持包含全部分量的单次顺序扫描
+func (s *jpegStream) parseSOS(seg []byte) error {
+	if len(seg) < 1 || int(seg[0]) != len(s.comps) || len(seg) < 4+2*len(s.comps) {
+		return fmt.Errorf("分量分多次扫描")
+	}
+	for i := range s.comps {
+		b := seg[1+2*i:]
+		if b[0] != s.comps[i].id || b[1]>>4 > 3 || b[1]&15 > 3 {
+			return fmt.Errorf("扫描头格式错误")
+		}
+		s.comps[i].td, s.comps[i].ta = b[1]>>4, b[1]&15
+	}
+	if tail := seg[1+2*len(s.comps):]; tail[0] != 0 || tail[1] != 63 || tail[2] != 0 {
+		return fmt.Errorf("扫描头格式错误")
+	}
+	return nil
+}
+
+// mcuSize 返回一个 MCU 覆盖的像素宽度和高度
+func (s *jpegStream) mcuSize() (int, int) {
+	return 8 * s.hmax, 8 * s.vmax
+}
+
+// scanBlocks 按 MCU 顺序熵解码全部块，对每个块调用 fn。c 为分量序号，bx、by 为块在该分量中的位置，
+// blk 为 Z 字形顺序的量化系数，DC 已加上预测值。fn 可以修改 blk，修改不影响后面块的解码
+func (s *jpegStream) scanBlocks(fn func(c, bx, by int, blk *[64]int32) error) error {
+	r := &jpegBitReader{data: s.scan}
+	var pred [3]int32
+	var blk [64]int32
+	n := 0
+	for my := range s.mcusY {
+		for mx := range s.mcusX {
+			if s.restart > 0 && n > 0 && n%s.restart == 0 {
+				if err := r.restart(); err != nil {
+					return err
+				}
+				pred = [3]int32{}
+			}
+			n++
+			for c := range s.comps {
+				comp := &s.comps[c]
+				dc, ac := s.huff[0][comp.td], s.huff[1][comp.ta]
+				for v := range comp.v {
+					for h := range comp.h {
+						blk = [64]int32{}
+						t, err := r.decode(dc)
+						if err != nil {
+							return err
+						}
+						pred[c] += r.receiveExtend(t)
+						blk[0] = pred[c]
+						for k := 1; k < 64; {
+							rs, err := r.decode(ac)
+							if err != nil {
+								return err
+							}
+							run, size := int(rs>>4), rs&15
+							if size == 0 {
+								if run != 15 {
+									break
+								}
+								k += 16
+								continue
+							}
+							k += run
+							if k > 63 {
+								return fmt.Errorf("JPEG 数据错误：AC 系数越界")
+							}
+							blk[k] = r.receiveExtend(size)
+							k++
+						}
+						pred[c] = blk[0]
+						if err := fn(c, mx*comp.h+h, my*comp.v+v, &blk); err != nil {
+							return err
+						}
+						blk[0] = pred[c]
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// huffmanTable 是解码用的哈夫曼表
+type huffmanTable struct {
+	lut     [256]uint16 // 8 位以内的码直接查表：高 8 位为码长，低 8 位为符号，0 表示需要逐位查找
+	mincode [17]int32
+	maxcode [17]int32
+	valptr  [17]int32
+	symbols []byte
+}
+
+func newHuffmanTable(counts, symbols []byte) (*huffmanTable, error) {
+	t := &huffmanTable{symbols: symbols}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		t.mincode[l], t.valptr[l] = code, k
+		t.maxcode[l] = code + n - 1
+		if n == 0 {
+			t.maxcode[l] = -1
+		}
+		if code+n > 1<<l {
+			return nil, fmt.Errorf("哈夫曼表格式错误")
+		}
+		if l <= 8 {
+			shift := 8 - l
+			for i := range n {
+				entry := uint16(l)<<8 | uint16(symbols[k+i])
+				for j := int32(0); j < 1<<shift; j++ {
+					t.lut[(code+i)<<shift|j] = entry
+				}
+			}
+		}
+		code, k = (code+n)<<1, k+n
+	}
+	return t, nil
+}
+
+// jpegBitReader 从熵编码数据中按位读取，去掉 0xFF 之后填充的 0x00，遇到标记后补 0
+type jpegBitReader struct {
+	data   []byte
+	pos    int
+	acc    uint64 // 未读的位，高位对齐
+	n      uint   // acc 中未读的位数
+	marker bool   // pos 处是标记，不再读入数据
+}
+
+func (r *jpegBitReader) fill() {
+	for r.n <= 56 {
+		var b byte
+		if !r.marker && r.pos < len(r.data) {
+			b = r.data[r.pos]
+			if b != 0xFF {
+				r.pos++
+			} else if r.pos+1 < len(r.data) && r.data[r.pos+1] == 0 {
+				r.pos += 2
+			} else {
+				r.marker, b = true, 0
+			}
+		}
+		r.acc |= uint64(b) << (56 - r.n)
+		r.n += 8
+	}
+}
+
+// bits 读取 n 位（n <= 16）
+func (r *jpegBitReader) bits(n uint) int32 {
+	if r.n < n {
+		r.fill()
+	}
+	v := int32(r.acc >> (64 - n))
+	r.acc <<= n
+	r.n -= n
+	return v
+}
+
+// receiveExtend 读取 size 位的差值并按 JPEG 的规则还原符号
+func (r *jpegBitReader) receiveExtend(size byte) int32 {
+	if size == 0 {
+		return 0
+	}
+	v := r.bits(uint(size))
+	if v < 1<<(size-1) {
+		v += -1<<size + 1
+	}
+	return v
+}
+
+func (r *jpegBitReader) decode(t *huffmanTable) (byte, error) {
+	if r.n < 16 {
+		r.fill()
+	}
+	if e := t.lut[r.acc>>56]; e != 0 {
+		l := uint(e >> 8)
+		r.acc <<= l
+		r.n -= l
+		return byte(e), nil
+	}
+	code := int32(0)
+	for l := 1; l <= 16; l++ {
+		code = code<<1 | int32(r.acc>>63)
+		r.acc <<= 1
+		r.n--
+		if code <= t.maxcode[l] {
+			return t.symbols[t.valptr[l]+code-t.mincode[l]], nil
+		}
+	}
+	return 0, fmt.Errorf("JPEG 数据错误：哈夫曼码无效")
+}
+
+// restart 丢弃补齐字节的剩余位，跳过 RST 标记
+func (r *jpegBitReader) restart() error {
+	r.acc, r.n = 0, 0
+	for !r.marker && r.pos+1 < len(r.data) {
+		if r.data[r.pos] == 0xFF && r.data[r.pos+1] != 0 {
+			break
+		}
+		r.pos++
+	}
+	for r.pos+1 < len(r.data) && r.data[r.pos+1] == 0xFF {
+		r.pos++
+	}
+	if r.pos+1 >= len(r.data) || r.data[r.pos+1] < 0xD0 || r.data[r.pos+1] > 0xD7 {
+		return fmt.Errorf("JPEG 数据错误：缺少 RST 标记")
+	}
+	r.pos += 2
+	r.marker = false
+	return nil
+}
+
+// huffmanSpec 是哈夫曼表的码长计数和符号，与 DHT 段的内容相同
+type huffmanSpec struct {
+	counts  [16]byte
+	symbols []byte
+}
+
+// 输出使用 JPEG 标准附录 K 中的哈夫曼表，任何系数都能编码，依次为亮度 DC、亮度 AC、色度 DC、色度 AC
+var standardHuffmanSpecs = [4]huffmanSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// huffmanCode 是编码用的哈夫曼表，按符号查码字和码长
+type huffmanCode struct {
+	code [256]uint16
+	size [256]byte
+}
+
+func newHuffmanCode(spec huffmanSpec) *huffmanCode {
+	h := &huffmanCode{}
+	code, k := uint16(0), 0
+	for l, n := range spec.counts {
+		for range n {
+			sym := spec.symbols[k]
+			h.code[sym], h.size[sym] = code, byte(l+1)
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return h
+}
+
+var standardHuffmanCodes = func() (codes [4]*huffmanCode) {
+	for i, spec := range standardHuffmanSpecs {
+		codes[i] = newHuffmanCode(spec)
+	}
+	return codes
+}()
+
+// jpegBitWriter 按位写入熵编码数据，0xFF 之后填充 0x00
+type jpegBitWriter struct {
+	buf *bytes.Buffer
+	acc uint32
+	n   uint
+}
+
+func (w *jpegBitWriter) write(v uint32, n uint) {
+	w.acc |= (v & (1<<n - 1)) << (32 - w.n - n)
+	w.n += n
+	for w.n >= 8 {
+		b := byte(w.acc >> 24)
+		w.buf.WriteByte(b)
+		if b == 0xFF {
+			w.buf.WriteByte(0)
+		}
+		w.acc <<= 8
+		w.n -= 8
+	}
+}
+
+// flush 用 1 补齐最后一个字节
+func (w *jpegBitWriter) flush() {
+	if w.n > 0 {
+		pad := 8 - w.n
+		w.write(1<<pad-1, pad)
+	}
+}
+
+func (w *jpegBitWriter) writeSymbol(h *huffmanCode, sym byte) {
+	w.write(uint32(h.code[sym]), uint(h.size[sym]))
+}
+
+// writeValue 写入 run 个零之后的一个非零值（DC 时 run 为 0）：先写类别，再写数值的低位
+func (w *jpegBitWriter) writeValue(h *huffmanCode, run int, v int32) {
+	a, b := v, v
+	if v < 0 {
+		a, b = -v, v-1
+	}
+	n := uint(bits.Len32(uint32(a)))
+	w.writeSymbol(h, byte(run<<4)|byte(n))
+	if n > 0 {
+		w.write(uint32(b), n)
+	}
+}
+
+// writeBlock 编码一个块，prevDC 为同一分量上一个块的 DC
+func (w *jpegBitWriter) writeBlock(blk *[64]int32, prevDC int32, dc, ac *huffmanCode) {
+	w.writeValue(dc, 0, blk[0]-prevDC)
+	run := 0
+	for k := 1; k < 64; k++ {
+		if blk[k] == 0 {
+			run++
+			continue
+		}
+		for ; run > 15; run -= 16 {
+			w.writeSymbol(ac, 0xF0)
+		}
+		w.writeValue(ac, run, blk[k])
+		run = 0
+	}
+	if run > 0 {
+		w.writeSymbol(ac, 0x00)
+	}
+}
+
+// writeHeader 写入 SOI 到 SOS 的各段：沿用原图的量化表和采样方式，哈夫曼表换成标准表，不设重启间隔
+func (s *jpegStream) writeHeader(buf *bytes.Buffer) {
+	segment := func(marker byte, payload []byte) {
+		buf.Write([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)})
+		buf.Write(payload)
+	}
+	buf.Write([]byte{0xFF, 0xD8})
+
+	var written [4]bool
+	for _, c := range s.comps {
+		if written[c.tq] {
+			continue
+		}
+		written[c.tq] = true
+		p := []byte{s.quantPrec[c.tq]<<4 | c.tq}
+		for _, q := range s.quant[c.tq] {
+			if s.quantPrec[c.tq] == 0 {
+				p = append(p, byte(q))
+			} else {
+				p = binary.BigEndian.AppendUint16(p, q)
+			}
+		}
+		segment(0xDB, p)
+	}
+
+	sof := []byte{8}
+	sof = binary.BigEndian.AppendUint16(sof, uint16(s.height))
+	sof = binary.BigEndian.AppendUint16(sof, uint16(s.width))
+	sof = append(sof, byte(len(s.comps)))
+	for _, c := range s.comps {
+		sof = append(sof, c.id, byte(c.h<<4|c.v), c.tq)
+	}
+	segment(s.sof, sof)
+
+	tables := 2
+	if len(s.comps) > 1 {
+		tables = 4
+	}
+	for i, spec := range standardHuffmanSpecs[:tables] {
+		p := []byte{byte(i%2)<<4 | byte(i/2)}
+		p = append(p, spec.counts[:]...)
+		segment(0xC4, append(p, spec.symbols...))
+	}
+
+	sos := []byte{byte(len(s.comps))}
+	for i, c := range s.comps {
+		table := byte(0x00)
+		if i > 0 {
+			table = 0x11
+		}
+		sos = append(sos, c.id, table)
+	}
+	segment(0xDA, append(sos, 0, 63, 0))
+}
+
+// dctCos[x][u] = C(u)/2·cos((2x+1)uπ/16)，二维变换按行、按列各做一次
+var dctCos = func() (t [8][8]float64) {
+	for x := range 8 {
+		for u := range 8 {
+			c := 0.5
+			if u == 0 {
+				c = 0.5 / math.Sqrt2
+			}
+			t[x][u] = c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return t
+}()
+
+// idctBlock 把 Z 字形顺序的量化系数反量化、反变换，得到的采样值写入 dst（行距 stride）
+func idctBlock(blk *[64]int32, q *[64]uint16, dst []byte, stride int) {
+	var coef, tmp [64]float64
+	for k := range 64 {
+		coef[unzig[k]] = float64(blk[k]) * float64(q[k])
+	}
+	for v := range 8 {
+		for x := range 8 {
+			var sum float64
+			for u := range 8 {
+				sum += dctCos[x][u] * coef[v*8+u]
+			}
+			tmp[v*8+x] = sum
+		}
+	}
+	for y := range 8 {
+		for x := range 8 {
+			var sum float64
+			for v := range 8 {
+				sum += dctCos[y][v] * tmp[v*8+x]
+			}
+			dst[y*stride+x] = clampByte(sum + 128)
+		}
+	}
+}
+
+// fdctBlock 对 src（行距 stride）中的 8x8 采样值做正变换并量化，结果按 Z 字形顺序写入 blk
+func fdctBlock(src []byte, stride int, q *[64]uint16, blk *[64]int32) {
+	var tmp, coef [64]float64
+	for y := range 8 {
+		for u := range 8 {
+			var sum float64
+			for x := range 8 {
+				sum += dctCos[x][u] * (float64(src[y*stride+x]) - 128)
+			}
+			tmp[y*8+u] = sum
+		}
+	}
+	for v := range 8 {
+		for u := range 8 {
+			var sum float64
+			for y := range 8 {
+				sum += dctCos[y][v] * tmp[y*8+u]
+			}
+			coef[v*8+u] = sum
+		}
+	}
+	for k := range 64 {
+		// 8 位采样的 AC 系数不超过 11 位，DC 差值类别不超过 11
+		blk[k] = int32(max(-1023, min(1023, math.Round(coef[unzig[k]]/float64(q[k])))))
+	}
+}
+
+func clampByte(v float64) byte {
+	return byte(max(0, min(255, math.Round(v))))
+}
@@ -0,0 +1,156 @@
+package watermark
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+var (
+	logoCacheMu sync.Mutex
+	logoCache   = map[string]image.Image{}
+)
+
+// loadLogo 读取 PNG/JPEG 标志图片，按路径缓存
+func loadLogo(path string) (image.Image, error) {
+	logoCacheMu.Lock()
+	defer logoCacheMu.Unlock()
+	if img, ok := logoCache[path]; ok {
+		return img, nil
+	}
+
+	img, err := imaging.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("加载标志图片 %s 失败: %v", path, err)
+	}
+	logoCache[path] = img
+	return img, nil
+}
+
+func logoEnabled() bool {
+	return config.Logo.Path != ""
+}
+
+// logoLayout 返回标志缩放后在整张图片中的位置，未启用或加载失败时返回 nil
+func logoLayout(bounds image.Rectangle) (image.Image, image.Rectangle) {
+	if !logoEnabled() {
+		return nil, image.Rectangle{}
+	}
+	logo, err := loadLogo(config.Logo.Path)
+	if err != nil {
+		log.Print(err)
+		return nil, image.Rectangle{}
+	}
+
+	// 标志的长边按图片长边的比例（或像素）缩放
+	width, height := bounds.Dx(), bounds.Dy()
+	target := resolveSize(config.Logo.Scale, max(width, height), config.WatermarkSettings.Unit)
+	lb := logo.Bounds()
+	ratio := target / float64(max(lb.Dx(), lb.Dy()))
+	w := max(1, int(math.Round(float64(lb.Dx())*ratio)))
+	h := max(1, int(math.Round(float64(lb.Dy())*ratio)))
+
+	ws := config.WatermarkSettings
+	widthPadding := int(resolveSize(ws.WidthPadding, width, ws.Unit))
+	heightPadding := int(resolveSize(ws.HeightPadding, height, ws.Unit))
+	fx, fy := anchorFactors(config.Logo.Position)
+	x := anchorOffset(bounds.Min.X, width, w, widthPadding, fx)
+	y := anchorOffset(bounds.Min.Y, height, h, heightPadding, fy)
+	return logo, image.Rect(x, y, x+w, y+h)
+}
+
+// drawLogo 把标志按配置的不透明度叠加到 dst 上
+func drawLogo(dst draw.Image, bounds image.Rectangle) {
+	logo, rect := logoLayout(bounds)
+	if logo == nil {
+		return
+	}
+	area := rect.Intersect(dst.Bounds())
+	if area.Empty() {
+		return
+	}
+
+	scaled := imaging.Resize(logo, rect.Dx(), rect.Dy(), imaging.Lanczos)
+	opacity := math.Max(0, math.Min(1, config.Logo.Opacity))
+	mask := image.NewUniform(RGBAColor{A: 255}.withOpacity(opacity))
+	srcPt := area.Min.Sub(rect.Min)
+	draw.DrawMask(dst, area, scaled, srcPt, mask, image.Point{}, draw.Over)
+}
+
+// brandAliases 把 EXIF Make 中常见的厂商名归一成标志文件名
+var brandAliases = map[string][]string{
+	"nikon":      {"nikon"},
+	"olympus":    {"olympus"},
+	"om":         {"om", "olympus"},
+	"xiaomi":     {"xiaomi", "小米"},
+	"redmi":      {"redmi", "xiaomi", "小米"},
+	"huawei":     {"huawei", "华为"},
+	"honor":      {"honor", "荣耀"},
+	"oppo":       {"oppo"},
+	"vivo":       {"vivo"},
+	"apple":      {"apple"},
+	"sony":       {"sony"},
+	"canon":      {"canon"},
+	"fujifilm":   {"fujifilm", "fuji"},
+	"panasonic":  {"panasonic", "lumix"},
+	"leica":      {"leica"},
+	"hasselblad": {"hasselblad"},
+	"dji":        {"dji", "大疆"},
+}
+
+// brandLogo 按 EXIF Make 在 brandLogo.folder 中查找厂商标志（如 canon.png、nikon.png、小米.png），
+// 找不到时返回 nil
+func brandLogo(make string) image.Image {
+	if !config.BrandLogo.Enabled || make == "" {
+		return nil
+	}
+
+	// "NIKON CORPORATION"、"OM Digital Solutions" 等只取第一个词
+	key := strings.ToLower(strings.TrimSpace(make))
+	if fields := strings.FieldsFunc(key, func(r rune) bool { return r == ' ' || r == ',' || r == '.' }); len(fields) > 0 {
+		key = fields[0]
+	}
+	names := brandAliases[key]
+	if len(names) == 0 {
+		names = []string{key}
+	}
+	names = append(names, strings.TrimSpace(make))
+
+	for _, name := range names {
+		for _, ext := range []string{".png", ".jpg", ".jpeg"} {
+			path := filepath.Join(config.BrandLogo.Folder, name+ext)
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			logo, err := loadLogo(path)
+			if err != nil {
+				log.Print(err)
+				return nil
+			}
+			return logo
+		}
+	}
+	log.Printf("没有找到厂商 %s 的标志图片", make)
+	return nil
+}
+
+// drawBrandLogo 把品牌标志缩放到 rect 大小绘制
+func drawBrandLogo(dst draw.Image, logo image.Image, rect image.Rectangle) {
+	if logo == nil || rect.Empty() {
+		return
+	}
+	area := rect.Intersect(dst.Bounds())
+	if area.Empty() {
+		return
+	}
+	scaled := imaging.Resize(logo, rect.Dx(), rect.Dy(), imaging.Lanczos)
+	draw.Draw(dst, area, scaled, area.Min.Sub(rect.Min), draw.Over)
+}
@@ -0,0 +1,343 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// 除了 JPEG 的 APP1 段，PNG 的 eXIf 块、WebP 的 EXIF 块和 HEIF 的 Exif 项中也是同样的 TIFF 格式 EXIF。
+// readExifTIFF 按文件头识别容器取出 TIFF 数据，拍摄时间、GPS 等信息的读取和写回输出文件对各格式一致
+
+// exifContainer 是一种能携带 EXIF 的图片格式
+type exifContainer struct {
+	name  string
+	match func(data []byte) bool
+	read  func(data []byte) ([]byte, error) // 返回不带 "Exif\0\0" 头的 TIFF 数据，没有 EXIF 时返回 nil
+}
+
+var exifContainers = []exifContainer{
+	{"JPEG", func(d []byte) bool { return bytes.HasPrefix(d, []byte{0xFF, 0xD8}) }, readJPEGExif},
+	{"PNG", func(d []byte) bool { return bytes.HasPrefix(d, pngSignature) }, readPNGExif},
+	{"WebP", func(d []byte) bool { return len(d) >= 12 && string(d[:4]) == "RIFF" && string(d[8:12]) == "WEBP" }, readWebPExif},
+	{"HEIF", func(d []byte) bool { return len(d) >= 12 && string(d[4:8]) == "ftyp" }, readHEIFExif},
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// readExifTIFF 读取图片中的 EXIF，返回 TIFF 数据的副本；不认识的格式返回错误，没有 EXIF 时返回 nil
+func readExifTIFF(data []byte) ([]byte, error) {
+	for _, c := range exifContainers {
+		if !c.match(data) {
+			continue
+		}
+		tiff, err := c.read(data)
+		if err != nil {
+			return nil, fmt.Errorf("读取%s中的EXIF失败: %v", c.name, err)
+		}
+		if tiff == nil {
+			return nil, nil
+		}
+		// 部分软件在 PNG、WebP 中也写入了 "Exif\0\0" 头
+		return slices.Clone(bytes.TrimPrefix(tiff, exifHeader)), nil
+	}
+	return nil, fmt.Errorf("不支持的图片格式")
+}
+
+// readExifAPP1 以 JPEG APP1 段的形式（"Exif\0\0" 加 TIFF 数据）返回图片中的 EXIF，没有时返回 nil
+func readExifAPP1(data []byte) ([]byte, error) {
+	tiff, err := readExifTIFF(data)
+	if err != nil || tiff == nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), exifHeader...), tiff...), nil
+}
+
+// decodeExif 解析图片中的 EXIF。只有子目录损坏时使用已读到的字段，更严重的损坏先尝试修复
+func decodeExif(filename string, data []byte) (*exif.Exif, error) {
+	tiff, err := readExifTIFF(data)
+	if err != nil {
+		return nil, err
+	}
+	if tiff == nil {
+		return nil, fmt.Errorf("没有EXIF信息")
+	}
+	x, err := exif.Decode(bytes.NewReader(tiff))
+	switch {
+	case err == nil:
+		return x, nil
+	case x != nil && !exif.IsCriticalError(err):
+		log.Printf("【EXIF损坏】%s: %v，使用其余字段", filename, err)
+		return x, nil
+	default:
+		return decodeDamagedExif(filename, tiff, err)
+	}
+}
+
+func readJPEGExif(data []byte) ([]byte, error) {
+	app1, err := readExifSegment(data)
+	if err != nil || app1 == nil {
+		return nil, err
+	}
+	return app1[len(exifHeader):], nil
+}
+
+// readPNGExif 查找 eXIf 块
+func readPNGExif(data []byte) ([]byte, error) {
+	return findPNGChunk(data, "eXIf")
+}
+
+// findPNGChunk 返回第一个类型为 typ 的块的数据。PNG 规范允许 eXIf、iTXt 出现在 IDAT 之后，因此一直查找到 IEND
+func findPNGChunk(data []byte, typ string) ([]byte, error) {
+	pos := len(pngSignature)
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunk := string(data[pos+4 : pos+8])
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, fmt.Errorf("PNG块长度错误: 偏移 %d", pos)
+		}
+		switch chunk {
+		case typ:
+			return data[pos+8 : pos+8+length], nil
+		case "IEND":
+			return nil, nil
+		}
+		pos = end
+	}
+	return nil, nil
+}
+
+// readWebPExif 查找扩展格式 WebP 中的 EXIF 块
+func readWebPExif(data []byte) ([]byte, error) {
+	return findWebPChunk(data, "EXIF")
+}
+
+// findWebPChunk 返回第一个类型为 fourCC 的块的数据，块的长度为奇数时后面有一个填充字节
+func findWebPChunk(data []byte, fourCC string) ([]byte, error) {
+	pos := 12
+	for pos+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size
+		if size < 0 || end > len(data) {
+			return nil, fmt.Errorf("WebP块长度错误: 偏移 %d", pos)
+		}
+		if string(data[pos:pos+4]) == fourCC {
+			return data[pos+8 : end], nil
+		}
+		pos = end + size%2
+	}
+	return nil, nil
+}
+
+// isobmffBox 是 HEIF（ISO BMFF）中的一个 box
+type isobmffBox struct {
+	typ  string
+	body []byte // 不含 box 头
+}
+
+// readBoxes 拆分一段数据中连续的 box
+func readBoxes(data []byte) ([]isobmffBox, error) {
+	var boxes []isobmffBox
+	for pos := 0; pos+8 <= len(data); {
+		size := uint64(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		header := uint64(8)
+		switch size {
+		case 0: // 一直到数据末尾
+			size = uint64(len(data) - pos)
+		case 1: // 64 位长度
+			if pos+16 > len(data) {
+				return nil, fmt.Errorf("box %s 长度错误", typ)
+			}
+			size, header = binary.BigEndian.Uint64(data[pos+8:]), 16
+		}
+		if size < header || size > uint64(len(data)-pos) {
+			return nil, fmt.Errorf("box %s 长度错误", typ)
+		}
+		boxes = append(boxes, isobmffBox{typ: typ, body: data[pos+int(header) : pos+int(size)]})
+		pos += int(size)
+	}
+	return boxes, nil
+}
+
+// findBox 返回第一个类型为 typ 的 box
+func findBox(boxes []isobmffBox, typ string) (isobmffBox, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+	return isobmffBox{}, false
+}
+
+// readHEIFExif 读取 HEIF/HEIC 中的 Exif 项：在 meta/iinf 中找到类型为 Exif 的项，
+// 再按 meta/iloc 中记录的位置取出数据。数据开头 4 字节为 TIFF 头相对其后的偏移
+func readHEIFExif(data []byte) ([]byte, error) {
+	top, err := readBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := findBox(top, "meta")
+	if !ok || len(meta.body) < 4 {
+		return nil, nil
+	}
+	// meta 是 FullBox，前 4 字节为版本和标志
+	children, err := readBoxes(meta.body[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	iinf, ok := findBox(children, "iinf")
+	if !ok {
+		return nil, nil
+	}
+	id, ok, err := heifExifItemID(iinf.body)
+	if err != nil || !ok {
+		return nil, err
+	}
+	iloc, ok := findBox(children, "iloc")
+	if !ok {
+		return nil, fmt.Errorf("缺少 iloc")
+	}
+	var idat []byte
+	if b, ok := findBox(children, "idat"); ok {
+		idat = b.body
+	}
+	item, err := heifItemData(iloc.body, id, data, idat)
+	if err != nil {
+		return nil, err
+	}
+	if len(item) < 4 {
+		return nil, fmt.Errorf("Exif 项长度不足")
+	}
+	start := 4 + int(binary.BigEndian.Uint32(item))
+	if start < 4 || start > len(item) {
+		return nil, fmt.Errorf("TIFF头偏移越界")
+	}
+	return item[start:], nil
+}
+
+// heifExifItemID 在 iinf 中查找类型为 Exif 的项的编号
+func heifExifItemID(body []byte) (uint32, bool, error) {
+	if len(body) < 4 {
+		return 0, false, fmt.Errorf("iinf 长度不足")
+	}
+	skip := 6 // 版本、标志和 16 位的项数
+	if body[0] != 0 {
+		skip = 8
+	}
+	if len(body) < skip {
+		return 0, false, fmt.Errorf("iinf 长度不足")
+	}
+	entries, err := readBoxes(body[skip:])
+	if err != nil {
+		return 0, false, err
+	}
+	for _, e := range entries {
+		b := e.body
+		// 只有版本 2、3 的 infe 记录项的类型
+		if e.typ != "infe" || len(b) < 4 || b[0] < 2 {
+			continue
+		}
+		var id uint32
+		if b[0] == 2 {
+			if len(b) < 12 {
+				continue
+			}
+			id, b = uint32(binary.BigEndian.Uint16(b[4:])), b[6:]
+		} else {
+			if len(b) < 14 {
+				continue
+			}
+			id, b = binary.BigEndian.Uint32(b[4:]), b[8:]
+		}
+		// 跳过 16 位的 item_protection_index，之后是项的类型
+		if string(b[2:6]) == "Exif" {
+			return id, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// heifItemData 按 iloc 取出某一项的数据，构造方式 0 为文件中的偏移，1 为 idat 中的偏移
+func heifItemData(body []byte, id uint32, file, idat []byte) ([]byte, error) {
+	r := &byteCursor{data: body}
+	version := r.uint(1)
+	r.uint(3)
+	sizes := r.uint(1)
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&0x0F)
+	sizes = r.uint(1)
+	baseOffsetSize, indexSize := int(sizes>>4), 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0x0F)
+	}
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	count := r.uint(idSize)
+
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		itemID := r.uint(idSize)
+		method := uint64(0)
+		if version == 1 || version == 2 {
+			method = r.uint(2) & 0x0F
+		}
+		r.uint(2) // data_reference_index
+		base := r.uint(baseOffsetSize)
+		extents := r.uint(2)
+		var item []byte
+		for j := uint64(0); j < extents && r.err == nil; j++ {
+			r.uint(indexSize)
+			offset, length := base+r.uint(offsetSize), r.uint(lengthSize)
+			if uint32(itemID) != id {
+				continue
+			}
+			src := file
+			if method == 1 {
+				src = idat
+			} else if method != 0 {
+				return nil, fmt.Errorf("不支持的构造方式 %d", method)
+			}
+			if length == 0 {
+				length = uint64(len(src)) - min(offset, uint64(len(src)))
+			}
+			if offset+length > uint64(len(src)) {
+				return nil, fmt.Errorf("Exif 项的位置越界")
+			}
+			item = append(item, src[offset:offset+length]...)
+		}
+		if uint32(itemID) == id && r.err == nil {
+			return item, nil
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("iloc 长度不足")
+	}
+	return nil, fmt.Errorf("iloc 中没有 Exif 项")
+}
+
+// byteCursor 按大端顺序依次读取长度不定的整数，数据不足时记下错误并返回 0
+type byteCursor struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (c *byteCursor) uint(size int) uint64 {
+	if c.err != nil || c.pos+size > len(c.data) {
+		c.err = fmt.Errorf("数据不足")
+		return 0
+	}
+	var v uint64
+	for _, b := range c.data[c.pos : c.pos+size] {
+		v = v<<8 | uint64(b)
+	}
+	c.pos += size
+	return v
+}
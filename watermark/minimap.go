@@ -0,0 +1,191 @@
+package watermark
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// 小地图先按固定尺寸获取，绘制时再缩放到 miniMap.size
+const miniMapPixels = 512
+
+var (
+	mapClient = &http.Client{Timeout: 20 * time.Second}
+
+	mapCacheMu sync.Mutex
+	mapCache   = map[string]image.Image{} // 同一地点连拍的照片只获取一次，获取失败也记录为 nil
+)
+
+// fetchMiniMap 获取以拍摄地点为中心的小地图，未启用、照片没有 GPS 或获取失败时返回 nil
+func fetchMiniMap(info *PhotoInfo) image.Image {
+	mm := config.MiniMap
+	if !mm.Enabled || !info.HasGPS {
+		return nil
+	}
+
+	// 坐标保留 5 位小数（约 1 米），足够区分地点
+	key := fmt.Sprintf("%s/%d/%.5f,%.5f", mm.Provider, mm.Zoom, info.Latitude, info.Longitude)
+	mapCacheMu.Lock()
+	img, ok := mapCache[key]
+	mapCacheMu.Unlock()
+	if ok {
+		return img
+	}
+
+	var err error
+	switch strings.ToLower(mm.Provider) {
+	case "amap":
+		img, err = fetchAmapStaticMap(info.Latitude, info.Longitude, mm.Zoom)
+	case "", "osm":
+		img, err = fetchTileMap(info.Latitude, info.Longitude, mm.Zoom)
+	default:
+		err = fmt.Errorf("不支持的地图服务: %s", mm.Provider)
+	}
+	if err != nil {
+		log.Printf("%s 获取小地图失败: %v", info.Filename, err)
+	}
+	mapCacheMu.Lock()
+	mapCache[key] = img
+	mapCacheMu.Unlock()
+	return img
+}
+
+// fetchAmapStaticMap 通过高德静态地图 API 获取地图，需要 amapAPIKey。高德地图使用 GCJ-02 坐标
+func fetchAmapStaticMap(lat, long float64, zoom int) (image.Image, error) {
+	if config.AmapAPIKey == "" {
+		return nil, fmt.Errorf("API Key 为空")
+	}
+	lat, long = toGCJ02(lat, long)
+	url := fmt.Sprintf("https://restapi.amap.com/v3/staticmap?location=%.6f,%.6f&zoom=%d&size=%d*%d&key=%s",
+		long, lat, zoom, miniMapPixels, miniMapPixels, config.AmapAPIKey)
+	return fetchMapImage(url)
+}
+
+// fetchTileMap 从 miniMap.tileURL 下载拍摄地点周围的瓦片（Web 墨卡托，256 像素），拼接后裁出以该点为中心的地图
+func fetchTileMap(lat, long float64, zoom int) (image.Image, error) {
+	n := 1 << zoom
+	worldSize := float64(256 * n)
+	latRad := lat * math.Pi / 180
+	px := (long + 180) / 360 * worldSize
+	py := (1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * worldSize
+
+	left, top := int(math.Floor(px))-miniMapPixels/2, int(math.Floor(py))-miniMapPixels/2
+	canvas := image.NewRGBA(image.Rect(0, 0, miniMapPixels, miniMapPixels))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.RGBA{230, 230, 230, 255}), image.Point{}, draw.Src)
+
+	for ty := floorDiv(top, 256); ty <= floorDiv(top+miniMapPixels-1, 256); ty++ {
+		if ty < 0 || ty >= n {
+			continue
+		}
+		for tx := floorDiv(left, 256); tx <= floorDiv(left+miniMapPixels-1, 256); tx++ {
+			// 经度方向首尾相接
+			x := ((tx % n) + n) % n
+			url := strings.NewReplacer("{z}", strconv.Itoa(zoom), "{x}", strconv.Itoa(x), "{y}", strconv.Itoa(ty)).Replace(config.MiniMap.TileURL)
+			tile, err := fetchMapImage(url)
+			if err != nil {
+				return nil, err
+			}
+			at := image.Pt(tx*256-left, ty*256-top)
+			draw.Draw(canvas, image.Rect(at.X, at.Y, at.X+256, at.Y+256), tile, tile.Bounds().Min, draw.Src)
+		}
+	}
+	return canvas, nil
+}
+
+func floorDiv(a, b int) int {
+	return int(math.Floor(float64(a) / float64(b)))
+}
+
+// fetchMapImage 下载并解码一张地图图片。OpenStreetMap 的瓦片服务要求请求带有能识别程序的 User-Agent
+func fetchMapImage(url string) (image.Image, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := mapClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("请求地图失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取地图失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("地图服务返回状态码 %d: %.200s", resp.StatusCode, body)
+	}
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		// 高德在 key 无效等情况下返回 JSON 错误信息而不是图片
+		return nil, fmt.Errorf("解析地图图片失败: %v，响应内容: %.200s", err, body)
+	}
+	return img, nil
+}
+
+// miniMapRect 返回小地图在整张图片中的位置，不绘制小地图时为空矩形
+func miniMapRect(bounds image.Rectangle, wm *watermark) image.Rectangle {
+	if wm.miniMap == nil {
+		return image.Rectangle{}
+	}
+	width, height := bounds.Dx(), bounds.Dy()
+	ws := config.WatermarkSettings
+	side := max(1, int(math.Round(resolveSize(config.MiniMap.Size, min(width, height), ws.Unit))))
+
+	widthPadding := int(resolveSize(ws.WidthPadding, width, ws.Unit))
+	heightPadding := int(resolveSize(ws.HeightPadding, height, ws.Unit))
+	fx, fy := anchorFactors(config.MiniMap.Position)
+	x := anchorOffset(bounds.Min.X, width, side, widthPadding, fx)
+	y := anchorOffset(bounds.Min.Y, height, side, heightPadding, fy)
+	return image.Rect(x, y, x+side, y+side)
+}
+
+// drawMiniMap 把小地图缩放后画成圆角方块，加上白色描边，并在中心画一个定位标记
+func drawMiniMap(dst draw.Image, bounds image.Rectangle, wm *watermark) {
+	rect := miniMapRect(bounds, wm)
+	area := rect.Intersect(dst.Bounds())
+	if area.Empty() {
+		return
+	}
+
+	side := float64(rect.Dx())
+	border := max(1, int(side/60))
+	radius := side / 12
+	outer := &roundedRectMask{rect: rect, radius: radius}
+	draw.DrawMask(dst, area, image.White, image.Point{}, outer, area.Min, draw.Over)
+
+	inner := rect.Inset(border)
+	scaled := imaging.Fill(wm.miniMap, inner.Dx(), inner.Dy(), imaging.Center, imaging.Lanczos)
+	innerArea := inner.Intersect(dst.Bounds())
+	mask := &roundedRectMask{rect: inner, radius: math.Max(0, radius-float64(border))}
+	draw.DrawMask(dst, innerArea, scaled, innerArea.Min.Sub(inner.Min), mask, innerArea.Min, draw.Over)
+
+	// 定位标记：白边红色圆点
+	center := inner.Min.Add(inner.Max).Div(2)
+	r := math.Max(3, side/24)
+	drawDot(dst, center, r, color.RGBA{255, 255, 255, 255})
+	drawDot(dst, center, r*0.7, color.RGBA{230, 40, 40, 255})
+}
+
+// drawDot 以 center 为圆心画一个抗锯齿的实心圆
+func drawDot(dst draw.Image, center image.Point, r float64, c color.Color) {
+	d := max(1, int(math.Round(2*r)))
+	origin := center.Sub(image.Pt(d/2, d/2))
+	mask := &roundedRectMask{rect: image.Rectangle{Min: origin, Max: origin.Add(image.Pt(d, d))}, radius: float64(d) / 2}
+	area := mask.rect.Intersect(dst.Bounds())
+	draw.DrawMask(dst, area, image.NewUniform(c), image.Point{}, mask, area.Min, draw.Over)
+}
@@ -0,0 +1,274 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// outputFormat 返回规范化后的输出格式
+func outputFormat() string {
+	switch f := strings.ToLower(config.OutputFormat); f {
+	case "", "jpg", "jpeg":
+		return "jpeg"
+	default:
+		return f
+	}
+}
+
+// outputExt 返回输出格式对应的扩展名
+func outputExt() string {
+	switch outputFormat() {
+	case "png":
+		return ".png"
+	case "webp":
+		return ".webp"
+	default:
+		return ".jpg"
+	}
+}
+
+// validateOutputFormat 检查输出格式是否受支持
+func validateOutputFormat() error {
+	switch outputFormat() {
+	case "jpeg", "png":
+		return nil
+	case "webp":
+		if config.WebPQuality < 0 || config.WebPQuality > 100 {
+			return fmt.Errorf("webpQuality 应为 0～100，当前为 %d", config.WebPQuality)
+		}
+		return nil
+	case "avif":
+		return fmt.Errorf("当前版本不支持 AVIF 编码（没有可用的纯 Go 编码器），请改用 jpeg、png 或 webp")
+	default:
+		return fmt.Errorf("未知的输出格式: %s", config.OutputFormat)
+	}
+}
+
+func pngCompressionLevel() png.CompressionLevel {
+	switch strings.ToLower(config.PNGCompression) {
+	case "none":
+		return png.NoCompression
+	case "fast":
+		return png.BestSpeed
+	case "best":
+		return png.BestCompression
+	default:
+		return png.DefaultCompression
+	}
+}
+
+// saveOutput 把处理后的图片按配置的格式编码后写入 outputPath，
+// 根据配置把原图的 EXIF 写回输出文件，并重新生成 EXIF 缩略图
+func saveOutput(img image.Image, source []byte, outputPath string) error {
+	app1, err := outputExif(img, source, outputPath)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	var data []byte
+	switch outputFormat() {
+	case "png":
+		if err := imaging.Encode(&buf, img, imaging.PNG, imaging.PNGCompressionLevel(pngCompressionLevel())); err != nil {
+			return fmt.Errorf("编码PNG失败: %v", err)
+		}
+		data = buf.Bytes()
+		if app1 != nil {
+			data = insertPNGExif(data, app1[len(exifHeader):])
+		}
+	case "webp":
+		// webpQuality 为 0 时无损编码，否则有损编码；EXIF、XMP 需要扩展格式
+		extended := app1 != nil || config.EmbedXMP
+		if config.WebPQuality > 0 {
+			if data, err = encodeWebPLossy(img, config.WebPQuality, extended); err != nil {
+				return fmt.Errorf("编码WebP失败: %v", err)
+			}
+		} else {
+			if err := nativewebp.Encode(&buf, img, &nativewebp.Options{UseExtendedFormat: extended}); err != nil {
+				return fmt.Errorf("编码WebP失败: %v", err)
+			}
+			data = buf.Bytes()
+		}
+		if app1 != nil {
+			var err error
+			if data, err = appendWebPExif(data, app1[len(exifHeader):]); err != nil {
+				log.Printf("%s: 写入WebP EXIF失败: %v", outputPath, err)
+			}
+		}
+	default:
+		if err := imaging.Encode(&buf, img, imaging.JPEG, imaging.JPEGQuality(config.JpegQuality)); err != nil {
+			return fmt.Errorf("编码图片失败: %v", err)
+		}
+		data = buf.Bytes()
+		if app1 != nil {
+			data = insertExifSegment(data, app1)
+		}
+	}
+
+	return writeOutputFile(outputPath, data)
+}
+
+// outputExif 返回要写入输出文件的 APP1 段：原图的 EXIF 按配置改写，输出 JPEG 时按 img 生成缩略图。
+// 不写入 EXIF 时返回 nil
+func outputExif(img image.Image, source []byte, outputPath string) ([]byte, error) {
+	app1, err := sourceExif(source)
+	if err != nil {
+		// 要求移除 GPS 时不能输出未处理的 EXIF，只保留 EXIF 时去掉 EXIF 继续输出
+		if config.StripGPS {
+			return nil, err
+		}
+		log.Printf("%s: %v，输出图片不带EXIF", outputPath, err)
+		app1 = nil
+	}
+
+	if config.ExifEdit.ApplyToOutput {
+		if edited, err := applyExifEdits(app1); err != nil {
+			log.Printf("%s: 写入作者、版权信息失败: %v", outputPath, err)
+		} else if edited != nil {
+			app1 = edited
+		}
+	}
+
+	if config.ExifThumbnail && outputFormat() == "jpeg" {
+		if app1 == nil {
+			app1 = minimalExif()
+		}
+		if withThumb, err := embedThumbnail(app1, img); err != nil {
+			log.Printf("%s: 生成EXIF缩略图失败: %v", outputPath, err)
+		} else {
+			app1 = withThumb
+		}
+	}
+	return app1, nil
+}
+
+// sourceExif 返回要写入输出文件的原图 EXIF，整段复制原图的 APP1，
+// 厂商私有的 MakerNote 等偏移不变的数据都能保留；像素已经按方向旋转过，Orientation 改为 1。
+// 不保留 EXIF 或原图没有 EXIF 时返回 nil
+func sourceExif(source []byte) ([]byte, error) {
+	if !config.KeepExif && !config.StripGPS {
+		return nil, nil
+	}
+	app1, err := readExifAPP1(source)
+	if err != nil {
+		return nil, fmt.Errorf("读取原图EXIF失败: %v", err)
+	}
+	if app1 == nil {
+		return nil, nil
+	}
+	// 损坏的 EXIF 先去掉损坏的字段，输出图片的 EXIF 能被正常读取
+	if _, err := exif.Decode(bytes.NewReader(app1[len(exifHeader):])); err != nil && exif.IsCriticalError(err) {
+		repaired, err := repairExif(app1[len(exifHeader):])
+		if err != nil {
+			return nil, fmt.Errorf("原图EXIF已损坏: %v", err)
+		}
+		if app1, err = finishAPP1(repaired); err != nil {
+			return nil, err
+		}
+	}
+	if err := rewriteExif(app1, config.StripGPS); err != nil {
+		return nil, fmt.Errorf("改写EXIF失败: %v", err)
+	}
+	return app1, nil
+}
+
+// webCopyFolder 返回网页版的输出目录
+func webCopyFolder() string {
+	return filepath.Join(config.OutputFolder, config.WebCopy.Folder)
+}
+
+// saveWebCopy 按配置额外保存一份缩小的网页版 JPEG，文件名与完整版相同
+func saveWebCopy(img image.Image, outputPath string) error {
+	if !config.WebCopy.Enabled {
+		return nil
+	}
+
+	if w := config.WebCopy.MaxWidth; w > 0 && img.Bounds().Dx() > w {
+		img = imaging.Resize(img, w, 0, imaging.Lanczos)
+	}
+
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, img, imaging.JPEG, imaging.JPEGQuality(config.WebCopy.Quality)); err != nil {
+		return fmt.Errorf("编码网页版图片失败: %v", err)
+	}
+	name := strings.TrimSuffix(filepath.Base(outputPath), filepath.Ext(outputPath)) + ".jpg"
+	return writeOutputFile(filepath.Join(webCopyFolder(), name), buf.Bytes())
+}
+
+// insertPNGExif 在 IHDR 之后插入 eXIf 块，tiff 为不带 "Exif\0\0" 头的 TIFF 数据
+func insertPNGExif(pngData, tiff []byte) []byte {
+	return insertPNGChunk(pngData, "eXIf", tiff)
+}
+
+// insertPNGChunk 在 IHDR 之后插入一个块
+func insertPNGChunk(pngData []byte, typ string, data []byte) []byte {
+	// 8 字节签名 + IHDR 块（4 长度 + 4 类型 + 13 数据 + 4 CRC）
+	const ihdrEnd = 8 + 25
+	if len(pngData) < ihdrEnd {
+		return pngData
+	}
+
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	out := make([]byte, 0, len(pngData)+len(chunk))
+	out = append(out, pngData[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, pngData[ihdrEnd:]...)
+}
+
+// appendWebPExif 在扩展格式（VP8X）的 WebP 末尾追加 EXIF 块并设置对应标志位
+func appendWebPExif(webpData, tiff []byte) ([]byte, error) {
+	// VP8X 标志位中 0x08 表示包含 EXIF
+	return appendWebPChunk(webpData, "EXIF", 0x08, tiff)
+}
+
+// appendWebPChunk 在扩展格式（VP8X）的 WebP 末尾追加一个块，并在 VP8X 中设置 flag 标志位
+func appendWebPChunk(webpData []byte, fourCC string, flag byte, data []byte) ([]byte, error) {
+	if len(webpData) < 30 || string(webpData[:4]) != "RIFF" || string(webpData[12:16]) != "VP8X" {
+		return webpData, fmt.Errorf("不是扩展格式的WebP")
+	}
+
+	out := append([]byte(nil), webpData...)
+	out = append(out, fourCC...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(data)))
+	out = append(out, data...)
+	if len(data)%2 == 1 {
+		out = append(out, 0)
+	}
+
+	out[20] |= flag
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// embedThumbnail 用处理后的图片生成缩略图并写入 EXIF 的 IFD1，
+// 这样资源管理器和手机相册显示的是带水印的缩略图
+func embedThumbnail(app1 []byte, img image.Image) ([]byte, error) {
+	thumb := imaging.Fit(img, 160, 160, imaging.Linear)
+	for quality := 80; quality >= 30; quality -= 25 {
+		var buf bytes.Buffer
+		if err := imaging.Encode(&buf, thumb, imaging.JPEG, imaging.JPEGQuality(quality)); err != nil {
+			return nil, err
+		}
+		// 缩略图必须放进 64KB 的 APP1 段内，放不下时降低品质重试
+		if result, err := setExifThumbnail(app1, buf.Bytes()); err == nil {
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("EXIF数据过大，无法放入缩略图")
+}
@@ -0,0 +1,114 @@
+package watermark
+
+import (
+	"image"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// autoPositionCandidates 是 position 为 auto 时依次比较的四个角
+var autoPositionCandidates = []string{"bottom-right", "bottom-left", "top-right", "top-left"}
+
+// faceFallbackPositions 是水印压到人脸时依次尝试的其他位置
+var faceFallbackPositions = []string{"bottom-right", "bottom-left", "top-right", "top-left", "bottom", "top", "right", "left"}
+
+// watermarkPosition 返回这张图片使用的水印位置。position 为 auto 时比较四个角的细节程度，
+// 选择最“安静”的一个，避免水印压在主体上；细节相同时按候选顺序优先右下角。
+// 开启 avoidFaces 时，如果水印会压到检测出的人脸，依次换到其他位置
+func watermarkPosition(img image.Image, wm *watermark) string {
+	candidates := positionCandidates(img, wm)
+	if !wm.ws.AvoidFaces {
+		return candidates[0]
+	}
+
+	faces := detectFaces(img)
+	if len(faces) == 0 {
+		return candidates[0]
+	}
+	for _, candidate := range appendMissing(candidates, faceFallbackPositions) {
+		region := watermarkBlock(img.Bounds(), wm.withPosition(candidate))
+		if !overlapsAny(region, faces) {
+			if candidate != candidates[0] {
+				log.Printf("水印会遮挡人脸，位置由 %s 改为 %s", candidates[0], candidate)
+			}
+			return candidate
+		}
+	}
+	log.Printf("检测到 %d 张人脸，所有位置都会遮挡，保持 %s", len(faces), candidates[0])
+	return candidates[0]
+}
+
+// positionCandidates 按优先顺序返回候选位置，第一个为首选
+func positionCandidates(img image.Image, wm *watermark) []string {
+	position := wm.ws.Position
+	if !strings.EqualFold(strings.TrimSpace(position), "auto") {
+		return []string{position}
+	}
+
+	scores := make(map[string]float64, len(autoPositionCandidates))
+	for _, candidate := range autoPositionCandidates {
+		scores[candidate] = regionDetail(img, watermarkBlock(img.Bounds(), wm.withPosition(candidate)))
+	}
+	candidates := append([]string(nil), autoPositionCandidates...)
+	sort.SliceStable(candidates, func(i, j int) bool { return scores[candidates[i]] < scores[candidates[j]] })
+	log.Printf("自动选择水印位置: %s", candidates[0])
+	return candidates
+}
+
+// watermarkBlock 返回文字块（包括品牌标志，有底板时包括底板）所占的矩形
+func watermarkBlock(bounds image.Rectangle, wm *watermark) image.Rectangle {
+	l := layoutWatermark(bounds, wm)
+	pad := backgroundPadding(l.ws, l.fontSize)
+	return l.block().Inset(-pad)
+}
+
+func overlapsAny(r image.Rectangle, rects []image.Rectangle) bool {
+	for _, other := range rects {
+		if r.Overlaps(other) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendMissing 把 extra 中不在 list 里的元素追加到 list 后面
+func appendMissing(list, extra []string) []string {
+	out := append([]string(nil), list...)
+	for _, e := range extra {
+		if !slices.Contains(out, e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// regionDetail 计算区域内相邻采样点亮度差的平均值，数值越大说明细节、纹理越多
+func regionDetail(img image.Image, region image.Rectangle) float64 {
+	region = region.Intersect(img.Bounds())
+	if region.Dx() < 2 || region.Dy() < 2 {
+		return math.Inf(1)
+	}
+
+	step := max(1, int(math.Sqrt(float64(region.Dx()*region.Dy())/10000)))
+	luma := func(x, y int) float64 {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return 0.299*float64(r>>8) + 0.587*float64(g>>8) + 0.114*float64(b>>8)
+	}
+
+	var sum float64
+	n := 0
+	for y := region.Min.Y; y+step < region.Max.Y; y += step {
+		for x := region.Min.X; x+step < region.Max.X; x += step {
+			v := luma(x, y)
+			sum += math.Abs(v-luma(x+step, y)) + math.Abs(v-luma(x, y+step))
+			n++
+		}
+	}
+	if n == 0 {
+		return math.Inf(1)
+	}
+	return sum / float64(n)
+}
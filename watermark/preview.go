@@ -0,0 +1,159 @@
+package watermark
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// 预览图先缩小到这个尺寸再绘制水印，按比例设置的字号、边距与正式处理的效果一致
+const previewRenderSize = 1200
+
+// 联系表中每张缩略图的长边
+const previewThumbSize = 400
+
+// 预览的字号倍数和不透明度，分别作为联系表的行，位置作为列
+var (
+	previewFontScales = []float64{0.5, 1, 2}
+	previewOpacities  = []float64{1, 0.6, 0.3}
+)
+
+// RunPreview 实现 preview 子命令：用一张样张按不同字号、不同透明度、不同位置渲染水印，拼成联系表 preview.jpg，在 Prepare 之后调用
+func RunPreview(files []string) int {
+	if len(files) != 1 {
+		fmt.Println("用法: jpg-watermark-cli preview 样张.jpg")
+		return 2
+	}
+	resolveFontPath()
+
+	sheet, err := renderPreviewSheet(files[0])
+	if err != nil {
+		fmt.Printf("生成预览失败: %v\n", err)
+		return 1
+	}
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, sheet, imaging.JPEG, imaging.JPEGQuality(90)); err != nil {
+		fmt.Printf("编码预览图失败: %v\n", err)
+		return 1
+	}
+	if err := os.WriteFile("preview.jpg", buf.Bytes(), 0644); err != nil {
+		fmt.Printf("保存预览图失败: %v\n", err)
+		return 1
+	}
+	fmt.Println("预览已保存到 preview.jpg")
+	return 0
+}
+
+// renderPreviewSheet 渲染联系表：每行一组字号和不透明度，每列一个位置，缩略图下方标注对应的设置
+func renderPreviewSheet(filename string) (image.Image, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	img, err := imaging.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("打开图片失败: %v", err)
+	}
+
+	// 没有 EXIF 的样张也能预览，拍摄时间用文件的修改时间代替
+	var info *PhotoInfo
+	if x, err := decodeExif(filename, data); err == nil {
+		if t, err := exifTime(x); err == nil && !t.IsZero() {
+			info = readPhotoInfo(filepath.Base(filename), x, t)
+		}
+	}
+	if info == nil {
+		log.Printf("%s 没有 EXIF 拍摄时间，预览使用文件修改时间", filename)
+		modTime := time.Now()
+		if st, err := os.Stat(filename); err == nil {
+			modTime = st.ModTime()
+		}
+		info = &PhotoInfo{Filename: filepath.Base(filename), Time: modTime}
+	}
+	text, err := renderWatermarkText(info)
+	if err != nil {
+		return nil, err
+	}
+
+	img = imaging.Fit(rotateImage(img, info.Orientation), previewRenderSize, previewRenderSize, imaging.Lanczos)
+	base := layoutSettings(img.Bounds())
+	positions := previewPositions(base.Position)
+
+	thumb := imaging.Fit(img, previewThumbSize, previewThumbSize, imaging.Box).Bounds().Size()
+	const gap, labelHeight = 8, 18
+	cellW, cellH := thumb.X+gap, thumb.Y+labelHeight+gap
+	rows := len(previewFontScales) * len(previewOpacities)
+	sheet := image.NewRGBA(image.Rect(0, 0, len(positions)*cellW+gap, rows*cellH+gap))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(color.RGBA{40, 40, 40, 255}), image.Point{}, draw.Src)
+
+	row := 0
+	for _, scale := range previewFontScales {
+		for _, opacity := range previewOpacities {
+			for col, position := range positions {
+				ws := previewSettings(base, scale, opacity, position)
+				wms := []*watermark{{ws: &ws, text: text, brand: brandLogo(info.Make)}}
+				placeWatermarks(img, wms, info.Filename)
+				rendered := imaging.Fit(addWatermark(img, wms), previewThumbSize, previewThumbSize, imaging.Lanczos)
+
+				at := image.Pt(gap+col*cellW, gap+row*cellH)
+				draw.Draw(sheet, rendered.Bounds().Add(at), rendered, image.Point{}, draw.Src)
+				drawPreviewLabel(sheet, at.Add(image.Pt(0, thumb.Y+labelHeight-5)),
+					fmt.Sprintf("fontSize %g  opacity %g%%  %s", ws.FontSize, opacity*100, position))
+			}
+			row++
+		}
+	}
+	return sheet, nil
+}
+
+// previewPositions 返回预览的位置：配置中的位置加上另外两个常用位置
+func previewPositions(configured string) []string {
+	positions := []string{cmp.Or(configured, "bottom-right")}
+	for _, p := range []string{"bottom-right", "bottom-left", "top-right", "center"} {
+		if len(positions) == 3 {
+			break
+		}
+		if !slices.Contains(positions, p) {
+			positions = append(positions, p)
+		}
+	}
+	return positions
+}
+
+// previewSettings 在样张对应的布局方案的基础上调整字号、不透明度和位置。
+// 不透明度同时作用于文字、描边、阴影和底板
+func previewSettings(base *WatermarkSettings, scale, opacity float64, position string) WatermarkSettings {
+	ws := *base
+	ws.Lines = slices.Clone(ws.Lines)
+	ws.FontSize *= scale
+	ws.Position = position
+	ws.Color.A = uint8(float64(ws.Color.A) * opacity)
+	ws.Stroke.Color.A = uint8(float64(ws.Stroke.Color.A) * opacity)
+	ws.Shadow.Opacity *= opacity
+	ws.Background.Opacity *= opacity
+	return ws
+}
+
+// drawPreviewLabel 用内置的点阵字体在基线 dot 处写一行说明，只包含 ASCII 字符，不依赖字体文件
+func drawPreviewLabel(dst draw.Image, dot image.Point, text string) {
+	d := font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(color.RGBA{220, 220, 220, 255}),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(dot.X, dot.Y),
+	}
+	d.DrawString(text)
+}
@@ -0,0 +1,143 @@
+package watermark
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// ProgressEventType 表示处理进度事件的类型
+type ProgressEventType int
+
+const (
+	FileStarted     ProgressEventType = iota // 开始处理某个文件
+	GeocodeResolved                          // 地址解析完成（地址可能为空）
+	FileDone                                 // 文件处理完成
+	FileFailed                               // 文件处理失败
+	RunFinished                              // Run 返回，所有文件的事件都已发出
+)
+
+func (t ProgressEventType) String() string {
+	switch t {
+	case FileStarted:
+		return "FileStarted"
+	case GeocodeResolved:
+		return "GeocodeResolved"
+	case FileDone:
+		return "FileDone"
+	case FileFailed:
+		return "FileFailed"
+	case RunFinished:
+		return "RunFinished"
+	default:
+		return "Unknown"
+	}
+}
+
+// ProgressEvent 是处理过程中发出的进度事件，供图形界面、网页前端等实时展示状态，
+// 不必再去解析 process.log
+type ProgressEvent struct {
+	Type       ProgressEventType
+	Filename   string    // 源文件
+	OutputPath string    // 输出文件，FileDone 时有效
+	Address    string    // 解析出的地址，GeocodeResolved 时有效
+	Err        error     // 失败原因，FileFailed 时有效
+	Time       time.Time // 事件发生时间
+}
+
+type progressHandler struct {
+	fn func(ProgressEvent)
+}
+
+var (
+	progressMu       sync.RWMutex
+	progressHandlers []*progressHandler
+)
+
+// OnProgress 注册进度回调，返回取消注册的函数。回调会在处理文件的 goroutine 中同步调用，
+// 可能被并发调用，耗时操作请自行转到其他 goroutine
+func OnProgress(handler func(ProgressEvent)) (unsubscribe func()) {
+	h := &progressHandler{fn: handler}
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	progressHandlers = append(progressHandlers, h)
+	return func() {
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		// 生成新的切片，正在遍历旧切片的 emitProgress 不受影响
+		progressHandlers = slices.DeleteFunc(slices.Clone(progressHandlers), func(x *progressHandler) bool { return x == h })
+	}
+}
+
+// ProgressChannel 返回一个接收进度事件的通道和取消订阅的函数。事件先放入不限长度的队列再转发到通道，
+// 读取慢时不会阻塞处理流程，也不会丢失事件。通道只接收一次 Run（或 RunTag）的事件：返回时发出 RunFinished，
+// 之前的事件全部送出后关闭通道。提前停止读取时调用 unsubscribe，通道随即关闭，未送出的事件丢弃
+func ProgressChannel(buffer int) (events <-chan ProgressEvent, unsubscribe func()) {
+	ch := make(chan ProgressEvent, buffer)
+	var (
+		mu       sync.Mutex
+		queue    []ProgressEvent
+		finished bool
+		wake     = make(chan struct{}, 1)
+		stop     = make(chan struct{})
+		once     sync.Once
+	)
+	remove := OnProgress(func(e ProgressEvent) {
+		mu.Lock()
+		if !finished {
+			queue = append(queue, e)
+			finished = e.Type == RunFinished
+		}
+		mu.Unlock()
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	})
+	unsubscribe = func() {
+		once.Do(func() {
+			remove()
+			close(stop)
+		})
+	}
+
+	go func() {
+		defer close(ch)
+		for {
+			mu.Lock()
+			if len(queue) == 0 {
+				done := finished
+				mu.Unlock()
+				if done {
+					unsubscribe()
+					return
+				}
+				select {
+				case <-wake:
+				case <-stop:
+					return
+				}
+				continue
+			}
+			e := queue[0]
+			queue = queue[1:]
+			mu.Unlock()
+			select {
+			case ch <- e:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return ch, unsubscribe
+}
+
+func emitProgress(e ProgressEvent) {
+	e.Time = time.Now()
+	progressMu.RLock()
+	handlers := progressHandlers
+	progressMu.RUnlock()
+	for _, h := range handlers {
+		h.fn(e)
+	}
+}
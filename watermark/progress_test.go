@@ -0,0 +1,67 @@
+package watermark
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestProgressChannel(t *testing.T) {
+	events, _ := ProgressChannel(1)
+	// 没有读取时通道很快写满，之后的事件留在队列中，emitProgress 不会阻塞
+	const n = 1000
+	for i := range n {
+		emitProgress(ProgressEvent{Type: FileDone, Filename: fmt.Sprintf("%d.jpg", i)})
+	}
+	emitProgress(ProgressEvent{Type: RunFinished})
+	emitProgress(ProgressEvent{Type: FileStarted, Filename: "下一次运行.jpg"})
+
+	var got []ProgressEvent
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				done = true
+				break
+			}
+			got = append(got, e)
+		case <-timeout:
+			t.Fatal("通道没有关闭")
+		}
+	}
+	if len(got) != n+1 {
+		t.Fatalf("收到 %d 个事件，期望 %d 个", len(got), n+1)
+	}
+	for i, e := range got[:n] {
+		if want := fmt.Sprintf("%d.jpg", i); e.Filename != want {
+			t.Fatalf("第 %d 个事件是 %s，期望 %s", i, e.Filename, want)
+		}
+	}
+	if got[n].Type != RunFinished {
+		t.Errorf("最后一个事件是 %v，期望 RunFinished", got[n].Type)
+	}
+}
+
+func TestProgressChannelUnsubscribe(t *testing.T) {
+	events, unsubscribe := ProgressChannel(0)
+	emitProgress(ProgressEvent{Type: FileStarted, Filename: "a.jpg"})
+	unsubscribe()
+	unsubscribe()
+	emitProgress(ProgressEvent{Type: FileStarted, Filename: "b.jpg"})
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if e.Filename == "b.jpg" {
+				t.Error("取消订阅后仍然收到事件")
+			}
+		case <-timeout:
+			t.Fatal("取消订阅后通道没有关闭")
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package watermark
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// renderQRCode 按 qrCode.content 模板生成照片的二维码，未启用或内容为空（例如照片没有 GPS）时返回 nil
+func renderQRCode(info *PhotoInfo) ([][]bool, error) {
+	if !config.QRCode.Enabled {
+		return nil, nil
+	}
+	content, err := executeTemplate(qrCodeTemplate, info)
+	if err != nil {
+		return nil, fmt.Errorf("渲染二维码内容模板失败: %v", err)
+	}
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return nil, nil
+	}
+	q, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		return nil, fmt.Errorf("生成二维码失败: %v", err)
+	}
+	return q.Bitmap(), nil
+}
+
+// qrCodeRect 返回二维码在整张图片中的位置，不绘制二维码时为空矩形。
+// 每个模块取整数像素，扫码时边缘清晰，实际边长可能略小于配置的大小
+func qrCodeRect(bounds image.Rectangle, wm *watermark) image.Rectangle {
+	n := len(wm.qr)
+	if n == 0 {
+		return image.Rectangle{}
+	}
+	width, height := bounds.Dx(), bounds.Dy()
+	ws := config.WatermarkSettings
+	target := resolveSize(config.QRCode.Size, min(width, height), ws.Unit)
+	side := max(1, int(target)/n) * n
+
+	widthPadding := int(resolveSize(ws.WidthPadding, width, ws.Unit))
+	heightPadding := int(resolveSize(ws.HeightPadding, height, ws.Unit))
+	fx, fy := anchorFactors(config.QRCode.Position)
+	x := anchorOffset(bounds.Min.X, width, side, widthPadding, fx)
+	y := anchorOffset(bounds.Min.Y, height, side, heightPadding, fy)
+	return image.Rect(x, y, x+side, y+side)
+}
+
+// drawQRCode 在 dst 上绘制二维码：先铺满背景色（包括四周留白），再逐个绘制深色模块
+func drawQRCode(dst draw.Image, bounds image.Rectangle, wm *watermark) {
+	rect := qrCodeRect(bounds, wm)
+	if rect.Intersect(dst.Bounds()).Empty() {
+		return
+	}
+
+	qr := config.QRCode
+	draw.Draw(dst, rect.Intersect(dst.Bounds()), image.NewUniform(qr.Background.toRGBA()), image.Point{}, draw.Over)
+	fg := image.NewUniform(qr.Color.toRGBA())
+	module := rect.Dx() / len(wm.qr)
+	for y, row := range wm.qr {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			m := image.Rect(rect.Min.X+x*module, rect.Min.Y+y*module, rect.Min.X+(x+1)*module, rect.Min.Y+(y+1)*module)
+			draw.Draw(dst, m.Intersect(dst.Bounds()), fg, image.Point{}, draw.Over)
+		}
+	}
+}
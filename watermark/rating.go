@@ -0,0 +1,202 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// 在 Lightroom、Bridge、digiKam 等软件中挑片时打的星级和关键词保存在 XMP（xmp:Rating、dc:subject）中，
+// 也可能在 IPTC 的关键词或 EXIF 的 Rating 字段中。这些信息可以印在水印上，也可以按 filter 只处理挑出的照片
+
+// photoTags 是照片的星级评分和关键词
+type photoTags struct {
+	rating    int // 0-5，-1 表示已拒绝
+	hasRating bool
+	keywords  []string
+}
+
+// tagRating 是 Windows 资源管理器写入 IFD0 的星级字段，goexif 不认识，按编号查找
+const tagRating = 0x4746
+
+// xmpTags 从 parseXMP 的结果中取出评分和关键词
+func xmpTags(values map[string]string, lists map[string][]string) photoTags {
+	var t photoTags
+	if r, err := strconv.ParseFloat(values["Rating"], 64); err == nil {
+		t.rating, t.hasRating = int(r), true
+	}
+	t.keywords = lists["subject"]
+	return t
+}
+
+// readPhotoTags 读取评分和关键词：依次使用照片内嵌的 XMP、IPTC 关键词、EXIF 的 Rating，
+// 附属文件中有评分或关键词时按 readXMPSidecar 的设置补上或代替
+func readPhotoTags(data []byte, x *exif.Exif, side *inputSidecar) photoTags {
+	var t photoTags
+	if packet := readEmbeddedXMP(data); packet != nil {
+		if values, lists, err := parseXMP(packet); err == nil {
+			t = xmpTags(values, lists)
+		}
+	}
+	if len(t.keywords) == 0 {
+		t.keywords = readIPTCKeywords(data)
+	}
+	if !t.hasRating && x != nil && len(x.Tiff.Dirs) > 0 {
+		for _, tag := range x.Tiff.Dirs[0].Tags {
+			if tag.Id == tagRating {
+				t.rating, _ = tag.Int(0)
+				t.hasRating = true
+			}
+		}
+	}
+
+	if side != nil {
+		if side.tags.hasRating && side.useSidecar(t.hasRating) {
+			t.rating, t.hasRating = side.tags.rating, true
+		}
+		if len(side.tags.keywords) > 0 && side.useSidecar(len(t.keywords) > 0) {
+			t.keywords = side.tags.keywords
+		}
+	}
+	return t
+}
+
+// readEmbeddedXMP 读取照片内嵌的 XMP：JPEG 的 APP1 段、PNG 的 iTXt 块、WebP 的 XMP 块，没有时返回 nil
+func readEmbeddedXMP(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return findJPEGSegment(data, 0xE1, xmpNamespace)
+	case bytes.HasPrefix(data, pngSignature):
+		// PNG 中可能有多个 iTXt 块，按关键字查找 XMP 所在的块
+		i := bytes.Index(data, []byte("iTXtXML:com.adobe.xmp\x00"))
+		if i < 4 {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint32(data[i-4:]))
+		if length < 0 || i+4+length > len(data) {
+			return nil
+		}
+		// 关键字之后依次是压缩标志、压缩方法、语言标签和翻译关键字，只支持未压缩的文本
+		rest := data[i+4+len("XML:com.adobe.xmp\x00") : i+4+length]
+		if len(rest) < 2 || rest[0] != 0 {
+			return nil
+		}
+		rest = rest[2:]
+		for range 2 {
+			var ok bool
+			if _, rest, ok = bytes.Cut(rest, []byte{0}); !ok {
+				return nil
+			}
+		}
+		return rest
+	case len(data) >= 12 && string(data[:4]) == "RIFF":
+		chunk, _ := findWebPChunk(data, "XMP ")
+		return chunk
+	}
+	return nil
+}
+
+// findJPEGSegment 返回第一个以 prefix 开头的 marker 段中 prefix 之后的内容，格式错误或没有时返回 nil
+func findJPEGSegment(data []byte, marker byte, prefix []byte) []byte {
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		m := data[pos+1]
+		if m == 0xDA || m == 0xD9 {
+			break
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) || end < pos+4 {
+			break
+		}
+		if payload, ok := bytes.CutPrefix(data[pos+4:end], prefix); m == marker && ok {
+			return payload
+		}
+		pos = end
+	}
+	return nil
+}
+
+// photoshopHeader 是 JPEG 中 APP13（Photoshop 图像资源）段的标识，IPTC 数据保存在编号 0x0404 的资源中
+var photoshopHeader = []byte("Photoshop 3.0\x00")
+
+// readIPTCKeywords 读取 APP13 中 IPTC 的关键词（2:25）
+func readIPTCKeywords(data []byte) []string {
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return nil
+	}
+	res := findJPEGSegment(data, 0xED, photoshopHeader)
+	// 每个资源为 "8BIM"、2 字节编号、偶数长度的 Pascal 字符串名称、4 字节长度和补齐到偶数的数据
+	for len(res) >= 12 && bytes.HasPrefix(res, []byte("8BIM")) {
+		id := binary.BigEndian.Uint16(res[4:])
+		nameLen := 1 + int(res[6])
+		nameLen += nameLen % 2
+		if 6+nameLen+4 > len(res) {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(res[6+nameLen:]))
+		start := 6 + nameLen + 4
+		if start+size > len(res) {
+			return nil
+		}
+		if id == 0x0404 {
+			return iptcKeywords(res[start : start+size])
+		}
+		res = res[start+size+size%2:]
+	}
+	return nil
+}
+
+// iptcKeywords 读取 IPTC 数据集中的关键词，每个数据集为 0x1C、记录号、数据集号、2 字节长度和数据
+func iptcKeywords(iptc []byte) []string {
+	var keywords []string
+	for len(iptc) >= 5 && iptc[0] == 0x1C {
+		size := int(binary.BigEndian.Uint16(iptc[3:]))
+		// 最高位为 1 表示扩展长度，关键词不会用到，遇到时停止
+		if size&0x8000 != 0 || 5+size > len(iptc) {
+			break
+		}
+		if iptc[1] == 2 && iptc[2] == 25 {
+			if k := strings.TrimSpace(string(iptc[5 : 5+size])); k != "" {
+				keywords = append(keywords, k)
+			}
+		}
+		iptc = iptc[5+size:]
+	}
+	return keywords
+}
+
+// passFilter 判断照片是否符合 filter 的条件，不符合时返回原因
+func (t photoTags) passFilter() (bool, string) {
+	f := config.Filter
+	if f.MinRating > 0 && t.rating < f.MinRating {
+		return false, fmt.Sprintf("评分 %d 低于 %d 星", t.rating, f.MinRating)
+	}
+	has := func(want string) bool {
+		return slices.ContainsFunc(t.keywords, func(k string) bool { return strings.EqualFold(k, want) })
+	}
+	if len(f.Keywords) > 0 && !slices.ContainsFunc(f.Keywords, has) {
+		return false, fmt.Sprintf("没有关键词 %s", strings.Join(f.Keywords, "、"))
+	}
+	if i := slices.IndexFunc(f.ExcludeKeywords, has); i >= 0 {
+		return false, fmt.Sprintf("带有关键词 %s", f.ExcludeKeywords[i])
+	}
+	return true, ""
+}
+
+// filterPhoto 按 filter 判断是否处理照片，跳过时记录日志
+func filterPhoto(filename string, t photoTags) bool {
+	ok, reason := t.passFilter()
+	if !ok {
+		log.Printf("跳过 %s：%s", filename, reason)
+		if dryRun {
+			fmt.Printf("[跳过] %s（%s）\n", filename, reason)
+		}
+	}
+	return ok
+}
@@ -0,0 +1,111 @@
+package watermark
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	reportMu      sync.Mutex
+	reportRecords []ImageRecord
+	reportStarted time.Time
+)
+
+// resetReport 在每次 Run 开始时清空上一次的记录，报告的开始时间和文件名按本次运行计算
+func resetReport() {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	reportRecords = nil
+	reportStarted = time.Now()
+}
+
+// reportEnabled 判断是否需要生成运行报告
+func reportEnabled() bool {
+	return config.ReportFormat != "" && !dryRun
+}
+
+// addRecord 记录一张图片的处理结果
+func addRecord(r ImageRecord) {
+	if !reportEnabled() {
+		return
+	}
+	r.SchemaVersion = ""
+	if r.ProcessedAt.IsZero() {
+		r.ProcessedAt = time.Now()
+	}
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	reportRecords = append(reportRecords, r)
+}
+
+// writeReport 按配置的格式（json、csv 或 both）写出运行报告，返回写入的文件
+func writeReport() ([]string, error) {
+	if !reportEnabled() {
+		return nil, nil
+	}
+
+	reportMu.Lock()
+	records := append([]ImageRecord(nil), reportRecords...)
+	reportMu.Unlock()
+	sort.Slice(records, func(i, j int) bool { return records[i].Source < records[j].Source })
+
+	base := "report_" + reportStarted.Format("20060102_150405")
+	format := strings.ToLower(config.ReportFormat)
+	var written []string
+
+	if format == "json" || format == "both" {
+		report := RunReport{
+			SchemaVersion: SchemaVersion,
+			StartedAt:     reportStarted,
+			FinishedAt:    time.Now(),
+			Files:         records,
+		}
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return written, fmt.Errorf("生成JSON报告失败: %v", err)
+		}
+		if err := os.WriteFile(base+".json", data, 0644); err != nil {
+			return written, fmt.Errorf("写入JSON报告失败: %v", err)
+		}
+		written = append(written, base+".json")
+	}
+
+	if format == "csv" || format == "both" {
+		if err := writeCSVReport(base+".csv", records); err != nil {
+			return written, err
+		}
+		written = append(written, base+".csv")
+	}
+	return written, nil
+}
+
+func writeCSVReport(path string, records []ImageRecord) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("创建CSV报告失败: %v", err)
+	}
+	defer file.Close()
+
+	// 写入 BOM，Excel 打开时中文不乱码
+	file.WriteString("\ufeff")
+	w := csv.NewWriter(file)
+	w.Write([]string{"source", "output", "status", "takenAt", "address", "camera", "error"})
+	for _, r := range records {
+		var takenAt string
+		if r.TakenAt != nil {
+			takenAt = r.TakenAt.Format("2006-01-02 15:04:05")
+		}
+		w.Write([]string{r.Source, r.Output, r.Status, takenAt, r.Address, r.Camera, r.Error})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("写入CSV报告失败: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package watermark
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+)
+
+// 稳健水印在亮度的 8×8 分块 DCT 中频系数上叠加一组由 robustWatermark.key 决定正负号的扩频信号。
+// 每个分块的信号相同，只是整体正负号按 8×8 个分块为周期的随机符号表翻转，
+// 这样照片内容在相邻分块间的相似性会相互抵消，不会被误判为水印。
+// 检测时把每个分块与信号做相关，按符号表加权求和后除以相关值的均方和得到 z 值：
+// 没有水印时 z 值近似服从标准正态分布，有水印时显著偏大。
+// 中频系数在 JPEG 重新压缩后大部分保留；裁剪只会让像素网格和符号表错位，检测时逐一尝试全部 64×64 种偏移
+
+// robustCoefficients 是承载信号的 DCT 系数（u+v 为 2~4 的中低频），
+// 频率更低的系数肉眼更容易察觉，更高的则会被 JPEG 量化掉
+var robustCoefficients = func() [][2]int {
+	var coeffs [][2]int
+	for u := range 8 {
+		for v := range 8 {
+			if s := u + v; s >= 2 && s <= 4 {
+				coeffs = append(coeffs, [2]int{u, v})
+			}
+		}
+	}
+	return coeffs
+}()
+
+// 检测时尝试的偏移数：像素网格 64 种，符号表 64 种
+const robustOffsets = 64 * 64
+
+// 检测结果的 p 值（已按偏移数校正）小于这个值时认为存在水印
+const robustDetectionP = 1e-3
+
+// robustKey 是由密钥生成的空间域图案和分块符号表
+type robustKey struct {
+	pattern [8][8]float64 // 一个分块内的图案，均方根为 1
+	signs   [8][8]float64 // 第 (i, j) 个分块使用的符号，按 8×8 个分块循环
+}
+
+// newRobustKey 由密钥生成图案和符号表，符号表中正负号各占一半
+func newRobustKey(key string) *robustKey {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	rng := rand.New(rand.NewSource(int64(h.Sum64())))
+
+	k := &robustKey{}
+	signs := rng.Perm(64)
+	for i, v := range signs {
+		k.signs[i/8][i%8] = float64(v%2*2 - 1)
+	}
+
+	pattern := &k.pattern
+	for _, c := range robustCoefficients {
+		sign := float64(rng.Intn(2)*2 - 1)
+		for y := range 8 {
+			for x := range 8 {
+				pattern[y][x] += sign * dctBasis(c[0], x) * dctBasis(c[1], y)
+			}
+		}
+	}
+	rms := math.Sqrt(float64(len(robustCoefficients)) / 64)
+	for y := range 8 {
+		for x := range 8 {
+			pattern[y][x] /= rms
+		}
+	}
+	return k
+}
+
+// dctBasis 是 8 点正交 DCT-II 的第 u 个基函数在 x 处的值
+func dctBasis(u, x int) float64 {
+	c := math.Sqrt(2.0 / 8)
+	if u == 0 {
+		c = math.Sqrt(1.0 / 8)
+	}
+	return c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+}
+
+// embedRobustWatermark 返回叠加了稳健水印的图片，未启用时返回原图
+func embedRobustWatermark(img image.Image) image.Image {
+	rw := config.RobustWatermark
+	if !rw.Enabled || rw.Strength <= 0 {
+		return img
+	}
+	return &robustImage{base: img, key: newRobustKey(rw.Key), strength: rw.Strength}
+}
+
+// embedInvisible 依次写入稳健水印和隐写水印。隐写数据在最低位，必须最后写入
+func embedInvisible(img image.Image, wm *watermark) image.Image {
+	return embedStego(embedRobustWatermark(img), wm)
+}
+
+// robustImage 在读取像素时给红、绿、蓝三个通道加上相同的图案值，即只改变亮度
+type robustImage struct {
+	base     image.Image
+	key      *robustKey
+	strength float64
+}
+
+func (r *robustImage) ColorModel() color.Model { return color.NRGBAModel }
+
+func (r *robustImage) Bounds() image.Rectangle { return r.base.Bounds() }
+
+func (r *robustImage) At(x, y int) color.Color {
+	c := color.NRGBAModel.Convert(r.base.At(x, y)).(color.NRGBA)
+	b := r.base.Bounds()
+	x, y = x-b.Min.X, y-b.Min.Y
+	d := r.strength * r.key.signs[y/8%8][x/8%8] * r.key.pattern[y%8][x%8]
+	c.R = clampUint8(float64(c.R) + d)
+	c.G = clampUint8(float64(c.G) + d)
+	c.B = clampUint8(float64(c.B) + d)
+	return c
+}
+
+func clampUint8(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
+
+// robustDetection 是一张图片的检测结果
+type robustDetection struct {
+	Z          float64 // 最佳偏移下的 z 值
+	Confidence float64 // 1 减去校正后的 p 值
+	Present    bool
+}
+
+// detectRobustWatermark 在全部像素网格偏移和符号表偏移中寻找相关性最强的一种
+func detectRobustWatermark(img image.Image, key string) robustDetection {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	luma := make([]float32, w*h)
+	for y := range h {
+		for x := range w {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			luma[y*w+x] = float32(0.299*float64(r)+0.587*float64(g)+0.114*float64(bl)) / 257
+		}
+	}
+
+	k := newRobustKey(key)
+	best := math.Inf(-1)
+	for oy := range 8 {
+		for ox := range 8 {
+			// 每个分块与图案的相关值
+			cols, rows := (w-ox)/8, (h-oy)/8
+			if cols < 8 || rows < 8 {
+				continue
+			}
+			corr := make([]float64, cols*rows)
+			var sumSq float64
+			for j := range rows {
+				for i := range cols {
+					var r float64
+					for y := range 8 {
+						row := luma[(oy+j*8+y)*w+ox+i*8:]
+						for x := range 8 {
+							r += float64(row[x]) * k.pattern[y][x]
+						}
+					}
+					corr[j*cols+i] = r
+					sumSq += r * r
+				}
+			}
+			if sumSq == 0 {
+				continue
+			}
+
+			// 按符号表加权求和，符号表的偏移对应裁掉的整块数
+			for dy := range 8 {
+				for dx := range 8 {
+					var sum float64
+					for j := range rows {
+						signs := &k.signs[(j+dy)%8]
+						for i := range cols {
+							sum += signs[(i+dx)%8] * corr[j*cols+i]
+						}
+					}
+					best = math.Max(best, sum/math.Sqrt(sumSq))
+				}
+			}
+		}
+	}
+	if math.IsInf(best, -1) {
+		return robustDetection{}
+	}
+
+	// 单侧检验，按尝试的偏移数做 Bonferroni 校正
+	p := math.Min(1, robustOffsets*0.5*math.Erfc(best/math.Sqrt2))
+	return robustDetection{Z: best, Confidence: 1 - p, Present: p < robustDetectionP}
+}
+
+// RunDetect 实现 detect 子命令：用配置中的密钥检测每个文件是否带有稳健水印，有文件读取失败时返回非零退出码
+func RunDetect(files []string) int {
+	if len(files) == 0 {
+		fmt.Println("用法: jpg-watermark-cli detect 图片文件...")
+		return 2
+	}
+	if err := LoadConfig(); err != nil {
+		fmt.Printf("加载配置失败: %v\n", err)
+		return 1
+	}
+	status := 0
+	for _, name := range files {
+		img, err := decodeImageFile(name)
+		if err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		d := detectRobustWatermark(img, config.RobustWatermark.Key)
+		if d.Present {
+			fmt.Printf("%s: 检测到水印，置信度 %.4f%%（z=%.1f）\n", name, d.Confidence*100, d.Z)
+		} else {
+			fmt.Printf("%s: 未检测到水印（z=%.1f）\n", name, d.Z)
+		}
+	}
+	return status
+}
@@ -0,0 +1,72 @@
+package watermark
+
+import (
+	"image"
+	"os"
+	"testing"
+)
+
+// demoCrop 从仓库中的示例照片截取一块 512x384 的区域，稳健水印的检测依赖真实照片的统计特性
+func demoCrop(t *testing.T) *image.NRGBA {
+	t.Helper()
+	f, err := os.Open("../demo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := img.Bounds().Size().Div(2)
+	return toNRGBA(img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}).SubImage(image.Rect(c.X-256, c.Y-192, c.X+256, c.Y+192)))
+}
+
+func TestDetectRobustWatermark(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+	config.RobustWatermark.Enabled = true
+	config.RobustWatermark.Key = "test-key"
+	config.RobustWatermark.Strength = 2
+
+	photo := demoCrop(t)
+	marked := embedRobustWatermark(photo)
+	// 裁掉左上角不是 8 的整数倍的像素，像素网格和符号表都会错位
+	b := photo.Bounds()
+	cropped := toNRGBA(marked).SubImage(image.Rect(b.Min.X+13, b.Min.Y+21, b.Max.X, b.Max.Y))
+
+	tests := []struct {
+		name   string
+		img    image.Image
+		format string
+		key    string
+		want   bool
+	}{
+		{"png", marked, "png", "test-key", true},
+		{"jpeg 重新压缩", marked, "jpeg", "test-key", true},
+		{"裁剪", cropped, "png", "test-key", true},
+		{"密钥不同", marked, "png", "other-key", false},
+		{"没有水印", photo, "png", "test-key", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := detectRobustWatermark(encodeDecode(t, tt.img, tt.format), tt.key)
+			if got.Present != tt.want {
+				t.Errorf("Present = %v（z = %.2f，置信度 %.4f），期望 %v", got.Present, got.Z, got.Confidence, tt.want)
+			}
+		})
+	}
+}
+
+// toNRGBA 把图片复制为 NRGBA，以便裁剪
+func toNRGBA(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			out.Set(x, y, img.At(x, y))
+		}
+	}
+	return out
+}
@@ -0,0 +1,149 @@
+package watermark
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// 包外调用处理流程的顺序：SetOptions 设置运行选项，LoadConfig 载入配置，Prepare 读取数据并检查配置，
+// ListInputFiles 列出当前目录中的图片，Run 处理图片，Finish 输出汇总并写入运行报告。
+// 处理进度用 OnProgress 或 ProgressChannel 接收。配置和运行状态保存在包级变量中，同一时间只能进行一次处理
+
+// Options 是配置文件之外的运行选项，命令行程序由参数设置
+type Options struct {
+	ConfigFiles []string        // 按顺序载入的配置文件，为空时使用当前目录或用户配置目录中的 config.json
+	Overrides   []func(*Config) // 载入配置文件之后、合并水印块和布局方案之前对配置的修改
+	Caption     string          // 追加在水印文字最后一行的固定说明，优先于 caption.txt 和配置
+	DryRun      bool            // 演练模式：只打印每个文件会写到哪里，不写入任何文件
+	Verbosity   Verbosity       // 控制台输出的详细程度
+}
+
+var captionOption string
+
+// SetOptions 设置运行选项，需要在 LoadConfig 之前调用
+func SetOptions(opts Options) {
+	configFiles = opts.ConfigFiles
+	configOverrides = opts.Overrides
+	captionOption = opts.Caption
+	dryRun = opts.DryRun
+	verbosity = opts.Verbosity
+}
+
+// SaveDefaultConfig 在当前目录生成默认配置文件 config.json
+func SaveDefaultConfig() error {
+	return os.WriteFile("config.json", []byte(configJSON), 0644)
+}
+
+// Prepare 读取说明文字、地点规则、轨迹等数据，检查配置并确定字体，在 LoadConfig 之后调用
+func Prepare() error {
+	if err := loadCaption(captionOption); err != nil {
+		return fmt.Errorf("读取说明文字失败: %v", err)
+	}
+	if err := loadLocationOverrides(); err != nil {
+		return fmt.Errorf("读取地点规则失败: %v", err)
+	}
+	if err := loadTracks(); err != nil {
+		return fmt.Errorf("读取轨迹失败: %v", err)
+	}
+	if err := loadTimezones(); err != nil {
+		return fmt.Errorf("读取时区数据失败: %v", err)
+	}
+	if err := loadCountries(); err != nil {
+		return fmt.Errorf("读取国家边界数据失败: %v", err)
+	}
+
+	checks := []func() error{
+		validateOutputFormat,
+		validateReadXMPSidecar,
+		validateDateSettings,
+		validateScreenshots,
+		compileWatermarkTemplate,
+		validateAddressComponents,
+		loadGeocoder,
+		validateBlendModes,
+		validateStego,
+		loadC2PASigner,
+	}
+	for _, check := range checks {
+		if err := check(); err != nil {
+			return fmt.Errorf("配置错误: %v", err)
+		}
+	}
+
+	if config.ColorCheck {
+		checkPrintGamut()
+	}
+	resolveFontPath()
+	return nil
+}
+
+// ListInputFiles 返回当前目录中要处理的图片
+func ListInputFiles() ([]string, error) {
+	return listInputFiles()
+}
+
+// Run 按 maxConcurrency 并发处理 files 中的图片，全部处理完才返回。单个文件失败时记入日志和运行报告，
+// 并发出 FileFailed 事件，不影响其他文件；只有创建输出目录失败时返回错误
+func Run(files []string) error {
+	defer emitProgress(ProgressEvent{Type: RunFinished})
+	resetReport()
+	initIOLimits()
+	if !dryRun {
+		if err := createRequiredDirectories(); err != nil {
+			return fmt.Errorf("创建目录失败: %v", err)
+		}
+	}
+
+	sources := prefetchSourceFiles(files)
+	for range max(config.MaxConcurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for src := range sources {
+				emitProgress(ProgressEvent{Type: FileStarted, Filename: src.filename})
+				err := src.err
+				if err == nil {
+					err = processImage(src.filename, src.data)
+				}
+				if err != nil {
+					log.Printf("处理文件 %s 失败: %v", src.filename, err)
+					addRecord(ImageRecord{Source: src.filename, Status: StatusError, Error: err.Error()})
+					emitProgress(ProgressEvent{Type: FileFailed, Filename: src.filename, Err: err})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// Finish 在控制台输出地址解析和上传的汇总，写入运行报告，返回运行报告的文件名
+func Finish() ([]string, error) {
+	printGeocodeSummary()
+	printUploadSummary()
+	files, err := writeReport()
+	if err != nil {
+		return nil, fmt.Errorf("写入运行报告失败: %v", err)
+	}
+	return files, nil
+}
+
+func createRequiredDirectories() error {
+	dirs := []string{config.OutputFolder, config.NoExifFolder}
+	if config.InPlace {
+		dirs = []string{config.BackupFolder}
+	} else if config.MoveOriginals {
+		dirs = append(dirs, config.OriginalsFolder)
+	}
+	if config.WebCopy.Enabled {
+		dirs = append(dirs, webCopyFolder())
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return fmt.Errorf("创建目录 %s 失败: %v", dir, err)
+		}
+		log.Printf("目录 %s 创建成功", dir)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package watermark
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SchemaVersion 是运行报告和 JSON 附属文件的结构版本，结构定义见 schema 目录。
+// 兼容约定：只新增字段时升级次版本号，删除、改名或改变字段含义时升级主版本号，
+// 同一主版本内下游脚本可以放心解析
+const SchemaVersion = "1.1"
+
+// 图片处理状态
+const (
+	StatusOK         = "ok"
+	StatusNoExif     = "no-exif"
+	StatusScreenshot = "screenshot"
+	StatusError      = "error"
+)
+
+// ImageRecord 描述一张图片的处理结果，既用于 JSON 附属文件，也是运行报告中的一项
+type ImageRecord struct {
+	SchemaVersion string     `json:"schemaVersion,omitempty"`
+	Source        string     `json:"source"`
+	Output        string     `json:"output,omitempty"`
+	Status        string     `json:"status"`
+	Error         string     `json:"error,omitempty"`
+	TakenAt       *time.Time `json:"takenAt,omitempty"`
+	Address       string     `json:"address,omitempty"`
+	Camera        string     `json:"camera,omitempty"`
+	WatermarkText string     `json:"watermarkText,omitempty"`
+	ProcessedAt   time.Time  `json:"processedAt"`
+}
+
+// RunReport 是一次运行的汇总报告
+type RunReport struct {
+	SchemaVersion string        `json:"schemaVersion"`
+	StartedAt     time.Time     `json:"startedAt"`
+	FinishedAt    time.Time     `json:"finishedAt"`
+	Files         []ImageRecord `json:"files"`
+}
+
+// newImageRecord 根据照片信息生成处理成功的记录
+func newImageRecord(info *PhotoInfo, outputPath, watermarkText string) ImageRecord {
+	return ImageRecord{
+		Source:        info.Filename,
+		Output:        outputPath,
+		Status:        StatusOK,
+		TakenAt:       &info.Time,
+		Address:       info.Address,
+		Camera:        cameraName(info.Make, info.Model),
+		WatermarkText: watermarkText,
+		ProcessedAt:   time.Now(),
+	}
+}
+
+// jsonSidecarPath 返回输出图片对应的 JSON 附属文件路径
+func jsonSidecarPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".json"
+}
+
+// writeJSONSidecar 为输出图片写入 JSON 附属文件
+func writeJSONSidecar(outputPath string, info *PhotoInfo, watermarkText string) error {
+	record := newImageRecord(info, outputPath, watermarkText)
+	record.SchemaVersion = SchemaVersion
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("生成JSON附属文件失败: %v", err)
+	}
+	path := jsonSidecarPath(outputPath)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("写入JSON附属文件 %s 失败: %v", path, err)
+	}
+	return nil
+}
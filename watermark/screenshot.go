@@ -0,0 +1,127 @@
+package watermark
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// 手机和电脑的截图原先和真正没有 EXIF 的老照片一起放进 noExifFolder，带有拍摄时间的截图（如 iOS）还会被加上水印。
+// 这里按没有相机厂商、EXIF UserComment 和文件名识别，按 screenshots.action 复制到单独的目录或跳过。
+// 扫描件、聊天软件保存的照片、编辑软件导出的图片同样没有相机厂商，分辨率也常与屏幕相同，
+// 因此常见屏幕分辨率和 Software 字段只作为佐证写进日志，不单独作为判断依据
+
+// screenshotResolutions 是常见手机和显示器的截图分辨率（竖屏为宽 x 高），横屏截图宽高互换
+var screenshotResolutions = []string{
+	// iPhone
+	"750x1334", "828x1792", "1125x2436", "1170x2532", "1179x2556", "1242x2208", "1242x2688",
+	"1284x2778", "1290x2796", "1206x2622", "1320x2868",
+	// Android
+	"720x1600", "1080x1920", "1080x2340", "1080x2400", "1080x2412", "1080x2460", "1220x2712",
+	"1260x2800", "1440x3088", "1440x3120", "1440x3200",
+	// 显示器
+	"768x1366", "900x1440", "1200x1920", "1440x2560", "1600x2560", "1800x2880",
+	"1964x3024", "2160x3840", "2234x3456",
+}
+
+// screenshotNamePattern 匹配系统和常用截图工具的默认文件名
+var screenshotNamePattern = regexp.MustCompile(`(?i)screenshot|screen shot|截屏|截图|屏幕快照|snipaste|cleanshot`)
+
+// validateScreenshots 检查 screenshots 的设置
+func validateScreenshots() error {
+	s := config.Screenshots
+	switch s.Action {
+	case "", "off", "skip":
+	case "folder":
+		if s.Folder == "" {
+			return fmt.Errorf("screenshots.action 为 folder 时需要填写 screenshots.folder")
+		}
+	default:
+		return fmt.Errorf("screenshots.action 的取值 %q 无效，可选 off、folder、skip", s.Action)
+	}
+	for _, r := range s.Resolutions {
+		var w, h int
+		if _, err := fmt.Sscanf(r, "%dx%d", &w, &h); err != nil || w <= 0 || h <= 0 {
+			return fmt.Errorf("screenshots.resolutions 中的 %q 无效，格式为 宽x高，如 1179x2556", r)
+		}
+	}
+	return nil
+}
+
+// detectScreenshot 判断图片是否是截图，是时返回判断依据。EXIF 中有相机厂商的一律视为照片；
+// 没有相机厂商时还需要 UserComment、文件名或 screenshots.resolutions 中的分辨率之一符合截图的特征
+func detectScreenshot(filename string, data []byte, x *exif.Exif) (string, bool) {
+	if exifString(x, exif.Make) != "" {
+		return "", false
+	}
+	var reasons, hints []string
+	// iOS 的截图在 UserComment 中写有 Screenshot
+	if userComment(x) == "Screenshot" {
+		reasons = append(reasons, "EXIF UserComment 为 Screenshot")
+	}
+	if screenshotNamePattern.MatchString(filepath.Base(filename)) {
+		reasons = append(reasons, "文件名为截图的命名方式")
+	}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		w, h := min(cfg.Width, cfg.Height), max(cfg.Width, cfg.Height)
+		size := fmt.Sprintf("%dx%d", w, h)
+		switch {
+		case slices.Contains(config.Screenshots.Resolutions, size) || slices.Contains(config.Screenshots.Resolutions, fmt.Sprintf("%dx%d", h, w)):
+			reasons = append(reasons, fmt.Sprintf("分辨率 %dx%d 在 screenshots.resolutions 中", cfg.Width, cfg.Height))
+		case slices.Contains(screenshotResolutions, size):
+			hints = append(hints, fmt.Sprintf("分辨率 %dx%d 与常见屏幕一致", cfg.Width, cfg.Height))
+		}
+	}
+	if software := exifString(x, exif.Software); software != "" {
+		hints = append(hints, fmt.Sprintf("由 %s 生成", software))
+	}
+	if len(reasons) == 0 {
+		return "", false
+	}
+	return strings.Join(append(reasons, hints...), "，"), true
+}
+
+// handleScreenshot 按 screenshots.action 处理识别为截图的图片：复制到 folder 目录或跳过。
+// 原地模式下保持不变
+func handleScreenshot(filename string, data []byte, reason string) error {
+	if dryRun {
+		newPath := ""
+		if config.Screenshots.Action == "folder" && !config.InPlace {
+			newPath = filepath.Join(config.Screenshots.Folder, filename)
+		}
+		dryRunCopy("截图", filename, newPath, reason)
+		return nil
+	}
+	if config.Screenshots.Action == "skip" || config.InPlace {
+		log.Printf("【截图】%s：%s，已跳过", filename, reason)
+		addRecord(ImageRecord{Source: filename, Status: StatusScreenshot})
+		emitProgress(ProgressEvent{Type: FileDone, Filename: filename})
+		return nil
+	}
+
+	// 截图不多，目录在第一次用到时才创建，避免每次运行都留下一个空目录
+	if err := os.MkdirAll(config.Screenshots.Folder, os.ModePerm); err != nil {
+		return fmt.Errorf("创建目录 %s 失败: %v", config.Screenshots.Folder, err)
+	}
+	newPath := filepath.Join(config.Screenshots.Folder, filename)
+	if err := writeOutputFile(newPath, data); err != nil {
+		return fmt.Errorf("复制文件内容失败: %v", err)
+	}
+	log.Printf("【截图】%s：%s，已复制到 %s", filename, reason, newPath)
+	if config.MoveOriginals {
+		if err := moveOriginal(filename, newPath); err != nil {
+			log.Printf("%s: %v", filename, err)
+		}
+	}
+	addRecord(ImageRecord{Source: filename, Output: newPath, Status: StatusScreenshot})
+	emitProgress(ProgressEvent{Type: FileDone, Filename: filename, OutputPath: newPath})
+	return nil
+}
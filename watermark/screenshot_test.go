@@ -0,0 +1,42 @@
+package watermark
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestDetectScreenshot(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+	config.Screenshots.Resolutions = []string{"1179x2556"}
+
+	encode := func(w, h int) []byte {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	phone, custom := encode(1080, 1920), encode(2556, 1179)
+
+	tests := []struct {
+		name     string
+		filename string
+		data     []byte
+		want     bool
+	}{
+		// 没有 EXIF 的照片（聊天软件保存、扫描件）分辨率与屏幕相同，不能只凭分辨率当作截图
+		{"常见屏幕分辨率", "IMG_0001.png", phone, false},
+		{"截图文件名", "Screenshot_2024-01-31-10-20-30.png", phone, true},
+		{"配置的分辨率", "IMG_0002.png", custom, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, got := detectScreenshot(tt.filename, tt.data, emptyExif())
+			if got != tt.want {
+				t.Errorf("detectScreenshot = %v（%s），期望 %v", got, reason, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package watermark
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+	"sync"
+	"unicode"
+
+	"github.com/go-text/typesetting/di"
+	gofont "github.com/go-text/typesetting/font"
+	ot "github.com/go-text/typesetting/font/opentype"
+	"github.com/go-text/typesetting/shaping"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// freetype 的 DrawString 逐字查表绘制，不做字形变换和双向排序，
+// 阿拉伯文会变成一个个孤立的字母、希伯来文顺序颠倒、天城文的元音符号位置错误。
+// 含这些文字的片段改用 HarfBuzz（go-text/typesetting）整形，再按字形轮廓光栅化
+
+// complexScripts 是需要整形的文字
+var complexScripts = []*unicode.RangeTable{
+	unicode.Arabic, unicode.Hebrew, unicode.Syriac, unicode.Thaana, unicode.Nko,
+	unicode.Devanagari, unicode.Bengali, unicode.Gurmukhi, unicode.Gujarati, unicode.Oriya,
+	unicode.Tamil, unicode.Telugu, unicode.Kannada, unicode.Malayalam, unicode.Sinhala,
+	unicode.Thai, unicode.Lao, unicode.Tibetan, unicode.Myanmar, unicode.Khmer,
+}
+
+// rtlScripts 是从右到左书写的文字
+var rtlScripts = []*unicode.RangeTable{unicode.Arabic, unicode.Hebrew, unicode.Syriac, unicode.Thaana, unicode.Nko}
+
+var (
+	// go-text 的字体对象内部有缓存，不能并发使用，整形和读取轮廓时统一加锁
+	shapingMu    sync.Mutex
+	shapingFaces = map[string]*gofont.Face{}
+)
+
+// shapedText 是整形后的一段文字，字形已按从左到右的显示顺序排列
+type shapedText struct {
+	face   *gofont.Face
+	size   float64
+	glyphs []shapedGlyph
+	width  int
+}
+
+// shapedGlyph 是一个字形及其相对于片段起点（基线）的位置，单位为像素
+type shapedGlyph struct {
+	id   gofont.GID
+	x, y float64
+}
+
+// needsShaping 判断文字中是否含有需要整形的文字
+func needsShaping(text string) bool {
+	for _, r := range text {
+		if unicode.In(r, complexScripts...) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadShapingFace 加载用于整形的字体，按路径缓存，调用方需持有 shapingMu
+func loadShapingFace(path string) (*gofont.Face, error) {
+	if face, ok := shapingFaces[path]; ok {
+		return face, nil
+	}
+	data, err := readFontFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取字体文件失败: %v", err)
+	}
+	index, err := selectCollectionFace(path, data)
+	if err != nil {
+		return nil, err
+	}
+	faces, err := gofont.ParseTTC(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("解析字体 %s 失败: %v", path, err)
+	}
+	face := faces[min(index, len(faces)-1)]
+	shapingFaces[path] = face
+	return face, nil
+}
+
+// singleFace 让所有字符都使用同一个字体
+type singleFace struct{ face *gofont.Face }
+
+func (s singleFace) ResolveFace(rune) *gofont.Face { return s.face }
+
+// shapeText 用 fontPath 指定的字体把 text 整形为 size 像素的字形序列：
+// 先按双向算法和文字种类切分，逐段整形，再按 Unicode 双向规则排出显示顺序
+func shapeText(fontPath, text string, size float64) (*shapedText, error) {
+	shapingMu.Lock()
+	defer shapingMu.Unlock()
+
+	face, err := loadShapingFace(fontPath)
+	if err != nil {
+		return nil, err
+	}
+
+	runes := []rune(text)
+	dir := di.DirectionLTR
+	for _, r := range runes {
+		if unicode.In(r, rtlScripts...) {
+			dir = di.DirectionRTL
+			break
+		}
+		if unicode.IsLetter(r) {
+			break
+		}
+	}
+
+	input := shaping.Input{
+		Text:      runes,
+		RunStart:  0,
+		RunEnd:    len(runes),
+		Direction: dir,
+		Face:      face,
+		Size:      fixed.Int26_6(size * 64),
+	}
+	var segmenter shaping.Segmenter
+	var shaper shaping.HarfbuzzShaper
+	var outputs []shaping.Output
+	for _, in := range segmenter.Split(input, singleFace{face}) {
+		outputs = append(outputs, shaper.Shape(in))
+	}
+
+	// 与段落方向相反的连续片段整体倒序，段落从右到左时再把全部片段倒序
+	for i := 0; i < len(outputs); {
+		if outputs[i].Direction == dir {
+			i++
+			continue
+		}
+		j := i
+		for j < len(outputs) && outputs[j].Direction != dir {
+			j++
+		}
+		reverseOutputs(outputs[i:j])
+		i = j
+	}
+	if dir == di.DirectionRTL {
+		reverseOutputs(outputs)
+	}
+
+	st := &shapedText{face: face, size: size}
+	var pen fixed.Int26_6
+	for _, out := range outputs {
+		for _, g := range out.Glyphs {
+			st.glyphs = append(st.glyphs, shapedGlyph{
+				id: g.GlyphID,
+				x:  float64(pen+g.XOffset) / 64,
+				y:  -float64(g.YOffset) / 64,
+			})
+			pen += g.XAdvance
+		}
+	}
+	st.width = pen.Ceil()
+	return st, nil
+}
+
+// shapeSegments 对需要整形的文字片段整形，失败时记录日志并保留原样（按 freetype 逐字绘制）
+func shapeSegments(segments []textSegment, st lineStyle) []textSegment {
+	for i, seg := range segments {
+		fontPath := st.fontPath
+		if seg.fontPath != "" {
+			fontPath = seg.fontPath
+		}
+		if seg.emoji != nil || fontPath == "" || !needsShaping(seg.text) {
+			continue
+		}
+		shaped, err := shapeText(fontPath, seg.text, st.size)
+		if err != nil {
+			log.Printf("文字整形失败: %v", err)
+			continue
+		}
+		segments[i].shaped = shaped
+	}
+	return segments
+}
+
+func reverseOutputs(outputs []shaping.Output) {
+	for i, j := 0, len(outputs)-1; i < j; i, j = i+1, j-1 {
+		outputs[i], outputs[j] = outputs[j], outputs[i]
+	}
+}
+
+// draw 以 dot 为基线起点，用 src 把整形后的文字绘制到 dst 上
+func (st *shapedText) draw(dst draw.Image, src image.Image, dot image.Point) {
+	shapingMu.Lock()
+	defer shapingMu.Unlock()
+
+	// 光栅化区域上下各留一个字号，容纳上下伸部和附加符号
+	margin := int(st.size)
+	rect := image.Rect(dot.X-margin, dot.Y-2*margin, dot.X+st.width+margin, dot.Y+margin)
+	area := rect.Intersect(dst.Bounds())
+	if area.Empty() {
+		return
+	}
+
+	scale := float32(st.size) / float32(st.face.Upem())
+	r := vector.NewRasterizer(rect.Dx(), rect.Dy())
+	ox, oy := float32(dot.X-rect.Min.X), float32(dot.Y-rect.Min.Y)
+	for _, g := range st.glyphs {
+		outline, ok := st.face.GlyphData(g.id).(gofont.GlyphOutline)
+		if !ok {
+			continue
+		}
+		gx, gy := ox+float32(g.x), oy+float32(g.y)
+		// 字体坐标的 Y 轴向上，图片坐标的 Y 轴向下
+		pt := func(p ot.SegmentPoint) (float32, float32) { return gx + p.X*scale, gy - p.Y*scale }
+		for _, seg := range outline.Segments {
+			switch seg.Op {
+			case ot.SegmentOpMoveTo:
+				r.ClosePath()
+				r.MoveTo(pt(seg.Args[0]))
+			case ot.SegmentOpLineTo:
+				r.LineTo(pt(seg.Args[0]))
+			case ot.SegmentOpQuadTo:
+				x1, y1 := pt(seg.Args[0])
+				x2, y2 := pt(seg.Args[1])
+				r.QuadTo(x1, y1, x2, y2)
+			case ot.SegmentOpCubeTo:
+				x1, y1 := pt(seg.Args[0])
+				x2, y2 := pt(seg.Args[1])
+				x3, y3 := pt(seg.Args[2])
+				r.CubeTo(x1, y1, x2, y2, x3, y3)
+			}
+		}
+		r.ClosePath()
+	}
+	mask := image.NewAlpha(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	r.Draw(mask, mask.Bounds(), image.Opaque, image.Point{})
+	draw.DrawMask(dst, area, src, area.Min, mask, area.Min.Sub(rect.Min), draw.Over)
+}
@@ -0,0 +1,188 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Lightroom、darktable 等软件把修改过的拍摄时间、补上的 GPS 和图片说明写在 XMP 附属文件里，
+// 不改动原图。处理照片时读取 photo.jpg.xmp 或 photo.xmp，按 readXMPSidecar 的设置
+// 在 EXIF 缺少这些信息时补上（fallback），或者优先使用附属文件中的值（override）
+
+// inputSidecar 是从照片的 XMP 附属文件中读到的信息
+type inputSidecar struct {
+	path        string
+	time        time.Time // 拍摄时间，没有时为零值
+	lat, long   float64
+	hasGPS      bool
+	description string
+	tags        photoTags
+}
+
+// validateReadXMPSidecar 检查 readXMPSidecar 的取值
+func validateReadXMPSidecar() error {
+	switch config.ReadXMPSidecar {
+	case "", "off", "fallback", "override":
+		return nil
+	default:
+		return fmt.Errorf("readXMPSidecar 的取值 %q 无效，可选 off、fallback、override", config.ReadXMPSidecar)
+	}
+}
+
+// useSidecar 判断是否使用附属文件中的值：override 时总是使用，fallback 时只在 EXIF 中没有时使用
+func (s *inputSidecar) useSidecar(exifOK bool) bool {
+	return config.ReadXMPSidecar == "override" || !exifOK
+}
+
+// readInputSidecar 读取照片的 XMP 附属文件，没有附属文件或未开启时返回 nil
+func readInputSidecar(filename string) *inputSidecar {
+	if config.ReadXMPSidecar == "" || config.ReadXMPSidecar == "off" {
+		return nil
+	}
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	for _, path := range []string{filename + ".xmp", filename + ".XMP", base + ".xmp", base + ".XMP"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		s, err := parseInputSidecar(data)
+		if err != nil {
+			log.Printf("解析 XMP 附属文件 %s 失败: %v", path, err)
+			return nil
+		}
+		s.path = path
+		return s
+	}
+	return nil
+}
+
+// parseInputSidecar 从 XMP 中读取拍摄时间、GPS 坐标、图片说明、评分和关键词
+func parseInputSidecar(data []byte) (*inputSidecar, error) {
+	values, lists, err := parseXMP(data)
+	if err != nil {
+		return nil, err
+	}
+	s := &inputSidecar{description: values["description"], tags: xmpTags(values, lists)}
+	for _, name := range []string{"DateTimeOriginal", "DateCreated", "CreateDate"} {
+		if t, ok := parseXMPDate(values[name]); ok {
+			s.time = t
+			break
+		}
+	}
+	lat, ok1 := parseXMPCoordinate(values["GPSLatitude"])
+	long, ok2 := parseXMPCoordinate(values["GPSLongitude"])
+	if ok1 && ok2 {
+		s.lat, s.long, s.hasGPS = lat, long, true
+	}
+	return s, nil
+}
+
+// parseXMP 按本地名称读取 XMP 中的属性。XMP 的属性既可以写成 rdf:Description 的属性，
+// 也可以写成子元素，两种写法都能读到；values 中为第一个值，lists 中为 rdf:Bag 等列表的全部值
+func parseXMP(data []byte) (values map[string]string, lists map[string][]string, err error) {
+	values, lists = map[string]string{}, map[string][]string{}
+	set := func(name, value string) {
+		if value = strings.TrimSpace(value); value == "" {
+			return
+		}
+		if values[name] == "" {
+			values[name] = value
+		}
+		lists[name] = append(lists[name], value)
+	}
+
+	// stack 记录当前所在的非 rdf 元素，dc:description 的文字在 rdf:Alt/rdf:li 中，归到 description
+	var stack []string
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			for _, a := range t.Attr {
+				set(a.Name.Local, a.Value)
+			}
+			if t.Name.Space == "http://www.w3.org/1999/02/22-rdf-syntax-ns#" && len(stack) > 0 {
+				stack = append(stack, stack[len(stack)-1])
+			} else {
+				stack = append(stack, t.Name.Local)
+			}
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				set(stack[len(stack)-1], string(t))
+			}
+		}
+	}
+	return values, lists, nil
+}
+
+// parseXMPDate 解析 XMP 的日期，如 2024-01-31T10:20:30.12+08:00。
+// 带 UTC 偏移时保留偏移，否则与 EXIF 的拍摄时间一致，作为本地时间
+func parseXMPDate(s string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02T15:04:05.999999999Z07:00", "2006-01-02T15:04Z07:00"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05.999999999", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseXMPCoordinate 解析 XMP 的 GPS 坐标，格式为 “度,分N” 或 “度,分,秒N”，如 30,15.3833N；
+// 也接受带符号的十进制度数
+func parseXMPCoordinate(s string) (float64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	sign := 1.0
+	switch s[len(s)-1] {
+	case 'N', 'E', 'n', 'e':
+		s = s[:len(s)-1]
+	case 'S', 'W', 's', 'w':
+		s, sign = s[:len(s)-1], -1
+	}
+	var v float64
+	for i, part := range strings.Split(s, ",") {
+		if i > 2 {
+			return 0, false
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return 0, false
+		}
+		v += f / [...]float64{1, 60, 3600}[i]
+	}
+	return sign * v, true
+}
+
+// emptyExif 返回不含任何信息的 EXIF，原图没有 EXIF 但附属文件中有拍摄时间时使用
+func emptyExif() *exif.Exif {
+	x, err := exif.Decode(bytes.NewReader(minimalExif()[len(exifHeader):]))
+	if err != nil {
+		panic(err)
+	}
+	return x
+}
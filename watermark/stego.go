@@ -0,0 +1,182 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"log"
+	"os"
+	"time"
+)
+
+// 隐写水印把一段 JSON 写进像素红、绿、蓝通道的最低位，每个像素 3 位，按行依次写入，肉眼不可见。
+// 数据格式：4 字节标记 + 4 字节长度 + JSON + 4 字节 CRC32，长度和 CRC32 均为大端序。
+// 最低位会被有损压缩破坏，因此只支持 png 和无损的 webp（webpQuality 为 0）输出
+
+var stegoMagic = []byte("WMK1")
+
+// StegoPayload 是隐写水印中记录的信息
+type StegoPayload struct {
+	Owner    string    `json:"owner,omitempty"` // 配置中的 stego.owner
+	Filename string    `json:"file"`            // 原图文件名
+	Taken    time.Time `json:"taken"`           // 拍摄时间
+	Embedded time.Time `json:"embedded"`        // 写入水印的时间
+}
+
+// validateStego 检查隐写水印的配置，JPEG 和有损 WebP 输出无法保留隐写的数据
+func validateStego() error {
+	lossy := outputFormat() == "jpeg" || outputFormat() == "webp" && config.WebPQuality > 0
+	if config.Stego.Enabled && lossy {
+		return fmt.Errorf("隐写水印需要无损的输出格式，请把 outputFormat 改为 png，或改为 webp 并把 webpQuality 设为 0")
+	}
+	return nil
+}
+
+// stegoPayload 生成一张照片要写入的隐写数据，未启用时返回 nil
+func stegoPayload(info *PhotoInfo) ([]byte, error) {
+	if !config.Stego.Enabled {
+		return nil, nil
+	}
+	data, err := json.Marshal(StegoPayload{
+		Owner:    config.Stego.Owner,
+		Filename: info.Filename,
+		Taken:    info.Time,
+		Embedded: time.Now().Truncate(time.Second),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("生成隐写数据失败: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(stegoMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(data))
+	return buf.Bytes(), nil
+}
+
+// embedStego 返回写入了 wm.stego 的图片，没有隐写数据或图片太小时返回原图
+func embedStego(img image.Image, wm *watermark) image.Image {
+	if len(wm.stego) == 0 {
+		return img
+	}
+	b := img.Bounds()
+	if len(wm.stego)*8 > b.Dx()*b.Dy()*3 {
+		log.Printf("图片尺寸 %dx%d 太小，无法写入隐写水印", b.Dx(), b.Dy())
+		return img
+	}
+	return &stegoImage{base: img, data: wm.stego}
+}
+
+// stegoImage 在读取像素时改写最低位，不复制整张图片
+type stegoImage struct {
+	base image.Image
+	data []byte
+}
+
+func (s *stegoImage) ColorModel() color.Model { return color.NRGBAModel }
+
+func (s *stegoImage) Bounds() image.Rectangle { return s.base.Bounds() }
+
+func (s *stegoImage) At(x, y int) color.Color {
+	c := color.NRGBAModel.Convert(s.base.At(x, y)).(color.NRGBA)
+	b := s.base.Bounds()
+	bit := ((y-b.Min.Y)*b.Dx() + (x - b.Min.X)) * 3
+	if bit >= len(s.data)*8 {
+		return c
+	}
+	channels := [3]*uint8{&c.R, &c.G, &c.B}
+	for i, ch := range channels {
+		if n := bit + i; n < len(s.data)*8 {
+			*ch = *ch&^1 | s.data[n/8]>>(7-n%8)&1
+		}
+	}
+	return c
+}
+
+// extractStego 从图片中读出隐写数据，没有隐写水印或数据损坏时返回错误
+func extractStego(img image.Image) (*StegoPayload, error) {
+	b := img.Bounds()
+	capacity := b.Dx() * b.Dy() * 3 / 8
+	read := func(offset, n int) ([]byte, error) {
+		if offset+n > capacity {
+			return nil, fmt.Errorf("图片中的数据不完整")
+		}
+		out := make([]byte, n)
+		for i := range n * 8 {
+			bit := offset*8 + i
+			p := bit / 3
+			r, g, bl, _ := img.At(b.Min.X+p%b.Dx(), b.Min.Y+p/b.Dx()).RGBA()
+			v := [3]uint32{r, g, bl}[bit%3] >> 8 & 1
+			out[i/8] |= byte(v) << (7 - i%8)
+		}
+		return out, nil
+	}
+
+	header, err := read(0, 8)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:4], stegoMagic) {
+		return nil, fmt.Errorf("没有找到隐写水印")
+	}
+	size := int(binary.BigEndian.Uint32(header[4:]))
+	body, err := read(8, size+4)
+	if err != nil {
+		return nil, err
+	}
+	data := body[:size]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(body[size:]) {
+		return nil, fmt.Errorf("隐写数据校验失败，图片可能被修改或重新压缩过")
+	}
+
+	var payload StegoPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, fmt.Errorf("解析隐写数据失败: %v", err)
+	}
+	return &payload, nil
+}
+
+// RunVerify 实现 verify 子命令：读出每个文件中的隐写水印并打印，有文件读取失败时返回非零退出码
+func RunVerify(files []string) int {
+	if len(files) == 0 {
+		fmt.Println("用法: jpg-watermark-cli verify 图片文件...")
+		return 2
+	}
+	status := 0
+	for _, name := range files {
+		img, err := decodeImageFile(name)
+		if err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		payload, err := extractStego(img)
+		if err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: 作者 %s，原图 %s，拍摄于 %s，写入于 %s\n", name, payload.Owner, payload.Filename,
+			payload.Taken.Format("2006-01-02 15:04:05"), payload.Embedded.Format("2006-01-02 15:04:05"))
+	}
+	return status
+}
+
+// decodeImageFile 解码 verify、detect 子命令要检查的图片
+func decodeImageFile(name string) (image.Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("解码图片失败: %v", err)
+	}
+	return img, nil
+}
@@ -0,0 +1,100 @@
+package watermark
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// testPhoto 生成一张带渐变和噪点的测试图片，起点为 min
+func testPhoto(min image.Point, w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(min.X, min.Y, min.X+w, min.Y+h))
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			n := uint8((x*7 + y*13) % 17)
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x*3) + n, uint8(y*5) + n, uint8(x+y) + n, 255})
+		}
+	}
+	return img
+}
+
+// encodeDecode 把图片按 format 编码后再解码，模拟保存到文件再读出
+func encodeDecode(t *testing.T, img image.Image, format string) image.Image {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		t.Fatalf("编码 %s 失败: %v", format, err)
+	}
+	out, _, err := image.Decode(&buf)
+	if err != nil {
+		t.Fatalf("解码 %s 失败: %v", format, err)
+	}
+	return out
+}
+
+func TestStegoRoundTrip(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+	config.Stego.Enabled = true
+	config.Stego.Owner = "张三 <zhangsan@example.com>"
+
+	info := &PhotoInfo{Filename: "IMG_0001.jpg", Time: time.Date(2024, 1, 31, 10, 20, 30, 0, time.UTC)}
+	payload, err := stegoPayload(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wm := &watermark{stego: payload}
+
+	tests := []struct {
+		name    string
+		img     *image.NRGBA
+		format  string
+		wantErr bool
+	}{
+		{"png", testPhoto(image.Point{}, 64, 48), "png", false},
+		{"起点不为 0", testPhoto(image.Pt(5, 7), 64, 48), "", false},
+		{"单列", testPhoto(image.Point{}, 1, 2000), "png", false},
+		{"jpeg 压缩后无法读出", testPhoto(image.Point{}, 64, 48), "jpeg", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out image.Image = embedStego(tt.img, wm)
+			if tt.format != "" {
+				out = encodeDecode(t, out, tt.format)
+			}
+			got, err := extractStego(out)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("extractStego 应当失败，得到 %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractStego 失败: %v", err)
+			}
+			if got.Owner != config.Stego.Owner || got.Filename != info.Filename || !got.Taken.Equal(info.Time) || got.Embedded.IsZero() {
+				t.Errorf("读出的数据为 %+v，期望 Owner=%q Filename=%q Taken=%v", got, config.Stego.Owner, info.Filename, info.Time)
+			}
+		})
+	}
+}
+
+func TestStegoUnmarked(t *testing.T) {
+	if _, err := extractStego(testPhoto(image.Point{}, 64, 48)); err == nil {
+		t.Error("没有隐写水印的图片应当返回错误")
+	}
+	// 太小的图片不写入，原样返回
+	small := testPhoto(image.Point{}, 4, 4)
+	if got := embedStego(small, &watermark{stego: make([]byte, 100)}); got != image.Image(small) {
+		t.Error("图片容量不足时应当返回原图")
+	}
+}
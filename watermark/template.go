@@ -0,0 +1,308 @@
+package watermark
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/mknote"
+)
+
+var (
+	watermarkTemplate  *template.Template
+	frameLeftTemplate  *template.Template
+	frameRightTemplate *template.Template
+	polaroidTemplate   *template.Template
+	qrCodeTemplate     *template.Template
+	blockTemplates     []*template.Template // 与 config.Watermarks 一一对应
+)
+
+var templateFuncs = template.FuncMap{
+	// date 按 Go 的时间格式输出，例如 {{date "2006年01月02日" .Time}}
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	// join 用分隔符连接列表，例如 {{join .Keywords " · "}}
+	"join": strings.Join,
+}
+
+// compileWatermarkTemplate 解析水印模板和边框模板，模板有误时程序启动即报错
+func compileWatermarkTemplate() error {
+	text := config.WatermarkTemplate
+	if text == "" {
+		text = "{{.Date}}\n{{.Address}}"
+	}
+	var err error
+	if watermarkTemplate, err = parseTemplate("watermark", text); err != nil {
+		return fmt.Errorf("解析水印模板失败: %v", err)
+	}
+	if frameLeftTemplate, err = parseTemplate("frameLeft", config.Frame.LeftTemplate); err != nil {
+		return fmt.Errorf("解析边框左侧模板失败: %v", err)
+	}
+	if frameRightTemplate, err = parseTemplate("frameRight", config.Frame.RightTemplate); err != nil {
+		return fmt.Errorf("解析边框右侧模板失败: %v", err)
+	}
+	if polaroidTemplate, err = parseTemplate("polaroid", config.Polaroid.Template); err != nil {
+		return fmt.Errorf("解析拍立得文字模板失败: %v", err)
+	}
+	if qrCodeTemplate, err = parseTemplate("qrCode", config.QRCode.Content); err != nil {
+		return fmt.Errorf("解析二维码内容模板失败: %v", err)
+	}
+	blockTemplates = nil
+	for i, block := range config.Watermarks {
+		t, err := parseTemplate(fmt.Sprintf("watermarks[%d]", i), block.Template)
+		if err != nil {
+			return fmt.Errorf("解析第 %d 个水印块的模板失败: %v", i+1, err)
+		}
+		blockTemplates = append(blockTemplates, t)
+	}
+	return nil
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// renderWatermarkText 用照片信息渲染水印文字，去掉末尾的空行
+func renderWatermarkText(info *PhotoInfo) (string, error) {
+	text, err := executeTemplate(watermarkTemplate, info)
+	if err != nil {
+		return "", fmt.Errorf("渲染水印模板失败: %v", err)
+	}
+	if config.Caption != "" {
+		text = strings.TrimRight(text, "\n")
+		if text != "" {
+			text += "\n"
+		}
+		text += config.Caption
+	}
+	if text == "" {
+		text = " "
+	}
+	return text, nil
+}
+
+// renderBlockTexts 渲染 watermarks 中每个水印块的文字
+func renderBlockTexts(info *PhotoInfo) ([]string, error) {
+	texts := make([]string, len(blockTemplates))
+	for i, t := range blockTemplates {
+		text, err := executeTemplate(t, info)
+		if err != nil {
+			return nil, fmt.Errorf("渲染第 %d 个水印块的模板失败: %v", i+1, err)
+		}
+		texts[i] = text
+	}
+	return texts, nil
+}
+
+// renderFrameText 渲染边框左右两侧的文字
+func renderFrameText(info *PhotoInfo) (left, right string, err error) {
+	if left, err = executeTemplate(frameLeftTemplate, info); err != nil {
+		return "", "", fmt.Errorf("渲染边框模板失败: %v", err)
+	}
+	if right, err = executeTemplate(frameRightTemplate, info); err != nil {
+		return "", "", fmt.Errorf("渲染边框模板失败: %v", err)
+	}
+	return left, right, nil
+}
+
+// renderPolaroidText 渲染拍立得相纸底部的文字
+func renderPolaroidText(info *PhotoInfo) (string, error) {
+	text, err := executeTemplate(polaroidTemplate, info)
+	if err != nil {
+		return "", fmt.Errorf("渲染拍立得文字模板失败: %v", err)
+	}
+	return text, nil
+}
+
+func executeTemplate(t *template.Template, info *PhotoInfo) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, info); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(b.String(), " \n"), nil
+}
+
+// Date 返回默认格式的拍摄时间，开启 showSubSeconds 时带毫秒，开启 showUTCOffset 且时区确定时带 UTC 偏移
+func (p *PhotoInfo) Date() string {
+	layout := "2006-01-02 15:04:05"
+	if config.ShowSubSeconds {
+		layout += ".000"
+	}
+	date := p.Time.Format(layout)
+	if config.ShowUTCOffset && p.UTCOffset != "" {
+		date += " " + p.UTCOffset
+	}
+	return date
+}
+
+// Camera 返回相机厂商和型号
+func (p *PhotoInfo) Camera() string {
+	return cameraName(p.Make, p.Model)
+}
+
+// Coordinates 返回十进制度数的坐标，保留 6 位小数（约 0.1 米），如 30.256389, 120.158889；没有 GPS 时为空
+func (p *PhotoInfo) Coordinates() string {
+	if !p.HasGPS {
+		return ""
+	}
+	return fmt.Sprintf("%.6f, %.6f", p.Latitude, p.Longitude)
+}
+
+// CoordinatesDMS 返回度分秒格式的坐标，秒取整，如 30°15'23"N 120°09'32"E；没有 GPS 时为空
+func (p *PhotoInfo) CoordinatesDMS() string {
+	if !p.HasGPS {
+		return ""
+	}
+	return formatDMS(p.Latitude, "N", "S") + " " + formatDMS(p.Longitude, "E", "W")
+}
+
+// Stars 返回星级评分，如 ★★★★☆；没有评分或已拒绝时为空
+func (p *PhotoInfo) Stars() string {
+	if p.Rating <= 0 {
+		return ""
+	}
+	r := min(p.Rating, 5)
+	return strings.Repeat("★", r) + strings.Repeat("☆", 5-r)
+}
+
+// formatDMS 把十进制度数换算为度分秒，正数用 pos 表示方向，负数用 neg
+func formatDMS(v float64, pos, neg string) string {
+	dir := pos
+	if v < 0 {
+		v, dir = -v, neg
+	}
+	// 先按秒取整再拆分，避免出现 60 秒
+	total := int(math.Round(v * 3600))
+	return fmt.Sprintf("%d°%02d'%02d\"%s", total/3600, total/60%60, total%60, dir)
+}
+
+// readExposureInfo 读取光圈、快门、ISO、焦距，格式化成适合印在照片上的文字
+func readExposureInfo(x *exif.Exif, info *PhotoInfo) {
+	if r, ok := exifRat(x, exif.FNumber); ok {
+		f, _ := r.Float64()
+		info.FNumber = "f/" + trimFloat(f, 1)
+	}
+	if r, ok := exifRat(x, exif.ExposureTime); ok {
+		f, _ := r.Float64()
+		switch {
+		case f >= 1:
+			info.ExposureTime = trimFloat(f, 1) + "s"
+		case f > 0:
+			info.ExposureTime = fmt.Sprintf("1/%.0fs", 1/f)
+		}
+	}
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		if v, err := tag.Int(0); err == nil {
+			info.ISO = fmt.Sprintf("ISO%d", v)
+		}
+	}
+	if r, ok := exifRat(x, exif.FocalLength); ok {
+		f, _ := r.Float64()
+		info.FocalLength = trimFloat(f, 1) + "mm"
+	}
+	readLensInfo(x, info)
+	readMakerNote(x, info)
+}
+
+// readLensInfo 读取镜头型号。较老的机身不写 LensModel，这时再从佳能、尼康的 MakerNote 中查找：
+// 佳能直接记录镜头名称，尼康只记录焦距和光圈范围，格式化成 24-70mm f/2.8
+func readLensInfo(x *exif.Exif, info *PhotoInfo) {
+	info.LensMake = exifString(x, exif.LensMake)
+	if info.Lens = exifString(x, exif.LensModel); info.Lens != "" {
+		return
+	}
+
+	// MakerNote 只在需要时解析，格式损坏时忽略，不影响其他信息
+	m, err := x.Get(exif.MakerNote)
+	if err != nil || len(m.Val) < 10 {
+		return
+	}
+	mknote.Canon.Parse(x)
+	mknote.NikonV3.Parse(x)
+	if lens := exifString(x, mknote.LensModel); lens != "" {
+		info.Lens = lens
+		return
+	}
+	tag, err := x.Get(mknote.Lens)
+	if err != nil || tag.Count < 4 {
+		return
+	}
+	var v [4]float64
+	for i := range v {
+		r, err := tag.Rat(i)
+		if err != nil {
+			return
+		}
+		v[i], _ = r.Float64()
+	}
+	if v[0] <= 0 {
+		return
+	}
+	focal := trimFloat(v[0], 1)
+	if v[1] > v[0] {
+		focal += "-" + trimFloat(v[1], 1)
+	}
+	aperture := trimFloat(v[2], 1)
+	if v[3] > v[2] {
+		aperture += "-" + trimFloat(v[3], 1)
+	}
+	info.Lens = fmt.Sprintf("%smm f/%s", focal, aperture)
+}
+
+// compassPoints 是八个方位的名称，从正北开始顺时针排列
+var compassPoints = []string{"北", "东北", "东", "东南", "南", "西南", "西", "西北"}
+
+// readGPSInfo 读取 GPS 中除经纬度以外的信息：拍摄朝向、海拔
+func readGPSInfo(x *exif.Exif, info *PhotoInfo) {
+	if tag, err := x.Get(exif.GPSAltitude); err == nil {
+		if r, err := tag.Rat(0); err == nil && r.Sign() >= 0 {
+			alt, _ := r.Float64()
+			// GPSAltitudeRef 为 1 表示海平面以下
+			if tag, err := x.Get(exif.GPSAltitudeRef); err == nil {
+				if ref, err := tag.Int(0); err == nil && ref == 1 {
+					alt = -alt
+				}
+			}
+			info.Altitude = fmt.Sprintf("%.0fm", alt)
+		}
+	}
+
+	// 朝向可以为 0（正北），不能用 exifRat
+	if tag, err := x.Get(exif.GPSImgDirection); err == nil {
+		if r, err := tag.Rat(0); err == nil && r.Sign() >= 0 {
+			deg, _ := r.Float64()
+			deg = math.Mod(deg, 360)
+			info.Heading = fmt.Sprintf("%s %.0f°", compassPoints[int(math.Round(deg/45))%8], deg)
+			// 参考方向为磁北（M）时注明，默认为真北（T）
+			if ref := exifString(x, exif.GPSImgDirectionRef); strings.EqualFold(ref, "M") {
+				info.Heading += "（磁北）"
+			}
+		}
+	}
+}
+
+func exifRat(x *exif.Exif, field exif.FieldName) (*big.Rat, bool) {
+	tag, err := x.Get(field)
+	if err != nil {
+		return nil, false
+	}
+	r, err := tag.Rat(0)
+	if err != nil || r.Sign() <= 0 {
+		return nil, false
+	}
+	return r, true
+}
+
+// trimFloat 按指定小数位格式化，并去掉末尾多余的 0
+func trimFloat(f float64, prec int) string {
+	s := fmt.Sprintf("%.*f", prec, f)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
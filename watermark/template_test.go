@@ -0,0 +1,25 @@
+package watermark
+
+import "testing"
+
+func TestFormatDMS(t *testing.T) {
+	tests := []struct {
+		v        float64
+		pos, neg string
+		want     string
+	}{
+		{30.256389, "N", "S", `30°15'23"N`},
+		{120.158889, "E", "W", `120°09'32"E`},
+		{-33.856784, "N", "S", `33°51'24"S`},
+		{-0.5, "E", "W", `0°30'00"W`},
+		{0, "N", "S", `0°00'00"N`},
+		// 59.9999 秒按秒取整后进位，不出现 60 秒
+		{10.999999, "N", "S", `11°00'00"N`},
+		{45.5 + 59.6/3600, "N", "S", `45°31'00"N`},
+	}
+	for _, tt := range tests {
+		if got := formatDMS(tt.v, tt.pos, tt.neg); got != tt.want {
+			t.Errorf("formatDMS(%v, %q, %q) = %s，期望 %s", tt.v, tt.pos, tt.neg, got, tt.want)
+		}
+	}
+}
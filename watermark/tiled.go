@@ -0,0 +1,319 @@
+package watermark
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+)
+
+// 超大 JPEG（全景、扫描件）的分块处理：整张解码需要每像素 4 字节以上的内存，几亿像素的图片容易耗尽内存。
+// 分块处理时先只用每个 8x8 块的 DC 系数得到 1/8 大小的预览图，在预览图上确定水印位置、统计直方图；
+// 再只解码水印覆盖的那一块区域，绘制后重新编码有变化的块，其余块的量化系数原样复制
+
+// tiledStream 判断图片是否需要分块处理，需要且能够分块时返回解析出的 JPEG 数据，否则返回 nil
+func tiledStream(filename string, data []byte, wms []*watermark, orientation int) *jpegStream {
+	if config.TiledThresholdMP <= 0 {
+		return nil
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width*cfg.Height <= config.TiledThresholdMP*1000000 {
+		return nil
+	}
+
+	var reason string
+	switch {
+	case outputFormat() != "jpeg":
+		reason = "输出格式不是 JPEG"
+	case framedStyle():
+		reason = "使用了边框样式"
+	case orientation > 1:
+		reason = "需要按 EXIF 方向旋转"
+	case config.MaxOutputDimension > 0 && max(cfg.Width, cfg.Height) > config.MaxOutputDimension:
+		reason = "需要缩小到 maxOutputDimension"
+	case config.RobustWatermark.Enabled:
+		reason = "开启了稳健水印"
+	case len(wms[0].stego) > 0:
+		reason = "开启了隐写水印"
+	}
+	if reason == "" {
+		s, err := parseJPEGStream(data)
+		if err == nil {
+			return s
+		}
+		reason = err.Error()
+	}
+	log.Printf("%s 超过 %d 百万像素，无法分块处理（%s），整张解码", filename, config.TiledThresholdMP, reason)
+	return nil
+}
+
+// renderAndSaveTiled 分块绘制水印并保存，网页版和 EXIF 缩略图由 1/8 大小的预览图生成
+func renderAndSaveTiled(s *jpegStream, filename string, data []byte, outputPath string, wms []*watermark) error {
+	preview, err := s.thumbnail()
+	if err != nil {
+		return fmt.Errorf("解码预览图失败: %v", err)
+	}
+	placeWatermarks(preview, wms, filename)
+
+	bounds := image.Rect(0, 0, s.width, s.height)
+	tile, err := s.decodeTile(watermarkArea(bounds, wms))
+	if err != nil {
+		return fmt.Errorf("解码水印区域失败: %v", err)
+	}
+	tile.draw(func(dst *image.RGBA) { drawWatermark(dst, bounds, wms) })
+	var buf bytes.Buffer
+	if err := s.encode(&buf, tile); err != nil {
+		return fmt.Errorf("编码图片失败: %v", err)
+	}
+	out := buf.Bytes()
+	log.Printf("%s 分块处理：重新编码 %d 个 MCU，其余保持原样", filename, tile.changedCount())
+
+	watermarkedPreview := addWatermark(preview, wms)
+	app1, err := outputExif(watermarkedPreview, data, outputPath)
+	if err != nil {
+		return err
+	}
+	if app1 != nil {
+		out = insertExifSegment(out, app1)
+	}
+	if err := writeOutputFile(outputPath, out); err != nil {
+		return err
+	}
+	return saveWebCopy(watermarkedPreview, outputPath)
+}
+
+// watermarkArea 返回所有水印块、标志、二维码、小地图和直方图合起来可能覆盖的区域
+func watermarkArea(bounds image.Rectangle, wms []*watermark) image.Rectangle {
+	_, area := logoLayout(bounds)
+	for _, r := range []image.Rectangle{qrCodeRect(bounds, wms[0]), miniMapRect(bounds, wms[0]), histogramRect(bounds, wms[0])} {
+		area = area.Union(r)
+	}
+	for _, wm := range wms {
+		area = area.Union(watermarkRegion(bounds, wm))
+	}
+	return area.Intersect(bounds)
+}
+
+// thumbnail 只解码每个块的 DC 系数，返回 1/8 大小的图片，一个像素对应原图的一个 8x8 块
+func (s *jpegStream) thumbnail() (image.Image, error) {
+	r := image.Rect(0, 0, (s.width+7)/8, (s.height+7)/8)
+	var planes [3][]byte
+	var strides [3]int
+	var img image.Image
+	if len(s.comps) == 1 {
+		g := image.NewGray(r)
+		planes[0], strides[0], img = g.Pix, g.Stride, g
+	} else {
+		y := image.NewYCbCr(r, s.ratio)
+		planes = [3][]byte{y.Y, y.Cb, y.Cr}
+		strides = [3]int{y.YStride, y.CStride, y.CStride}
+		img = y
+	}
+	err := s.scanBlocks(func(c, bx, by int, blk *[64]int32) error {
+		if bx >= strides[c] || (by+1)*strides[c] > len(planes[c]) {
+			return nil
+		}
+		// DC 系数是块内采样值减去 128 后平均值的 8 倍
+		dc := float64(blk[0]) * float64(s.quant[s.comps[c].tq][0])
+		planes[c][by*strides[c]+bx] = clampByte(dc/8 + 128)
+		return nil
+	})
+	return img, err
+}
+
+// jpegTile 是解码出的一块按 MCU 对齐的区域，各分量的采样值按分量自己的分辨率存放
+type jpegTile struct {
+	mx0, my0, mx1, my1 int // 覆盖的 MCU 范围，不含 mx1、my1
+	planes             []tilePlane
+	changed            []bool // 绘制水印后有变化的 MCU，需要重新编码
+	stream             *jpegStream
+}
+
+// tilePlane 是一个分量的采样值，x0、y0 为左上角在该分量中的坐标
+type tilePlane struct {
+	pix    []byte
+	stride int
+	x0, y0 int
+}
+
+// decodeTile 解码覆盖 area 的所有 MCU
+func (s *jpegStream) decodeTile(area image.Rectangle) (*jpegTile, error) {
+	mw, mh := s.mcuSize()
+	t := &jpegTile{
+		mx0:    area.Min.X / mw,
+		my0:    area.Min.Y / mh,
+		mx1:    (area.Max.X + mw - 1) / mw,
+		my1:    (area.Max.Y + mh - 1) / mh,
+		stream: s,
+	}
+	if area.Empty() {
+		t.mx1, t.my1 = t.mx0, t.my0
+	}
+	for _, c := range s.comps {
+		w, h := (t.mx1-t.mx0)*c.h*8, (t.my1-t.my0)*c.v*8
+		t.planes = append(t.planes, tilePlane{pix: make([]byte, w*h), stride: w, x0: t.mx0 * c.h * 8, y0: t.my0 * c.v * 8})
+	}
+	t.changed = make([]bool, (t.mx1-t.mx0)*(t.my1-t.my0))
+
+	err := s.scanBlocks(func(c, bx, by int, blk *[64]int32) error {
+		if !t.contains(c, bx, by) {
+			return nil
+		}
+		p := &t.planes[c]
+		idctBlock(blk, &s.quant[s.comps[c].tq], p.pix[(by*8-p.y0)*p.stride+bx*8-p.x0:], p.stride)
+		return nil
+	})
+	return t, err
+}
+
+// contains 判断分量 c 的块 (bx, by) 是否在这块区域中
+func (t *jpegTile) contains(c, bx, by int) bool {
+	comp := t.stream.comps[c]
+	mx, my := bx/comp.h, by/comp.v
+	return mx >= t.mx0 && mx < t.mx1 && my >= t.my0 && my < t.my1
+}
+
+// isChanged 判断分量 c 的块 (bx, by) 所在的 MCU 是否需要重新编码
+func (t *jpegTile) isChanged(c, bx, by int) bool {
+	if !t.contains(c, bx, by) {
+		return false
+	}
+	comp := t.stream.comps[c]
+	return t.changed[(by/comp.v-t.my0)*(t.mx1-t.mx0)+bx/comp.h-t.mx0]
+}
+
+func (t *jpegTile) changedCount() int {
+	n := 0
+	for _, c := range t.changed {
+		if c {
+			n++
+		}
+	}
+	return n
+}
+
+// pixelRect 返回这块区域在图片中的像素范围（不超出图片）
+func (t *jpegTile) pixelRect() image.Rectangle {
+	mw, mh := t.stream.mcuSize()
+	r := image.Rect(t.mx0*mw, t.my0*mh, t.mx1*mw, t.my1*mh)
+	return r.Intersect(image.Rect(0, 0, t.stream.width, t.stream.height))
+}
+
+// image 返回这块区域的图片，与各分量的采样值共用内存
+func (t *jpegTile) image() image.Image {
+	s := t.stream
+	mw, mh := s.mcuSize()
+	r := image.Rect(t.mx0*mw, t.my0*mh, t.mx1*mw, t.my1*mh)
+	if len(s.comps) == 1 {
+		return &image.Gray{Pix: t.planes[0].pix, Stride: t.planes[0].stride, Rect: r}
+	}
+	return &image.YCbCr{
+		Y: t.planes[0].pix, Cb: t.planes[1].pix, Cr: t.planes[2].pix,
+		YStride: t.planes[0].stride, CStride: t.planes[1].stride,
+		SubsampleRatio: s.ratio,
+		Rect:           r,
+	}
+}
+
+// draw 用 paint 在这块区域上绘制，把有变化的 MCU 换算回各分量的采样值并标记为需要重新编码
+func (t *jpegTile) draw(paint func(dst *image.RGBA)) {
+	r := t.pixelRect()
+	if r.Empty() {
+		return
+	}
+	rgba := image.NewRGBA(r)
+	draw.Draw(rgba, r, t.image(), r.Min, draw.Src)
+	before := bytes.Clone(rgba.Pix)
+	paint(rgba)
+
+	s := t.stream
+	mw, mh := s.mcuSize()
+	for my := t.my0; my < t.my1; my++ {
+		for mx := t.mx0; mx < t.mx1; mx++ {
+			mcu := image.Rect(mx*mw, my*mh, (mx+1)*mw, (my+1)*mh).Intersect(r)
+			if !pixelsDiffer(rgba, before, mcu) {
+				continue
+			}
+			t.changed[(my-t.my0)*(t.mx1-t.mx0)+mx-t.mx0] = true
+			t.store(rgba, mcu)
+		}
+	}
+}
+
+// pixelsDiffer 判断 rgba 在 r 中的像素与绘制前的 before 是否不同
+func pixelsDiffer(rgba *image.RGBA, before []byte, r image.Rectangle) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := rgba.PixOffset(r.Min.X, y)
+		if !bytes.Equal(rgba.Pix[i:i+4*r.Dx()], before[i:i+4*r.Dx()]) {
+			return true
+		}
+	}
+	return false
+}
+
+// store 把 rgba 在 r（一个 MCU 中图片内的部分）中的像素换算为 YCbCr 写回各分量，
+// 色度取下采样范围内各像素的平均值
+func (t *jpegTile) store(rgba *image.RGBA, r image.Rectangle) {
+	s := t.stream
+	y := &t.planes[0]
+	if len(s.comps) == 1 {
+		for py := r.Min.Y; py < r.Max.Y; py++ {
+			for px := r.Min.X; px < r.Max.X; px++ {
+				g := color.GrayModel.Convert(rgba.RGBAAt(px, py)).(color.Gray)
+				y.pix[(py-y.y0)*y.stride+px-y.x0] = g.Y
+			}
+		}
+		return
+	}
+
+	type sum struct{ cb, cr, n int }
+	sums := map[image.Point]*sum{}
+	for py := r.Min.Y; py < r.Max.Y; py++ {
+		for px := r.Min.X; px < r.Max.X; px++ {
+			c := rgba.RGBAAt(px, py)
+			yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+			y.pix[(py-y.y0)*y.stride+px-y.x0] = yy
+			p := image.Pt(px/s.hmax, py/s.vmax)
+			if sums[p] == nil {
+				sums[p] = &sum{}
+			}
+			sums[p].cb += int(cb)
+			sums[p].cr += int(cr)
+			sums[p].n++
+		}
+	}
+	cb, cr := &t.planes[1], &t.planes[2]
+	for p, v := range sums {
+		i := (p.Y-cb.y0)*cb.stride + p.X - cb.x0
+		cb.pix[i] = byte((v.cb + v.n/2) / v.n)
+		cr.pix[i] = byte((v.cr + v.n/2) / v.n)
+	}
+}
+
+// encode 重新编码整张图片：t 中有变化的 MCU 由采样值重新变换、量化，其余块沿用原来的量化系数
+func (s *jpegStream) encode(buf *bytes.Buffer, t *jpegTile) error {
+	s.writeHeader(buf)
+	w := &jpegBitWriter{buf: buf}
+	var prev [3]int32
+	err := s.scanBlocks(func(c, bx, by int, blk *[64]int32) error {
+		if t.isChanged(c, bx, by) {
+			p := &t.planes[c]
+			fdctBlock(p.pix[(by*8-p.y0)*p.stride+bx*8-p.x0:], p.stride, &s.quant[s.comps[c].tq], blk)
+		}
+		table := 0
+		if c > 0 {
+			table = 2
+		}
+		w.writeBlock(blk, prev[c], standardHuffmanCodes[table], standardHuffmanCodes[table+1])
+		prev[c] = blk[0]
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.flush()
+	buf.Write([]byte{0xFF, 0xD9})
+	return nil
+}
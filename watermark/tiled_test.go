@@ -0,0 +1,181 @@
+package watermark
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+)
+
+// tiledSource 把示例照片的一块编码为 JPEG，gray 为 true 时编码为灰度图
+func tiledSource(t *testing.T, gray bool) ([]byte, *jpegStream) {
+	t.Helper()
+	var img image.Image = demoCrop(t)
+	if gray {
+		g := image.NewGray(img.Bounds())
+		draw.Draw(g, g.Bounds(), img, img.Bounds().Min, draw.Src)
+		img = g
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := parseJPEGStream(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), s
+}
+
+func decodeJPEG(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestTiledEncode(t *testing.T) {
+	for _, gray := range []bool{false, true} {
+		data, s := tiledSource(t, gray)
+		want := decodeJPEG(t, data)
+
+		tile, err := s.decodeTile(image.Rect(100, 90, 260, 150))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 解码出的区域与标准库解码的结果只有舍入误差
+		if d := meanAbsDiff(tile.image(), want, tile.pixelRect()); d > 1 {
+			t.Errorf("gray=%v: 解码区域的平均误差 %.2f", gray, d)
+		}
+
+		fill := image.Rect(120, 100, 200, 130)
+		tile.draw(func(dst *image.RGBA) {
+			draw.Draw(dst, fill, image.NewUniform(color.RGBA{200, 30, 30, 255}), image.Point{}, draw.Src)
+		})
+		var buf bytes.Buffer
+		if err := s.encode(&buf, tile); err != nil {
+			t.Fatal(err)
+		}
+		got := decodeJPEG(t, buf.Bytes())
+		if got.Bounds() != want.Bounds() {
+			t.Fatalf("gray=%v: 尺寸 %v，期望 %v", gray, got.Bounds(), want.Bounds())
+		}
+
+		mw, mh := s.mcuSize()
+		redrawn := image.Rect(fill.Min.X/mw*mw, fill.Min.Y/mh*mh, (fill.Max.X+mw-1)/mw*mw, (fill.Max.Y+mh-1)/mh*mh)
+		b := want.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if image.Pt(x, y).In(redrawn) {
+					continue
+				}
+				if got.At(x, y) != want.At(x, y) {
+					t.Fatalf("gray=%v: 没有绘制的块 (%d, %d) 发生了变化", gray, x, y)
+				}
+			}
+		}
+
+		// 绘制的区域按原图的量化表重新编码
+		expected := image.NewRGBA(b)
+		draw.Draw(expected, b, want, b.Min, draw.Src)
+		draw.Draw(expected, fill, image.NewUniform(color.RGBA{200, 30, 30, 255}), image.Point{}, draw.Src)
+		var model color.Model = color.RGBAModel
+		if gray {
+			model = color.GrayModel
+		}
+		inner := fill.Inset(4)
+		if d := meanAbsDiff(got, convertImage(expected, model), inner); d > 6 {
+			t.Errorf("gray=%v: 绘制区域的平均误差 %.2f", gray, d)
+		}
+	}
+}
+
+func TestTiledThumbnail(t *testing.T) {
+	data, s := tiledSource(t, false)
+	full := decodeJPEG(t, data)
+	thumb, err := s.thumbnail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := full.Bounds()
+	if want := image.Rect(0, 0, (b.Dx()+7)/8, (b.Dy()+7)/8); thumb.Bounds() != want {
+		t.Fatalf("预览图尺寸 %v，期望 %v", thumb.Bounds(), want)
+	}
+
+	// 预览图的每个像素是对应 8x8 块的平均值
+	var total float64
+	tb := thumb.Bounds()
+	for y := tb.Min.Y; y < tb.Max.Y; y++ {
+		for x := tb.Min.X; x < tb.Max.X; x++ {
+			var sum [3]float64
+			n := 0
+			for _, p := range pointsIn(image.Rect(x*8, y*8, x*8+8, y*8+8).Intersect(b)) {
+				r, g, bl, _ := full.At(p.X, p.Y).RGBA()
+				sum[0], sum[1], sum[2] = sum[0]+float64(r>>8), sum[1]+float64(g>>8), sum[2]+float64(bl>>8)
+				n++
+			}
+			r, g, bl, _ := thumb.At(x, y).RGBA()
+			total += absFloat(sum[0]/float64(n)-float64(r>>8)) + absFloat(sum[1]/float64(n)-float64(g>>8)) + absFloat(sum[2]/float64(n)-float64(bl>>8))
+		}
+	}
+	if d := total / float64(3*tb.Dx()*tb.Dy()); d > 4 {
+		t.Errorf("预览图与按块平均的平均误差 %.2f", d)
+	}
+}
+
+func TestParseJPEGStreamUnsupported(t *testing.T) {
+	img := demoCrop(t)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	// 把 SOF0 改成 SOF2（渐进式）
+	progressive := bytes.Replace(buf.Bytes(), []byte{0xFF, 0xC0}, []byte{0xFF, 0xC2}, 1)
+	if _, err := parseJPEGStream(progressive); err == nil {
+		t.Error("渐进式 JPEG 应当返回错误")
+	}
+	if _, err := parseJPEGStream([]byte("not a jpeg")); err == nil {
+		t.Error("不是 JPEG 的数据应当返回错误")
+	}
+}
+
+func meanAbsDiff(a, b image.Image, r image.Rectangle) float64 {
+	var total float64
+	points := pointsIn(r)
+	for _, p := range points {
+		r1, g1, b1, _ := a.At(p.X, p.Y).RGBA()
+		r2, g2, b2, _ := b.At(p.X, p.Y).RGBA()
+		total += absFloat(float64(r1>>8)-float64(r2>>8)) + absFloat(float64(g1>>8)-float64(g2>>8)) + absFloat(float64(b1>>8)-float64(b2>>8))
+	}
+	return total / float64(3*len(points))
+}
+
+func convertImage(img image.Image, model color.Model) image.Image {
+	if model == color.RGBAModel {
+		return img
+	}
+	g := image.NewGray(img.Bounds())
+	draw.Draw(g, g.Bounds(), img, img.Bounds().Min, draw.Src)
+	return g
+}
+
+func pointsIn(r image.Rectangle) []image.Point {
+	var points []image.Point
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			points = append(points, image.Pt(x, y))
+		}
+	}
+	return points
+}
+
+func absFloat(v float64) float64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
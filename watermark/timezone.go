@@ -0,0 +1,131 @@
+package watermark
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	// 内置时区数据库，Windows 等没有 zoneinfo 的系统上也能按名称加载时区
+	_ "time/tzdata"
+)
+
+// 旅行时相机的时钟通常还是出发地的时间。按 GPS 坐标在时区边界数据中找到拍摄地的时区，
+// 可以在水印中显示拍摄地的时区，或者把拍摄时间换算为当地时间。
+// 时区边界使用 timezone-boundary-builder 发布的 GeoJSON（如 timezones.geojson），
+// 每个 Feature 的 properties.tzid 为时区名称，geometry 为 Polygon 或 MultiPolygon。
+// 边界数据不随程序提供：完整数据有上百 MB，简化到能嵌入程序的大小后边境附近会判断错时区，
+// 而换算错的拍摄时间比不换算更难发现，所以需要用户自行下载
+
+// tzPolygon 是某个时区边界中的一个多边形
+type tzPolygon struct {
+	boundaryPolygon
+	loc *time.Location
+}
+
+// tzPolygons 全部时区的多边形，未配置 gpsTimezone.dataset 时为空
+var tzPolygons []tzPolygon
+
+// loadTimezones 读取时区边界数据并检查相机时区的配置
+func loadTimezones() error {
+	tc := config.GPSTimezone
+	if _, err := parseTimezone(tc.CameraTimezone); err != nil {
+		return fmt.Errorf("gpsTimezone.cameraTimezone 无效: %v", err)
+	}
+	if tc.Dataset == "" {
+		if tc.Convert {
+			return fmt.Errorf("gpsTimezone.convert 需要时区边界数据，请在 gpsTimezone.dataset 中填写 timezones.geojson 的路径")
+		}
+		return nil
+	}
+
+	features, err := readGeoJSON(tc.Dataset)
+	if err != nil {
+		return err
+	}
+	for _, f := range features {
+		var props struct {
+			TZID string `json:"tzid"`
+		}
+		json.Unmarshal(f.Properties, &props)
+		loc, err := time.LoadLocation(props.TZID)
+		if err != nil {
+			log.Printf("跳过未知的时区 %q: %v", props.TZID, err)
+			continue
+		}
+		polygons, err := f.polygons()
+		if err != nil {
+			return fmt.Errorf("解析时区 %s 的边界失败: %v", props.TZID, err)
+		}
+		for _, p := range polygons {
+			tzPolygons = append(tzPolygons, tzPolygon{boundaryPolygon: p, loc: loc})
+		}
+	}
+	if len(tzPolygons) == 0 {
+		return fmt.Errorf("时区边界数据 %s 中没有时区", tc.Dataset)
+	}
+	log.Printf("已读取时区边界数据 %s，共 %d 个多边形", tc.Dataset, len(tzPolygons))
+	return nil
+}
+
+// timezoneAt 返回坐标所在的时区，找不到时返回 nil
+func timezoneAt(lat, long float64) *time.Location {
+	for i := range tzPolygons {
+		if tzPolygons[i].contains(lat, long) {
+			return tzPolygons[i].loc
+		}
+	}
+	return nil
+}
+
+// localizeTime 按拍摄地的时区设置 info.Time 和 info.TimeZone。
+// 开启 convert 时把相机时区的时间换算为当地时间，否则只给原来的时间加上拍摄地的时区
+func localizeTime(info *PhotoInfo) {
+	if len(tzPolygons) == 0 || !info.HasGPS {
+		return
+	}
+	loc := timezoneAt(info.Latitude, info.Longitude)
+	if loc == nil {
+		log.Printf("%s 的坐标不在时区边界数据中的任何时区内", info.Filename)
+		return
+	}
+	info.TimeZone = loc.String()
+
+	t := info.Time
+	// EXIF 中记录了 UTC 偏移时，相机时钟的时区是确定的，不需要 cameraTimezone
+	wall := t
+	if !hasKnownZone(t) {
+		camera, _ := parseTimezone(config.GPSTimezone.CameraTimezone)
+		wall = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), camera)
+	}
+	if config.GPSTimezone.Convert {
+		info.Time = wall.In(loc)
+		_, from := wall.Zone()
+		if _, to := info.Time.Zone(); from != to {
+			log.Printf("%s 拍摄时间按 %s 换算为 %s", info.Filename, loc, info.Time.Format("2006-01-02 15:04:05"))
+		}
+	} else {
+		info.Time = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+	}
+}
+
+// parseTimezone 解析 +08:00、UTC-5 这样的偏移或 Asia/Shanghai 这样的时区名，留空时为本机时区
+func parseTimezone(tz string) (*time.Location, error) {
+	if tz == "" {
+		return time.Local, nil
+	}
+	if m := utcOffsetPattern.FindStringSubmatch(tz); m != nil {
+		h, _ := strconv.Atoi(m[2])
+		min, _ := strconv.Atoi(m[3])
+		offset := (h*60 + min) * 60
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(tz, offset), nil
+	}
+	return time.LoadLocation(tz)
+}
+
+var utcOffsetPattern = regexp.MustCompile(`^(?:UTC)?([+-])(\d{1,2})(?::?(\d{2}))?$`)
@@ -0,0 +1,250 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 没有 GPS 的照片可以按拍摄时间从运动手表、手机记录的轨迹（GPX、KML）中推算位置：
+// 找到拍摄时间前后的两个轨迹点，按时间线性插值。轨迹点的时间是 UTC，
+// 照片的拍摄时间是相机的本地时间，需要用 gpsTrack.timezone 指明相机时钟所在的时区
+
+// trackPoint 是轨迹中的一个点
+type trackPoint struct {
+	t         time.Time
+	lat, long float64
+}
+
+// trackPoints 按时间排序的全部轨迹点，来自所有轨迹文件
+var trackPoints []trackPoint
+
+// loadTracks 读取 gpsTrack.files 和当前目录下的 .gpx、.kml 文件
+func loadTracks() error {
+	tc := config.GPSTrack
+	files := slices.Clone(tc.Files)
+	for _, pattern := range []string{"*.gpx", "*.GPX", "*.kml", "*.KML"} {
+		matches, _ := filepath.Glob(pattern)
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	if _, err := trackTimezone(); err != nil {
+		return err
+	}
+	if _, err := trackClockOffset(); err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, name := range files {
+		if abs, err := filepath.Abs(name); err == nil {
+			if seen[abs] {
+				continue
+			}
+			seen[abs] = true
+		}
+		points, err := readTrackFile(name)
+		if err != nil {
+			return fmt.Errorf("读取轨迹文件 %s 失败: %v", name, err)
+		}
+		log.Printf("已读取轨迹文件 %s，共 %d 个点", name, len(points))
+		trackPoints = append(trackPoints, points...)
+	}
+	sort.Slice(trackPoints, func(i, j int) bool { return trackPoints[i].t.Before(trackPoints[j].t) })
+	return nil
+}
+
+// trackTimezone 返回相机时钟所在的时区，留空时为本机时区
+func trackTimezone() (*time.Location, error) {
+	loc, err := parseTimezone(config.GPSTrack.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("gpsTrack.timezone 无效: %v", err)
+	}
+	return loc, nil
+}
+
+// trackClockOffset 返回相机时钟比实际时间快多少，如 "2m30s"，慢时为负数
+func trackClockOffset() (time.Duration, error) {
+	if config.GPSTrack.ClockOffset == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(config.GPSTrack.ClockOffset)
+	if err != nil {
+		return 0, fmt.Errorf("gpsTrack.clockOffset 无效: %v", err)
+	}
+	return d, nil
+}
+
+// trackPosition 按拍摄时间在轨迹中推算位置。taken 的年月日时分秒是相机时钟的读数，
+// EXIF 中没有记录 UTC 偏移时，时区以 gpsTrack.timezone 为准
+func trackPosition(taken time.Time) (lat, long float64, ok bool) {
+	if len(trackPoints) == 0 {
+		return 0, 0, false
+	}
+	t := taken
+	if !hasKnownZone(t) {
+		tz, _ := trackTimezone()
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, tz)
+	}
+	offset, _ := trackClockOffset()
+	t = t.Add(-offset)
+	maxGap := time.Duration(config.GPSTrack.MaxGapMinutes * float64(time.Minute))
+
+	// i 是第一个不早于拍摄时间的点
+	i := sort.Search(len(trackPoints), func(i int) bool { return !trackPoints[i].t.Before(t) })
+	if i < len(trackPoints) && i > 0 {
+		a, b := trackPoints[i-1], trackPoints[i]
+		if span := b.t.Sub(a.t); span <= maxGap {
+			f := 0.0
+			if span > 0 {
+				f = float64(t.Sub(a.t)) / float64(span)
+			}
+			return a.lat + (b.lat-a.lat)*f, a.long + (b.long-a.long)*f, true
+		}
+	}
+	// 前后两点相隔太久（如中途关闭了记录）时，只使用时间足够接近的那一个点
+	for _, j := range []int{i - 1, i} {
+		if j >= 0 && j < len(trackPoints) {
+			if d := trackPoints[j].t.Sub(t).Abs(); d <= maxGap {
+				return trackPoints[j].lat, trackPoints[j].long, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// readTrackFile 按扩展名读取 GPX 或 KML 轨迹
+func readTrackFile(name string) ([]trackPoint, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gpx":
+		return parseGPX(data)
+	case ".kml":
+		return parseKML(data)
+	default:
+		return nil, fmt.Errorf("不支持的轨迹格式，请使用 .gpx 或 .kml")
+	}
+}
+
+// parseGPX 读取 GPX 中全部轨迹段的点，没有时间的点跳过
+func parseGPX(data []byte) ([]trackPoint, error) {
+	var doc struct {
+		Tracks []struct {
+			Segments []struct {
+				Points []struct {
+					Lat  float64 `xml:"lat,attr"`
+					Lon  float64 `xml:"lon,attr"`
+					Time string  `xml:"time"`
+				} `xml:"trkpt"`
+			} `xml:"trkseg"`
+		} `xml:"trk"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var points []trackPoint
+	for _, trk := range doc.Tracks {
+		for _, seg := range trk.Segments {
+			for _, p := range seg.Points {
+				if t, err := time.Parse(time.RFC3339, strings.TrimSpace(p.Time)); err == nil {
+					points = append(points, trackPoint{t: t, lat: p.Lat, long: p.Lon})
+				}
+			}
+		}
+	}
+	return points, nil
+}
+
+// kmlTrack 是 KML 中的 gx:Track，when 与 gx:coord 一一对应
+type kmlTrack struct {
+	When   []string `xml:"when"`
+	Coords []string `xml:"coord"`
+}
+
+func (trk kmlTrack) points() []trackPoint {
+	var points []trackPoint
+	for i := 0; i < len(trk.When) && i < len(trk.Coords); i++ {
+		// gx:coord 为 “经度 纬度 海拔”，以空格分隔
+		if p, ok := kmlPoint(trk.When[i], strings.Fields(trk.Coords[i])); ok {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// parseKML 读取 KML 中的 gx:Track 和带 TimeStamp 的 Point。
+// 它们可能嵌套在任意层的 Folder 中，所以逐个元素查找，而不是按固定的层级解析
+func parseKML(data []byte) ([]trackPoint, error) {
+	var points []trackPoint
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return points, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Local {
+		case "Track":
+			var trk kmlTrack
+			if err := dec.DecodeElement(&trk, &se); err != nil {
+				return nil, err
+			}
+			points = append(points, trk.points()...)
+		case "Placemark":
+			var pm struct {
+				When        string     `xml:"TimeStamp>when"`
+				Coordinates string     `xml:"Point>coordinates"`
+				Tracks      []kmlTrack `xml:"Track"`
+				MultiTracks []struct {
+					Tracks []kmlTrack `xml:"Track"`
+				} `xml:"MultiTrack"`
+			}
+			if err := dec.DecodeElement(&pm, &se); err != nil {
+				return nil, err
+			}
+			// coordinates 为 “经度,纬度,海拔”，以逗号分隔
+			if p, ok := kmlPoint(pm.When, strings.Split(strings.TrimSpace(pm.Coordinates), ",")); ok {
+				points = append(points, p)
+			}
+			for _, mt := range pm.MultiTracks {
+				pm.Tracks = append(pm.Tracks, mt.Tracks...)
+			}
+			for _, trk := range pm.Tracks {
+				points = append(points, trk.points()...)
+			}
+		}
+	}
+}
+
+func kmlPoint(when string, coord []string) (trackPoint, bool) {
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(when))
+	if err != nil || len(coord) < 2 {
+		return trackPoint{}, false
+	}
+	long, err1 := strconv.ParseFloat(strings.TrimSpace(coord[0]), 64)
+	lat, err2 := strconv.ParseFloat(strings.TrimSpace(coord[1]), 64)
+	if err1 != nil || err2 != nil {
+		return trackPoint{}, false
+	}
+	return trackPoint{t: t, lat: lat, long: long}, true
+}
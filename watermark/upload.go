@@ -0,0 +1,216 @@
+package watermark
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	uploadMu     sync.Mutex
+	uploadedKeys []string
+	uploadFailed []string
+	uploadClient = &http.Client{Timeout: 5 * time.Minute}
+)
+
+// uploadEnabled 判断是否配置了上传
+func uploadEnabled() bool {
+	return config.Upload.Provider != ""
+}
+
+// uploadOutput 把输出文件上传到配置的云存储，失败时按指数退避重试
+func uploadOutput(outputPath string) error {
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		return fmt.Errorf("读取待上传文件失败: %v", err)
+	}
+	key := path.Join(config.Upload.Prefix, filepath.Base(outputPath))
+
+	retries := config.Upload.Retries
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err = uploadOnce(key, data)
+		if err == nil {
+			break
+		}
+		if attempt >= retries {
+			uploadMu.Lock()
+			uploadFailed = append(uploadFailed, key)
+			uploadMu.Unlock()
+			return fmt.Errorf("上传 %s 失败（已重试 %d 次）: %v", key, retries, err)
+		}
+		log.Printf("上传 %s 失败，%v 后重试: %v", key, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	uploadMu.Lock()
+	uploadedKeys = append(uploadedKeys, key)
+	uploadMu.Unlock()
+	log.Printf("已上传: %s -> %s", outputPath, key)
+	return nil
+}
+
+func uploadOnce(key string, data []byte) error {
+	var req *http.Request
+	var err error
+	switch strings.ToLower(config.Upload.Provider) {
+	case "s3", "oss":
+		req, err = newS3PutRequest(key, data)
+	case "webdav":
+		req, err = newWebDAVPutRequest(key, data)
+	default:
+		return fmt.Errorf("未知的上传方式: %s", config.Upload.Provider)
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := uploadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("状态码 %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// printUploadSummary 输出上传汇总
+func printUploadSummary() {
+	if !uploadEnabled() {
+		return
+	}
+	uploadMu.Lock()
+	defer uploadMu.Unlock()
+
+	for _, key := range uploadedKeys {
+		log.Printf("已上传对象: %s", key)
+	}
+	for _, key := range uploadFailed {
+		log.Printf("上传失败对象: %s", key)
+	}
+	consolePrintf("上传完成: 成功 %d 个，失败 %d 个\n", len(uploadedKeys), len(uploadFailed))
+}
+
+// newWebDAVPutRequest 构造 WebDAV 上传请求，endpoint 为目标目录的地址
+func newWebDAVPutRequest(key string, data []byte) (*http.Request, error) {
+	target := strings.TrimRight(config.Upload.Endpoint, "/") + "/" + uriEncodePath(key)
+	req, err := http.NewRequest(http.MethodPut, target, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Upload.Username != "" {
+		req.SetBasicAuth(config.Upload.Username, config.Upload.Password)
+	}
+	req.Header.Set("Content-Type", contentTypeFor(key))
+	return req, nil
+}
+
+// newS3PutRequest 构造使用 AWS Signature V4 签名的上传请求。
+// 阿里云 OSS 的 S3 兼容接口使用同样的签名方式
+func newS3PutRequest(key string, data []byte) (*http.Request, error) {
+	endpoint, err := url.Parse(config.Upload.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("endpoint 配置错误: %s", config.Upload.Endpoint)
+	}
+	// 使用虚拟主机风格: https://bucket.endpoint/key
+	host := config.Upload.Bucket + "." + endpoint.Host
+	uri := "/" + uriEncodePath(key)
+
+	req, err := http.NewRequest(http.MethodPut, endpoint.Scheme+"://"+host+uri, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(data)
+	contentType := contentTypeFor(key)
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		http.MethodPut,
+		uri,
+		"",
+		"content-type:" + contentType,
+		"host:" + host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + config.Upload.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signingKey := hmacSHA256([]byte("AWS4"+config.Upload.SecretKey), day)
+	signingKey = hmacSHA256(signingKey, config.Upload.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		config.Upload.AccessKey, scope, signedHeaders, signature))
+	return req, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncodePath 按 RFC 3986 对路径逐段编码，保留分隔符 /
+func uriEncodePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		var b strings.Builder
+		for _, c := range []byte(s) {
+			if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+				c == '-' || c == '_' || c == '.' || c == '~' {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		segments[i] = b.String()
+	}
+	return strings.Join(segments, "/")
+}
+
+func contentTypeFor(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png":
+		return "image/png"
+	case ".webp":
+		return "image/webp"
+	default:
+		return "image/jpeg"
+	}
+}
@@ -0,0 +1,42 @@
+package watermark
+
+import (
+	"fmt"
+	"log"
+)
+
+// 控制台输出的详细程度。安静模式不向控制台输出任何内容；默认只输出汇总；-v、-vv 时命令行程序
+// 逐个显示文件的去向和用时，-vv 再记录每次逆地理编码请求的坐标和耗时。日志的去向由调用方决定
+
+// Verbosity 是控制台输出的详细程度
+type Verbosity int
+
+const (
+	VerbosityQuiet   Verbosity = -1 // 不向控制台输出任何内容
+	VerbosityNormal  Verbosity = 0  // 输出提示和汇总
+	VerbosityVerbose Verbosity = 1  // 逐个显示文件的处理结果
+	VerbosityDebug   Verbosity = 2  // 再记录调试日志
+)
+
+var verbosity = VerbosityNormal
+
+// consolePrintf 向控制台输出，安静模式下不输出
+func consolePrintf(format string, args ...any) {
+	if verbosity > VerbosityQuiet {
+		fmt.Printf(format, args...)
+	}
+}
+
+// consolePrintln 向控制台输出一行，安静模式下不输出
+func consolePrintln(args ...any) {
+	if verbosity > VerbosityQuiet {
+		fmt.Println(args...)
+	}
+}
+
+// debugf 在 VerbosityDebug 时写入日志
+func debugf(format string, args ...any) {
+	if verbosity >= VerbosityDebug {
+		log.Printf("[调试] "+format, args...)
+	}
+}
@@ -0,0 +1,39 @@
+package watermark
+
+import "runtime/debug"
+
+// Version 是写入 XMP 的程序版本，命令行程序在发布时通过 -ldflags 设置
+var Version string
+
+// toolVersion 返回程序版本，没有设置 Version 时使用编译信息中的模块版本或 git 提交号
+func toolVersion() string {
+	if Version != "" {
+		return Version
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := bi.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var revision, modified string
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return revision
+}
@@ -0,0 +1,146 @@
+package watermark
+
+import (
+	"image"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+)
+
+// layoutVertical 竖排文字：每一行变成一列，字从上到下排列，第一列在最右边。
+// 每个字（包括 emoji）占一个字号见方的格子并水平居中，数字和英文字母也保持正立；空格只占半格
+func layoutVertical(bounds image.Rectangle, wm *watermark, lines []string, fontSize float64, widthPadding, heightPadding int) watermarkLayout {
+	width, height := bounds.Dx(), bounds.Dy()
+	ws := wm.ws
+
+	type cell struct {
+		text         string
+		emoji        image.Image
+		font         *truetype.Font
+		width, top   int
+		baselineSkip int
+	}
+	styles := make([]lineStyle, len(lines))
+	columns := make([][]cell, len(lines))
+	columnWidths := make([]int, len(lines))
+	columnHeights := make([]int, len(lines))
+
+	// 列距按字号的 lineSpacing - 1 倍计算，与横排的行间空白一致；字距加在每个格子下方
+	columnGap := func(size float64) int { return int(size * (resolveLineSpacing(ws) - 1)) }
+	blockWidth, blockHeight := 0, 0
+	for i, line := range lines {
+		st := resolveLineStyle(ws, i, fontSize)
+		styles[i] = st
+		em := int(math.Ceil(st.size))
+		tracking := int(math.Round(st.size * ws.LetterSpacing))
+
+		var face font.Face
+		baselineSkip := int(st.size * 0.88)
+		if st.font != nil {
+			face = truetype.NewFace(st.font, &truetype.Options{Size: st.size, DPI: 72})
+			m := face.Metrics()
+			// 按字体的上下伸部比例把基线放在格子里，使字身在格子内垂直居中
+			a, d := float64(m.Ascent), float64(m.Descent)
+			if a+d > 0 {
+				baselineSkip = int(st.size * a / (a + d))
+			}
+		}
+
+		top := 0
+		for _, seg := range splitByFont(splitEmoji(line), st.font) {
+			if seg.emoji != nil {
+				columns[i] = append(columns[i], cell{text: seg.text, emoji: seg.emoji, width: em, top: top, baselineSkip: baselineSkip})
+				top += em + tracking
+				continue
+			}
+			for _, r := range seg.text {
+				advance := em
+				if unicode.IsSpace(r) {
+					advance = em / 2
+				}
+				w := measureSegment(face, st.size, textSegment{text: string(r), font: seg.font})
+				columns[i] = append(columns[i], cell{text: string(r), font: seg.font, width: w, top: top, baselineSkip: baselineSkip})
+				top += advance + tracking
+			}
+		}
+		if len(columns[i]) > 0 {
+			top -= tracking
+		}
+		if face != nil {
+			face.Close()
+		}
+
+		columnWidths[i] = em
+		columnHeights[i] = top
+		if i > 0 {
+			blockWidth += columnGap(st.size)
+		}
+		blockWidth += em
+		blockHeight = max(blockHeight, top)
+	}
+
+	fx, fy := anchorFactors(wm.position)
+
+	// 品牌标志与文字块等宽，放在文字上方
+	var brandHeight, gap int
+	if wm.brand != nil {
+		b := wm.brand.Bounds()
+		brandHeight = int(math.Round(float64(b.Dy()) * float64(blockWidth) / float64(b.Dx())))
+		gap = int(fontSize / 2)
+	}
+
+	pad := backgroundPadding(ws, fontSize)
+	x := anchorOffset(bounds.Min.X, width, blockWidth+2*pad, widthPadding, fx) + pad
+	blockY := anchorOffset(bounds.Min.Y, height, brandHeight+gap+blockHeight+2*pad, heightPadding, fy) + pad
+	y := blockY + brandHeight + gap
+
+	// 竖排时对齐的是各列的上下位置
+	ay := fy
+	switch strings.ToLower(ws.Align) {
+	case "left":
+		ay = 0
+	case "center":
+		ay = 0.5
+	case "right":
+		ay = 1
+	}
+
+	var runs []textRun
+	right := x + blockWidth
+	for i, column := range columns {
+		left := right - columnWidths[i]
+		top := y + int(float64(blockHeight-columnHeights[i])*ay)
+		for _, c := range column {
+			if strings.TrimSpace(c.text) == "" {
+				continue
+			}
+			dot := image.Pt(left+(columnWidths[i]-c.width)/2, top+c.top+c.baselineSkip)
+			runs = append(runs, textRun{line: i, text: c.text, emoji: c.emoji, font: c.font, dot: dot})
+		}
+		if i+1 < len(columns) {
+			right = left - columnGap(styles[i+1].size)
+		}
+	}
+
+	l := watermarkLayout{
+		ws:       ws,
+		x:        x,
+		y:        y,
+		fontSize: fontSize,
+		height:   blockHeight,
+		maxWidth: blockWidth,
+		lines:    lines,
+		styles:   styles,
+		runs:     runs,
+	}
+	if len(columns) > 0 && len(columns[0]) > 0 {
+		l.ascent = columns[0][0].baselineSkip
+	}
+	if wm.brand != nil {
+		l.brand = image.Rect(x, blockY, x+blockWidth, blockY+brandHeight)
+	}
+	return l
+}
@@ -0,0 +1,1850 @@
+package watermark
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/font"
+)
+
+// Config 结构体用于存储配置信息
+type Config struct {
+	OutputFolder       string   `json:"outputFolder"`
+	NoExifFolder       string   `json:"noExifFolder"`
+	JpegQuality        int      `json:"jpegQuality"`
+	AmapAPIKey         string   `json:"amapAPIKey"`
+	Geocoder           string   `json:"geocoder"`          // 逆地理编码服务: amap、nominatim、google、baidu、tencent、offline
+	ConvertGCJ02       bool     `json:"convertGCJ02"`      // 请求高德、腾讯前把 GPS 坐标从 WGS-84 换算为 GCJ-02
+	GeocodeLanguage    string   `json:"geocodeLanguage"`   // 地址的语言，如 zh-CN、en、ja，支持的服务按这个语言返回地名
+	AddressComponents  []string `json:"addressComponents"` // {{.Address}} 包含的部分: country、province、city、district、township、street、number，留空为省、市、区
+	MaxConcurrency     int      `json:"maxConcurrency"`
+	FontPath           string   `json:"fontPath"`
+	FontIndex          int      `json:"fontIndex"`          // fontPath 为字体集合（.ttc）时使用其中第几个字体，从 0 开始
+	FontStyle          string   `json:"fontStyle"`          // 按样式名选择字体集合中的字体，如 "Bold"、"Light"，优先于 fontIndex
+	FallbackFonts      []string `json:"fallbackFonts"`      // 备用字体，fontPath 中没有的字符依次在这些字体中查找
+	KeepExif           bool     `json:"keepExif"`           // 输出图片保留原图的全部EXIF，方向改为正常
+	StripGPS           bool     `json:"stripGPS"`           // 输出保留日期、相机等EXIF，但移除GPS定位
+	ColorCheck         bool     `json:"colorCheck"`         // 检查水印颜色的对比度和印刷色域
+	XMPSidecar         bool     `json:"xmpSidecar"`         // 为每张输出图片写入 .xmp 附属文件
+	EmbedXMP           bool     `json:"embedXMP"`           // 把水印文字、配置摘要、程序版本等写入输出图片的 XMP
+	ShowSubSeconds     bool     `json:"showSubSeconds"`     // {{.Date}} 中显示毫秒，如 10:20:30.120
+	ShowUTCOffset      bool     `json:"showUTCOffset"`      // {{.Date}} 后面加上 UTC 偏移，如 UTC+08:00
+	DisplayTimezone    string   `json:"displayTimezone"`    // 把带时区的拍摄时间换算到这个时区显示，留空不换算
+	DateTags           []string `json:"dateTags"`           // 依次读取的 EXIF 日期字段：DateTimeOriginal、CreateDate（即 DateTimeDigitized）、DateTime
+	DateFallback       []string `json:"dateFallback"`       // 没有 EXIF 拍摄时间时依次尝试：filename（文件名中的日期）、mtime（文件修改时间）
+	ReadXMPSidecar     string   `json:"readXMPSidecar"`     // 读取照片的 XMP 附属文件：off、fallback（EXIF 中没有时使用）、override（优先使用）
+	JSONSidecar        bool     `json:"jsonSidecar"`        // 为每张输出图片写入 .json 附属文件
+	SetFileTime        bool     `json:"setFileTime"`        // 把输出文件的时间设置为拍摄时间
+	ReadConcurrency    int      `json:"readConcurrency"`    // 同时读取源文件的数量，0 表示与 maxConcurrency 相同
+	WriteConcurrency   int      `json:"writeConcurrency"`   // 同时写入输出文件的数量，0 表示与 maxConcurrency 相同
+	IOBufferSizeKB     int      `json:"ioBufferSizeKB"`     // 读写缓冲区大小（KB）
+	OutputFormat       string   `json:"outputFormat"`       // 输出格式: jpeg、png、webp
+	MaxOutputDimension int      `json:"maxOutputDimension"` // 输出图片长边的最大像素数，0 表示不缩放
+	TiledThresholdMP   int      `json:"tiledThresholdMP"`   // 超过该像素数（百万）的 JPEG 分块处理，0 表示不启用
+	PNGCompression     string   `json:"pngCompression"`     // PNG 压缩级别: default、none、fast、best
+	WebPQuality        int      `json:"webpQuality"`        // WebP 有损编码的品质 1～100，0 表示无损编码
+	ExifThumbnail      bool     `json:"exifThumbnail"`      // 在输出 JPEG 的 EXIF 中嵌入带水印的缩略图
+	AltText            bool     `json:"altText"`            // 为每张输出图片生成图片描述文本文件
+	AltTextCommand     string   `json:"altTextCommand"`     // 可选的外部描述生成命令，输出图片路径作为最后一个参数
+	ReportFormat       string   `json:"reportFormat"`       // 运行报告格式: json、csv、both，留空不生成
+	WatermarkTemplate  string   `json:"watermarkTemplate"`  // 水印内容模板，语法见 README
+	Artist             string   `json:"artist"`             // 照片 EXIF 中没有 Artist 时使用的作者
+	Copyright          string   `json:"copyright"`          // 照片 EXIF 中没有 Copyright 时使用的版权信息
+	Caption            string   `json:"caption"`            // 追加在水印文字最后一行的固定说明，可被 -caption 参数或输入目录中的 caption.txt 覆盖
+	InPlace            bool     `json:"inPlace"`            // 原地模式：用带水印的图片替换原图，原图移入备份目录
+	BackupFolder       string   `json:"backupFolder"`       // 原地模式下原图的备份目录
+	MoveOriginals      bool     `json:"moveOriginals"`      // 处理成功后把原图移入原图目录
+	OriginalsFolder    string   `json:"originalsFolder"`    // 原图目录
+	WebCopy            struct {
+		Enabled  bool   `json:"enabled"`
+		Folder   string `json:"folder"`   // 输出目录下的子目录
+		MaxWidth int    `json:"maxWidth"` // 网页版的最大宽度
+		Quality  int    `json:"quality"`  // 网页版的 JPEG 品质
+	} `json:"webCopy"` // 额外输出一份缩小的网页版
+	LensNames map[string]string `json:"lensNames"` // 按镜头编号（{{.LensID}}）指定镜头名称，用于 EXIF 中没有镜头型号的老机身
+	ExifEdit  struct {
+		UserComment   string `json:"userComment"`   // 写入 EXIF UserComment 的文字
+		Overwrite     bool   `json:"overwrite"`     // 覆盖照片中已有的 Artist、Copyright、UserComment
+		ApplyToOutput bool   `json:"applyToOutput"` // 加水印时也写入输出图片的 EXIF
+	} `json:"exifEdit"` // tag 子命令把 artist、copyright 和 userComment 写入照片的 EXIF
+	Filter struct {
+		MinRating       int      `json:"minRating"`       // 只处理评分不低于这个星级的照片，0 表示不限
+		Keywords        []string `json:"keywords"`        // 只处理带有其中任一关键词的照片，不区分大小写
+		ExcludeKeywords []string `json:"excludeKeywords"` // 跳过带有其中任一关键词的照片
+	} `json:"filter"` // 按 XMP/IPTC 中的星级和关键词筛选要处理的照片
+	Screenshots struct {
+		Action      string   `json:"action"`      // 识别为截图时的处理: off 照常处理，folder 复制到 folder 目录，skip 跳过
+		Folder      string   `json:"folder"`      // action 为 folder 时的存放目录
+		Resolutions []string `json:"resolutions"` // 额外视为截图的分辨率，如 1179x2556，不区分横竖
+	} `json:"screenshots"` // 识别截图，不和没有 EXIF 的老照片混在一起
+	Upload struct {
+		Provider  string `json:"provider"`  // s3、oss、webdav，留空表示不上传
+		Endpoint  string `json:"endpoint"`  // 服务地址，WebDAV 为目标目录地址
+		Region    string `json:"region"`    // S3/OSS 签名使用的区域
+		Bucket    string `json:"bucket"`    // S3/OSS 存储桶
+		Prefix    string `json:"prefix"`    // 对象键前缀
+		AccessKey string `json:"accessKey"` // S3/OSS 访问密钥
+		SecretKey string `json:"secretKey"`
+		Username  string `json:"username"` // WebDAV 用户名
+		Password  string `json:"password"`
+		Retries   int    `json:"retries"` // 失败重试次数
+	} `json:"upload"` // 处理完成后上传到云存储
+	Logo struct {
+		Path     string  `json:"path"`     // PNG/JPEG 标志图片，留空不使用
+		Position string  `json:"position"` // 九宫格锚点
+		Scale    float64 `json:"scale"`    // 标志长边占图片长边的比例，大于等于 1 时为像素
+		Opacity  float64 `json:"opacity"`  // 不透明度，0-1
+		HideText bool    `json:"hideText"` // 只绘制标志，不绘制文字水印
+	} `json:"logo"` // 图片标志水印
+	BrandLogo struct {
+		Enabled bool   `json:"enabled"`
+		Folder  string `json:"folder"` // 存放厂商标志的目录，文件名为厂商名，如 canon.png
+	} `json:"brandLogo"` // 按 EXIF 厂商在文字旁边绘制相机品牌标志
+	QRCode struct {
+		Enabled    bool      `json:"enabled"`
+		Content    string    `json:"content"`    // 二维码内容模板，语法同 watermarkTemplate，渲染结果为空时不绘制
+		Position   string    `json:"position"`   // 九宫格锚点
+		Size       float64   `json:"size"`       // 边长占图片短边的比例，大于等于 1 时为像素
+		Color      RGBAColor `json:"color"`      // 深色模块的颜色
+		Background RGBAColor `json:"background"` // 浅色模块和四周留白的颜色
+	} `json:"qrCode"` // 二维码，默认链接到拍摄地点的地图
+	Geocoders struct {
+		Nominatim struct {
+			URL   string `json:"url"`   // 服务地址，默认为 OpenStreetMap 的公共服务，也可以填自建服务的地址
+			Email string `json:"email"` // 联系邮箱，大量请求公共服务时建议填写
+		} `json:"nominatim"`
+		Google struct {
+			APIKey      string   `json:"apiKey"`
+			Language    string   `json:"language"`    // 返回地址的语言，留空时使用 geocodeLanguage
+			ResultTypes []string `json:"resultTypes"` // 只返回这些类型的结果，如 locality、sublocality，留空不过滤
+		} `json:"google"`
+		Baidu struct {
+			APIKey string `json:"apiKey"` // 百度地图开放平台的 AK
+		} `json:"baidu"`
+		Tencent struct {
+			APIKey string `json:"apiKey"` // 腾讯位置服务的 Key
+		} `json:"tencent"`
+		Offline struct {
+			Dataset       string  `json:"dataset"`       // 地名数据文件：纬度,经度,省,市,区 格式的 .csv，或 GeoNames 的 .txt
+			MaxDistanceKm float64 `json:"maxDistanceKm"` // 离最近的地点超过这个距离（千米）时不返回地址
+		} `json:"offline"`
+	} `json:"geocoders"` // 各逆地理编码服务的设置
+	Landmark struct {
+		Enabled  bool     `json:"enabled"`
+		Radius   float64  `json:"radius"`   // 离地标不超过这个距离（米）时使用地标名称
+		POITypes []string `json:"poiTypes"` // 只考虑类型包含这些关键字的兴趣点，留空不限
+	} `json:"landmark"` // 附近有景区、公园等地标时用地标名称代替行政区划地址，目前只支持高德
+	GPSTrack struct {
+		Files         []string `json:"files"`         // GPX、KML 轨迹文件，当前目录下的 .gpx、.kml 文件也会自动读取
+		Timezone      string   `json:"timezone"`      // 相机时钟所在的时区，如 +08:00、Asia/Shanghai，留空为本机时区
+		ClockOffset   string   `json:"clockOffset"`   // 相机时钟比实际时间快多少，如 2m30s，慢时为负数
+		MaxGapMinutes float64  `json:"maxGapMinutes"` // 拍摄时间与轨迹点相差超过这个时间（分钟）时不推算
+	} `json:"gpsTrack"` // 没有 GPS 的照片按拍摄时间从轨迹中推算位置
+	GPSTimezone struct {
+		Dataset        string `json:"dataset"`        // timezone-boundary-builder 的时区边界 GeoJSON
+		CameraTimezone string `json:"cameraTimezone"` // 相机时钟所在的时区，留空为本机时区
+		Convert        bool   `json:"convert"`        // 把拍摄时间换算为拍摄地的当地时间
+	} `json:"gpsTimezone"` // 按 GPS 坐标确定拍摄地的时区
+	Countries struct {
+		Dataset string `json:"dataset"` // Natural Earth 等国家边界 GeoJSON
+		Flag    bool   `json:"flag"`    // 境外的地址前加上国旗 emoji
+	} `json:"countries"` // 按 GPS 坐标离线查出所在国家
+	GeocodeClient struct {
+		QPS            float64 `json:"qps"`            // 每秒最多发出的请求数，0 表示不限制
+		TimeoutSeconds int     `json:"timeoutSeconds"` // 单次请求的超时时间（秒）
+		Retries        int     `json:"retries"`        // 请求过于频繁、网络或服务端出错时的重试次数
+	} `json:"geocodeClient"` // 逆地理编码请求的限速、超时和重试
+	GeocodeCache struct {
+		Enabled   bool   `json:"enabled"`
+		Path      string `json:"path"`      // 缓存文件
+		Precision int    `json:"precision"` // 坐标保留的小数位数，4 位约为 10 米，位数越少命中越多、地址越粗略
+	} `json:"geocodeCache"` // 把解析过的地址保存在本地，重复处理和同一地点的照片不再请求 API
+	GeocodeCluster struct {
+		Enabled bool    `json:"enabled"`
+		Radius  float64 `json:"radius"` // 距离（米）不超过这个值的照片使用同一地址
+	} `json:"geocodeCluster"` // 相距很近的照片只请求一次逆地理编码
+	Weather struct {
+		Enabled  bool   `json:"enabled"`
+		Provider string `json:"provider"` // 天气服务，目前支持 open-meteo
+		APIKey   string `json:"apiKey"`   // 商业版的 API Key，免费版留空
+	} `json:"weather"` // 按 GPS 坐标和拍摄时间查询历史天气
+	MiniMap struct {
+		Enabled  bool    `json:"enabled"`
+		Provider string  `json:"provider"` // 地图服务: osm（按 tileURL 下载瓦片）、amap（高德静态地图，需要 amapAPIKey）
+		TileURL  string  `json:"tileURL"`  // 瓦片地址模板，{z}、{x}、{y} 替换为缩放级别和瓦片坐标
+		Zoom     int     `json:"zoom"`     // 缩放级别，数字越大越详细
+		Position string  `json:"position"` // 九宫格锚点
+		Size     float64 `json:"size"`     // 边长占图片短边的比例，大于等于 1 时为像素
+	} `json:"miniMap"` // 以拍摄地点为中心的小地图
+	Histogram struct {
+		Enabled  bool    `json:"enabled"`
+		Mode     string  `json:"mode"`     // luminance（亮度）或 rgb（红绿蓝三通道叠加）
+		Position string  `json:"position"` // 九宫格锚点
+		Size     float64 `json:"size"`     // 宽度占图片短边的比例，大于等于 1 时为像素；高度为宽度的一半
+		Opacity  float64 `json:"opacity"`  // 背景的不透明度
+	} `json:"histogram"` // 在角落绘制照片的直方图
+	Stego struct {
+		Enabled bool   `json:"enabled"`
+		Owner   string `json:"owner"` // 写入隐写数据的作者标识
+	} `json:"stego"` // 肉眼不可见的隐写水印，需要 png 或 webp 输出
+	RobustWatermark struct {
+		Enabled  bool    `json:"enabled"`
+		Key      string  `json:"key"`      // 密钥，检测时需要使用相同的密钥
+		Strength float64 `json:"strength"` // 叠加图案的强度（像素值的均方根），越大越稳健也越容易察觉
+	} `json:"robustWatermark"` // 能经受重新压缩和轻度裁剪的不可见水印
+	C2PA struct {
+		Enabled     bool   `json:"enabled"`
+		Certificate string `json:"certificate"` // PEM 格式的证书链文件，签名证书在前
+		PrivateKey  string `json:"privateKey"`  // PEM 格式的私钥文件，支持 ECDSA P-256/P-384、RSA 和 Ed25519
+	} `json:"c2pa"` // 在输出 JPEG 中写入签名的 C2PA 内容凭证
+	Emoji struct {
+		Enabled bool   `json:"enabled"`
+		Folder  string `json:"folder"` // 存放 emoji 图片的目录，文件名为码位，如 1f4cd.png
+		Font    string `json:"font"`   // 彩色 emoji 字体（CBDT 或 sbix 位图），folder 中没有图片时使用
+	} `json:"emoji"` // 用图片或彩色字体绘制水印文字中的 emoji
+	Style string `json:"style"` // 水印样式: overlay（印在照片上）、frame（印在照片下方的白色边框中）、polaroid（拍立得相纸）
+	Frame struct {
+		BarHeight      float64   `json:"barHeight"`      // 底部信息栏高度，小于 1 时为照片短边的比例，否则为像素
+		Border         float64   `json:"border"`         // 上、左、右边框宽度，规则同上
+		Color          RGBAColor `json:"color"`          // 边框颜色
+		TextColor      RGBAColor `json:"textColor"`      // 第一行文字颜色
+		SecondaryColor RGBAColor `json:"secondaryColor"` // 其余行文字颜色
+		LeftTemplate   string    `json:"leftTemplate"`   // 信息栏左侧文字模板
+		RightTemplate  string    `json:"rightTemplate"`  // 信息栏右侧文字模板
+	} `json:"frame"` // frame 样式的设置
+	Polaroid struct {
+		Border    float64   `json:"border"`    // 上、左、右边框宽度，小于 1 时为照片短边的比例，否则为像素
+		Bottom    float64   `json:"bottom"`    // 底部留白高度，规则同上
+		Color     RGBAColor `json:"color"`     // 相纸颜色
+		TextColor RGBAColor `json:"textColor"` // 文字颜色
+		FontPath  string    `json:"fontPath"`  // 手写风格字体，留空时使用 fontPath
+		Template  string    `json:"template"`  // 底部文字模板
+	} `json:"polaroid"` // polaroid 样式的设置
+	WatermarkSettings WatermarkSettings `json:"watermarkSettings"`
+	Watermarks        []WatermarkBlock  `json:"watermarks"` // 额外的水印块，各自有模板、位置和样式
+	LayoutProfiles    struct {
+		Portrait        json.RawMessage `json:"portrait"`        // 竖图覆盖 watermarkSettings 中的部分设置
+		Landscape       json.RawMessage `json:"landscape"`       // 横图覆盖的设置
+		Square          json.RawMessage `json:"square"`          // 方图覆盖的设置
+		SquareTolerance float64         `json:"squareTolerance"` // 长边比短边长出不超过这个比例时视为方图
+
+		portrait, landscape, square WatermarkSettings // 合并后的完整设置
+	} `json:"layoutProfiles"` // 按照片方向分别设置主水印的位置和样式
+}
+
+// WatermarkSettings 是一个水印块的位置和样式
+type WatermarkSettings struct {
+	FontSize      float64     `json:"fontSize"`
+	MinFontPx     float64     `json:"minFontPx"` // 换算后字号的下限（像素），0 表示不限制
+	MaxFontPx     float64     `json:"maxFontPx"` // 换算后字号的上限（像素），0 表示不限制
+	WidthPadding  float64     `json:"widthPadding"`
+	HeightPadding float64     `json:"heightPadding"`
+	Position      string      `json:"position"`      // 水印位置，九宫格锚点或 auto，默认 bottom-right
+	Unit          string      `json:"unit"`          // 字号和边距的单位: auto、ratio、px
+	AvoidFaces    bool        `json:"avoidFaces"`    // 检测人脸，水印会遮挡人脸时换一个位置
+	Rotation      float64     `json:"rotation"`      // 文字块绕中心逆时针旋转的角度
+	BlendMode     string      `json:"blendMode"`     // 与照片的混合模式: normal、multiply、screen、overlay、soft-light
+	Align         string      `json:"align"`         // 多行文字的对齐方式: auto、left、center、right
+	Direction     string      `json:"direction"`     // 排版方向: horizontal 横排，vertical 竖排（从上到下、从右到左）
+	LineSpacing   float64     `json:"lineSpacing"`   // 行距，为该行字号的倍数，默认 1.2；竖排时为列距
+	LetterSpacing float64     `json:"letterSpacing"` // 字距，为字号的倍数，可以为负数，0 表示使用字体默认的字距
+	Lines         []LineStyle `json:"lines"`         // 按行设置字号、颜色、粗细，第 1 项对应第 1 行
+	Color         RGBAColor   `json:"color"`
+	Stroke        struct {
+		Enabled bool      `json:"enabled"`
+		Width   float64   `json:"width"` // 描边宽度，小于 1 时为字号的比例，否则为像素
+		Color   RGBAColor `json:"color"`
+		Hollow  bool      `json:"hollow"` // 空心字：描边只画在文字外围，文字本身按 color 的透明度绘制
+	} `json:"stroke"` // 文字描边
+	Shadow struct {
+		Enabled bool      `json:"enabled"`
+		OffsetX float64   `json:"offsetX"` // 阴影偏移，小于 1 时为字号的比例，否则为像素
+		OffsetY float64   `json:"offsetY"`
+		Color   RGBAColor `json:"color"`
+		Opacity float64   `json:"opacity"` // 阴影不透明度，0-1
+		Blur    float64   `json:"blur"`    // 模糊半径，小于 1 时为字号的比例，否则为像素，0 为硬边阴影
+	} `json:"shadow"` // 文字阴影
+	Background struct {
+		Enabled bool      `json:"enabled"`
+		Color   RGBAColor `json:"color"`
+		Opacity float64   `json:"opacity"` // 不透明度，0-1
+		Radius  float64   `json:"radius"`  // 圆角半径，小于 1 时为字号的比例，否则为像素
+		Padding float64   `json:"padding"` // 文字与底板边缘的距离，规则同上
+	} `json:"background"` // 文字后面的半透明圆角底板
+	Scrim struct {
+		Enabled  bool      `json:"enabled"`
+		Height   float64   `json:"height"`   // 渐变高度，小于 1 时为图片高度的比例，否则为像素
+		Strength float64   `json:"strength"` // 图片边缘处的最大不透明度，0-1
+		Color    RGBAColor `json:"color"`
+	} `json:"scrim"` // 从图片底边向上渐隐的暗色渐变
+	AdaptiveColor struct {
+		Enabled bool      `json:"enabled"`
+		Light   RGBAColor `json:"light"` // 背景偏暗时使用的文字颜色
+		Dark    RGBAColor `json:"dark"`  // 背景偏亮时使用的文字颜色
+	} `json:"adaptiveColor"` // 根据背景亮度自动切换浅色、深色文字
+}
+
+// WatermarkBlock 是 watermarks 中的一个水印块
+type WatermarkBlock struct {
+	Template string          `json:"template"` // 文字模板，语法同 watermarkTemplate
+	Settings json.RawMessage `json:"settings"` // 覆盖 watermarkSettings 中的部分设置，未设置的项与 watermarkSettings 相同
+
+	settings WatermarkSettings // 合并后的完整设置
+}
+
+// LineStyle 是水印中某一行的样式，未设置的项与其他行相同
+type LineStyle struct {
+	Scale    float64    `json:"scale"`    // 字号相对 fontSize 的倍数，0 表示不变
+	Color    *RGBAColor `json:"color"`    // 文字颜色，留空时使用 color
+	Opacity  float64    `json:"opacity"`  // 不透明度 0-1，0 表示不变
+	Bold     bool       `json:"bold"`     // 加粗
+	FontPath string     `json:"fontPath"` // 该行使用的字体，留空时使用 fontPath
+}
+
+// RGBAColor 是配置文件中的颜色
+type RGBAColor struct {
+	R uint8 `json:"r"`
+	G uint8 `json:"g"`
+	B uint8 `json:"b"`
+	A uint8 `json:"a"`
+}
+
+func (c RGBAColor) toRGBA() color.RGBA {
+	return color.RGBA{c.R, c.G, c.B, c.A}
+}
+
+// withOpacity 返回按 opacity（0-1）降低透明度后的颜色
+func (c RGBAColor) withOpacity(opacity float64) color.NRGBA {
+	opacity = math.Max(0, math.Min(1, opacity))
+	return color.NRGBA{c.R, c.G, c.B, uint8(math.Round(float64(c.A) * opacity))}
+}
+
+const configJSON = `{
+    "outputFolder": "已处理",
+    "noExifFolder": "无EXIF信息",
+    "outputFormat": "jpeg",
+    "jpegQuality": 70,
+    "pngCompression": "default",
+    "webpQuality": 0,
+    "maxOutputDimension": 0,
+    "tiledThresholdMP": 100,
+    "amapAPIKey": "",
+    "geocoder": "amap",
+    "convertGCJ02": true,
+    "geocodeLanguage": "zh-CN",
+    "addressComponents": [],
+    "maxConcurrency": 5,
+    "fontPath": "C:/Windows/Fonts/msyh.ttc",
+    "fontIndex": 0,
+    "fontStyle": "",
+    "fallbackFonts": [],
+    "keepExif": false,
+    "stripGPS": false,
+    "exifThumbnail": false,
+    "colorCheck": false,
+    "xmpSidecar": false,
+    "embedXMP": false,
+    "readXMPSidecar": "fallback",
+    "showSubSeconds": false,
+    "showUTCOffset": false,
+    "displayTimezone": "",
+    "dateTags": ["DateTimeOriginal", "DateTimeDigitized", "DateTime"],
+    "dateFallback": [],
+    "lensNames": {},
+    "jsonSidecar": false,
+    "setFileTime": false,
+    "altText": false,
+    "altTextCommand": "",
+    "reportFormat": "",
+    "watermarkTemplate": "{{.Date}}\n{{.Address}}",
+    "artist": "",
+    "copyright": "",
+    "caption": "",
+    "inPlace": false,
+    "backupFolder": "backup",
+    "moveOriginals": false,
+    "originalsFolder": "原图",
+    "readConcurrency": 0,
+    "writeConcurrency": 0,
+    "ioBufferSizeKB": 64,
+    "webCopy": {
+        "enabled": false,
+        "folder": "web",
+        "maxWidth": 1920,
+        "quality": 80
+    },
+    "exifEdit": {
+        "userComment": "",
+        "overwrite": false,
+        "applyToOutput": false
+    },
+    "filter": {
+        "minRating": 0,
+        "keywords": [],
+        "excludeKeywords": []
+    },
+    "screenshots": {
+        "action": "folder",
+        "folder": "截图",
+        "resolutions": []
+    },
+    "upload": {
+        "provider": "",
+        "endpoint": "",
+        "region": "",
+        "bucket": "",
+        "prefix": "",
+        "accessKey": "",
+        "secretKey": "",
+        "username": "",
+        "password": "",
+        "retries": 3
+    },
+    "logo": {
+        "path": "",
+        "position": "bottom-left",
+        "scale": 0.1,
+        "opacity": 0.8,
+        "hideText": false
+    },
+    "brandLogo": {
+        "enabled": false,
+        "folder": "logos"
+    },
+    "qrCode": {
+        "enabled": false,
+        "content": "{{if .HasGPS}}https://uri.amap.com/marker?position={{.Longitude}},{{.Latitude}}&coordinate=wgs84{{end}}",
+        "position": "top-left",
+        "size": 0.12,
+        "color": {
+            "r": 0,
+            "g": 0,
+            "b": 0,
+            "a": 255
+        },
+        "background": {
+            "r": 255,
+            "g": 255,
+            "b": 255,
+            "a": 255
+        }
+    },
+    "geocoders": {
+        "nominatim": {
+            "url": "https://nominatim.openstreetmap.org",
+            "email": ""
+        },
+        "google": {
+            "apiKey": "",
+            "language": "",
+            "resultTypes": []
+        },
+        "baidu": {
+            "apiKey": ""
+        },
+        "tencent": {
+            "apiKey": ""
+        },
+        "offline": {
+            "dataset": "",
+            "maxDistanceKm": 50
+        }
+    },
+    "landmark": {
+        "enabled": false,
+        "radius": 200,
+        "poiTypes": ["风景名胜"]
+    },
+    "gpsTrack": {
+        "files": [],
+        "timezone": "",
+        "clockOffset": "",
+        "maxGapMinutes": 10
+    },
+    "gpsTimezone": {
+        "dataset": "",
+        "cameraTimezone": "",
+        "convert": false
+    },
+    "countries": {
+        "dataset": "",
+        "flag": false
+    },
+    "geocodeClient": {
+        "qps": 3,
+        "timeoutSeconds": 10,
+        "retries": 3
+    },
+    "geocodeCache": {
+        "enabled": true,
+        "path": "geocode-cache.jsonl",
+        "precision": 4
+    },
+    "geocodeCluster": {
+        "enabled": true,
+        "radius": 100
+    },
+    "weather": {
+        "enabled": false,
+        "provider": "open-meteo",
+        "apiKey": ""
+    },
+    "miniMap": {
+        "enabled": false,
+        "provider": "osm",
+        "tileURL": "https://tile.openstreetmap.org/{z}/{x}/{y}.png",
+        "zoom": 14,
+        "position": "top-right",
+        "size": 0.2
+    },
+    "histogram": {
+        "enabled": false,
+        "mode": "luminance",
+        "position": "bottom-left",
+        "size": 0.25,
+        "opacity": 0.5
+    },
+    "stego": {
+        "enabled": false,
+        "owner": ""
+    },
+    "robustWatermark": {
+        "enabled": false,
+        "key": "",
+        "strength": 2
+    },
+    "c2pa": {
+        "enabled": false,
+        "certificate": "",
+        "privateKey": ""
+    },
+    "emoji": {
+        "enabled": false,
+        "folder": "emoji",
+        "font": ""
+    },
+    "style": "overlay",
+    "frame": {
+        "barHeight": 0.12,
+        "border": 0,
+        "color": {
+            "r": 255,
+            "g": 255,
+            "b": 255,
+            "a": 255
+        },
+        "textColor": {
+            "r": 33,
+            "g": 33,
+            "b": 33,
+            "a": 255
+        },
+        "secondaryColor": {
+            "r": 136,
+            "g": 136,
+            "b": 136,
+            "a": 255
+        },
+        "leftTemplate": "{{.Camera}}\n{{.FocalLength}} {{.FNumber}} {{.ExposureTime}} {{.ISO}}",
+        "rightTemplate": "{{.Date}}\n{{.Address}}"
+    },
+    "polaroid": {
+        "border": 0.06,
+        "bottom": 0.3,
+        "color": {
+            "r": 250,
+            "g": 248,
+            "b": 240,
+            "a": 255
+        },
+        "textColor": {
+            "r": 40,
+            "g": 45,
+            "b": 90,
+            "a": 255
+        },
+        "fontPath": "",
+        "template": "{{date \"2006.01.02\" .Time}}  {{.City}}{{.District}}"
+    },
+    "watermarkSettings": {
+        "fontSize": 0.02,
+        "minFontPx": 0,
+        "maxFontPx": 0,
+        "widthPadding": 0.02,
+        "heightPadding": 0.01,
+        "position": "bottom-right",
+        "unit": "auto",
+        "avoidFaces": false,
+        "rotation": 0,
+        "blendMode": "normal",
+        "align": "auto",
+        "direction": "horizontal",
+        "lineSpacing": 1.2,
+        "letterSpacing": 0,
+        "lines": [],
+        "color": {
+            "r": 255,
+            "g": 165,
+            "b": 0,
+            "a": 255
+        },
+        "stroke": {
+            "enabled": true,
+            "width": 2,
+            "color": {
+                "r": 0,
+                "g": 0,
+                "b": 0,
+                "a": 255
+            },
+            "hollow": false
+        },
+        "shadow": {
+            "enabled": true,
+            "offsetX": 4,
+            "offsetY": 4,
+            "color": {
+                "r": 0,
+                "g": 0,
+                "b": 0,
+                "a": 255
+            },
+            "opacity": 0.7,
+            "blur": 0.1
+        },
+        "background": {
+            "enabled": false,
+            "color": {
+                "r": 0,
+                "g": 0,
+                "b": 0,
+                "a": 255
+            },
+            "opacity": 0.4,
+            "radius": 0.3,
+            "padding": 0.4
+        },
+        "scrim": {
+            "enabled": false,
+            "height": 0.25,
+            "strength": 0.5,
+            "color": {
+                "r": 0,
+                "g": 0,
+                "b": 0,
+                "a": 255
+            }
+        },
+        "adaptiveColor": {
+            "enabled": false,
+            "light": {
+                "r": 255,
+                "g": 255,
+                "b": 255,
+                "a": 255
+            },
+            "dark": {
+                "r": 30,
+                "g": 30,
+                "b": 30,
+                "a": 255
+            }
+        }
+    },
+    "watermarks": [],
+    "layoutProfiles": {
+        "portrait": {},
+        "landscape": {},
+        "square": {},
+        "squareTolerance": 0.02
+    }
+}`
+
+// Location 是逆地理编码得到的行政区划和街道
+type Location struct {
+	Country      string `json:",omitempty"` // 国家，中文地址默认只在境外时显示
+	CountryCode  string `json:",omitempty"` // ISO 3166-1 国家代码，如 JP，需要配置 countries.dataset
+	Province     string
+	City         string
+	District     string
+	Township     string `json:",omitempty"` // 乡镇、街道
+	Street       string `json:",omitempty"` // 道路
+	StreetNumber string `json:",omitempty"` // 门牌号
+
+	Landmark         string  `json:",omitempty"` // 附近的地标（区域或兴趣点）名称
+	LandmarkDistance float64 `json:",omitempty"` // 与地标的距离（米），在区域内时为 0
+}
+
+// addressComponentNames 是 addressComponents 可选的地址组成部分，从大到小排列
+var addressComponentNames = []string{"country", "province", "city", "district", "township", "street", "number"}
+
+func (l Location) component(name string) string {
+	switch name {
+	case "country":
+		return l.Country
+	case "province":
+		return l.Province
+	case "city":
+		return l.City
+	case "district":
+		return l.District
+	case "township":
+		return l.Township
+	case "street":
+		return l.Street
+	case "number":
+		return l.StreetNumber
+	}
+	return ""
+}
+
+// String 返回完整地址，开启 countries.flag 时境外的地址前加上国旗
+func (l Location) String() string {
+	s := l.address()
+	if config.Countries.Flag && s != "" && l.abroad() {
+		return l.Flag() + " " + s
+	}
+	return s
+}
+
+// address 返回不带国旗的地址。开启 landmark 且附近有地标时只返回地标名称，否则按 addressComponents 组成地址。中文、日文地址从大到小直接连写，如 浙江省杭州市西湖区；
+// 其他语言从小到大用逗号分隔，如 12 Rue de Rivoli, Paris, Île-de-France, France
+func (l Location) address() string {
+	if lm := config.Landmark; lm.Enabled && l.Landmark != "" && l.LandmarkDistance <= lm.Radius {
+		return l.Landmark
+	}
+	cjk := cjkAddressLanguage(config.GeocodeLanguage)
+	selected := config.AddressComponents
+	if len(selected) == 0 {
+		// 默认到区县，其他语言和境外的地址带上国家
+		selected = []string{"province", "city", "district"}
+		if !cjk || l.abroad() {
+			selected = append(selected, "country")
+		}
+	}
+
+	var parts []string
+	for _, name := range addressComponentNames {
+		if !slices.Contains(selected, name) {
+			continue
+		}
+		v := l.component(name)
+		if v == "" || slices.Contains(parts, v) {
+			continue
+		}
+		// 其他语言的门牌号写在道路名之前
+		if name == "number" && !cjk && len(parts) > 0 && parts[len(parts)-1] == l.Street {
+			parts[len(parts)-1] = v + " " + l.Street
+			continue
+		}
+		parts = append(parts, v)
+	}
+	if cjk {
+		return strings.Join(parts, "")
+	}
+	slices.Reverse(parts)
+	return strings.Join(parts, ", ")
+}
+
+// validateAddressComponents 检查 addressComponents 中的名称
+func validateAddressComponents() error {
+	for _, name := range config.AddressComponents {
+		if !slices.Contains(addressComponentNames, name) {
+			return fmt.Errorf("addressComponents 中的 %q 无效，可选 %s", name, strings.Join(addressComponentNames, "、"))
+		}
+	}
+	return nil
+}
+
+// PhotoInfo 汇总处理一张照片时用到的信息，同时也是水印模板的数据
+type PhotoInfo struct {
+	Location
+	Filename       string
+	Time           time.Time
+	TimeZone       string // 拍摄地的时区，如 Asia/Tokyo，需要配置 gpsTimezone.dataset
+	UTCOffset      string // 拍摄时间的 UTC 偏移，如 UTC+08:00，时区不确定时为空
+	Address        string
+	Orientation    int
+	Make           string
+	Model          string
+	FNumber        string  // 如 f/2.8
+	ExposureTime   string  // 如 1/200s
+	ISO            string  // 如 ISO400
+	FocalLength    string  // 如 50mm
+	Lens           string  // 镜头型号，如 FE 24-70mm F2.8 GM II
+	LensMake       string  // 镜头厂商，如 Sony
+	LensID         string  // 佳能 MakerNote 中的镜头编号，如 61182
+	FilmSimulation string  // 富士相机的胶片模拟，如 Classic Chrome
+	Artist         string  // 作者（EXIF Artist，没有时为 artist 配置）
+	Copyright      string  // 版权信息（EXIF Copyright，没有时为 copyright 配置）
+	Description    string  // 图片说明（EXIF ImageDescription 或 XMP 附属文件中的 dc:description）
+	Heading        string  // 拍摄朝向，如 东北 45°
+	Altitude       string  // 海拔，如 3650m
+	Weather        string  // 拍摄时的天气，如 多云 23°C
+	Temperature    string  // 气温，如 23°C
+	Conditions     string  // 天气现象，如 多云
+	HasGPS         bool    // 照片是否带有 GPS 坐标
+	Latitude       float64 // 纬度（WGS-84），没有 GPS 时为 0
+	Longitude      float64 // 经度（WGS-84），没有 GPS 时为 0
+
+	Rating   int      // 星级评分（XMP xmp:Rating 或 EXIF Rating），0-5，-1 表示已拒绝
+	Keywords []string // 关键词（XMP dc:subject 或 IPTC Keywords）
+}
+
+var (
+	config Config
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+)
+
+// LoadConfig 加载配置文件，多个配置文件时后面的覆盖前面的
+func LoadConfig() error {
+	// 先载入默认配置，旧版配置文件中缺少的字段保持默认值
+	if err := json.Unmarshal([]byte(configJSON), &config); err != nil {
+		return fmt.Errorf("解析默认配置失败: %v", err)
+	}
+
+	loadedConfigFiles = findConfigFiles()
+	for _, path := range loadedConfigFiles {
+		if err := decodeConfigFile(path); err != nil {
+			return err
+		}
+	}
+	applyConfigOverrides()
+
+	var err error
+
+	// 水印块和各方向的布局方案都以 watermarkSettings 为基础，只覆盖其中写出的项
+	for i := range config.Watermarks {
+		block := &config.Watermarks[i]
+		if block.settings, err = mergeSettings(block.Settings); err != nil {
+			return fmt.Errorf("解析第 %d 个水印块的设置失败: %v", i+1, err)
+		}
+	}
+	lp := &config.LayoutProfiles
+	if lp.portrait, err = mergeSettings(lp.Portrait); err != nil {
+		return fmt.Errorf("解析竖图布局方案失败: %v", err)
+	}
+	if lp.landscape, err = mergeSettings(lp.Landscape); err != nil {
+		return fmt.Errorf("解析横图布局方案失败: %v", err)
+	}
+	if lp.square, err = mergeSettings(lp.Square); err != nil {
+		return fmt.Errorf("解析方图布局方案失败: %v", err)
+	}
+	return nil
+}
+
+// mergeSettings 返回用 override 覆盖了部分项的 watermarkSettings 副本
+func mergeSettings(override json.RawMessage) (WatermarkSettings, error) {
+	ws := config.WatermarkSettings
+	ws.Lines = slices.Clone(ws.Lines)
+	if len(override) > 0 {
+		if err := json.Unmarshal(override, &ws); err != nil {
+			return ws, err
+		}
+	}
+	return ws, nil
+}
+
+// layoutSettings 按照片的宽高比选择主水印使用的布局方案
+func layoutSettings(bounds image.Rectangle) *WatermarkSettings {
+	lp := &config.LayoutProfiles
+	long, short := max(bounds.Dx(), bounds.Dy()), min(bounds.Dx(), bounds.Dy())
+	switch {
+	case float64(long) <= float64(short)*(1+lp.SquareTolerance):
+		return &lp.square
+	case bounds.Dy() > bounds.Dx():
+		return &lp.portrait
+	default:
+		return &lp.landscape
+	}
+}
+
+func processImage(filename string, data []byte) error {
+	side := readInputSidecar(filename)
+	x, err := decodeExif(filename, data)
+	if err != nil {
+		// 附属文件或 dateFallback 能提供拍摄时间时，没有 EXIF 的照片也照常处理
+		x = emptyExif()
+	}
+	tags := readPhotoTags(data, x, side)
+	if !filterPhoto(filename, tags) {
+		emitProgress(ProgressEvent{Type: FileDone, Filename: filename})
+		return nil
+	}
+	if action := config.Screenshots.Action; action != "" && action != "off" {
+		if reason, ok := detectScreenshot(filename, data, x); ok {
+			return handleScreenshot(filename, data, reason)
+		}
+	}
+
+	timeStr, err := exifTime(x)
+	hasTime := err == nil && !timeStr.IsZero()
+	if side != nil && !side.time.IsZero() && side.useSidecar(hasTime) {
+		timeStr, hasTime = side.time, true
+		log.Printf("%s 使用 %s 中的拍摄时间", filename, side.path)
+	}
+	if !hasTime {
+		t, source, ok := fallbackTime(filename)
+		if !ok {
+			return copyToNoExifFolder(filename, data)
+		}
+		timeStr = t
+		log.Printf("【推测时间】%s 没有 EXIF 拍摄时间，按%s %s 加水印", filename, source, t.Format("2006-01-02 15:04:05"))
+	}
+
+	info := readPhotoInfo(filename, x, timeStr)
+	info.Rating, info.Keywords = tags.rating, tags.keywords
+	return processImageWithWatermark(info, data)
+}
+
+// readPhotoInfo 从 EXIF 中读取模板数据，包括按 GPS 坐标解析地址和查询天气
+func readPhotoInfo(filename string, x *exif.Exif, timeStr time.Time) *PhotoInfo {
+	orientation, _ := x.Get(exif.Orientation)
+	var orientationValue int
+	if orientation != nil {
+		orientationValue, _ = orientation.Int(0)
+	}
+
+	// locations.txt 中指定了地点的照片不请求逆地理编码
+	place, overridden := overrideLocation(filename)
+	side := readInputSidecar(filename)
+
+	// lat、long 在写入 addressChan 之前赋值，读到地址后即可使用
+	var lat, long float64
+	var hasGPS bool
+	addressChan := make(chan Location, 1)
+	go func() {
+		var err error
+		lat, long, err = x.LatLong()
+		if side != nil && side.hasGPS && side.useSidecar(err == nil) {
+			lat, long, err = side.lat, side.long, nil
+			log.Printf("%s 使用 %s 中的 GPS 坐标: lat=%f, long=%f", filename, side.path, lat, long)
+		} else if err == nil {
+			log.Printf("解析到的 GPS 坐标: lat=%f, long=%f", lat, long)
+		} else if tlat, tlong, ok := trackPosition(timeStr); ok {
+			lat, long = tlat, tlong
+			log.Printf("%s 没有 GPS 数据，根据轨迹推算的坐标: lat=%f, long=%f", filename, lat, long)
+		} else {
+			log.Printf("无法获取 GPS 数据: %v", err)
+			addressChan <- Location{}
+			return
+		}
+		hasGPS = true
+		if overridden {
+			addressChan <- Location{}
+			return
+		}
+
+		loc := getAddressFromGPS(lat, long)
+		fillCountry(&loc, lat, long)
+		log.Printf("获取的地址: %s", loc)
+		addressChan <- loc
+	}()
+
+	loc := <-addressChan
+	address := loc.String()
+	if overridden {
+		address = place
+		log.Printf("%s 使用 locations.txt 中指定的地点: %s", filename, place)
+	}
+	emitProgress(ProgressEvent{Type: GeocodeResolved, Filename: filename, Address: address})
+
+	info := &PhotoInfo{
+		Filename:    filename,
+		Time:        timeStr,
+		Location:    loc,
+		Address:     address,
+		Orientation: orientationValue,
+		Make:        exifString(x, exif.Make),
+		Model:       exifString(x, exif.Model),
+		Artist:      cmp.Or(exifString(x, exif.Artist), config.Artist),
+		Copyright:   cmp.Or(exifString(x, exif.Copyright), config.Copyright),
+		Description: exifString(x, exif.ImageDescription),
+		HasGPS:      hasGPS,
+	}
+	if side != nil && side.description != "" && side.useSidecar(info.Description != "") {
+		info.Description = side.description
+	}
+	if hasGPS {
+		info.Latitude, info.Longitude = lat, long
+	}
+	readExposureInfo(x, info)
+	readGPSInfo(x, info)
+	localizeTime(info)
+	applyDisplayTimezone(info)
+	info.UTCOffset = utcOffset(info.Time)
+	readWeather(info)
+	return info
+}
+
+// exifString 读取字符串类型的 EXIF 字段，不存在时返回空字符串
+func exifString(x *exif.Exif, field exif.FieldName) string {
+	tag, err := x.Get(field)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func processImageWithWatermark(info *PhotoInfo, data []byte) error {
+	filename := info.Filename
+	watermarkText, err := renderWatermarkText(info)
+	if err != nil {
+		return err
+	}
+	outputPath := filepath.Join(config.OutputFolder, outputBaseName(info.Time)+outputExt())
+	if config.InPlace {
+		outputPath = inPlaceOutputPath(filename)
+		// 换了扩展名时不能覆盖输入目录中已有的同名文件
+		if outputPath != filename {
+			if _, err := os.Stat(outputPath); err == nil {
+				return fmt.Errorf("原地模式下 %s 已存在，无法写入", outputPath)
+			}
+		}
+	}
+	if dryRun {
+		dryRunWatermark(info, outputPath, watermarkText)
+		return nil
+	}
+
+	// 原地模式先把原图移入备份目录（数据已读入内存），再把结果写回原位置
+	var backups map[string]string
+	if config.InPlace {
+		if backups, err = backupOriginal(filename, inPlaceSidecars(outputPath)); err != nil {
+			return err
+		}
+	}
+
+	wm := &watermark{ws: &config.WatermarkSettings, text: watermarkText, brand: brandLogo(info.Make)}
+	switch {
+	case frameStyle():
+		if wm.frameLeft, wm.frameRight, err = renderFrameText(info); err != nil {
+			return err
+		}
+	case polaroidStyle():
+		if wm.caption, err = renderPolaroidText(info); err != nil {
+			return err
+		}
+	}
+	if wm.qr, err = renderQRCode(info); err != nil {
+		return err
+	}
+	wm.miniMap = fetchMiniMap(info)
+	if wm.stego, err = stegoPayload(info); err != nil {
+		return err
+	}
+	// watermarks 中的水印块与主水印一起绘制
+	wms := []*watermark{wm}
+	blockTexts, err := renderBlockTexts(info)
+	if err != nil {
+		return err
+	}
+	for i, text := range blockTexts {
+		wms = append(wms, &watermark{ws: &config.Watermarks[i].settings, text: text})
+	}
+
+	if err := renderAndSave(filename, data, outputPath, wms, info.Orientation); err != nil {
+		if backups != nil {
+			os.Remove(outputPath)
+			restoreBackup(backups)
+		}
+		return err
+	}
+
+	// XMP 在 C2PA 签名之前写入，签名覆盖完整的文件
+	if config.EmbedXMP {
+		if err := embedXMP(outputPath, info, watermarkText); err != nil {
+			return err
+		}
+	}
+
+	if config.C2PA.Enabled {
+		if err := signC2PA(outputPath, info, watermarkText); err != nil {
+			return err
+		}
+	}
+
+	if config.XMPSidecar {
+		if err := writeXMPSidecar(outputPath, info, watermarkText); err != nil {
+			return err
+		}
+	}
+
+	if config.JSONSidecar {
+		if err := writeJSONSidecar(outputPath, info, watermarkText); err != nil {
+			return err
+		}
+	}
+
+	if config.AltText {
+		if err := writeAltText(outputPath, info); err != nil {
+			log.Printf("%s: %v", outputPath, err)
+		}
+	}
+
+	if config.SetFileTime {
+		if err := setFileTimes(outputPath, info.Time); err != nil {
+			log.Printf("%s: %v", outputPath, err)
+		}
+	}
+
+	if uploadEnabled() {
+		if err := uploadOutput(outputPath); err != nil {
+			log.Printf("%s: %v", outputPath, err)
+		}
+	}
+
+	if config.MoveOriginals && !config.InPlace {
+		if err := moveOriginal(filename, outputPath); err != nil {
+			log.Printf("%s: %v", filename, err)
+		}
+	}
+
+	addRecord(newImageRecord(info, outputPath, watermarkText))
+	emitProgress(ProgressEvent{Type: FileDone, Filename: filename, OutputPath: outputPath})
+	return nil
+}
+
+func renderAndSave(filename string, data []byte, outputPath string, wms []*watermark, orientation int) error {
+	if s := tiledStream(filename, data, wms, orientation); s != nil {
+		return renderAndSaveTiled(s, filename, data, outputPath, wms)
+	}
+	img, err := imaging.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("打开图片失败: %v", err)
+	}
+
+	img = rotateImage(img, orientation)
+	img = resizeToMaxDimension(img)
+	if framedStyle() {
+		framed := renderFrame(img, wms[0])
+		if err := saveOutput(embedInvisible(framed, wms[0]), data, outputPath); err != nil {
+			return err
+		}
+		return saveWebCopy(framed, outputPath)
+	}
+	placeWatermarks(img, wms, filename)
+
+	watermarkedImg := addWatermark(img, wms)
+
+	if err := saveOutput(embedInvisible(watermarkedImg, wms[0]), data, outputPath); err != nil {
+		return err
+	}
+	return saveWebCopy(watermarkedImg, outputPath)
+}
+
+// resizeToMaxDimension 按 maxOutputDimension 等比缩小图片，长边不超过该值
+func resizeToMaxDimension(img image.Image) image.Image {
+	max := config.MaxOutputDimension
+	bounds := img.Bounds()
+	if max <= 0 || (bounds.Dx() <= max && bounds.Dy() <= max) {
+		return img
+	}
+	return imaging.Fit(img, max, max, imaging.Lanczos)
+}
+
+// rotateImage 按 EXIF 方向（1～8）旋转或镜像图片，得到正常方向的图片
+func rotateImage(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		// 镜像后逆时针旋转 90 度，即沿左上到右下的对角线翻转
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		// 镜像后顺时针旋转 90 度，即沿右上到左下的对角线翻转
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	default:
+		return img
+	}
+}
+
+// placeWatermarks 确定每个水印块的位置，开启 colorCheck 时检查各自的对比度。
+// 使用 watermarkSettings 的主水印换成照片方向对应的布局方案
+func placeWatermarks(img image.Image, wms []*watermark, filename string) {
+	if wms[0].ws == &config.WatermarkSettings {
+		wms[0].ws = layoutSettings(img.Bounds())
+	}
+	// 直方图统计绘制水印之前的照片
+	if config.Histogram.Enabled {
+		wms[0].hist = computeHistogram(img)
+	}
+	for _, wm := range wms {
+		wm.position = watermarkPosition(img, wm)
+		if config.ColorCheck {
+			checkWatermarkContrast(img, watermarkRegion(img.Bounds(), wm), filename, wm.ws)
+		}
+	}
+}
+
+func addWatermark(img image.Image, wms []*watermark) image.Image {
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(bounds)
+	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+
+	drawWatermark(rgba, bounds, wms)
+	return rgba
+}
+
+// watermark 是一张图片要绘制的水印内容
+type watermark struct {
+	ws       *WatermarkSettings // 这个水印块使用的设置
+	text     string
+	position string      // 实际使用的位置，由 watermarkPosition 决定
+	brand    image.Image // 相机品牌标志，没有时为 nil
+	qr       [][]bool    // 二维码的模块（含四周留白），true 为深色；不绘制二维码时为 nil
+	miniMap  image.Image // 拍摄地点的小地图，不绘制时为 nil
+	hist     *histogram  // 照片的直方图，由 placeWatermarks 统计，不绘制时为 nil
+	stego    []byte      // 要写入像素最低位的隐写数据，未启用时为 nil
+
+	// frame 样式下信息栏左右两侧的文字
+	frameLeft, frameRight string
+	// polaroid 样式下相纸底部的文字
+	caption string
+}
+
+// withPosition 返回换了位置的副本，用于比较候选位置
+func (wm *watermark) withPosition(position string) *watermark {
+	c := *wm
+	c.position = position
+	return &c
+}
+
+// watermarkLayout 描述水印文字在整张图片坐标系中的排版位置
+type watermarkLayout struct {
+	ws         *WatermarkSettings
+	x, y       int
+	fontSize   float64 // 基准字号，描边、阴影等按它计算
+	ascent     int     // 第一行基线到文字块顶部的距离
+	height     int     // 文字块的高度
+	maxWidth   int
+	lineWidths []int
+	lines      []string
+	styles     []lineStyle     // 每一行的字体和字号
+	baselines  []int           // 每一行基线相对文字块顶部的位置
+	runs       []textRun       // 实际绘制的文字片段，横排时每行一段，竖排时每个字一段
+	brand      image.Rectangle // 品牌标志的位置，没有时为空
+}
+
+// textRun 是按第 line 行的样式、从 dot（基线起点）开始绘制的一段文字
+type textRun struct {
+	line   int
+	text   string
+	emoji  image.Image    // 不为 nil 时绘制 emoji 图片而不是文字
+	shaped *shapedText    // 不为 nil 时按整形结果绘制
+	font   *truetype.Font // 备用字体，为 nil 时使用该行的字体
+	dot    image.Point
+}
+
+// lineStyle 是某一行实际使用的字体、字号和样式
+type lineStyle struct {
+	LineStyle
+	font     *truetype.Font
+	fontPath string // font 对应的字体文件，整形时使用
+	size     float64
+}
+
+// block 返回文字块和品牌标志合起来的矩形
+func (l watermarkLayout) block() image.Rectangle {
+	return image.Rect(l.x, l.y, l.x+l.maxWidth, l.y+l.height).Union(l.brand)
+}
+
+func layoutWatermark(bounds image.Rectangle, wm *watermark) watermarkLayout {
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// 使用长边计算字体大小
+	maxSide := width
+	if height > width {
+		maxSide = height
+	}
+	ws := wm.ws
+	fontSize := clampFontSize(ws, resolveSize(ws.FontSize, maxSide, ws.Unit))
+
+	widthPadding := int(resolveSize(ws.WidthPadding, width, ws.Unit))
+	heightPadding := int(resolveSize(ws.HeightPadding, height, ws.Unit))
+
+	lines := strings.Split(wm.text, "\n")
+	if strings.EqualFold(ws.Direction, "vertical") {
+		return layoutVertical(bounds, wm, lines, fontSize, widthPadding, heightPadding)
+	}
+	lineWidths := make([]int, len(lines))
+	styles := make([]lineStyle, len(lines))
+	baselines := make([]int, len(lines))
+	segments := make([][]textSegment, len(lines))
+	segmentWidths := make([][]int, len(lines))
+
+	// 按字体实际的字宽测量每一行，字体加载失败时退回估算；
+	// 每行的行距按该行字号的 lineSpacing 倍计算，设置了字距时逐字排列
+	lineSpacing := resolveLineSpacing(ws)
+	baseline, descent := 0, 0
+	for i, line := range lines {
+		st := resolveLineStyle(ws, i, fontSize)
+		styles[i] = st
+		ascent := int(st.size)
+		descent = 0
+		var face font.Face
+		if st.font != nil {
+			face = truetype.NewFace(st.font, &truetype.Options{Size: st.size, DPI: 72})
+			m := face.Metrics()
+			ascent, descent = m.Ascent.Ceil(), m.Descent.Ceil()
+		}
+		segments[i] = shapeSegments(splitByFont(splitEmoji(line), st.font), st)
+		tracking := 0
+		if ws.LetterSpacing != 0 {
+			segments[i] = splitLetters(segments[i])
+			tracking = int(math.Round(st.size * ws.LetterSpacing))
+		}
+		segmentWidths[i] = make([]int, len(segments[i]))
+		for j, seg := range segments[i] {
+			segmentWidths[i][j] = measureSegment(face, st.size, seg)
+			if j < len(segments[i])-1 {
+				segmentWidths[i][j] += tracking
+			}
+			lineWidths[i] += segmentWidths[i][j]
+		}
+		if face != nil {
+			face.Close()
+		}
+		if i == 0 {
+			baseline = ascent
+		} else {
+			baseline += int(st.size * lineSpacing)
+		}
+		baselines[i] = baseline
+	}
+
+	//宽度按最宽的一行计算
+	maxWidth := 0
+	for _, w := range lineWidths {
+		maxWidth = max(maxWidth, w)
+	}
+
+	blockHeight := baseline + descent
+	fx, fy := anchorFactors(wm.position)
+
+	// 品牌标志与文字块等高，放在文字左侧
+	var brandWidth, gap int
+	if wm.brand != nil {
+		b := wm.brand.Bounds()
+		brandWidth = int(math.Round(float64(b.Dx()) * float64(blockHeight) / float64(b.Dy())))
+		gap = int(fontSize / 2)
+	}
+
+	// 有底板时按底板的外沿对齐边距
+	pad := backgroundPadding(ws, fontSize)
+	blockX := anchorOffset(bounds.Min.X, width, brandWidth+gap+maxWidth+2*pad, widthPadding, fx) + pad
+	y := anchorOffset(bounds.Min.Y, height, blockHeight+2*pad, heightPadding, fy) + pad
+
+	// 行在文字块内的对齐方式，auto 时跟随锚点所在的一侧
+	ax := fx
+	switch strings.ToLower(ws.Align) {
+	case "left":
+		ax = 0
+	case "center":
+		ax = 0.5
+	case "right":
+		ax = 1
+	}
+	x := blockX + brandWidth + gap
+	var runs []textRun
+	for i, w := range lineWidths {
+		dot := image.Pt(x+int(float64(maxWidth-w)*ax), y+baselines[i])
+		for j, seg := range segments[i] {
+			runs = append(runs, textRun{line: i, text: seg.text, emoji: seg.emoji, shaped: seg.shaped, font: seg.font, dot: dot})
+			dot.X += segmentWidths[i][j]
+		}
+	}
+
+	l := watermarkLayout{
+		ws:         ws,
+		x:          x,
+		y:          y,
+		fontSize:   fontSize,
+		ascent:     baselines[0],
+		height:     blockHeight,
+		maxWidth:   maxWidth,
+		lineWidths: lineWidths,
+		lines:      lines,
+		styles:     styles,
+		baselines:  baselines,
+		runs:       runs,
+	}
+	if wm.brand != nil {
+		l.brand = image.Rect(blockX, y, blockX+brandWidth, y+blockHeight)
+	}
+	return l
+}
+
+// resolveLineSpacing 返回行距倍数，未设置时为 1.2
+func resolveLineSpacing(ws *WatermarkSettings) float64 {
+	if ws.LineSpacing <= 0 {
+		return 1.2
+	}
+	return ws.LineSpacing
+}
+
+// splitLetters 把普通文字片段拆成单个字符，以便逐字加上字距。
+// 整形过的片段（阿拉伯文等连写的文字）拆开后无法连写，保持整段
+func splitLetters(segments []textSegment) []textSegment {
+	var out []textSegment
+	for _, seg := range segments {
+		if seg.emoji != nil || seg.shaped != nil {
+			out = append(out, seg)
+			continue
+		}
+		for _, r := range seg.text {
+			out = append(out, textSegment{text: string(r), font: seg.font, fontPath: seg.fontPath})
+		}
+	}
+	return out
+}
+
+// resolveLineStyle 返回第 i 行的样式：watermarkSettings.lines 中有对应条目时按条目设置，否则与基准样式相同
+func resolveLineStyle(ws *WatermarkSettings, i int, fontSize float64) lineStyle {
+	var st lineStyle
+	if i < len(ws.Lines) {
+		st.LineStyle = ws.Lines[i]
+	}
+	st.size = fontSize
+	if st.Scale > 0 {
+		st.size = fontSize * st.Scale
+	}
+	fontPath := config.FontPath
+	if st.FontPath != "" {
+		fontPath = st.FontPath
+	}
+	f, err := loadFont(fontPath)
+	if err != nil && fontPath != config.FontPath {
+		log.Printf("第 %d 行: %v，改用默认字体", i+1, err)
+		f, err = loadFont(config.FontPath)
+	}
+	if err == nil {
+		st.font = f
+		st.fontPath = fontPath
+	}
+	return st
+}
+
+// fillColor 返回该行的文字颜色：配置了 color 时替换默认颜色（开启自适应颜色时不替换），再按 opacity 降低不透明度
+func (st lineStyle) fillColor(base RGBAColor, adaptive bool) color.NRGBA {
+	c := base
+	if st.Color != nil && !adaptive {
+		c = *st.Color
+	}
+	if st.Opacity > 0 {
+		return c.withOpacity(st.Opacity)
+	}
+	return color.NRGBA{c.R, c.G, c.B, c.A}
+}
+
+// clampFontSize 把按比例换算出的字号限制在 minFontPx 和 maxFontPx 之间，
+// 小截图上的文字不至于看不清，大尺寸照片上也不会大得夸张
+func clampFontSize(ws *WatermarkSettings, size float64) float64 {
+	if ws.MinFontPx > 0 {
+		size = math.Max(size, ws.MinFontPx)
+	}
+	if ws.MaxFontPx > 0 {
+		size = math.Min(size, ws.MaxFontPx)
+	}
+	return size
+}
+
+// resolveSize 把配置的尺寸换算成像素。unit 为 ratio 时按参考边长的比例计算，
+// 为 px/pt 时是绝对像素（以 72 DPI 绘制，1pt 即 1 像素），为空或 auto 时小于 1 视为比例，否则视为像素
+func resolveSize(value float64, reference int, unit string) float64 {
+	switch strings.ToLower(unit) {
+	case "px", "pt":
+		return value
+	case "ratio":
+		return value * float64(reference)
+	default:
+		if value < 1 {
+			return value * float64(reference)
+		}
+		return value
+	}
+}
+
+// anchorFactors 把位置名称转换成水平、垂直方向的比例：0 靠左/上，0.5 居中，1 靠右/下
+func anchorFactors(position string) (fx, fy float64) {
+	fx, fy = 1, 1
+	p := strings.ToLower(strings.TrimSpace(position))
+	if p == "" {
+		return
+	}
+	if p == "center" || p == "middle" {
+		return 0.5, 0.5
+	}
+
+	switch {
+	case strings.Contains(p, "left"):
+		fx = 0
+	case strings.Contains(p, "right"):
+		fx = 1
+	default:
+		fx = 0.5
+	}
+	switch {
+	case strings.Contains(p, "top"):
+		fy = 0
+	case strings.Contains(p, "bottom"):
+		fy = 1
+	default:
+		fy = 0.5
+	}
+	return
+}
+
+// anchorOffset 计算锚点方向上的起始坐标，贴边时留出 padding，居中时忽略 padding
+func anchorOffset(min, total, size, padding int, factor float64) int {
+	switch factor {
+	case 0:
+		return min + padding
+	case 1:
+		return min + total - size - padding
+	default:
+		return min + int(float64(total-size)*factor)
+	}
+}
+
+// estimateLineWidth 在字体无法加载时估算一行文字的宽度（以字号为单位）：半角字符约半个字宽，全角字符一个字宽
+func estimateLineWidth(line string) float64 {
+	var w float64
+	for _, r := range line {
+		if r < 0x80 {
+			w += 0.5
+		} else {
+			w += 1
+		}
+	}
+	return w
+}
+
+// watermarkRegion 返回一个水印块（含描边、阴影和渐变）可能覆盖的矩形区域
+func watermarkRegion(bounds image.Rectangle, wm *watermark) image.Rectangle {
+	l := layoutWatermark(bounds, wm)
+	region := textRegion(l)
+	if angle := wm.ws.Rotation; angle != 0 {
+		w, h := rotatedSize(region.Size(), angle)
+		region = rotatedPlacement(bounds, region, image.Pt(w, h))
+	}
+	return region.Union(scrimRect(wm.ws, bounds, wm.position)).Intersect(bounds)
+}
+
+// textRegion 返回未旋转时文字块（含描边、阴影、底板和品牌标志）可能覆盖的矩形
+func textRegion(l watermarkLayout) image.Rectangle {
+	dx, dy := shadowOffset(l.ws, l.fontSize)
+	margin := int(l.fontSize) + 8 + strokeWidth(l.ws, l.fontSize) + max(absInt(dx)+shadowBlur(l.ws, l.fontSize), absInt(dy)+shadowBlur(l.ws, l.fontSize), backgroundPadding(l.ws, l.fontSize))
+	return image.Rect(l.x-margin, l.y-margin, l.x+l.maxWidth+margin, l.y+l.height+margin).Union(l.brand)
+}
+
+// rotatedSize 返回 size 大小的矩形旋转 angle 度后的外接矩形尺寸
+func rotatedSize(size image.Point, angle float64) (int, int) {
+	rad := angle * math.Pi / 180
+	sin, cos := math.Abs(math.Sin(rad)), math.Abs(math.Cos(rad))
+	w := float64(size.X)*cos + float64(size.Y)*sin
+	h := float64(size.X)*sin + float64(size.Y)*cos
+	return int(math.Ceil(w)) + 2, int(math.Ceil(h)) + 2
+}
+
+// rotatedPlacement 让旋转后的图层与原文字块中心对齐，超出图片时往里移
+func rotatedPlacement(bounds, region image.Rectangle, size image.Point) image.Rectangle {
+	center := region.Min.Add(region.Max).Div(2)
+	r := image.Rectangle{Min: center.Sub(size.Div(2))}
+	r.Max = r.Min.Add(size)
+
+	shift := image.Point{}
+	if r.Max.X > bounds.Max.X {
+		shift.X = bounds.Max.X - r.Max.X
+	}
+	if r.Min.X+shift.X < bounds.Min.X {
+		shift.X = bounds.Min.X - r.Min.X
+	}
+	if r.Max.Y > bounds.Max.Y {
+		shift.Y = bounds.Max.Y - r.Max.Y
+	}
+	if r.Min.Y+shift.Y < bounds.Min.Y {
+		shift.Y = bounds.Min.Y - r.Min.Y
+	}
+	return r.Add(shift)
+}
+
+// drawWatermark 在 dst 上绘制全部水印块和标志，坐标以整张图片的 bounds 为准，
+// dst 可以只是图片中的一块区域
+func drawWatermark(dst draw.Image, bounds image.Rectangle, wms []*watermark) {
+	if _, err := loadFont(config.FontPath); err != nil {
+		log.Print(err)
+		return
+	}
+
+	for _, wm := range wms {
+		drawScrim(dst, bounds, wm)
+	}
+	drawLogo(dst, bounds)
+	drawQRCode(dst, bounds, wms[0])
+	drawMiniMap(dst, bounds, wms[0])
+	drawHistogram(dst, bounds, wms[0])
+	if logoEnabled() && config.Logo.HideText {
+		return
+	}
+	for _, wm := range wms {
+		drawTextWatermark(dst, bounds, wm)
+	}
+}
+
+// drawTextWatermark 绘制一个水印块的文字，设置了 rotation 时旋转后叠加
+func drawTextWatermark(dst draw.Image, bounds image.Rectangle, wm *watermark) {
+	l := layoutWatermark(bounds, wm)
+	angle := wm.ws.Rotation
+	mode := wm.ws.BlendMode
+	if angle == 0 && blendModes[mode] == nil {
+		drawTextBlock(dst, dst, l, wm)
+		return
+	}
+
+	// 旋转或混合时先把文字块画在单独的透明图层上，旋转后再叠加到原位置
+	region := textRegion(l)
+	layer := image.NewRGBA(region)
+	drawTextBlock(layer, dst, l, wm)
+	if angle == 0 {
+		drawBlended(dst, region, layer, mode)
+		return
+	}
+	rotated := imaging.Rotate(layer, angle, color.Transparent)
+	target := rotatedPlacement(bounds, region, rotated.Bounds().Size())
+	drawBlended(dst, target, rotated, mode)
+}
+
+// drawTextBlock 绘制底板、品牌标志和文字（阴影、描边、正文），backdrop 用于自适应颜色的背景采样
+func drawTextBlock(dst draw.Image, backdrop image.Image, l watermarkLayout, wm *watermark) {
+	drawBackground(dst, l)
+	drawBrandLogo(dst, wm.brand, l.brand)
+	fill, strokeColor := watermarkColors(backdrop, l)
+
+	c := freetype.NewContext()
+	c.SetDPI(72)
+
+	// drawRun 把一段文字平移 offset 后绘制到 target 上，整形过的文字按字形轮廓绘制，其余用 freetype 逐字绘制
+	drawRun := func(target draw.Image, run textRun, st lineStyle, src image.Image, offset image.Point) error {
+		if run.shaped != nil {
+			run.shaped.draw(target, src, run.dot.Add(offset))
+			return nil
+		}
+		if run.font != nil {
+			c.SetFont(run.font)
+		} else {
+			c.SetFont(st.font)
+		}
+		c.SetClip(target.Bounds())
+		c.SetDst(target)
+		c.SetFontSize(st.size)
+		c.SetSrc(src)
+		_, err := c.DrawString(run.text, freetype.Pt(run.dot.X+offset.X, run.dot.Y+offset.Y))
+		return err
+	}
+
+	// 阴影和描边都由文字的覆盖遮罩生成，字形只需光栅化一次。
+	// 遮罩比 dst 多出描边宽度和阴影偏移，dst 只是图片中的一块时，块外的文字也能在块内留下描边和阴影
+	sw := strokeWidth(l.ws, l.fontSize)
+	dx, dy := shadowOffset(l.ws, l.fontSize)
+	blur := shadowBlur(l.ws, l.fontSize)
+	shadow := l.ws.Shadow
+	drawShadow := shadow.Enabled && shadow.Opacity > 0
+	if drawShadow || sw > 0 {
+		reach := max(sw, absInt(dx)+blur, absInt(dy)+blur) + 1
+		rect := l.block().Inset(-reach - int(l.fontSize)).Intersect(dst.Bounds().Inset(-reach))
+		glyphs := image.NewAlpha(rect)
+		for _, run := range l.runs {
+			st := l.styles[run.line]
+			if st.font == nil || run.emoji != nil {
+				continue
+			}
+			if err := drawRun(glyphs, run, st, image.Opaque, image.Point{}); err != nil {
+				log.Printf("绘制文本轮廓失败: %v", err)
+			}
+		}
+
+		// 空心字只保留文字外围的一圈描边，阴影也由这一圈投下，透过字的内部能看到照片
+		var outline *image.Alpha
+		shape := glyphs
+		if sw > 0 {
+			outline = dilateMask(glyphs, sw)
+			if l.ws.Stroke.Hollow {
+				subtractMask(outline, glyphs)
+				shape = outline
+			}
+		}
+
+		// 先绘制阴影，被描边和文字覆盖。模糊时对遮罩做一次高斯模糊，阴影边缘柔和过渡
+		if drawShadow {
+			offset := image.Pt(dx, dy)
+			area := rect.Add(offset).Intersect(dst.Bounds())
+			src := image.NewUniform(shadow.Color.withOpacity(shadow.Opacity))
+			var mask image.Image = shape
+			mp := area.Min.Sub(offset)
+			if blur > 0 {
+				// 模糊半径约为 2 倍标准差，imaging.Blur 的结果从 (0, 0) 开始
+				mask = imaging.Blur(shape, float64(blur)/2)
+				mp = mp.Sub(rect.Min)
+			}
+			draw.DrawMask(dst, area, src, image.Point{}, mask, mp, draw.Over)
+		}
+
+		// 再绘制描边
+		if outline != nil {
+			area := rect.Intersect(dst.Bounds())
+			draw.DrawMask(dst, area, image.NewUniform(strokeColor.toRGBA()), image.Point{}, outline, area.Min, draw.Over)
+		}
+	}
+
+	// 最后绘制主要文本，加粗的行在四周小幅偏移重复绘制
+	for _, run := range l.runs {
+		st := l.styles[run.line]
+		if run.emoji != nil {
+			drawBrandLogo(dst, run.emoji, run.emojiRect(st.size))
+			continue
+		}
+		if st.font == nil {
+			continue
+		}
+		src := image.NewUniform(st.fillColor(fill, l.ws.AdaptiveColor.Enabled))
+		offsets := []image.Point{{}}
+		if st.Bold {
+			offsets = append(offsets, strokeOffsets(max(1, int(st.size/30)))...)
+		}
+		for _, offset := range offsets {
+			if err := drawRun(dst, run, st, src, offset); err != nil {
+				log.Printf("绘制主要文本失败: %v", err)
+			}
+		}
+	}
+}
+
+// strokeWidth 返回描边宽度（像素），未启用描边时为 0
+func strokeWidth(ws *WatermarkSettings, fontSize float64) int {
+	stroke := ws.Stroke
+	if !stroke.Enabled {
+		return 0
+	}
+	return int(math.Round(resolveSize(stroke.Width, int(fontSize), ws.Unit)))
+}
+
+// shadowOffset 返回阴影的偏移（像素），未启用阴影时为 0
+func shadowOffset(ws *WatermarkSettings, fontSize float64) (dx, dy int) {
+	shadow := ws.Shadow
+	if !shadow.Enabled {
+		return 0, 0
+	}
+	unit := ws.Unit
+	dx = int(math.Round(resolveSize(math.Abs(shadow.OffsetX), int(fontSize), unit) * sign(shadow.OffsetX)))
+	dy = int(math.Round(resolveSize(math.Abs(shadow.OffsetY), int(fontSize), unit) * sign(shadow.OffsetY)))
+	return dx, dy
+}
+
+// shadowBlur 返回阴影的模糊半径（像素），未启用阴影时为 0
+func shadowBlur(ws *WatermarkSettings, fontSize float64) int {
+	shadow := ws.Shadow
+	if !shadow.Enabled || shadow.Blur <= 0 {
+		return 0
+	}
+	return int(math.Round(resolveSize(shadow.Blur, int(fontSize), ws.Unit)))
+}
+
+func sign(v float64) float64 {
+	if v < 0 {
+		return -1
+	}
+	return 1
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// strokeOffsets 返回加粗时文字的平移量：在半径为 width 的圆内每隔 2 像素取一圈，
+// 每圈按约 1 像素的间距取点，叠加后形成均匀的轮廓
+func strokeOffsets(width int) []image.Point {
+	if width <= 0 {
+		return nil
+	}
+	seen := map[image.Point]bool{}
+	var offsets []image.Point
+	for r := width; r > 0; r -= 2 {
+		n := max(8, int(math.Ceil(2*math.Pi*float64(r))))
+		for i := 0; i < n; i++ {
+			a := 2 * math.Pi * float64(i) / float64(n)
+			p := image.Pt(int(math.Round(float64(r)*math.Cos(a))), int(math.Round(float64(r)*math.Sin(a))))
+			if !seen[p] {
+				seen[p] = true
+				offsets = append(offsets, p)
+			}
+		}
+	}
+	return offsets
+}
+
+func copyToNoExifFolder(filename string, data []byte) error {
+	if dryRun {
+		newPath := ""
+		if !config.InPlace {
+			newPath = filepath.Join(config.NoExifFolder, filename)
+		}
+		dryRunCopy("无EXIF", filename, newPath, "")
+		return nil
+	}
+	if config.InPlace {
+		log.Printf("%s 没有EXIF信息，原地模式下保持不变", filename)
+		addRecord(ImageRecord{Source: filename, Status: StatusNoExif})
+		emitProgress(ProgressEvent{Type: FileDone, Filename: filename, OutputPath: filename})
+		return nil
+	}
+
+	newPath := filepath.Join(config.NoExifFolder, filename)
+
+	if err := writeOutputFile(newPath, data); err != nil {
+		return fmt.Errorf("复制文件内容失败: %v", err)
+	}
+
+	log.Printf("已复制文件: %s -> %s", filename, newPath)
+	if config.MoveOriginals {
+		if err := moveOriginal(filename, newPath); err != nil {
+			log.Printf("%s: %v", filename, err)
+		}
+	}
+	addRecord(ImageRecord{Source: filename, Output: newPath, Status: StatusNoExif})
+	emitProgress(ProgressEvent{Type: FileDone, Filename: filename, OutputPath: newPath})
+	return nil
+}
@@ -0,0 +1,146 @@
+package watermark
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 历史天气按 GPS 坐标和拍摄日期查询 Open-Meteo 的历史天气 API，
+// 一次请求返回当天 24 小时的数据，同一天、同一地点（约 1 公里内）的照片只请求一次
+
+var weatherClient = &http.Client{Timeout: 20 * time.Second}
+
+// weatherDay 是某地某天逐小时的天气，按请求缓存
+type weatherDay struct {
+	once  sync.Once
+	hours map[string]weatherHour // 键为当地时间 2006-01-02T15:00
+	err   error
+}
+
+type weatherHour struct {
+	temperature float64 // 摄氏度
+	code        int     // WMO 天气代码
+}
+
+var (
+	weatherCacheMu sync.Mutex
+	weatherCache   = map[string]*weatherDay{}
+)
+
+// wmoWeatherNames 是 WMO 天气代码对应的中文天气现象
+var wmoWeatherNames = map[int]string{
+	0: "晴", 1: "晴间多云", 2: "多云", 3: "阴",
+	45: "雾", 48: "雾凇",
+	51: "小毛毛雨", 53: "毛毛雨", 55: "大毛毛雨", 56: "冻毛毛雨", 57: "冻毛毛雨",
+	61: "小雨", 63: "中雨", 65: "大雨", 66: "冻雨", 67: "冻雨",
+	71: "小雪", 73: "中雪", 75: "大雪", 77: "米雪",
+	80: "小阵雨", 81: "阵雨", 82: "强阵雨", 85: "阵雪", 86: "强阵雪",
+	95: "雷阵雨", 96: "雷阵雨伴有冰雹", 99: "雷阵雨伴有冰雹",
+}
+
+// readWeather 查询拍摄时的天气，填入模板变量；未启用、照片没有 GPS 或查询失败时保持为空
+func readWeather(info *PhotoInfo) {
+	if !config.Weather.Enabled || !info.HasGPS {
+		return
+	}
+
+	// 拍摄时间是当地时间，直接用日期和小时匹配 API 按当地时区返回的数据
+	date := info.Time.Format("2006-01-02")
+	key := fmt.Sprintf("%.2f,%.2f/%s", info.Latitude, info.Longitude, date)
+	weatherCacheMu.Lock()
+	day, ok := weatherCache[key]
+	if !ok {
+		day = &weatherDay{}
+		weatherCache[key] = day
+	}
+	weatherCacheMu.Unlock()
+
+	// 同时处理的几张照片只有第一张发出请求，其余等待结果
+	day.once.Do(func() {
+		day.hours, day.err = fetchWeatherDay(info.Latitude, info.Longitude, date)
+		if day.err != nil {
+			log.Printf("查询 %s 的天气失败: %v", date, day.err)
+		}
+	})
+	if day.err != nil {
+		return
+	}
+
+	hour, ok := day.hours[info.Time.Format("2006-01-02T15:00")]
+	if !ok {
+		return
+	}
+	info.Temperature = fmt.Sprintf("%.0f°C", math.Round(hour.temperature))
+	info.Conditions = wmoWeatherNames[hour.code]
+	info.Weather = strings.TrimSpace(info.Conditions + " " + info.Temperature)
+}
+
+// fetchWeatherDay 请求某地某天逐小时的气温和天气代码
+func fetchWeatherDay(lat, long float64, date string) (map[string]weatherHour, error) {
+	w := config.Weather
+	switch strings.ToLower(w.Provider) {
+	case "", "open-meteo":
+	default:
+		return nil, fmt.Errorf("不支持的天气服务: %s", w.Provider)
+	}
+
+	// 填写了 apiKey 时使用 Open-Meteo 的商业接口
+	endpoint := "https://archive-api.open-meteo.com/v1/archive"
+	if w.APIKey != "" {
+		endpoint = "https://customer-archive-api.open-meteo.com/v1/archive"
+	}
+	q := url.Values{}
+	q.Set("latitude", fmt.Sprintf("%.4f", lat))
+	q.Set("longitude", fmt.Sprintf("%.4f", long))
+	q.Set("start_date", date)
+	q.Set("end_date", date)
+	q.Set("hourly", "temperature_2m,weather_code")
+	q.Set("timezone", "auto")
+	if w.APIKey != "" {
+		q.Set("apikey", w.APIKey)
+	}
+
+	resp, err := weatherClient.Get(endpoint + "?" + q.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("天气 API 请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取天气 API 响应失败: %v", err)
+	}
+
+	var result struct {
+		Reason string `json:"reason"`
+		Hourly struct {
+			Time        []string   `json:"time"`
+			Temperature []*float64 `json:"temperature_2m"`
+			WeatherCode []*int     `json:"weather_code"`
+		} `json:"hourly"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("解析天气 API 响应失败，状态码: %d，响应体内容: %.200s，错误信息: %v", resp.StatusCode, body, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("天气 API 返回错误: %d %s", resp.StatusCode, result.Reason)
+	}
+
+	// 最近几天的数据可能还没有整理好，对应的值为 null
+	hours := map[string]weatherHour{}
+	h := result.Hourly
+	for i, t := range h.Time {
+		if i >= len(h.Temperature) || i >= len(h.WeatherCode) || h.Temperature[i] == nil || h.WeatherCode[i] == nil {
+			continue
+		}
+		hours[t] = weatherHour{temperature: *h.Temperature[i], code: *h.WeatherCode[i]}
+	}
+	return hours, nil
+}
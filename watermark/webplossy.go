@@ -0,0 +1,701 @@
+package watermark
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+// 有损 WebP（VP8 关键帧）编码。nativewebp 只能无损编码，这里实现一个简单的编码器：
+// 每个宏块在 16x16 亮度和 8x8 色度的 DC、V、H、TM 四种预测中取误差最小的一种，
+// 残差按 RFC 6386 变换、量化后用默认概率表编码，不做环路滤波，也不更新概率表
+
+// vp8Bands 把系数序号换算为概率表中的频带
+var vp8Bands = [17]int{0, 1, 2, 3, 6, 4, 5, 6, 6, 6, 6, 6, 6, 6, 6, 7, 0}
+
+// vp8Zigzag 把系数的编码顺序换算为 4x4 块中按行排列的序号
+var vp8Zigzag = [16]int{0, 1, 4, 8, 5, 2, 3, 6, 9, 12, 13, 10, 7, 11, 14, 15}
+
+// 系数类别 cat3～cat6 的附加位使用的固定概率
+var vp8CatProbs = [4][]uint8{
+	{173, 148, 140},
+	{176, 155, 140, 135},
+	{180, 157, 141, 134, 130},
+	{254, 254, 243, 230, 196, 177, 153, 140, 133, 130, 129},
+}
+
+// 预测模式，同时也是模式在树形编码中的顺序
+const (
+	vp8PredDC = iota
+	vp8PredV
+	vp8PredH
+	vp8PredTM
+)
+
+// 系数概率表中的平面类型
+const (
+	vp8PlaneYAfterY2 = 0
+	vp8PlaneY2       = 1
+	vp8PlaneUV       = 2
+)
+
+// encodeWebPLossy 把图片编码为有损 WebP，quality 为 1～100。extended 为 true 时使用 VP8X 扩展格式，
+// 之后可以追加 EXIF、XMP 块。有损 WebP 不带透明通道
+func encodeWebPLossy(img image.Image, quality int, extended bool) ([]byte, error) {
+	b := img.Bounds()
+	if b.Dx() > 16383 || b.Dy() > 16383 {
+		return nil, fmt.Errorf("有损 WebP 的宽高不能超过 16383 像素，当前为 %dx%d", b.Dx(), b.Dy())
+	}
+	e := newVP8Encoder(imaging.Clone(img), quality)
+	frame := e.encode()
+
+	var out []byte
+	out = append(out, "RIFF\x00\x00\x00\x00WEBP"...)
+	if extended {
+		out = append(out, "VP8X"...)
+		out = binary.LittleEndian.AppendUint32(out, 10)
+		out = append(out, 0, 0, 0, 0)
+		out = appendUint24(out, uint32(b.Dx()-1))
+		out = appendUint24(out, uint32(b.Dy()-1))
+	}
+	out = append(out, "VP8 "...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(frame)))
+	out = append(out, frame...)
+	if len(frame)%2 == 1 {
+		out = append(out, 0)
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+func appendUint24(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16))
+}
+
+// vp8Quant 是一个平面的 DC、AC 量化步长
+type vp8Quant struct {
+	dc, ac int32
+}
+
+// vp8Encoder 保存编码一帧的状态。y、u、v 为补齐到宏块整数倍的原图，
+// ry、ru、rv 为解码器会得到的重建图像，后面宏块的预测以它为准
+type vp8Encoder struct {
+	width, height int
+	mbw, mbh      int
+	qi            int
+	y1, y2, uv    vp8Quant
+
+	y, u, v    []uint8
+	ry, ru, rv []uint8
+	yStride    int
+	cStride    int
+
+	header *vp8BoolEncoder // 第一分区：帧头和每个宏块的预测模式
+	tokens *vp8BoolEncoder // 第二分区：系数
+
+	// 每个 4x4 块是否有非零系数，作为相邻块编码的上下文：
+	// 0～3 为亮度，4～5 为 U，6～7 为 V，8 为 Y2
+	topNz  [][9]bool
+	leftNz [9]bool
+}
+
+func newVP8Encoder(img *image.NRGBA, quality int) *vp8Encoder {
+	b := img.Bounds()
+	e := &vp8Encoder{width: b.Dx(), height: b.Dy()}
+	e.mbw, e.mbh = (e.width+15)/16, (e.height+15)/16
+	e.yStride, e.cStride = e.mbw*16, e.mbw*8
+
+	// 品质 100 对应最小的量化索引 0，品质 1 对应最大的 127
+	e.qi = max(0, min(127, (100-quality)*127/99))
+	e.y1 = vp8Quant{vp8DCQuant[e.qi], vp8ACQuant[e.qi]}
+	e.y2 = vp8Quant{vp8DCQuant[e.qi] * 2, max(8, vp8ACQuant[e.qi]*155/100)}
+	e.uv = vp8Quant{vp8DCQuant[min(e.qi, 117)], vp8ACQuant[e.qi]}
+
+	e.y = make([]uint8, e.yStride*e.mbh*16)
+	e.u = make([]uint8, e.cStride*e.mbh*8)
+	e.v = make([]uint8, e.cStride*e.mbh*8)
+	e.ry = make([]uint8, len(e.y))
+	e.ru = make([]uint8, len(e.u))
+	e.rv = make([]uint8, len(e.v))
+	e.convert(img)
+
+	e.header = newVP8BoolEncoder()
+	e.tokens = newVP8BoolEncoder()
+	e.topNz = make([][9]bool, e.mbw)
+	return e
+}
+
+// convert 按 BT.601（亮度 16～235）把图片换算为 YUV 4:2:0，右边和下边复制边缘像素补齐到宏块的整数倍
+func (e *vp8Encoder) convert(img *image.NRGBA) {
+	b := img.Bounds()
+	rgb := func(x, y int) (int32, int32, int32) {
+		x, y = min(x, e.width-1), min(y, e.height-1)
+		i := img.PixOffset(b.Min.X+x, b.Min.Y+y)
+		return int32(img.Pix[i]), int32(img.Pix[i+1]), int32(img.Pix[i+2])
+	}
+	for y := range e.mbh * 16 {
+		for x := range e.yStride {
+			r, g, bl := rgb(x, y)
+			e.y[y*e.yStride+x] = uint8((16839*r + 33059*g + 6420*bl + 16<<16 + 1<<15) >> 16)
+		}
+	}
+	for y := range e.mbh * 8 {
+		for x := range e.cStride {
+			var r, g, bl int32
+			for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				pr, pg, pb := rgb(2*x+d[0], 2*y+d[1])
+				r, g, bl = r+pr, g+pg, bl+pb
+			}
+			e.u[y*e.cStride+x] = clip8((-9719*r - 19081*g + 28800*bl + 128<<18 + 1<<17) >> 18)
+			e.v[y*e.cStride+x] = clip8((28800*r - 24116*g - 4684*bl + 128<<18 + 1<<17) >> 18)
+		}
+	}
+}
+
+// encode 编码整帧，返回 VP8 数据（帧标记、起始码、宽高和两个分区）
+func (e *vp8Encoder) encode() []byte {
+	e.writeFrameHeader()
+	for mby := range e.mbh {
+		e.leftNz = [9]bool{}
+		for mbx := range e.mbw {
+			e.encodeMacroblock(mbx, mby)
+		}
+	}
+	first, second := e.header.finish(), e.tokens.finish()
+
+	size := len(first)
+	out := []byte{byte(size<<5) | 1<<4, byte(size >> 3), byte(size >> 11), 0x9d, 0x01, 0x2a}
+	out = binary.LittleEndian.AppendUint16(out, uint16(e.width))
+	out = binary.LittleEndian.AppendUint16(out, uint16(e.height))
+	out = append(out, first...)
+	return append(out, second...)
+}
+
+// writeFrameHeader 写入关键帧的帧头（RFC 6386 第 9 节）：不分段、不滤波、一个系数分区、使用默认概率
+func (e *vp8Encoder) writeFrameHeader() {
+	h := e.header
+	h.writeLiteral(0, 2) // 色彩空间、像素值截断方式
+	h.writeLiteral(0, 1) // 不分段
+	h.writeLiteral(0, 1) // 滤波器类型
+	h.writeLiteral(0, 6) // 环路滤波强度 0，即不滤波
+	h.writeLiteral(0, 3) // 锐度
+	h.writeLiteral(0, 1) // 不按参考帧、模式调整滤波强度
+	h.writeLiteral(0, 2) // 一个系数分区
+	h.writeLiteral(uint32(e.qi), 7)
+	h.writeLiteral(0, 5) // 各平面的量化索引都不另加偏移
+	h.writeLiteral(1, 1) // refresh_entropy_probs
+	for i := range vp8TokenUpdateProbs {
+		for j := range vp8TokenUpdateProbs[i] {
+			for k := range vp8TokenUpdateProbs[i][j] {
+				for _, p := range vp8TokenUpdateProbs[i][j][k] {
+					h.writeBool(p, false)
+				}
+			}
+		}
+	}
+	h.writeLiteral(0, 1) // 不使用宏块跳过标志，每个宏块都编码系数
+}
+
+// encodeMacroblock 选择预测模式，编码一个宏块的模式和系数，并写入重建结果
+func (e *vp8Encoder) encodeMacroblock(mbx, mby int) {
+	// 亮度：16x16 预测，各 4x4 块的 DC 另外组成 Y2 块做 Walsh-Hadamard 变换
+	yMode, yPred := e.choosePrediction(e.y, e.ry, e.yStride, mbx, mby, 16)
+	var yCoeffs [16][16]int32
+	var dcs [16]int32
+	for n := range 16 {
+		x, y := mbx*16+n%4*4, mby*16+n/4*4
+		vp8ForwardDCT(e.residual(e.y, e.yStride, x, y, yPred[:], 16, n%4*4, n/4*4), &yCoeffs[n])
+		dcs[n] = yCoeffs[n][0]
+	}
+	var y2 [16]int32
+	vp8ForwardWHT(&dcs, &y2)
+	quantizeBlock(&y2, e.y2)
+	for n := range yCoeffs {
+		quantizeBlock(&yCoeffs[n], e.y1)
+	}
+
+	uMode, uvPred := e.chooseChromaPrediction(mbx, mby)
+	var uvCoeffs [8][16]int32
+	for n := range 8 {
+		src, pred := e.u, uvPred[0][:]
+		if n >= 4 {
+			src, pred = e.v, uvPred[1][:]
+		}
+		x, y := n%2*4, n%4/2*4
+		vp8ForwardDCT(e.residual(src, e.cStride, mbx*8+x, mby*8+y, pred, 8, x, y), &uvCoeffs[n])
+		quantizeBlock(&uvCoeffs[n], e.uv)
+	}
+
+	// 模式：16x16 亮度预测（不是 B_PRED），再写亮度和色度的模式
+	h := e.header
+	h.writeBool(145, true)
+	switch yMode {
+	case vp8PredDC, vp8PredV:
+		h.writeBool(156, false)
+		h.writeBool(163, yMode == vp8PredV)
+	default:
+		h.writeBool(156, true)
+		h.writeBool(128, yMode == vp8PredTM)
+	}
+	h.writeBool(142, uMode != vp8PredDC)
+	if uMode != vp8PredDC {
+		h.writeBool(114, uMode != vp8PredV)
+		if uMode != vp8PredV {
+			h.writeBool(183, uMode == vp8PredTM)
+		}
+	}
+
+	// 系数，上下文为左边和上边相邻块是否有非零系数
+	top := &e.topNz[mbx]
+	nz := e.writeBlock(&y2, vp8PlaneY2, 0, b2i(e.leftNz[8])+b2i(top[8]))
+	e.leftNz[8], top[8] = nz, nz
+	for n := range 16 {
+		x, y := n%4, n/4
+		nz := e.writeBlock(&yCoeffs[n], vp8PlaneYAfterY2, 1, b2i(e.leftNz[y])+b2i(top[x]))
+		e.leftNz[y], top[x] = nz, nz
+	}
+	for n := range 8 {
+		base := 4 + n/4*2
+		x, y := n%2, n%4/2
+		nz := e.writeBlock(&uvCoeffs[n], vp8PlaneUV, 0, b2i(e.leftNz[base+y])+b2i(top[base+x]))
+		e.leftNz[base+y], top[base+x] = nz, nz
+	}
+
+	// 重建：与解码器相同地反量化、反变换后加上预测值
+	var dq [16]int32
+	dequantizeBlock(&y2, e.y2, &dq)
+	var ydc [16]int32
+	vp8InverseWHT(&dq, &ydc)
+	for n := range 16 {
+		dequantizeBlock(&yCoeffs[n], e.y1, &dq)
+		dq[0] = ydc[n]
+		x, y := n%4*4, n/4*4
+		vp8InverseDCT(&dq, yPred[:], 16, x, y, e.ry, e.yStride, mbx*16+x, mby*16+y)
+	}
+	for n := range 8 {
+		dst, pred := e.ru, uvPred[0][:]
+		if n >= 4 {
+			dst, pred = e.rv, uvPred[1][:]
+		}
+		dequantizeBlock(&uvCoeffs[n], e.uv, &dq)
+		x, y := n%2*4, n%4/2*4
+		vp8InverseDCT(&dq, pred, 8, x, y, dst, e.cStride, mbx*8+x, mby*8+y)
+	}
+}
+
+// residual 返回原图 src 在 (x, y) 处的 4x4 块减去预测值 pred（宽 size，块在其中的 (px, py) 处）的差
+func (e *vp8Encoder) residual(src []uint8, stride, x, y int, pred []uint8, size, px, py int) *[16]int32 {
+	var r [16]int32
+	for j := range 4 {
+		for i := range 4 {
+			r[j*4+i] = int32(src[(y+j)*stride+x+i]) - int32(pred[(py+j)*size+px+i])
+		}
+	}
+	return &r
+}
+
+// vp8Edges 返回宏块在重建图像中的上边一行、左边一列和左上角的像素。
+// 没有上边时为 127，没有左边时为 129，与解码器的约定相同
+func vp8Edges(rec []uint8, stride, mbx, mby, size int) (top, left []uint8, corner uint8) {
+	top, left = make([]uint8, size), make([]uint8, size)
+	x0, y0 := mbx*size, mby*size
+	for i := range size {
+		top[i], left[i] = 127, 129
+		if mby > 0 {
+			top[i] = rec[(y0-1)*stride+x0+i]
+		}
+		if mbx > 0 {
+			left[i] = rec[(y0+i)*stride+x0-1]
+		}
+	}
+	switch {
+	case mby == 0:
+		corner = 127
+	case mbx == 0:
+		corner = 129
+	default:
+		corner = rec[(y0-1)*stride+x0-1]
+	}
+	return top, left, corner
+}
+
+// vp8Predict 按模式生成 size x size 的预测块
+func vp8Predict(mode int, top, left []uint8, corner uint8, hasTop, hasLeft bool, size int) []uint8 {
+	p := make([]uint8, size*size)
+	switch mode {
+	case vp8PredDC:
+		var sum, n int
+		if hasTop {
+			for _, v := range top {
+				sum += int(v)
+			}
+			n += size
+		}
+		if hasLeft {
+			for _, v := range left {
+				sum += int(v)
+			}
+			n += size
+		}
+		dc := uint8(128)
+		if n > 0 {
+			dc = uint8((sum + n/2) / n)
+		}
+		for i := range p {
+			p[i] = dc
+		}
+	case vp8PredV:
+		for j := range size {
+			copy(p[j*size:], top)
+		}
+	case vp8PredH:
+		for j := range size {
+			for i := range size {
+				p[j*size+i] = left[j]
+			}
+		}
+	case vp8PredTM:
+		for j := range size {
+			for i := range size {
+				p[j*size+i] = clip8(int32(left[j]) + int32(top[i]) - int32(corner))
+			}
+		}
+	}
+	return p
+}
+
+// choosePrediction 在四种预测中选出与原图差的绝对值之和最小的一种
+func (e *vp8Encoder) choosePrediction(src, rec []uint8, stride, mbx, mby, size int) (int, []uint8) {
+	top, left, corner := vp8Edges(rec, stride, mbx, mby, size)
+	best, bestPred, bestSAD := 0, []uint8(nil), -1
+	for mode := vp8PredDC; mode <= vp8PredTM; mode++ {
+		p := vp8Predict(mode, top, left, corner, mby > 0, mbx > 0, size)
+		if sad := vp8SAD(src, stride, mbx*size, mby*size, p, size); bestSAD < 0 || sad < bestSAD {
+			best, bestPred, bestSAD = mode, p, sad
+		}
+	}
+	return best, bestPred
+}
+
+// chooseChromaPrediction 为 U、V 选出共同的预测模式，返回模式和两个平面的预测块
+func (e *vp8Encoder) chooseChromaPrediction(mbx, mby int) (int, [2][]uint8) {
+	ut, ul, uc := vp8Edges(e.ru, e.cStride, mbx, mby, 8)
+	vt, vl, vc := vp8Edges(e.rv, e.cStride, mbx, mby, 8)
+	best, bestSAD := 0, -1
+	var bestPred [2][]uint8
+	for mode := vp8PredDC; mode <= vp8PredTM; mode++ {
+		pu := vp8Predict(mode, ut, ul, uc, mby > 0, mbx > 0, 8)
+		pv := vp8Predict(mode, vt, vl, vc, mby > 0, mbx > 0, 8)
+		sad := vp8SAD(e.u, e.cStride, mbx*8, mby*8, pu, 8) + vp8SAD(e.v, e.cStride, mbx*8, mby*8, pv, 8)
+		if bestSAD < 0 || sad < bestSAD {
+			best, bestPred, bestSAD = mode, [2][]uint8{pu, pv}, sad
+		}
+	}
+	return best, bestPred
+}
+
+func vp8SAD(src []uint8, stride, x, y int, pred []uint8, size int) int {
+	sum := 0
+	for j := range size {
+		for i := range size {
+			d := int(src[(y+j)*stride+x+i]) - int(pred[j*size+i])
+			sum += max(d, -d)
+		}
+	}
+	return sum
+}
+
+// writeBlock 按 Z 字形顺序从第 first 个系数开始编码一个块，ctx 为上下文（相邻块中有非零系数的个数）。
+// 返回块中是否有编码的非零系数
+func (e *vp8Encoder) writeBlock(coeffs *[16]int32, plane, first, ctx int) bool {
+	last := -1
+	for n := 15; n >= first; n-- {
+		if coeffs[vp8Zigzag[n]] != 0 {
+			last = n
+			break
+		}
+	}
+	w := e.tokens
+	probs := &vp8DefaultTokenProbs[plane]
+	p := &probs[vp8Bands[first]][ctx]
+	if last < 0 {
+		w.writeBool(p[0], false) // 块结束
+		return false
+	}
+	afterZero := false
+	for n := first; n <= last; n++ {
+		if !afterZero {
+			w.writeBool(p[0], true) // 不是块结束
+		}
+		v := coeffs[vp8Zigzag[n]]
+		if v == 0 {
+			w.writeBool(p[1], false)
+			p, afterZero = &probs[vp8Bands[n+1]][0], true
+			continue
+		}
+		w.writeBool(p[1], true)
+		a := min(max(v, -v), 2048)
+		w.writeMagnitude(p, a)
+		w.writeBool(128, v < 0)
+		ctx := 2
+		if a == 1 {
+			ctx = 1
+		}
+		p, afterZero = &probs[vp8Bands[n+1]][ctx], false
+	}
+	if last < 15 {
+		w.writeBool(p[0], false)
+	}
+	return true
+}
+
+// writeMagnitude 按系数树编码非零系数的绝对值 a（RFC 6386 第 13.2 节）
+func (w *vp8BoolEncoder) writeMagnitude(p *[11]uint8, a int32) {
+	if a == 1 {
+		w.writeBool(p[2], false)
+		return
+	}
+	w.writeBool(p[2], true)
+	switch {
+	case a <= 4:
+		w.writeBool(p[3], false)
+		w.writeBool(p[4], a != 2)
+		if a != 2 {
+			w.writeBool(p[5], a == 4)
+		}
+	case a <= 10:
+		w.writeBool(p[3], true)
+		w.writeBool(p[6], false)
+		if a <= 6 {
+			w.writeBool(p[7], false)
+			w.writeBool(159, a == 6)
+		} else {
+			w.writeBool(p[7], true)
+			w.writeBool(165, (a-7)&2 != 0)
+			w.writeBool(145, (a-7)&1 != 0)
+		}
+	default:
+		w.writeBool(p[3], true)
+		w.writeBool(p[6], true)
+		cat, base := 3, int32(67)
+		switch {
+		case a <= 18:
+			cat, base = 0, 11
+		case a <= 34:
+			cat, base = 1, 19
+		case a <= 66:
+			cat, base = 2, 35
+		}
+		w.writeBool(p[8], cat >= 2)
+		w.writeBool(p[9+cat/2], cat%2 == 1)
+		probs := vp8CatProbs[cat]
+		for i, prob := range probs {
+			w.writeBool(prob, (a-base)>>(len(probs)-1-i)&1 != 0)
+		}
+	}
+}
+
+// quantizeBlock 把按行排列的系数量化，第 0 个用 DC 步长，其余用 AC 步长
+func quantizeBlock(c *[16]int32, q vp8Quant) {
+	for i := range c {
+		step := q.ac
+		if i == 0 {
+			step = q.dc
+		}
+		v := c[i]
+		if v < 0 {
+			c[i] = -((-v + step/2) / step)
+		} else {
+			c[i] = (v + step/2) / step
+		}
+		c[i] = max(-2048, min(2048, c[i]))
+	}
+}
+
+func dequantizeBlock(c *[16]int32, q vp8Quant, out *[16]int32) {
+	for i := range c {
+		step := q.ac
+		if i == 0 {
+			step = q.dc
+		}
+		out[i] = c[i] * step
+	}
+}
+
+// vp8ForwardDCT 是 libvpx 的 4x4 正变换，输入输出都按行排列
+func vp8ForwardDCT(in, out *[16]int32) {
+	var t [16]int32
+	for i := range 4 {
+		d := in[i*4 : i*4+4]
+		a1, b1 := (d[0]+d[3])*8, (d[1]+d[2])*8
+		c1, d1 := (d[1]-d[2])*8, (d[0]-d[3])*8
+		t[i*4+0] = a1 + b1
+		t[i*4+2] = a1 - b1
+		t[i*4+1] = (c1*2217 + d1*5352 + 14500) >> 12
+		t[i*4+3] = (d1*2217 - c1*5352 + 7500) >> 12
+	}
+	for i := range 4 {
+		a1, b1 := t[i]+t[12+i], t[4+i]+t[8+i]
+		c1, d1 := t[4+i]-t[8+i], t[i]-t[12+i]
+		out[i] = (a1 + b1 + 7) >> 4
+		out[8+i] = (a1 - b1 + 7) >> 4
+		out[4+i] = (c1*2217+d1*5352+12000)>>16 + b2i32(d1 != 0)
+		out[12+i] = (d1*2217 - c1*5352 + 51000) >> 16
+	}
+}
+
+// vp8ForwardWHT 对 16 个 DC 系数做 Walsh-Hadamard 变换，是 vp8InverseWHT 的逆运算
+func vp8ForwardWHT(in, out *[16]int32) {
+	var t [16]int32
+	for i := range 4 {
+		a1, d1 := in[i]+in[12+i], in[i]-in[12+i]
+		b1, c1 := in[4+i]+in[8+i], in[4+i]-in[8+i]
+		t[i], t[8+i] = a1+b1, a1-b1
+		t[4+i], t[12+i] = d1+c1, d1-c1
+	}
+	for i := range 4 {
+		r := t[i*4 : i*4+4]
+		a1, d1 := r[0]+r[3], r[0]-r[3]
+		b1, c1 := r[1]+r[2], r[1]-r[2]
+		for j, v := range [4]int32{a1 + b1, d1 + c1, a1 - b1, d1 - c1} {
+			// 反变换除以 8，正反合起来是 16 倍，这里除以 2
+			if v < 0 {
+				out[i*4+j] = -((-v + 1) >> 1)
+			} else {
+				out[i*4+j] = (v + 1) >> 1
+			}
+		}
+	}
+}
+
+// vp8InverseWHT 与解码器相同，得到 16 个亮度块的 DC 系数
+func vp8InverseWHT(in, out *[16]int32) {
+	var m [16]int32
+	for i := range 4 {
+		a0, a1 := in[i]+in[12+i], in[4+i]+in[8+i]
+		a2, a3 := in[4+i]-in[8+i], in[i]-in[12+i]
+		m[i], m[8+i] = a0+a1, a0-a1
+		m[4+i], m[12+i] = a3+a2, a3-a2
+	}
+	for i := range 4 {
+		dc := m[i*4] + 3
+		a0, a3 := dc+m[i*4+3], dc-m[i*4+3]
+		a1, a2 := m[i*4+1]+m[i*4+2], m[i*4+1]-m[i*4+2]
+		out[i*4+0] = (a0 + a1) >> 3
+		out[i*4+1] = (a3 + a2) >> 3
+		out[i*4+2] = (a0 - a1) >> 3
+		out[i*4+3] = (a3 - a2) >> 3
+	}
+}
+
+// vp8InverseDCT 与解码器相同地做 4x4 反变换，加上预测块 pred 中 (px, py) 处的值后写入 dst 的 (x, y) 处
+func vp8InverseDCT(c *[16]int32, pred []uint8, size, px, py int, dst []uint8, stride, x, y int) {
+	const (
+		c1 = 85627 // 65536·cos(π/8)·√2
+		c2 = 35468 // 65536·sin(π/8)·√2
+	)
+	var m [4][4]int32
+	for i := range 4 {
+		a, b := c[i]+c[8+i], c[i]-c[8+i]
+		cc := (c[4+i]*c2)>>16 - (c[12+i]*c1)>>16
+		d := (c[4+i]*c1)>>16 + (c[12+i]*c2)>>16
+		m[i] = [4]int32{a + d, b + cc, b - cc, a - d}
+	}
+	for j := range 4 {
+		dc := m[0][j] + 4
+		a, b := dc+m[2][j], dc-m[2][j]
+		cc := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		for i, r := range [4]int32{a + d, b + cc, b - cc, a - d} {
+			dst[(y+j)*stride+x+i] = clip8(int32(pred[(py+j)*size+px+i]) + r>>3)
+		}
+	}
+}
+
+func clip8(v int32) uint8 {
+	return uint8(max(0, min(255, v)))
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func b2i32(b bool) int32 {
+	return int32(b2i(b))
+}
+
+// vp8BoolEncoder 是 VP8 的布尔算术编码器（RFC 6386 第 7 节）
+type vp8BoolEncoder struct {
+	buf      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newVP8BoolEncoder() *vp8BoolEncoder {
+	return &vp8BoolEncoder{rng: 255, bitCount: 24}
+}
+
+// writeBool 写入一位，prob 为该位是 0 的概率（256 分之几）
+func (w *vp8BoolEncoder) writeBool(prob uint8, bit bool) {
+	split := 1 + (w.rng-1)*uint32(prob)>>8
+	if bit {
+		w.bottom += split
+		w.rng -= split
+	} else {
+		w.rng = split
+	}
+	for w.rng < 128 {
+		w.rng <<= 1
+		if w.bottom&(1<<31) != 0 {
+			w.carry()
+		}
+		w.bottom <<= 1
+		w.bitCount--
+		if w.bitCount == 0 {
+			w.buf = append(w.buf, byte(w.bottom>>24))
+			w.bottom &= 1<<24 - 1
+			w.bitCount = 8
+		}
+	}
+}
+
+// writeLiteral 以均等概率从高位到低位写入 n 位
+func (w *vp8BoolEncoder) writeLiteral(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBool(128, v>>i&1 != 0)
+	}
+}
+
+// carry 把进位加到已经输出的字节上
+func (w *vp8BoolEncoder) carry() {
+	for i := len(w.buf) - 1; i >= 0; i-- {
+		w.buf[i]++
+		if w.buf[i] != 0 {
+			return
+		}
+	}
+}
+
+// finish 输出剩余的位，返回编码结果
+func (w *vp8BoolEncoder) finish() []byte {
+	c := w.bitCount
+	v := w.bottom
+	if v&(1<<(32-c)) != 0 {
+		w.carry()
+	}
+	v <<= c & 7
+	for c >>= 3; c > 0; c-- {
+		v <<= 8
+	}
+	for range 4 {
+		w.buf = append(w.buf, byte(v>>24))
+		v <<= 8
+	}
+	return w.buf
+}
@@ -0,0 +1,92 @@
+package watermark
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func decodeWebP(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	img, err := webp.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestEncodeWebPLossy(t *testing.T) {
+	src := demoCrop(t)
+	// 宽高不是 16 的倍数，检查边缘宏块的补齐
+	min := src.Bounds().Min.Add(image.Pt(3, 5))
+	src = src.SubImage(image.Rectangle{Min: min, Max: min.Add(image.Pt(201, 147))}).(*image.NRGBA)
+
+	var sizes []int
+	for _, quality := range []int{95, 75, 30} {
+		data, err := encodeWebPLossy(src, quality, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := decodeWebP(t, data)
+		if got.Bounds().Size() != src.Bounds().Size() {
+			t.Fatalf("quality=%d: 尺寸 %v，期望 %v", quality, got.Bounds().Size(), src.Bounds().Size())
+		}
+		if d := webpDiff(got, src); d > 2+float64(100-quality)/10 {
+			t.Errorf("quality=%d: 平均误差 %.2f", quality, d)
+		}
+		sizes = append(sizes, len(data))
+	}
+	if sizes[0] <= sizes[1] || sizes[1] <= sizes[2] {
+		t.Errorf("品质越低文件应当越小: %v", sizes)
+	}
+}
+
+func TestEncodeWebPLossyExtended(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 24))
+	for y := range 24 {
+		for x := range 40 {
+			src.SetNRGBA(x, y, color.NRGBA{uint8(x * 6), uint8(y * 10), 90, 255})
+		}
+	}
+	data, err := encodeWebPLossy(src, 80, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = appendWebPExif(data, []byte("II*\x00\x08\x00\x00\x00\x00\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := webp.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 40 || cfg.Height != 24 {
+		t.Errorf("尺寸 %dx%d，期望 40x24", cfg.Width, cfg.Height)
+	}
+	if d := webpDiff(decodeWebP(t, data), src); d > 5 {
+		t.Errorf("平均误差 %.2f", d)
+	}
+}
+
+// webpDiff 返回解码出的 WebP 与原图每个颜色分量的平均误差。
+// x/image/webp 返回的 YCbCr 按全范围换算为 RGB，这里按 WebP 使用的 BT.601（亮度 16～235）换算
+func webpDiff(got image.Image, want *image.NRGBA) float64 {
+	yuv := got.(*image.YCbCr)
+	b := want.Bounds()
+	var total float64
+	for y := range b.Dy() {
+		for x := range b.Dx() {
+			c := yuv.YCbCrAt(x, y)
+			l := 1.164 * (float64(c.Y) - 16)
+			cb, cr := float64(c.Cb)-128, float64(c.Cr)-128
+			w := want.NRGBAAt(b.Min.X+x, b.Min.Y+y)
+			for i, v := range [3]float64{l + 1.596*cr, l - 0.391*cb - 0.813*cr, l + 2.018*cb} {
+				total += absFloat(max(0, min(255, v)) - float64([3]uint8{w.R, w.G, w.B}[i]))
+			}
+		}
+	}
+	return total / float64(3*b.Dx()*b.Dy())
+}
@@ -0,0 +1,153 @@
+package watermark
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// xmpSidecarPath 返回输出图片对应的 .xmp 附属文件路径（Lightroom/digiKam 的命名方式）
+func xmpSidecarPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".xmp"
+}
+
+// writeXMPSidecar 为输出图片写入 XMP 附属文件
+func writeXMPSidecar(outputPath string, info *PhotoInfo, watermarkText string) error {
+	path := xmpSidecarPath(outputPath)
+	if err := os.WriteFile(path, xmpPacket(info, watermarkText), 0644); err != nil {
+		return fmt.Errorf("写入XMP文件 %s 失败: %v", path, err)
+	}
+	return nil
+}
+
+// xmpPacket 生成 XMP 数据包，包含解析出的地址、原文件名、处理参数，
+// 以及水印文字、配置摘要、程序版本和处理时间，事后可以查出一张图片是用什么设置生成的
+func xmpPacket(info *PhotoInfo, watermarkText string) []byte {
+	ws := config.WatermarkSettings
+	now := time.Now().Format(time.RFC3339)
+
+	var b bytes.Buffer
+	b.WriteString(`<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>` + "\n")
+	b.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/">` + "\n")
+	b.WriteString(` <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` + "\n")
+	b.WriteString(`  <rdf:Description rdf:about=""` + "\n")
+	b.WriteString(`    xmlns:dc="http://purl.org/dc/elements/1.1/"` + "\n")
+	b.WriteString(`    xmlns:xmp="http://ns.adobe.com/xap/1.0/"` + "\n")
+	b.WriteString(`    xmlns:xmpMM="http://ns.adobe.com/xap/1.0/mm/"` + "\n")
+	b.WriteString(`    xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"` + "\n")
+	b.WriteString(`    xmlns:Iptc4xmpCore="http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/"` + "\n")
+	b.WriteString(`    xmlns:jwm="https://github.com/li01452/Jpg-EXIF-Watermarker/ns/1.0/"` + "\n")
+	writeXMPAttr(&b, "xmpMM:PreservedFileName", filepath.Base(info.Filename))
+	writeXMPAttr(&b, "photoshop:DateCreated", info.Time.Format("2006-01-02T15:04:05"))
+	writeXMPAttr(&b, "xmp:ModifyDate", now)
+	writeXMPAttr(&b, "xmp:MetadataDate", now)
+	writeXMPAttr(&b, "xmp:CreatorTool", "Jpg-EXIF-Watermarker "+toolVersion())
+	writeXMPAttr(&b, "Iptc4xmpCore:Location", info.Address)
+	if info.Rating != 0 {
+		writeXMPAttr(&b, "xmp:Rating", strconv.Itoa(info.Rating))
+	}
+	writeXMPAttr(&b, "jwm:WatermarkText", watermarkText)
+	writeXMPAttr(&b, "jwm:FontPath", config.FontPath)
+	writeXMPAttr(&b, "jwm:FontSize", fmt.Sprint(ws.FontSize))
+	writeXMPAttr(&b, "jwm:Color", fmt.Sprintf("%d,%d,%d,%d", ws.Color.R, ws.Color.G, ws.Color.B, ws.Color.A))
+	writeXMPAttr(&b, "jwm:JpegQuality", fmt.Sprint(config.JpegQuality))
+	writeXMPAttr(&b, "jwm:ConfigHash", configHash())
+	writeXMPAttr(&b, "jwm:ToolVersion", toolVersion())
+	writeXMPAttr(&b, "jwm:ProcessedAt", now)
+	b.WriteString(`    >` + "\n")
+	if info.Address != "" {
+		b.WriteString(`   <dc:description><rdf:Alt><rdf:li xml:lang="x-default">`)
+		xml.EscapeText(&b, []byte(info.Address))
+		b.WriteString(`</rdf:li></rdf:Alt></dc:description>` + "\n")
+	}
+	if len(info.Keywords) > 0 {
+		b.WriteString(`   <dc:subject><rdf:Bag>`)
+		for _, k := range info.Keywords {
+			b.WriteString(`<rdf:li>`)
+			xml.EscapeText(&b, []byte(k))
+			b.WriteString(`</rdf:li>`)
+		}
+		b.WriteString(`</rdf:Bag></dc:subject>` + "\n")
+	}
+	b.WriteString(`  </rdf:Description>` + "\n")
+	b.WriteString(` </rdf:RDF>` + "\n")
+	b.WriteString(`</x:xmpmeta>` + "\n")
+	b.WriteString(`<?xpacket end="w"?>` + "\n")
+	return b.Bytes()
+}
+
+// configHash 返回生效配置（含默认值）的 SHA-256，配置相同的两次处理摘要相同
+var configHash = sync.OnceValue(func() string {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+})
+
+// xmpNamespace 是 JPEG 中 XMP APP1 段的标识
+var xmpNamespace = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+// embedXMP 把 XMP 数据包写入已保存的输出文件：JPEG 为 APP1 段，PNG 为 iTXt 块，WebP 为 XMP 块
+func embedXMP(outputPath string, info *PhotoInfo, watermarkText string) error {
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		return fmt.Errorf("读取输出文件失败: %v", err)
+	}
+	packet := xmpPacket(info, watermarkText)
+	switch outputFormat() {
+	case "png":
+		data = insertPNGXMP(data, packet)
+	case "webp":
+		if data, err = appendWebPChunk(data, "XMP ", 0x04, packet); err != nil {
+			return fmt.Errorf("写入WebP XMP失败: %v", err)
+		}
+	default:
+		if data, err = insertJPEGXMP(data, packet); err != nil {
+			return err
+		}
+	}
+	return writeOutputFile(outputPath, data)
+}
+
+// insertJPEGXMP 把 XMP APP1 段插入到 EXIF 段之后（没有 EXIF 时在 SOI 之后）
+func insertJPEGXMP(jpegData, packet []byte) ([]byte, error) {
+	payload := append(append([]byte(nil), xmpNamespace...), packet...)
+	if len(payload) > maxAPP1PayloadSize {
+		return nil, fmt.Errorf("XMP数据超过APP1段的64KB上限")
+	}
+	pos := 2
+	if len(jpegData) >= 8 && jpegData[2] == 0xFF && jpegData[3] == 0xE1 && bytes.HasPrefix(jpegData[6:], exifHeader) {
+		pos = 4 + int(binary.BigEndian.Uint16(jpegData[4:]))
+	}
+	out := make([]byte, 0, len(jpegData)+len(payload)+4)
+	out = append(out, jpegData[:pos]...)
+	out = append(out, 0xFF, 0xE1, byte((len(payload)+2)>>8), byte(len(payload)+2))
+	out = append(out, payload...)
+	return append(out, jpegData[pos:]...), nil
+}
+
+// insertPNGXMP 在 IHDR 之后插入关键字为 XML:com.adobe.xmp 的未压缩 iTXt 块
+func insertPNGXMP(pngData, packet []byte) []byte {
+	// 关键字、压缩标志、压缩方法、空的语言标签和翻译关键字
+	text := append([]byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), packet...)
+	return insertPNGChunk(pngData, "iTXt", text)
+}
+
+func writeXMPAttr(b *bytes.Buffer, name, value string) {
+	if value == "" {
+		return
+	}
+	b.WriteString("    " + name + `="`)
+	xml.EscapeText(b, []byte(value))
+	b.WriteString(`"` + "\n")
+}